@@ -3,14 +3,21 @@
 package authenticate
 
 import (
+	"context"
 	"crypto/cipher"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"net/http"
 	"net/url"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/pomerium/pomerium/config"
+	"github.com/pomerium/pomerium/internal/audit"
 	"github.com/pomerium/pomerium/internal/cryptutil"
 	"github.com/pomerium/pomerium/internal/encoding"
 	"github.com/pomerium/pomerium/internal/encoding/ecjson"
@@ -19,11 +26,14 @@ import (
 	"github.com/pomerium/pomerium/internal/grpc"
 	"github.com/pomerium/pomerium/internal/grpc/cache/client"
 	"github.com/pomerium/pomerium/internal/identity"
+	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/sessions"
 	"github.com/pomerium/pomerium/internal/sessions/cache"
 	"github.com/pomerium/pomerium/internal/sessions/cookie"
+	"github.com/pomerium/pomerium/internal/sessions/database"
 	"github.com/pomerium/pomerium/internal/sessions/header"
 	"github.com/pomerium/pomerium/internal/sessions/queryparam"
+	"github.com/pomerium/pomerium/internal/sessions/revocation"
 	"github.com/pomerium/pomerium/internal/urlutil"
 )
 
@@ -87,11 +97,52 @@ type Authenticate struct {
 	// a user's session state from
 	sessionLoaders []sessions.SessionLoader
 
-	// provider is the interface to interacting with the identity provider (IdP)
+	// provider is the interface to interacting with the default identity
+	// provider (IdP)
 	provider identity.Authenticator
+	// providers are any additional, named identity providers
+	providers map[string]identity.Authenticator
+	// providerDomains maps an email domain to the named identity provider
+	// its users sign in with
+	providerDomains map[string]string
+	// discoverIssuer, if set, discovers the issuer of an email domain in
+	// discoveryDomains which isn't in providerDomains, and providerIssuers
+	// maps the issuer to the named identity provider its users sign in with
+	discoverIssuer   func(ctx context.Context, emailOrDomain string) (string, error)
+	discoveryDomains map[string]bool
+	providerIssuers  map[string]string
+
+	// pkce enables PKCE for the authorization code flow
+	pkce bool
+	// endSession sends users signing out to the identity provider's
+	// end_session_endpoint, if it has one
+	endSession bool
+	// reauthenticateBeforeExpiry is how long before a session that can't be
+	// refreshed expires that the user is sent to sign in again
+	reauthenticateBeforeExpiry time.Duration
+	// groupsRefreshInterval, if set, is how often a session's groups are
+	// refreshed, rather than only when it expires
+	groupsRefreshInterval time.Duration
+	// sessionMaxDuration and sessionIdleTimeout, if set, limit how long
+	// after signing in, and after last being used, a session is valid for
+	sessionMaxDuration time.Duration
+	sessionIdleTimeout time.Duration
+	// revocations, if set, records signed out sessions, and is checked
+	// before a session is accepted
+	revocations revocation.Store
+	// sessionRefresher, if set, refreshes sessions in the background before
+	// they expire
+	sessionRefresher *sessionRefresher
+	// audit, if set, records sign ins, sign outs, refreshes and revocations
+	audit *audit.Logger
 
 	// cacheClient is the interface for setting and getting sessions from a cache
 	cacheClient client.Cacher
+	// sessionDatabase, if set, keeps sessions server side
+	sessionDatabase *database.PostgresStore
+	// stopBackground stops background work, such as deleting expired
+	// sessions from the session database
+	stopBackground context.CancelFunc
 
 	templates *template.Template
 }
@@ -112,7 +163,7 @@ func New(opts config.Options) (*Authenticate, error) {
 	// private state encoder setup
 	decodedCookieSecret, _ := base64.StdEncoding.DecodeString(opts.CookieSecret)
 	cookieCipher, _ := cryptutil.NewAEADCipher(decodedCookieSecret)
-	encryptedEncoder := ecjson.New(cookieCipher)
+	encryptedEncoder := ecjson.NewWithCompressionThreshold(cookieCipher, opts.CookieCompressionThreshold)
 
 	cookieOptions := &cookie.Options{
 		Name:     opts.CookieName,
@@ -126,6 +177,25 @@ func New(opts config.Options) (*Authenticate, error) {
 	if err != nil {
 		return nil, err
 	}
+	var sessionDatabase *database.PostgresStore
+	if opts.SessionDatabaseURL != "" {
+		// sessions are kept in the database, and the cookie only holds
+		// their ids
+		sessionDatabase, err = database.NewPostgresStore(opts.SessionDatabaseURL)
+		if err != nil {
+			return nil, err
+		}
+		cookieStore, err = database.NewStore(&database.Options{
+			Name:     opts.CookieName,
+			Domain:   opts.CookieDomain,
+			Secure:   opts.CookieSecure,
+			HTTPOnly: opts.CookieHTTPOnly,
+			Expire:   opts.CookieExpire,
+		}, sessionDatabase, encryptedEncoder)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	cacheConn, err := grpc.NewGRPCClientConn(
 		&grpc.Options{
@@ -154,23 +224,62 @@ func New(opts config.Options) (*Authenticate, error) {
 
 	redirectURL, _ := urlutil.DeepCopy(opts.AuthenticateURL)
 	redirectURL.Path = opts.AuthenticateCallbackPath
-	// configure our identity provider
-	provider, err := identity.New(
-		opts.Provider,
-		&identity.Provider{
-			RedirectURL:    redirectURL,
-			ProviderName:   opts.Provider,
-			ProviderURL:    opts.ProviderURL,
-			ClientID:       opts.ClientID,
-			ClientSecret:   opts.ClientSecret,
-			Scopes:         opts.Scopes,
-			ServiceAccount: opts.ServiceAccount,
-		})
+	// configure our identity providers, which share a groups cache
+	var groupsCache identity.GroupsCache
+	if opts.GroupsCacheRedisURL != "" {
+		sharedKeys := append([]string{opts.SharedKey}, opts.PreviousSharedKeys...)
+		groupsCache, err = identity.NewRedisGroupsCache(opts.GroupsCacheRedisURL, sharedKeys...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	auditLogger, err := audit.NewLogger(opts.AuditLog)
+	if err != nil {
+		return nil, err
+	}
+	var revocations revocation.Store
+	if opts.SessionRevocationRedisURL != "" {
+		revocations, err = revocation.NewRedisStore(opts.SessionRevocationRedisURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	provider, err := newProvider(opts, redirectURL, groupsCache, auditLogger, "", opts.Provider, opts.ProviderURL,
+		opts.ClientID, opts.ClientSecret, opts.Scopes, opts.ServiceAccount)
 	if err != nil {
 		return nil, err
 	}
+	var discoverIssuer func(context.Context, string) (string, error)
+	if opts.IssuerDiscovery {
+		discoverIssuer = identity.NewIssuerDiscovery(opts.IssuerDiscoveryTTL).Issuer
+	}
+	providers := make(map[string]identity.Authenticator, len(opts.IdentityProviders))
+	providerDomains := make(map[string]string)
+	providerIssuers := make(map[string]string)
+	discoveryDomains := make(map[string]bool, len(opts.IssuerDiscoveryDomains))
+	for _, domain := range opts.IssuerDiscoveryDomains {
+		discoveryDomains[strings.ToLower(domain)] = true
+	}
+	for _, idp := range opts.IdentityProviders {
+		providerURL, err := identityProviderURL(context.Background(), discoverIssuer, idp)
+		if err != nil {
+			return nil, fmt.Errorf("authenticate: identity provider %q: %w", idp.Name, err)
+		}
+		p, err := newProvider(opts, redirectURL, groupsCache, auditLogger, idp.Name, idp.Provider, providerURL,
+			idp.ClientID, idp.ClientSecret, idp.Scopes, idp.ServiceAccount)
+		if err != nil {
+			return nil, fmt.Errorf("authenticate: identity provider %q: %w", idp.Name, err)
+		}
+		providers[idp.Name] = p
+		for _, domain := range idp.EmailDomains {
+			providerDomains[domain] = idp.Name
+		}
+		if providerURL != "" {
+			providerIssuers[strings.TrimSuffix(providerURL, "/")] = idp.Name
+		}
+	}
 
-	return &Authenticate{
+	a := &Authenticate{
 		RedirectURL: redirectURL,
 		// shared state
 		sharedKey:     opts.SharedKey,
@@ -184,10 +293,270 @@ func New(opts config.Options) (*Authenticate, error) {
 		encryptedEncoder: encryptedEncoder,
 		sessionLoaders:   []sessions.SessionLoader{cacheStore, qpStore, headerStore, cookieStore},
 		// IdP
-		provider: provider,
+		provider:         provider,
+		providers:        providers,
+		providerDomains:  providerDomains,
+		discoverIssuer:   discoverIssuer,
+		discoveryDomains: discoveryDomains,
+		providerIssuers:  providerIssuers,
+		pkce:             opts.ProviderPKCE,
+		endSession:       opts.ProviderEndSession,
+		// session lifetime
+		reauthenticateBeforeExpiry: opts.ReauthenticateBeforeExpiry,
+		groupsRefreshInterval:      opts.GroupsRefreshInterval,
+		sessionMaxDuration:         opts.SessionMaxDuration,
+		sessionIdleTimeout:         opts.SessionIdleTimeout,
+		revocations:                revocations,
+		audit:                      auditLogger,
 		// grpc client for cache
-		cacheClient: cacheClient,
+		cacheClient:     cacheClient,
+		sessionDatabase: sessionDatabase,
 
 		templates: template.Must(frontend.NewTemplates()),
-	}, nil
+	}
+	if opts.RefreshBeforeExpiry > 0 {
+		a.sessionRefresher = newSessionRefresher(a.refreshSession, cacheStore.LoadState, cacheStore.SaveState, opts.RefreshBeforeExpiry, opts.CookieExpire)
+	}
+	var ctx context.Context
+	ctx, a.stopBackground = context.WithCancel(context.Background())
+	if a.sessionRefresher != nil {
+		go a.sessionRefresher.run(ctx)
+	}
+	if sessionDatabase != nil {
+		go sessionDatabase.RunCleanup(ctx, database.DefaultCleanupInterval)
+	}
+	return a, nil
+}
+
+// Close stops the authenticate service's background work, including its
+// identity providers', and closes its session database.
+func (a *Authenticate) Close() error {
+	if a.stopBackground != nil {
+		a.stopBackground()
+	}
+	if c, ok := a.provider.(io.Closer); ok {
+		c.Close()
+	}
+	for _, p := range a.providers {
+		if c, ok := p.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	if a.sessionDatabase != nil {
+		return a.sessionDatabase.Close()
+	}
+	return nil
+}
+
+// identityProviderURL returns the provider url of a named identity provider.
+// If it isn't configured, and issuer discovery is enabled, the issuer of the
+// provider's first email domain is used.
+func identityProviderURL(ctx context.Context, discoverIssuer func(context.Context, string) (string, error), idp config.IdentityProviderOptions) (string, error) {
+	if idp.ProviderURL != "" || discoverIssuer == nil || len(idp.EmailDomains) == 0 {
+		return idp.ProviderURL, nil
+	}
+	issuer, err := discoverIssuer(ctx, idp.EmailDomains[0])
+	if err != nil {
+		return "", err
+	}
+	log.Info().Str("provider", idp.Name).Str("issuer", issuer).Msg("authenticate: discovered identity provider issuer")
+	return issuer, nil
+}
+
+// newProvider creates the named identity provider, which is empty for the
+// default provider, from its client settings, and the group, groups cache,
+// audit, and certificate authority settings shared by all providers.
+func newProvider(opts config.Options, redirectURL *url.URL, groupsCache identity.GroupsCache, auditLogger *audit.Logger, name, providerName, providerURL, clientID, clientSecret string, scopes []string, serviceAccount string) (identity.Authenticator, error) {
+	p := newProviderConfig(opts, redirectURL, groupsCache, providerName, providerURL,
+		clientID, clientSecret, scopes, serviceAccount)
+	p.Name = name
+	p.Audit = auditLogger
+	p.ForwardedClaims = forwardedClaims(opts.IdentityProviderClaimHeaders(name))
+	p.AllowedAudiences = opts.IdentityProviderAllowedAudiences(name)
+	p.AllowedIssuers = opts.IdentityProviderAllowedIssuers(name)
+	p.AuthURLParams = opts.IdentityProviderAuthURLParams(name)
+	p.EnableRefresh = opts.IdentityProviderEnableRefresh(name)
+	return identity.New(providerName, p)
+}
+
+// forwardedClaims returns the claims a claim to header mapping sets headers
+// from, which sessions need to keep.
+func forwardedClaims(claimHeaders map[string]string) []string {
+	var claims []string
+	for claim := range claimHeaders {
+		claims = append(claims, claim)
+	}
+	sort.Strings(claims)
+	return claims
+}
+
+// newProviderConfig returns the identity provider configuration newProvider
+// creates a provider from.
+func newProviderConfig(opts config.Options, redirectURL *url.URL, groupsCache identity.GroupsCache, providerName, providerURL, clientID, clientSecret string, scopes []string, serviceAccount string) *identity.Provider {
+	return &identity.Provider{
+		RedirectURL:                   redirectURL,
+		AllowInsecureRedirectURL:      opts.InsecureServer,
+		ProviderName:                  providerName,
+		ProviderURL:                   providerURL,
+		ClientID:                      clientID,
+		ClientSecret:                  clientSecret,
+		Scopes:                        scopes,
+		ServiceAccount:                serviceAccount,
+		ACRValues:                     opts.ACRValues,
+		RequireACR:                    opts.RequireACR,
+		GroupFormat:                   opts.GroupFormat,
+		MinGroupAccessLevel:           opts.MinGroupAccessLevel,
+		GroupsPageSize:                opts.GroupsPageSize,
+		IncludeParentGroups:           opts.IncludeParentGroups,
+		GitLabGroupScope:              opts.GitLabGroupScope,
+		GroupsGraphQL:                 opts.GroupsGraphQL,
+		IncludeProjects:               opts.IncludeProjects,
+		EmailDomainGroup:              opts.EmailDomainGroup,
+		GroupsNamePrefix:              opts.GroupsNamePrefix,
+		GroupAliases:                  opts.GroupAliases,
+		GroupsCaseInsensitive:         opts.GroupsCaseInsensitive,
+		AttributesURL:                 opts.AttributesURL,
+		AttributesHeaders:             opts.AttributesHeaders,
+		AttributesFailOpen:            opts.AttributesFailOpen,
+		RoleSource:                    opts.RoleSource,
+		GroupsClaim:                   opts.GroupsClaim,
+		GroupsURL:                     opts.GroupsURL,
+		GroupsIDField:                 opts.GroupsIDField,
+		GroupsCacheTTL:                opts.GroupsCacheTTL,
+		GroupsCache:                   groupsCache,
+		GroupsBestEffort:              opts.GroupsBestEffort,
+		GroupsRequestTimeout:          opts.GroupsRequestTimeout,
+		GroupsCircuitBreakerThreshold: opts.GroupsCircuitBreakerThreshold,
+		GroupsCircuitBreakerCooldown:  opts.GroupsCircuitBreakerCooldown,
+		GroupsCircuitBreakerFallback:  opts.GroupsCircuitBreakerFallback,
+		MaxStaleGroups:                opts.GroupsMaxStale,
+		JWKSRefreshInterval:           opts.JWKSRefreshInterval,
+		InsecureSkipVerify:            opts.InsecureSkipVerify,
+		AllowPersonalAccessTokens:     opts.AllowPersonalAccessTokens,
+		AllowDeviceAuthorization:      opts.AllowDeviceAuthorization,
+		MachineClients:                machineClients(opts.MachineClients),
+		CA:                            opts.ProviderCA,
+		CAFile:                        opts.ProviderCAFile,
+		TLSMinVersion:                 opts.ProviderTLSMinVersion,
+		TLSCipherSuites:               opts.ProviderTLSCipherSuites,
+		ClientCert:                    opts.ProviderClientCert,
+		ClientKey:                     opts.ProviderClientKey,
+		ClientCertFile:                opts.ProviderClientCertFile,
+		ClientKeyFile:                 opts.ProviderClientKeyFile,
+		ProxyURL:                      opts.ProviderProxyURL,
+		NoProxy:                       opts.ProviderNoProxy,
+		DialTimeout:                   opts.ProviderDialTimeout,
+		TLSHandshakeTimeout:           opts.ProviderTLSHandshakeTimeout,
+		ResponseHeaderTimeout:         opts.ProviderResponseHeaderTimeout,
+		DiscoveryRetries:              opts.ProviderDiscoveryRetries,
+		DiscoveryTimeout:              opts.ProviderDiscoveryTimeout,
+		UserAgent:                     opts.ProviderUserAgent,
+	}
+}
+
+// machineClients converts the configured machine clients to the identity
+// package's form.
+func machineClients(opts []config.MachineClientOptions) []identity.MachineClient {
+	var clients []identity.MachineClient
+	for _, c := range opts {
+		clients = append(clients, identity.MachineClient{
+			ClientID: c.ClientID,
+			Email:    c.Email,
+			Groups:   c.Groups,
+			Scopes:   c.Scopes,
+		})
+	}
+	return clients
+}
+
+// ProviderReport is the result of validating an identity provider.
+type ProviderReport struct {
+	// Name is the identity provider's name, which is empty for the default
+	// provider.
+	Name     string
+	Provider string
+	Checks   []identity.CheckResult
+}
+
+// Passed reports whether none of the provider's checks failed.
+func (r ProviderReport) Passed() bool {
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateProviders checks the default and any additional identity providers
+// configured in opts without starting the authenticate service, so that
+// their configuration can be verified before deploying.
+//
+// See identity.Validate for the checks run.
+func ValidateProviders(ctx context.Context, opts config.Options, probeGroups bool) []ProviderReport {
+	redirectURL, _ := urlutil.DeepCopy(opts.AuthenticateURL)
+	if redirectURL != nil {
+		redirectURL.Path = opts.AuthenticateCallbackPath
+	}
+	reports := []ProviderReport{{
+		Provider: opts.Provider,
+		Checks: identity.Validate(ctx, opts.Provider, newProviderConfig(opts, redirectURL, nil, opts.Provider,
+			opts.ProviderURL, opts.ClientID, opts.ClientSecret, opts.Scopes, opts.ServiceAccount), probeGroups),
+	}}
+	var discoverIssuer func(context.Context, string) (string, error)
+	if opts.IssuerDiscovery {
+		discoverIssuer = identity.NewIssuerDiscovery(opts.IssuerDiscoveryTTL).Issuer
+	}
+	for _, idp := range opts.IdentityProviders {
+		report := ProviderReport{Name: idp.Name, Provider: idp.Provider}
+		providerURL, err := identityProviderURL(ctx, discoverIssuer, idp)
+		if err != nil {
+			report.Checks = []identity.CheckResult{{Name: identity.CheckProvider, Err: err}}
+		} else {
+			report.Checks = identity.Validate(ctx, idp.Provider, newProviderConfig(opts, redirectURL, nil, idp.Provider,
+				providerURL, idp.ClientID, idp.ClientSecret, idp.Scopes, idp.ServiceAccount), probeGroups)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// getProvider returns the identity provider with the given name. An empty
+// name refers to the default provider.
+func (a *Authenticate) getProvider(name string) (identity.Authenticator, error) {
+	if name == "" {
+		return a.provider, nil
+	}
+	if p, ok := a.providers[name]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("authenticate: unknown identity provider %q", name)
+}
+
+// selectProvider returns the name of the identity provider a user should
+// sign in with; either explicitly requested, or matched from the domain of
+// the user's login hint. If issuer discovery is enabled, the issuer of a
+// domain which isn't matched, but is allowed to be discovered, is discovered
+// and matched against the named providers' issuers. Login hints aren't
+// authenticated, so only the configured domains are looked up. An empty
+// name refers to the default provider.
+func (a *Authenticate) selectProvider(r *http.Request) string {
+	if name := r.FormValue(urlutil.QueryIdentityProvider); name != "" {
+		return name
+	}
+	hint := r.FormValue(urlutil.QueryLoginHint)
+	i := strings.LastIndex(hint, "@")
+	if i < 0 {
+		return ""
+	}
+	domain := strings.ToLower(hint[i+1:])
+	if name, ok := a.providerDomains[domain]; ok || a.discoverIssuer == nil || !a.discoveryDomains[domain] {
+		return name
+	}
+	issuer, err := a.discoverIssuer(r.Context(), hint)
+	if err != nil {
+		log.FromRequest(r).Debug().Err(err).Msg("authenticate: couldn't discover login hint's issuer, using the default provider")
+		return ""
+	}
+	return a.providerIssuers[strings.TrimSuffix(issuer, "/")]
 }
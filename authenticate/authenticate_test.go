@@ -1,9 +1,14 @@
 package authenticate
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/pomerium/pomerium/config"
+	"github.com/pomerium/pomerium/internal/identity"
 )
 
 func newTestOptions(t *testing.T) *config.Options {
@@ -74,8 +79,30 @@ func TestOptions_Validate(t *testing.T) {
 }
 
 func TestNew(t *testing.T) {
+	// a local discovery document, so that creating the provider doesn't
+	// depend on reaching the real identity provider
+	var idp *httptest.Server
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                 idp.URL,
+				"authorization_endpoint": idp.URL + "/auth",
+				"token_endpoint":         idp.URL + "/token",
+				"jwks_uri":               idp.URL + "/keys",
+			})
+		case "/keys":
+			w.Write([]byte(`{"keys":[]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+
 	good := newTestOptions(t)
 	good.CookieName = "A"
+	good.ProviderURL = idp.URL
+	good.ProviderDiscoveryRetries = -1
 
 	badRedirectURL := newTestOptions(t)
 	badRedirectURL.AuthenticateURL = nil
@@ -106,11 +133,58 @@ func TestNew(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := New(*tt.opts)
+			a, err := New(*tt.opts)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if a != nil {
+				if err := a.Close(); err != nil {
+					t.Errorf("Close() error = %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticate_selectProvider(t *testing.T) {
+	a := &Authenticate{
+		providerDomains: map[string]string{"contractor.example": "contractors"},
+		discoverIssuer: func(ctx context.Context, email string) (string, error) {
+			switch email {
+			case "user@partner.example":
+				return "https://partners.okta.example/", nil
+			case "user@other.example":
+				return "https://other.example", nil
+			}
+			return "", identity.ErrIssuerNotFound
+		},
+		discoveryDomains: map[string]bool{"partner.example": true, "other.example": true, "unsupported.example": true},
+		providerIssuers:  map[string]string{"https://partners.okta.example": "partners"},
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"default", "", ""},
+		{"explicit provider", "pomerium_identity_provider=partners", "partners"},
+		{"explicit provider wins over login hint", "pomerium_identity_provider=partners&login_hint=user%40contractor.example", "partners"},
+		{"login hint domain", "login_hint=user%40contractor.example", "contractors"},
+		{"login hint domain case insensitive", "login_hint=user%40Contractor.Example", "contractors"},
+		{"login hint unknown domain", "login_hint=user%40corp.example", ""},
+		{"login hint discovered issuer", "login_hint=user%40partner.example", "partners"},
+		{"login hint issuer of no provider", "login_hint=user%40other.example", ""},
+		{"login hint issuer not found", "login_hint=user%40unsupported.example", ""},
+		{"login hint domain not allowed to be discovered", "login_hint=user%40attacker.example", ""},
+		{"login hint not an email", "login_hint=user", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+			if got := a.selectProvider(r); got != tt.want {
+				t.Errorf("selectProvider() = %q, want %q", got, tt.want)
+			}
 		})
 	}
 }
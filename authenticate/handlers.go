@@ -8,26 +8,36 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/rs/cors"
 
 	"github.com/pomerium/csrf"
+	"github.com/pomerium/pomerium/internal/audit"
 	"github.com/pomerium/pomerium/internal/cryptutil"
 	"github.com/pomerium/pomerium/internal/httputil"
 	"github.com/pomerium/pomerium/internal/identity"
 	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/middleware"
 	"github.com/pomerium/pomerium/internal/sessions"
+	"github.com/pomerium/pomerium/internal/sessions/header"
+	"github.com/pomerium/pomerium/internal/sessions/revocation"
 	"github.com/pomerium/pomerium/internal/telemetry/trace"
 	"github.com/pomerium/pomerium/internal/urlutil"
 )
 
+// personalAccessTokenAuthType is the authorization header type clients send
+// personal access tokens as.
+const personalAccessTokenAuthType = "Personal-Access-Token"
+
 // Handler returns the authenticate service's handler chain.
 func (a *Authenticate) Handler() http.Handler {
 	r := httputil.NewRouter()
 	r.Use(middleware.SetHeaders(httputil.HeadersContentSecurityPolicy))
+	r.Use(skipCSRF)
 	r.Use(csrf.Protect(
 		a.cookieSecret,
 		csrf.Secure(a.cookieOptions.Secure),
@@ -39,8 +49,13 @@ func (a *Authenticate) Handler() http.Handler {
 	))
 
 	r.Path("/robots.txt").HandlerFunc(a.RobotsTxt).Methods(http.MethodGet)
+	r.Path("/readyz").HandlerFunc(a.Readyz).Methods(http.MethodGet, http.MethodHead)
 	// Identity Provider (IdP) endpoints
 	r.Path("/oauth2/callback").Handler(httputil.HandlerFunc(a.OAuthCallback)).Methods(http.MethodGet)
+	// back-channel logout needs somewhere to record revoked sessions
+	if a.revocations != nil {
+		r.Path(backChannelLogoutPath).Handler(httputil.HandlerFunc(a.BackChannelLogout)).Methods(http.MethodPost)
+	}
 
 	// Proxy service endpoints
 	v := r.PathPrefix("/.pomerium").Subrouter()
@@ -67,6 +82,15 @@ func (a *Authenticate) Handler() http.Handler {
 	api := r.PathPrefix("/api").Subrouter()
 	api.Use(sessions.RetrieveSession(a.sessionLoaders...))
 	api.Path("/v1/refresh").Handler(httputil.HandlerFunc(a.RefreshAPI))
+	api.Path("/v1/token").Handler(httputil.HandlerFunc(a.PersonalAccessTokenAPI)).Methods(http.MethodGet)
+	api.Path("/v1/client_credentials").Handler(httputil.HandlerFunc(a.ClientCredentialsAPI)).Methods(http.MethodPost)
+	api.Path("/v1/device_authorization").Handler(httputil.HandlerFunc(a.DeviceAuthorizationAPI)).Methods(http.MethodPost)
+	api.Path("/v1/device_token").Handler(httputil.HandlerFunc(a.DeviceTokenAPI)).Methods(http.MethodPost)
+
+	// admin endpoints, which are signed with the shared secret
+	r.Path(invalidateGroupsPath).
+		Handler(middleware.ValidateSignature(a.sharedKey)(httputil.HandlerFunc(a.InvalidateGroupsAPI))).
+		Methods(http.MethodPost)
 
 	return r
 }
@@ -85,32 +109,102 @@ func (a *Authenticate) VerifySession(next http.Handler) http.Handler {
 		if err := a.encryptedEncoder.Unmarshal([]byte(jwt), &s); err != nil {
 			return httputil.NewError(http.StatusBadRequest, err)
 		}
+		a.sessionRefresher.seen(&s)
 
-		if err := s.Verify(r.Host); errors.Is(err, sessions.ErrExpired) {
-			ctx, err = a.refresh(w, r, &s)
-			if err != nil {
+		status := a.revocationStatus(r, &s)
+		if status.Revoked {
+			return a.reauthenticateOrFail(w, r, sessions.ErrRevoked)
+		}
+		touched := s.Touch(a.sessionMaxDuration, a.sessionIdleTimeout)
+		if err := s.CheckLifetime(a.sessionMaxDuration, a.sessionIdleTimeout); err != nil {
+			log.FromRequest(r).Info().Err(err).Msg("authenticate: verify session lifetime")
+			return a.reauthenticateOrFail(w, r, err)
+		}
+		if touched {
+			if ctx, err = a.saveActivity(w, r, &s); err != nil {
+				return httputil.NewError(http.StatusInternalServerError, err)
+			}
+		}
+
+		if err := s.Verify(r.Host); errors.Is(err, sessions.ErrExpired) || (err == nil && (s.GroupsStale(a.groupsRefreshInterval) || status.GroupsInvalidated(&s))) {
+			ctx, err = a.refresh(w, r, &s, status)
+			if providerErrorStatus(err) == http.StatusServiceUnavailable {
+				// re-authenticating won't help if the identity provider is down
+				log.FromRequest(r).Warn().Err(err).Msg("authenticate: verify session, refresh")
+				return httputil.NewError(http.StatusServiceUnavailable, err)
+			} else if errors.Is(err, identity.ErrTokenRevoked) {
+				// the session is of no further use, so it's cleared even
+				// for requests which aren't redirected to sign in again
+				log.FromRequest(r).Info().Err(err).Msg("authenticate: verify session, token revoked")
+				a.sessionRefresher.forget(s.AccessTokenID)
+				a.sessionStore.ClearSession(w, r)
+				return a.reauthenticateOrFail(w, r, err)
+			} else if err != nil {
 				log.FromRequest(r).Info().Err(err).Msg("authenticate: verify session, refresh")
 				return a.reauthenticateOrFail(w, r, err)
 			}
 		} else if err != nil {
 			log.FromRequest(r).Info().Err(err).Msg("authenticate: verify session")
 			return a.reauthenticateOrFail(w, r, err)
+		} else if s.NeedsReauthentication(a.reauthenticateBeforeExpiry) {
+			log.FromRequest(r).Info().Time("expiry", s.TokenExpiry()).Msg("authenticate: session expires soon, re-authenticating")
+			return a.reauthenticateOrFail(w, r, sessions.ErrExpiringSoon)
+		} else if scopes := strings.Fields(r.FormValue(urlutil.QueryScope)); !s.HasScopes(scopes) {
+			log.FromRequest(r).Info().Strs("scopes", scopes).Msg("authenticate: session lacks the route's scopes, re-authenticating")
+			return a.reauthenticateOrFail(w, r, sessions.ErrInsufficientScope)
+		} else if maxAge, err := signInMaxAge(r); err != nil {
+			return httputil.NewError(http.StatusBadRequest, err)
+		} else if !s.AuthenticatedWithin(maxAge) {
+			log.FromRequest(r).Info().Dur("max_age", maxAge).Msg("authenticate: session authenticated too long ago for the route, re-authenticating")
+			return a.reauthenticateOrFail(w, r, sessions.ErrAuthenticationTooOld)
 		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 		return nil
 	})
 }
 
-func (a *Authenticate) refresh(w http.ResponseWriter, r *http.Request, s *sessions.State) (context.Context, error) {
+// saveActivity saves a session whose last activity has been updated, and
+// adds it to the request context in place of the one loaded.
+func (a *Authenticate) saveActivity(w http.ResponseWriter, r *http.Request, s *sessions.State) (context.Context, error) {
+	if err := a.sessionStore.SaveSession(w, r, s); err != nil {
+		return nil, fmt.Errorf("authenticate: activity save failed: %w", err)
+	}
+	encSession, err := a.encryptedEncoder.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return sessions.NewContext(r.Context(), string(encSession), nil), nil
+}
+
+// proxyLastActive returns when the user was last active on one of the
+// proxy's routes, as sent by the proxy in the signed url it refreshes their
+// session with.
+func proxyLastActive(r *http.Request) (time.Time, bool) {
+	secs, err := strconv.ParseInt(r.URL.Query().Get(urlutil.QueryLastActive), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
+
+func (a *Authenticate) refresh(w http.ResponseWriter, r *http.Request, s *sessions.State, status revocation.Status) (context.Context, error) {
 	ctx, span := trace.StartSpan(r.Context(), "authenticate.VerifySession/refresh")
 	defer span.End()
-	newSession, err := a.provider.Refresh(ctx, s)
-	if err != nil {
-		return nil, fmt.Errorf("authenticate: refresh failed: %w", err)
+	// the session may already have been refreshed in the background, though
+	// not since its groups were invalidated
+	newSession := a.sessionRefresher.refreshed(ctx, s)
+	if newSession == nil || status.GroupsInvalidated(newSession) {
+		var err error
+		newSession, err = a.refreshSession(ctx, s)
+		if err != nil {
+			return nil, fmt.Errorf("authenticate: refresh failed: %w", err)
+		}
+		a.sessionRefresher.forget(s.AccessTokenID)
 	}
 	if err := a.sessionStore.SaveSession(w, r, newSession); err != nil {
 		return nil, fmt.Errorf("authenticate: refresh save failed: %w", err)
 	}
+	a.sessionRefresher.track(newSession)
 	newSession = newSession.NewSession(s.Issuer, s.Audience)
 	encSession, err := a.encryptedEncoder.Marshal(newSession)
 	if err != nil {
@@ -127,6 +221,36 @@ func (a *Authenticate) RobotsTxt(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "User-agent: *\nDisallow: /")
 }
 
+// Readyz handles the /readyz route, responding with a 503 if any of the
+// identity providers is unreachable so that the authenticate service can be
+// taken out of rotation until it recovers.
+func (a *Authenticate) Readyz(w http.ResponseWriter, r *http.Request) {
+	var failed []string
+	check := func(name string, provider identity.Authenticator) {
+		hc, ok := provider.(identity.HealthChecker)
+		if !ok {
+			return
+		}
+		if err := hc.Healthy(r.Context()); err != nil {
+			log.FromRequest(r).Warn().Err(err).Str("idp", name).Msg("authenticate: identity provider unhealthy")
+			failed = append(failed, name)
+		}
+	}
+	check("default", a.provider)
+	for name, provider := range a.providers {
+		check(name, provider)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "identity provider unhealthy: %s\n", strings.Join(failed, ", "))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, http.StatusText(http.StatusOK))
+}
+
 // SignIn handles to authenticating a user.
 func (a *Authenticate) SignIn(w http.ResponseWriter, r *http.Request) error {
 	redirectURL, err := urlutil.ParseAndValidateURL(r.FormValue(urlutil.QueryRedirectURI))
@@ -227,21 +351,179 @@ func (a *Authenticate) SignOut(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	a.sessionStore.ClearSession(w, r)
-	err = a.provider.Revoke(r.Context(), s.AccessToken)
+	a.sessionRefresher.forget(s.AccessTokenID)
+	a.revoke(r, &s)
+	provider, err := a.getProvider(s.IdentityProvider)
+	if err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	err = provider.Revoke(r.Context(), s.AccessToken)
 	if errors.Is(err, identity.ErrRevokeNotImplemented) {
 		log.FromRequest(r).Warn().Err(err).Msg("authenticate: revoke not implemented")
+	} else if errors.Is(err, identity.ErrMissingToken) {
+		log.FromRequest(r).Debug().Msg("authenticate: session has no token to revoke")
 	} else if err != nil {
+		a.audit.Emit(r.Context(), audit.NewEvent(audit.SignOut, audit.Failure, &s).WithReason(err))
 		return httputil.NewError(http.StatusBadRequest, err)
 	}
+	a.audit.Emit(r.Context(), audit.NewEvent(audit.SignOut, audit.Success, &s))
 	redirectURL, err := urlutil.ParseAndValidateURL(r.FormValue(urlutil.QueryRedirectURI))
 	if err != nil {
 		return httputil.NewError(http.StatusBadRequest, err)
 
 	}
+	// end the identity provider's own session too, if it keeps one
+	if p, ok := provider.(identity.SignOutURLer); ok {
+		httputil.Redirect(w, r, p.GetSignOutURL(redirectURL.String()), http.StatusFound)
+		return nil
+	}
+	if p, ok := provider.(identity.EndSessionURLer); ok && a.endSession {
+		if endSessionURL := p.GetEndSessionURL(s.RawIDToken, redirectURL.String()); endSessionURL != "" {
+			httputil.Redirect(w, r, endSessionURL, http.StatusFound)
+			return nil
+		}
+	}
 	httputil.Redirect(w, r, redirectURL.String(), http.StatusFound)
 	return nil
 }
 
+// BackChannelLogout handles OpenID Connect back-channel logout requests,
+// which identity providers make directly to tell us that a user's session
+// with them has ended. The logout token names the provider's session, whose
+// sessions are revoked, or just the user, all of whose sessions signed in
+// until now are. Named identity providers are chosen by the
+// `pomerium_identity_provider` query parameter of the url registered with
+// them.
+//
+// https://openid.net/specs/openid-connect-backchannel-1_0.html
+func (a *Authenticate) BackChannelLogout(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	providerName := r.URL.Query().Get(urlutil.QueryIdentityProvider)
+	provider, err := a.getProvider(providerName)
+	if err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	bcl, ok := provider.(identity.BackChannelLogouter)
+	if !ok {
+		return httputil.NewError(http.StatusBadRequest, identity.ErrBackChannelLogoutNotSupported)
+	}
+	token, err := bcl.VerifyLogoutToken(r.Context(), r.PostFormValue("logout_token"))
+	if err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	// the provider's tokens can't be known, so revocations are only kept for
+	// as long as a session's cookie
+	ttl := a.cookieOptions.Expire
+	if token.SessionID != "" {
+		err = revocation.RevokeIdentityProviderSession(r.Context(), a.revocations, providerName, token.SessionID, ttl)
+	} else {
+		err = revocation.RevokeSubject(r.Context(), a.revocations, providerName, token.Subject, ttl)
+	}
+	e := audit.NewEvent(audit.Revocation, audit.Success, &sessions.State{Subject: token.Subject, IdentityProvider: providerName})
+	if err != nil {
+		e.Outcome = audit.Failure
+		a.audit.Emit(r.Context(), e.WithReason(err))
+		return httputil.NewError(http.StatusInternalServerError, err)
+	}
+	a.audit.Emit(r.Context(), e)
+	log.FromRequest(r).Info().Str("sub", token.Subject).Str("sid", token.SessionID).Msg("authenticate: back-channel logout")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// InvalidateGroupsAPI drops the cached groups of a user, named by their
+// subject, of the identity provider given by the `pomerium_identity_provider`
+// query parameter, for when an admin changes their membership. If a
+// revocation store is set, the user's sessions on every replica then fetch
+// their groups again, rather than once their groups refresh interval is up.
+// Requests must be signed with the shared secret, as the proxy's are.
+//
+//	POST /api/v1/groups/invalidate?user=<sub>&pomerium_identity_provider=<name>
+func (a *Authenticate) InvalidateGroupsAPI(w http.ResponseWriter, r *http.Request) error {
+	sub := r.URL.Query().Get("user")
+	if sub == "" {
+		return httputil.NewError(http.StatusBadRequest, errors.New("authenticate: missing user"))
+	}
+	providerName := r.URL.Query().Get(urlutil.QueryIdentityProvider)
+	provider, err := a.getProvider(providerName)
+	if err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	if gi, ok := provider.(identity.GroupsInvalidator); ok {
+		gi.InvalidateGroups(r.Context(), sub)
+	}
+	e := audit.NewEvent(audit.GroupInvalidation, audit.Success, &sessions.State{Subject: sub, IdentityProvider: providerName})
+	if a.revocations != nil {
+		// sessions live no longer than their cookie
+		if err := revocation.InvalidateGroups(r.Context(), a.revocations, providerName, sub, a.cookieOptions.Expire); err != nil {
+			e.Outcome = audit.Failure
+			a.audit.Emit(r.Context(), e.WithReason(err))
+			return httputil.NewError(http.StatusInternalServerError, err)
+		}
+	}
+	a.audit.Emit(r.Context(), e)
+	log.FromRequest(r).Info().Str("sub", sub).Str("idp", providerName).Msg("authenticate: invalidated user's groups")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// backChannelLogoutPath is the path identity providers make back-channel
+// logout requests to.
+const backChannelLogoutPath = "/oauth2/backchannel_logout"
+
+// invalidateGroupsPath is the path admins invalidate a user's groups at.
+const invalidateGroupsPath = "/api/v1/groups/invalidate"
+
+// skipCSRF exempts back-channel logout requests, which identity providers
+// make without a user's cookies and are authenticated by their logout
+// token, and admin requests, which are signed, from CSRF protection.
+func skipCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == backChannelLogoutPath || r.URL.Path == invalidateGroupsPath {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// revoke records the session as revoked, if a revocation store is set, so
+// that other replicas reject it too. The record is kept until the session
+// would have expired: when its cookie or, if later, its token does.
+// Failures are logged rather than failing the sign out, as the session's
+// cookie has already been cleared.
+func (a *Authenticate) revoke(r *http.Request, s *sessions.State) {
+	if a.revocations == nil {
+		return
+	}
+	ttl := a.cookieOptions.Expire
+	if d := time.Until(s.TokenExpiry()); d > ttl {
+		ttl = d
+	}
+	if err := revocation.RevokeSession(r.Context(), a.revocations, s, ttl); err != nil {
+		log.FromRequest(r).Error().Err(err).Msg("authenticate: session revocation failed")
+		a.audit.Emit(r.Context(), audit.NewEvent(audit.Revocation, audit.Failure, s).WithReason(err))
+		return
+	}
+	a.audit.Emit(r.Context(), audit.NewEvent(audit.Revocation, audit.Success, s))
+}
+
+// revocationStatus returns whether the session has been revoked, and when
+// its groups were invalidated. If the revocation store can't be reached,
+// the session is accepted with its groups, so that an outage of the store
+// doesn't sign everyone out; they're kept until the groups refresh
+// interval anyway.
+func (a *Authenticate) revocationStatus(r *http.Request, s *sessions.State) revocation.Status {
+	if a.revocations == nil {
+		return revocation.Status{}
+	}
+	status, err := revocation.Check(r.Context(), a.revocations, s)
+	if err != nil {
+		log.FromRequest(r).Warn().Err(err).Msg("authenticate: session revocation check failed")
+		return revocation.Status{}
+	}
+	return status
+}
+
 // reauthenticateOrFail starts the authenticate process by redirecting the
 // user to their respective identity provider. This function also builds the
 // 'state' parameter which is encrypted and includes authenticating data
@@ -257,18 +539,212 @@ func (a *Authenticate) reauthenticateOrFail(w http.ResponseWriter, r *http.Reque
 	if reqType := r.Header.Get("X-Requested-With"); strings.EqualFold(reqType, "XmlHttpRequest") {
 		return httputil.NewError(http.StatusUnauthorized, err)
 	}
+	providerName := a.selectProvider(r)
+	provider, err := a.getProvider(providerName)
+	if err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	opts := identity.SignInOptions{
+		Prompt:    r.FormValue(urlutil.QueryPrompt),
+		LoginHint: r.FormValue(urlutil.QueryLoginHint),
+		Scopes:    a.signInScopes(r, providerName),
+	}
+	if err := identity.ValidatePrompt(opts.Prompt); err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	if opts.MaxAge, err = signInMaxAge(r); err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
 	a.sessionStore.ClearSession(w, r)
 	redirectURL := a.RedirectURL.ResolveReference(r.URL)
 	nonce := csrf.Token(r)
 	now := time.Now().Unix()
-	b := []byte(fmt.Sprintf("%s|%d|", nonce, now))
+	b := []byte(fmt.Sprintf("%s|%d|%s|", nonce, now, providerName))
 	enc := cryptutil.Encrypt(a.cookieCipher, []byte(redirectURL.String()), b)
 	b = append(b, enc...)
 	encodedState := base64.URLEncoding.EncodeToString(b)
-	httputil.Redirect(w, r, a.provider.GetSignInURL(encodedState), http.StatusFound)
+	if a.pkce {
+		opts.CodeVerifier = identity.NewCodeVerifier()
+		a.setCodeVerifier(w, nonce, opts.CodeVerifier)
+	}
+	if len(opts.Scopes) != 0 {
+		a.setSignInScopes(w, nonce, opts.Scopes)
+	}
+	if opts.MaxAge > 0 {
+		a.setSignInMaxAge(w, nonce, opts.MaxAge)
+	}
+	httputil.Redirect(w, r, provider.GetSignInURL(encodedState, opts), http.StatusFound)
 	return nil
 }
 
+// signInScopes returns the additional scopes to request when signing a user
+// in: those required by the route they're signing in to, along with the ones
+// their current session with the provider already holds, so that stepping up
+// to one route's scopes doesn't lose another's.
+func (a *Authenticate) signInScopes(r *http.Request, providerName string) []string {
+	scopes := strings.Fields(r.FormValue(urlutil.QueryScope))
+	if len(scopes) == 0 {
+		return nil
+	}
+	if jwt, err := sessions.FromContext(r.Context()); err == nil {
+		var s sessions.State
+		if err := a.encryptedEncoder.Unmarshal([]byte(jwt), &s); err == nil && s.IdentityProvider == providerName {
+			scopes = append(s.Scopes, scopes...)
+		}
+	}
+	seen := make(map[string]bool, len(scopes))
+	merged := scopes[:0:0]
+	for _, scope := range scopes {
+		if !seen[scope] {
+			seen[scope] = true
+			merged = append(merged, scope)
+		}
+	}
+	return merged
+}
+
+// signInMaxAge returns how long ago, if the route the user is signing in to
+// requires it, they may have last authenticated with the identity provider.
+func signInMaxAge(r *http.Request) (time.Duration, error) {
+	v := r.FormValue(urlutil.QueryMaxAge)
+	if v == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("authenticate: bad max age %q", v)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// signInCookieMaxAge bounds how long a user may take to sign in with the
+// identity provider before the sign in's cookies, such as its PKCE code
+// verifier, are discarded.
+const signInCookieMaxAge = 10 * time.Minute
+
+func (a *Authenticate) codeVerifierCookieName() string {
+	return fmt.Sprintf("%s_pkce", a.cookieOptions.Name)
+}
+
+// setCodeVerifier stores a sign in's PKCE code verifier in a short lived
+// cookie, encrypted and bound to the sign in's csrf nonce. The verifier must
+// not reach the identity provider, so it can't be kept in the state.
+//
+// https://tools.ietf.org/html/rfc7636#section-4.1
+func (a *Authenticate) setCodeVerifier(w http.ResponseWriter, nonce, codeVerifier string) {
+	a.setSignInCookie(w, a.codeVerifierCookieName(), nonce, codeVerifier)
+}
+
+// popCodeVerifier returns the PKCE code verifier stored for the sign in
+// with the given csrf nonce, and clears it so it is only used once.
+func (a *Authenticate) popCodeVerifier(w http.ResponseWriter, r *http.Request, nonce string) (string, error) {
+	codeVerifier, err := a.popSignInCookie(w, r, a.codeVerifierCookieName(), nonce)
+	if err != nil {
+		return "", fmt.Errorf("code verifier: %w", err)
+	}
+	return codeVerifier, nil
+}
+
+func (a *Authenticate) signInScopesCookieName() string {
+	return fmt.Sprintf("%s_scope", a.cookieOptions.Name)
+}
+
+// setSignInScopes stores the additional scopes a sign in requested, so that
+// they can be checked against those granted once the user is redirected
+// back. Providers only list the granted scopes if they differ from those
+// requested (rfc6749 5.1).
+func (a *Authenticate) setSignInScopes(w http.ResponseWriter, nonce string, scopes []string) {
+	a.setSignInCookie(w, a.signInScopesCookieName(), nonce, strings.Join(scopes, " "))
+}
+
+// popSignInScopes returns the additional scopes requested by the sign in
+// with the given csrf nonce, if any, and clears them.
+func (a *Authenticate) popSignInScopes(w http.ResponseWriter, r *http.Request, nonce string) ([]string, error) {
+	scopes, err := a.popSignInCookie(w, r, a.signInScopesCookieName(), nonce)
+	if errors.Is(err, http.ErrNoCookie) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("sign in scopes: %w", err)
+	}
+	return strings.Fields(scopes), nil
+}
+
+func (a *Authenticate) signInMaxAgeCookieName() string {
+	return fmt.Sprintf("%s_max_age", a.cookieOptions.Name)
+}
+
+// setSignInMaxAge stores the max age a sign in requested, so that the time
+// the user authenticated at can be checked against it once they're
+// redirected back; identity providers which don't support max_age ignore it.
+func (a *Authenticate) setSignInMaxAge(w http.ResponseWriter, nonce string, maxAge time.Duration) {
+	a.setSignInCookie(w, a.signInMaxAgeCookieName(), nonce, strconv.FormatInt(int64(maxAge/time.Second), 10))
+}
+
+// popSignInMaxAge returns the max age requested by the sign in with the
+// given csrf nonce, if any, and clears it.
+func (a *Authenticate) popSignInMaxAge(w http.ResponseWriter, r *http.Request, nonce string) (time.Duration, error) {
+	v, err := a.popSignInCookie(w, r, a.signInMaxAgeCookieName(), nonce)
+	if errors.Is(err, http.ErrNoCookie) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("sign in max age: %w", err)
+	}
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("sign in max age: %w", err)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// signInCookieName returns the name of the sign in cookie with the given
+// csrf nonce, so that sign ins made at the same time, from several tabs,
+// each keep their own cookies.
+func signInCookieName(name, nonce string) string {
+	return fmt.Sprintf("%s_%x", name, cryptutil.Hash("sign in cookie name", []byte(nonce))[:8])
+}
+
+// setSignInCookie stores a value for the duration of a sign in in a short
+// lived cookie, encrypted and bound to the sign in's csrf nonce.
+func (a *Authenticate) setSignInCookie(w http.ResponseWriter, name, nonce, value string) {
+	enc := cryptutil.Encrypt(a.cookieCipher, []byte(value), []byte(nonce))
+	http.SetCookie(w, &http.Cookie{
+		Name:     signInCookieName(name, nonce),
+		Value:    base64.URLEncoding.EncodeToString(enc),
+		Path:     a.RedirectURL.Path,
+		Domain:   a.cookieOptions.Domain,
+		Expires:  time.Now().Add(signInCookieMaxAge),
+		Secure:   a.cookieOptions.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// popSignInCookie returns the value stored by setSignInCookie for the sign
+// in with the given csrf nonce, and clears it so it is only used once.
+func (a *Authenticate) popSignInCookie(w http.ResponseWriter, r *http.Request, name, nonce string) (string, error) {
+	c, err := r.Cookie(signInCookieName(name, nonce))
+	if err != nil {
+		return "", fmt.Errorf("missing cookie: %w", err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:    c.Name,
+		Value:   "",
+		Path:    a.RedirectURL.Path,
+		Domain:  a.cookieOptions.Domain,
+		Expires: time.Unix(0, 0),
+		MaxAge:  -1,
+	})
+	enc, err := base64.URLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return "", fmt.Errorf("malformed cookie: %w", err)
+	}
+	value, err := cryptutil.Decrypt(a.cookieCipher, enc, []byte(nonce))
+	if err != nil {
+		return "", fmt.Errorf("invalid cookie: %w", err)
+	}
+	return string(value), nil
+}
+
 // OAuthCallback handles the callback from the identity provider.
 //
 // https://openid.net/specs/openid-connect-core-1_0.html#CodeFlowSteps
@@ -296,7 +772,9 @@ func (a *Authenticate) getOAuthCallback(w http.ResponseWriter, r *http.Request)
 	//
 	// first, check if the identity provider returned an error
 	if idpError := r.FormValue("error"); idpError != "" {
-		return nil, httputil.NewError(a.statusForErrorCode(idpError), fmt.Errorf("identity provider: %v", idpError))
+		err := fmt.Errorf("identity provider: %v", idpError)
+		a.audit.Emit(r.Context(), audit.NewEvent(audit.SignIn, audit.Failure, nil).WithReason(err))
+		return nil, httputil.NewError(a.statusForErrorCode(idpError), err)
 	}
 	// fail if no session redemption code is returned
 	code := r.FormValue("code")
@@ -304,23 +782,17 @@ func (a *Authenticate) getOAuthCallback(w http.ResponseWriter, r *http.Request)
 		return nil, httputil.NewError(http.StatusBadRequest, fmt.Errorf("identity provider returned empty code"))
 	}
 
-	// Successful Authentication Response: rfc6749#section-4.1.2 & OIDC#3.1.2.5
-	//
-	// Exchange the supplied Authorization Code for a valid user session.
-	session, err := a.provider.Authenticate(r.Context(), code)
-	if err != nil {
-		return nil, fmt.Errorf("error redeeming authenticate code: %w", err)
-	}
-	// state includes a csrf nonce (validated by middleware) and redirect uri
+	// state includes a csrf nonce (validated by middleware), the identity
+	// provider the user was sent to, and the redirect uri
 	bytes, err := base64.URLEncoding.DecodeString(r.FormValue("state"))
 	if err != nil {
 		return nil, httputil.NewError(http.StatusBadRequest, err)
 	}
 
 	// split state into concat'd components
-	// (nonce|timestamp|redirect_url|encrypted_data(redirect_url)+mac(nonce,ts))
-	statePayload := strings.SplitN(string(bytes), "|", 3)
-	if len(statePayload) != 3 {
+	// (nonce|timestamp|provider|encrypted_data(redirect_url)+mac(nonce,ts,provider))
+	statePayload := strings.SplitN(string(bytes), "|", 4)
+	if len(statePayload) != 4 {
 		return nil, httputil.NewError(http.StatusBadRequest, fmt.Errorf("state malformed, size: %d", len(statePayload)))
 	}
 
@@ -330,10 +802,10 @@ func (a *Authenticate) getOAuthCallback(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Use our AEAD construct to enforce secrecy and authenticity:
-	// mac: to validate the nonce again, and above timestamp
+	// mac: to validate the nonce again, the above timestamp, and provider
 	// decrypt: to prevent leaking 'redirect_uri' to IdP or logs
-	b := []byte(fmt.Sprint(statePayload[0], "|", statePayload[1], "|"))
-	redirectString, err := cryptutil.Decrypt(a.cookieCipher, []byte(statePayload[2]), b)
+	b := []byte(fmt.Sprint(statePayload[0], "|", statePayload[1], "|", statePayload[2], "|"))
+	redirectString, err := cryptutil.Decrypt(a.cookieCipher, []byte(statePayload[3]), b)
 	if err != nil {
 		return nil, httputil.NewError(http.StatusBadRequest, err)
 	}
@@ -343,10 +815,66 @@ func (a *Authenticate) getOAuthCallback(w http.ResponseWriter, r *http.Request)
 		return nil, httputil.NewError(http.StatusBadRequest, err)
 	}
 
+	provider, err := a.getProvider(statePayload[2])
+	if err != nil {
+		return nil, httputil.NewError(http.StatusBadRequest, err)
+	}
+
+	var codeVerifier string
+	if a.pkce {
+		codeVerifier, err = a.popCodeVerifier(w, r, statePayload[0])
+		if err != nil {
+			return nil, httputil.NewError(http.StatusBadRequest, err)
+		}
+	}
+
+	// Successful Authentication Response: rfc6749#section-4.1.2 & OIDC#3.1.2.5
+	//
+	// Exchange the supplied Authorization Code for a valid user session.
+	session, err := provider.Authenticate(r.Context(), code, codeVerifier)
+	if err != nil {
+		a.auditSignIn(r.Context(), statePayload[2], nil, err)
+	}
+	if errors.Is(err, identity.ErrACRNotSatisfied) {
+		return nil, httputil.NewError(http.StatusForbidden, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("error redeeming authenticate code: %w", err)
+	}
+	session.IdentityProvider = statePayload[2]
+	session.SetSignedIn()
+
+	// a step-up sign in must have been granted the scopes it asked for, or
+	// the user would be sent straight back to the identity provider
+	scopes, err := a.popSignInScopes(w, r, statePayload[0])
+	if err != nil {
+		return nil, httputil.NewError(http.StatusBadRequest, err)
+	}
+	if len(session.Scopes) == 0 {
+		session.Scopes = scopes
+	} else if !session.HasScopes(scopes) {
+		err := fmt.Errorf("identity provider did not grant scopes %q: %w", scopes, sessions.ErrInsufficientScope)
+		a.auditSignIn(r.Context(), session.IdentityProvider, session, err)
+		return nil, httputil.NewError(http.StatusForbidden, err)
+	}
+	// likewise, a sign in with a max age must have authenticated the user
+	// within it, and said when they did
+	maxAge, err := a.popSignInMaxAge(w, r, statePayload[0])
+	if err != nil {
+		return nil, httputil.NewError(http.StatusBadRequest, err)
+	}
+	if !session.AuthenticatedWithin(maxAge) {
+		err := fmt.Errorf("identity provider did not authenticate the user within max age %s: %w", maxAge, sessions.ErrAuthenticationTooOld)
+		a.auditSignIn(r.Context(), session.IdentityProvider, session, err)
+		return nil, httputil.NewError(http.StatusForbidden, err)
+	}
+
 	// OK. Looks good so let's persist our user session
 	if err := a.sessionStore.SaveSession(w, r, session); err != nil {
+		a.auditSignIn(r.Context(), session.IdentityProvider, session, err)
 		return nil, fmt.Errorf("failed saving new session: %w", err)
 	}
+	a.sessionRefresher.track(session)
+	a.auditSignIn(r.Context(), session.IdentityProvider, session, nil)
 	return redirectURL, nil
 }
 
@@ -366,12 +894,194 @@ func (a *Authenticate) RefreshAPI(w http.ResponseWriter, r *http.Request) error
 	if err != nil && !errors.Is(err, sessions.ErrExpired) {
 		return httputil.NewError(http.StatusBadRequest, err)
 	}
-	newSession, err := a.provider.Refresh(r.Context(), &s)
+	if a.revocationStatus(r, &s).Revoked {
+		return httputil.NewError(http.StatusUnauthorized, sessions.ErrRevoked)
+	}
+	newSession, err := a.refreshSession(r.Context(), &s)
 	if err != nil {
-		return err
+		return httputil.NewError(providerErrorStatus(err), err)
 	}
 	newSession = newSession.NewSession(s.Issuer, s.Audience)
+	return a.writeProgrammaticTokens(w, newSession)
+}
+
+// PersonalAccessTokenAPI authenticates non-interactive clients, such as CI
+// jobs, with a personal access token issued by the identity provider instead
+// of the interactive sign in flow. It responds with the same tokens as
+// RefreshAPI, where the jwt is valid for the route given as the redirect uri.
+//
+//	Authorization: Personal-Access-Token <token>
+func (a *Authenticate) PersonalAccessTokenAPI(w http.ResponseWriter, r *http.Request) error {
+	token := header.TokenFromHeader(r, "Authorization", personalAccessTokenAuthType)
+	if token == "" {
+		return httputil.NewError(http.StatusUnauthorized, errors.New("authenticate: missing personal access token"))
+	}
+	redirectURL, err := urlutil.ParseAndValidateURL(r.FormValue(urlutil.QueryRedirectURI))
+	if err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	providerName := r.FormValue(urlutil.QueryIdentityProvider)
+	provider, err := a.getProvider(providerName)
+	if err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	pat, ok := provider.(identity.PersonalAccessTokenAuthenticator)
+	if !ok {
+		return httputil.NewError(http.StatusBadRequest, errors.New("authenticate: identity provider does not support personal access tokens"))
+	}
+	s, err := pat.AuthenticatePersonalAccessToken(r.Context(), token)
+	if err != nil {
+		a.auditSignIn(r.Context(), providerName, nil, err)
+		return httputil.NewError(providerErrorStatus(err), err)
+	}
+	s.IdentityProvider = providerName
+	s.Programmatic = true
+	s.SetSignedIn()
+	a.auditSignIn(r.Context(), providerName, s, nil)
+	newSession := s.NewSession(a.RedirectURL.Host, []string{a.RedirectURL.Host, redirectURL.Host})
+	return a.writeProgrammaticTokens(w, newSession)
+}
 
+// ClientCredentialsAPI authenticates machine clients, for service to service
+// requests, with the OAuth 2.0 client credentials grant. The client's id and
+// secret, sent with basic authentication, are exchanged for a token at the
+// identity provider, and the session is given the client's configured
+// identity. It responds with the same tokens as PersonalAccessTokenAPI, but
+// the session can't be refreshed; the client authenticates again instead.
+//
+//	Authorization: Basic base64(<client_id>:<client_secret>)
+func (a *Authenticate) ClientCredentialsAPI(w http.ResponseWriter, r *http.Request) error {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		return httputil.NewError(http.StatusUnauthorized, errors.New("authenticate: missing client credentials"))
+	}
+	redirectURL, err := urlutil.ParseAndValidateURL(r.FormValue(urlutil.QueryRedirectURI))
+	if err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	providerName := r.FormValue(urlutil.QueryIdentityProvider)
+	provider, err := a.getProvider(providerName)
+	if err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	cc, ok := provider.(identity.ClientCredentialsAuthenticator)
+	if !ok {
+		return httputil.NewError(http.StatusBadRequest, errors.New("authenticate: identity provider does not support client credentials"))
+	}
+	s, err := cc.AuthenticateClientCredentials(r.Context(), clientID, clientSecret)
+	if err != nil {
+		a.auditSignIn(r.Context(), providerName, nil, err)
+		return httputil.NewError(providerErrorStatus(err), err)
+	}
+	s.IdentityProvider = providerName
+	s.Programmatic = true
+	s.SetSignedIn()
+	a.auditSignIn(r.Context(), providerName, s, nil)
+	newSession := s.NewSession(a.RedirectURL.Host, []string{a.RedirectURL.Host, redirectURL.Host})
+	return a.writeProgrammaticTokens(w, newSession)
+}
+
+// DeviceAuthorizationAPI starts the OAuth 2.0 device authorization grant,
+// for command line tools and other clients which can't open a browser. It
+// responds with the identity provider's device authorization: the client
+// shows the user its user code and verification uri, where they sign in,
+// and then calls DeviceTokenAPI with its device code.
+func (a *Authenticate) DeviceAuthorizationAPI(w http.ResponseWriter, r *http.Request) error {
+	providerName := r.FormValue(urlutil.QueryIdentityProvider)
+	provider, err := a.getProvider(providerName)
+	if err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	da, ok := provider.(identity.DeviceAuthenticator)
+	if !ok {
+		return httputil.NewError(http.StatusBadRequest, identity.ErrDeviceAuthorizationNotSupported)
+	}
+	authorization, err := da.AuthorizeDevice(r.Context())
+	if err != nil {
+		return httputil.NewError(providerErrorStatus(err), err)
+	}
+	jsonResponse, err := json.Marshal(authorization)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResponse)
+	return nil
+}
+
+// DeviceTokenAPI completes the device authorization grant started with
+// DeviceAuthorizationAPI. Each request polls the identity provider once
+// with the client's device code. Until the user approves the sign in, it
+// responds with an authorization_pending error, or slow_down if the client
+// is polling too often, and the client polls again after the interval the
+// provider asked for. Once approved, it responds with the same tokens as
+// PersonalAccessTokenAPI.
+//
+//	device_code=<device_code>
+//
+// https://tools.ietf.org/html/rfc8628#section-3.5
+func (a *Authenticate) DeviceTokenAPI(w http.ResponseWriter, r *http.Request) error {
+	deviceCode := r.FormValue("device_code")
+	if deviceCode == "" {
+		return httputil.NewError(http.StatusBadRequest, errors.New("authenticate: missing device code"))
+	}
+	redirectURL, err := urlutil.ParseAndValidateURL(r.FormValue(urlutil.QueryRedirectURI))
+	if err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	providerName := r.FormValue(urlutil.QueryIdentityProvider)
+	provider, err := a.getProvider(providerName)
+	if err != nil {
+		return httputil.NewError(http.StatusBadRequest, err)
+	}
+	da, ok := provider.(identity.DeviceAuthenticator)
+	if !ok {
+		return httputil.NewError(http.StatusBadRequest, identity.ErrDeviceAuthorizationNotSupported)
+	}
+	s, err := da.AuthenticateDevice(r.Context(), deviceCode)
+	switch {
+	case errors.Is(err, identity.ErrAuthorizationPending):
+		return writeDeviceTokenError(w, "authorization_pending")
+	case errors.Is(err, identity.ErrSlowDown):
+		return writeDeviceTokenError(w, "slow_down")
+	case err != nil:
+		a.auditSignIn(r.Context(), providerName, nil, err)
+		return httputil.NewError(providerErrorStatus(err), err)
+	}
+	s.IdentityProvider = providerName
+	s.Programmatic = true
+	s.SetSignedIn()
+	a.auditSignIn(r.Context(), providerName, s, nil)
+	newSession := s.NewSession(a.RedirectURL.Host, []string{a.RedirectURL.Host, redirectURL.Host})
+	return a.writeProgrammaticTokens(w, newSession)
+}
+
+// writeDeviceTokenError responds with an OAuth 2.0 error telling a device to
+// keep polling.
+//
+// https://tools.ietf.org/html/rfc6749#section-5.2
+func writeDeviceTokenError(w http.ResponseWriter, code string) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadRequest)
+	return json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// auditSignIn records a sign in with the named identity provider, which
+// failed if err is set.
+func (a *Authenticate) auditSignIn(ctx context.Context, providerName string, s *sessions.State, err error) {
+	e := audit.NewEvent(audit.SignIn, audit.Success, s)
+	e.Provider = providerName
+	if err != nil {
+		e.Outcome = audit.Failure
+		e = e.WithReason(err)
+	}
+	a.audit.Emit(ctx, e)
+}
+
+// writeProgrammaticTokens responds with the session's signed route jwt, and
+// its encrypted form which can be exchanged for a new one using RefreshAPI.
+func (a *Authenticate) writeProgrammaticTokens(w http.ResponseWriter, newSession *sessions.State) error {
 	encSession, err := a.encryptedEncoder.Marshal(newSession)
 	if err != nil {
 		return err
@@ -414,6 +1124,13 @@ func (a *Authenticate) Refresh(w http.ResponseWriter, r *http.Request) error {
 	if err := s.Verify(r.Host); err != nil && !errors.Is(err, sessions.ErrExpired) {
 		return httputil.NewError(http.StatusBadRequest, err)
 	}
+	// the user's activity on the route, which this service doesn't otherwise
+	// see, once the session itself has passed its lifetime checks
+	if lastActive, ok := proxyLastActive(r); ok && s.ActiveAt(lastActive) {
+		if _, err := a.saveActivity(w, r, &s); err != nil {
+			return httputil.NewError(http.StatusInternalServerError, err)
+		}
+	}
 	aud := strings.Split(r.FormValue(urlutil.QueryAudience), ",")
 	routeSession := s.NewSession(r.Host, aud)
 	routeSession.AccessTokenID = s.AccessTokenID
@@ -427,3 +1144,44 @@ func (a *Authenticate) Refresh(w http.ResponseWriter, r *http.Request) error {
 	w.Write(signedJWT)
 	return nil
 }
+
+// refreshSession refreshes a session with the identity provider which
+// authenticated it.
+func (a *Authenticate) refreshSession(ctx context.Context, s *sessions.State) (*sessions.State, error) {
+	provider, err := a.getProvider(s.IdentityProvider)
+	if err != nil {
+		return nil, err
+	}
+	newSession, err := provider.Refresh(ctx, s)
+	if err != nil {
+		a.audit.Emit(ctx, audit.NewEvent(audit.TokenRefresh, audit.Failure, s).WithReason(err))
+		return nil, err
+	}
+	newSession.IdentityProvider = s.IdentityProvider
+	a.audit.Emit(ctx, audit.NewEvent(audit.TokenRefresh, audit.Success, newSession))
+	return newSession, nil
+}
+
+// providerErrorStatus maps an error returned by the identity provider to the
+// HTTP status reported to the client: unauthorized if the user must
+// re-authenticate, and service unavailable if the request may be retried.
+func providerErrorStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, identity.ErrTokenExpired), errors.Is(err, identity.ErrTokenRevoked),
+		errors.Is(err, identity.ErrMissingSession), errors.Is(err, identity.ErrUnknownMachineClient):
+		return http.StatusUnauthorized
+	case errors.Is(err, identity.ErrDeviceCodeExpired):
+		return http.StatusUnauthorized
+	case errors.Is(err, identity.ErrPersonalAccessTokensDisabled), errors.Is(err, identity.ErrClientCredentialsDisabled),
+		errors.Is(err, identity.ErrDeviceAuthorizationDisabled), errors.Is(err, identity.ErrAccessDenied):
+		return http.StatusForbidden
+	case errors.Is(err, identity.ErrDeviceAuthorizationNotSupported):
+		return http.StatusBadRequest
+	case errors.Is(err, identity.ErrProviderUnavailable), errors.Is(err, identity.ErrGroupsRequestTimeout):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -1,6 +1,7 @@
 package authenticate
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -8,9 +9,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/pomerium/pomerium/internal/audit"
 	"github.com/pomerium/pomerium/internal/cryptutil"
 	"github.com/pomerium/pomerium/internal/encoding"
 	"github.com/pomerium/pomerium/internal/encoding/jws"
@@ -21,6 +24,7 @@ import (
 	"github.com/pomerium/pomerium/internal/sessions"
 	"github.com/pomerium/pomerium/internal/sessions/cookie"
 	mstore "github.com/pomerium/pomerium/internal/sessions/mock"
+	"github.com/pomerium/pomerium/internal/sessions/revocation"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/pomerium/pomerium/internal/urlutil"
@@ -57,6 +61,38 @@ func TestAuthenticate_RobotsTxt(t *testing.T) {
 	}
 }
 
+func TestAuthenticate_Readyz(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		provider  identity.MockProvider
+		providers map[string]identity.Authenticator
+		wantCode  int
+		wantBody  string
+	}{
+		{"healthy", identity.MockProvider{}, map[string]identity.Authenticator{"contractors": identity.MockProvider{}}, http.StatusOK, "OK\n"},
+		{"default unhealthy", identity.MockProvider{HealthyError: errors.New("unreachable")}, nil, http.StatusServiceUnavailable, "identity provider unhealthy: default\n"},
+		{"named unhealthy", identity.MockProvider{}, map[string]identity.Authenticator{"contractors": identity.MockProvider{HealthyError: errors.New("unreachable")}}, http.StatusServiceUnavailable, "identity provider unhealthy: contractors\n"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			a := testAuthenticate()
+			a.provider = tt.provider
+			a.providers = tt.providers
+			w := httptest.NewRecorder()
+			a.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("Readyz() status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if diff := cmp.Diff(tt.wantBody, w.Body.String()); diff != "" {
+				t.Errorf("Readyz() body = %s", diff)
+			}
+		})
+	}
+}
+
 func TestAuthenticate_Handler(t *testing.T) {
 	auth := testAuthenticate()
 
@@ -233,6 +269,49 @@ func TestAuthenticate_SignOut(t *testing.T) {
 	}
 }
 
+func TestAuthenticate_SignOutEndSession(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name         string
+		endSession   bool
+		provider     identity.Authenticator
+		wantLocation string
+	}{
+		{"enabled", true, identity.MockProvider{GetEndSessionURLResponse: "https://idp.example.com/logout"}, "https://idp.example.com/logout"},
+		{"not enabled", false, identity.MockProvider{GetEndSessionURLResponse: "https://idp.example.com/logout"}, "https://corp.pomerium.io/"},
+		{"no end session endpoint", true, identity.MockProvider{}, "https://corp.pomerium.io/"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			sessionStore := &mstore.Store{Encrypted: true, Session: &sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}
+			a := &Authenticate{
+				sessionStore:     sessionStore,
+				provider:         tt.provider,
+				endSession:       tt.endSession,
+				encryptedEncoder: mock.Encoder{},
+				templates:        template.Must(frontend.NewTemplates()),
+			}
+			r := httptest.NewRequest(http.MethodPost, "/sign_out?"+url.Values{urlutil.QueryRedirectURI: {"https://corp.pomerium.io/"}}.Encode(), nil)
+			state, err := sessionStore.LoadSession(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = r.WithContext(sessions.NewContext(r.Context(), state, nil))
+
+			w := httptest.NewRecorder()
+			httputil.HandlerFunc(a.SignOut).ServeHTTP(w, r)
+			if w.Code != http.StatusFound {
+				t.Fatalf("SignOut() status = %v, want %v\n%v", w.Code, http.StatusFound, w.Body.String())
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("SignOut() location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
 func TestAuthenticate_OAuthCallback(t *testing.T) {
 	t.Parallel()
 
@@ -241,6 +320,7 @@ func TestAuthenticate_OAuthCallback(t *testing.T) {
 		method string
 
 		ts            int64
+		idp           string
 		stateOvveride string
 		extraMac      string
 		extraState    string
@@ -255,20 +335,22 @@ func TestAuthenticate_OAuthCallback(t *testing.T) {
 		want     string
 		wantCode int
 	}{
-		{"good", http.MethodGet, time.Now().Unix(), "", "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusFound},
-		{"failed authenticate", http.MethodGet, time.Now().Unix(), "", "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateError: errors.New("error")}, "", http.StatusInternalServerError},
-		{"failed save session", http.MethodGet, time.Now().Unix(), "", "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{SaveError: errors.New("error")}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "", http.StatusInternalServerError},
-		{"provider returned error", http.MethodGet, time.Now().Unix(), "", "", "", "idp error", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "", http.StatusBadRequest},
-		{"provider returned error imply 401", http.MethodGet, time.Now().Unix(), "", "", "", "access_denied", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "", http.StatusUnauthorized},
-		{"empty code", http.MethodGet, time.Now().Unix(), "", "", "", "", "", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "", http.StatusBadRequest},
-		{"invalid redirect uri", http.MethodGet, time.Now().Unix(), "", "", "", "", "code", "corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "", http.StatusBadRequest},
-		{"bad redirect uri", http.MethodGet, time.Now().Unix(), "", "", "", "", "code", "http://^^^", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
-		{"bad timing - too soon", http.MethodGet, time.Now().Add(1 * time.Hour).Unix(), "", "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
-		{"bad timing - expired", http.MethodGet, time.Now().Add(-1 * time.Hour).Unix(), "", "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
-		{"bad base64", http.MethodGet, time.Now().Unix(), "", "", "^", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
-		{"too many seperators", http.MethodGet, time.Now().Unix(), "", "", "|ok|now|what", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
-		{"bad hmac", http.MethodGet, time.Now().Unix(), "", "NOTMAC", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
-		{"bad hmac", http.MethodGet, time.Now().Unix(), base64.URLEncoding.EncodeToString([]byte("malformed_state")), "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
+		{"good", http.MethodGet, time.Now().Unix(), "", "", "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusFound},
+		{"named identity provider", http.MethodGet, time.Now().Unix(), "corp", "", "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusFound},
+		{"unknown identity provider", http.MethodGet, time.Now().Unix(), "other", "", "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "", http.StatusBadRequest},
+		{"failed authenticate", http.MethodGet, time.Now().Unix(), "", "", "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateError: errors.New("error")}, "", http.StatusInternalServerError},
+		{"failed save session", http.MethodGet, time.Now().Unix(), "", "", "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{SaveError: errors.New("error")}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "", http.StatusInternalServerError},
+		{"provider returned error", http.MethodGet, time.Now().Unix(), "", "", "", "", "idp error", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "", http.StatusBadRequest},
+		{"provider returned error imply 401", http.MethodGet, time.Now().Unix(), "", "", "", "", "access_denied", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "", http.StatusUnauthorized},
+		{"empty code", http.MethodGet, time.Now().Unix(), "", "", "", "", "", "", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "", http.StatusBadRequest},
+		{"invalid redirect uri", http.MethodGet, time.Now().Unix(), "", "", "", "", "", "code", "corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "", http.StatusBadRequest},
+		{"bad redirect uri", http.MethodGet, time.Now().Unix(), "", "", "", "", "", "code", "http://^^^", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
+		{"bad timing - too soon", http.MethodGet, time.Now().Add(1 * time.Hour).Unix(), "", "", "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
+		{"bad timing - expired", http.MethodGet, time.Now().Add(-1 * time.Hour).Unix(), "", "", "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
+		{"bad base64", http.MethodGet, time.Now().Unix(), "", "", "", "^", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
+		{"too many seperators", http.MethodGet, time.Now().Unix(), "", "", "", "|ok|now|what", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
+		{"bad hmac", http.MethodGet, time.Now().Unix(), "", "", "NOTMAC", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
+		{"bad hmac", http.MethodGet, time.Now().Unix(), "", base64.URLEncoding.EncodeToString([]byte("malformed_state")), "", "", "", "code", "https://corp.pomerium.io", "https://authenticate.pomerium.io", &mstore.Store{}, identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}, "https://corp.pomerium.io", http.StatusBadRequest},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -278,10 +360,12 @@ func TestAuthenticate_OAuthCallback(t *testing.T) {
 			}
 			authURL, _ := url.Parse(tt.authenticateURL)
 			a := &Authenticate{
-				RedirectURL:  authURL,
-				sessionStore: tt.session,
-				provider:     tt.provider,
-				cookieCipher: aead,
+				RedirectURL:   authURL,
+				sessionStore:  tt.session,
+				provider:      tt.provider,
+				providers:     map[string]identity.Authenticator{"corp": tt.provider},
+				cookieCipher:  aead,
+				cookieOptions: &cookie.Options{Name: "name"},
 			}
 			u, _ := url.Parse("/oauthGet")
 			params, _ := url.ParseQuery(u.RawQuery)
@@ -289,8 +373,8 @@ func TestAuthenticate_OAuthCallback(t *testing.T) {
 			params.Add("code", tt.code)
 			nonce := cryptutil.NewBase64Key() // mock csrf
 
-			// (nonce|timestamp|redirect_url|encrypt(redirect_url),mac(nonce,ts))
-			b := []byte(fmt.Sprintf("%s|%d|%s", nonce, tt.ts, tt.extraMac))
+			// (nonce|timestamp|provider|encrypt(redirect_url),mac(nonce,ts,provider))
+			b := []byte(fmt.Sprintf("%s|%d|%s|%s", nonce, tt.ts, tt.idp, tt.extraMac))
 
 			enc := cryptutil.Encrypt(a.cookieCipher, []byte(tt.redirectURI), b)
 			b = append(b, enc...)
@@ -317,6 +401,162 @@ func TestAuthenticate_OAuthCallback(t *testing.T) {
 	}
 }
 
+func TestAuthenticate_OAuthCallbackScopes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		requested []string
+		granted   []string
+		wantCode  int
+	}{
+		{"no step up", nil, []string{"openid"}, http.StatusFound},
+		{"granted", []string{"admin"}, []string{"openid", "admin"}, http.StatusFound},
+		{"grant not reported", []string{"admin"}, nil, http.StatusFound},
+		{"not granted", []string{"admin"}, []string{"openid"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			aead, err := chacha20poly1305.NewX(cryptutil.NewKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := testAuthenticate()
+			a.sessionStore = &mstore.Store{}
+			a.provider = identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", Scopes: tt.granted, AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}
+			a.cookieCipher = aead
+
+			nonce := cryptutil.NewBase64Key()
+			b := []byte(fmt.Sprintf("%s|%d||", nonce, time.Now().Unix()))
+			b = append(b, cryptutil.Encrypt(a.cookieCipher, []byte("https://corp.pomerium.io"), b)...)
+			params := url.Values{"code": {"code"}, "state": {base64.URLEncoding.EncodeToString(b)}}
+			r := httptest.NewRequest(http.MethodGet, "/oauth/callback?"+params.Encode(), nil)
+			// a sign in from another tab, for a route requiring other scopes
+			other := httptest.NewRecorder()
+			a.setSignInScopes(other, cryptutil.NewBase64Key(), []string{"billing"})
+			r.AddCookie(other.Result().Cookies()[0])
+			if tt.requested != nil {
+				w := httptest.NewRecorder()
+				a.setSignInScopes(w, nonce, tt.requested)
+				r.AddCookie(w.Result().Cookies()[0])
+			}
+			w := httptest.NewRecorder()
+			httputil.HandlerFunc(a.OAuthCallback).ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("OAuthCallback() status = %v, want %v\n%v", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthenticate_OAuthCallbackMaxAge(t *testing.T) {
+	t.Parallel()
+	ago := func(d time.Duration) *jwt.NumericDate { return jwt.NewNumericDate(time.Now().Add(-d)) }
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		authTime *jwt.NumericDate
+		wantCode int
+	}{
+		{"no max age", 0, nil, http.StatusFound},
+		{"authenticated within", 5 * time.Minute, ago(time.Second), http.StatusFound},
+		{"authenticated too long ago", 5 * time.Minute, ago(time.Hour), http.StatusForbidden},
+		{"auth time not reported", 5 * time.Minute, nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			aead, err := chacha20poly1305.NewX(cryptutil.NewKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := testAuthenticate()
+			a.sessionStore = &mstore.Store{}
+			a.provider = identity.MockProvider{AuthenticateResponse: sessions.State{Email: "user@pomerium.io", AuthTime: tt.authTime, AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Second)}}}
+			a.cookieCipher = aead
+
+			nonce := cryptutil.NewBase64Key()
+			b := []byte(fmt.Sprintf("%s|%d||", nonce, time.Now().Unix()))
+			b = append(b, cryptutil.Encrypt(a.cookieCipher, []byte("https://corp.pomerium.io"), b)...)
+			params := url.Values{"code": {"code"}, "state": {base64.URLEncoding.EncodeToString(b)}}
+			r := httptest.NewRequest(http.MethodGet, "/oauth/callback?"+params.Encode(), nil)
+			// a sign in from another tab, for a route with a longer max age
+			other := httptest.NewRecorder()
+			a.setSignInMaxAge(other, cryptutil.NewBase64Key(), 24*time.Hour)
+			r.AddCookie(other.Result().Cookies()[0])
+			if tt.maxAge > 0 {
+				w := httptest.NewRecorder()
+				a.setSignInMaxAge(w, nonce, tt.maxAge)
+				r.AddCookie(w.Result().Cookies()[0])
+			}
+			w := httptest.NewRecorder()
+			httputil.HandlerFunc(a.OAuthCallback).ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("OAuthCallback() status = %v, want %v\n%v", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthenticate_codeVerifier(t *testing.T) {
+	t.Parallel()
+	aead, err := chacha20poly1305.NewX(cryptutil.NewKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := testAuthenticate()
+	a.cookieCipher = aead
+
+	w := httptest.NewRecorder()
+	a.setCodeVerifier(w, "nonce", "verifier")
+	// another sign in, from another tab, doesn't overwrite the first's
+	a.setCodeVerifier(w, "other", "other verifier")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 2 || cookies[0].Name == cookies[1].Name || !cookies[0].HttpOnly || cookies[0].Path != a.RedirectURL.Path {
+		t.Fatalf("setCodeVerifier() cookies = %v", cookies)
+	}
+
+	tests := []struct {
+		name    string
+		cookie  *http.Cookie
+		nonce   string
+		want    string
+		wantErr bool
+	}{
+		{"good", cookies[0], "nonce", "verifier", false},
+		{"concurrent sign in", cookies[1], "other", "other verifier", false},
+		{"other sign in's cookie", &http.Cookie{Name: cookies[1].Name, Value: cookies[0].Value}, "other", "", true},
+		{"missing", nil, "nonce", "", true},
+		{"malformed", &http.Cookie{Name: cookies[0].Name, Value: "^"}, "nonce", "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			r := httptest.NewRequest(http.MethodGet, "/oauth/callback", nil)
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+			w := httptest.NewRecorder()
+			got, err := a.popCodeVerifier(w, r, tt.nonce)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("popCodeVerifier() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("popCodeVerifier() = %q, want %q", got, tt.want)
+			}
+			if tt.cookie != nil {
+				// the verifier is cleared whether or not it was valid
+				if c := w.Result().Cookies(); len(c) != 1 || c[0].MaxAge >= 0 {
+					t.Errorf("popCodeVerifier() cookies = %v", c)
+				}
+			}
+		})
+	}
+}
+
 func TestAuthenticate_SessionValidatorMiddleware(t *testing.T) {
 	t.Parallel()
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -341,6 +581,10 @@ func TestAuthenticate_SessionValidatorMiddleware(t *testing.T) {
 		{"expired,refresh error", nil, &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(-10 * time.Minute))}}, sessions.ErrExpired, identity.MockProvider{RefreshError: errors.New("error")}, http.StatusFound},
 		{"expired,save error", nil, &mstore.Store{SaveError: errors.New("error"), Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(-10 * time.Minute))}}, sessions.ErrExpired, identity.MockProvider{RefreshResponse: sessions.State{AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Minute)}}}, http.StatusFound},
 		{"expired XHR,refresh error", map[string]string{"X-Requested-With": "XmlHttpRequest"}, &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(-10 * time.Minute))}}, sessions.ErrExpired, identity.MockProvider{RefreshError: errors.New("error")}, http.StatusUnauthorized},
+		{"expired,provider unavailable", nil, &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(-10 * time.Minute))}}, nil, identity.MockProvider{RefreshError: identity.ErrProviderUnavailable}, http.StatusServiceUnavailable},
+		{"expired,token revoked", nil, &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(-10 * time.Minute))}}, nil, identity.MockProvider{RefreshError: identity.ErrTokenRevoked}, http.StatusFound},
+		{"expires soon", nil, &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(2 * time.Minute))}}, nil, identity.MockProvider{}, http.StatusFound},
+		{"expires soon,refreshable", nil, &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(2 * time.Minute)), AccessToken: &oauth2.Token{RefreshToken: "refresh", Expiry: time.Now().Add(2 * time.Minute)}}}, nil, identity.MockProvider{}, http.StatusOK},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -360,6 +604,8 @@ func TestAuthenticate_SessionValidatorMiddleware(t *testing.T) {
 				provider:         tt.provider,
 				cookieCipher:     aead,
 				encryptedEncoder: signer,
+
+				reauthenticateBeforeExpiry: 5 * time.Minute,
 			}
 			r := httptest.NewRequest("GET", "/", nil)
 			state, err := tt.session.LoadSession(r)
@@ -387,6 +633,161 @@ func TestAuthenticate_SessionValidatorMiddleware(t *testing.T) {
 	}
 }
 
+func TestAuthenticate_VerifySessionTokenRevoked(t *testing.T) {
+	t.Parallel()
+	signer, err := jws.NewHS256Signer(nil, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &mstore.Store{
+		ResponseSession: "session",
+		Session:         &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(-10 * time.Minute))},
+	}
+	a := testAuthenticate()
+	a.sessionStore = store
+	a.provider = identity.MockProvider{RefreshError: fmt.Errorf("groups failed: %w", identity.ErrTokenRevoked)}
+	a.encryptedEncoder = signer
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Requested-With", "XmlHttpRequest")
+	state, _ := store.LoadSession(r)
+	r = r.WithContext(sessions.NewContext(r.Context(), state, nil))
+	w := httptest.NewRecorder()
+	a.VerifySession(http.NotFoundHandler()).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("VerifySession() status = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+	if store.ResponseSession != "" {
+		t.Error("VerifySession() didn't clear the session")
+	}
+}
+
+func TestAuthenticate_VerifySessionScopes(t *testing.T) {
+	t.Parallel()
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	expiry := jwt.NewNumericDate(time.Now().Add(10 * time.Minute))
+	tests := []struct {
+		name       string
+		session    *sessions.State
+		scope      string
+		wantStatus int
+		wantScopes []string
+	}{
+		{"no scopes required", &sessions.State{Email: "user@test.example", Expiry: expiry}, "", http.StatusOK, nil},
+		{"scopes granted", &sessions.State{Email: "user@test.example", Expiry: expiry, Scopes: []string{"openid", "admin"}}, "admin", http.StatusOK, nil},
+		{"step up", &sessions.State{Email: "user@test.example", Expiry: expiry, Scopes: []string{"openid", "billing"}}, "admin", http.StatusFound, []string{"openid", "billing", "admin"}},
+		{"step up, other provider's grant", &sessions.State{Email: "user@test.example", Expiry: expiry, Scopes: []string{"openid"}, IdentityProvider: "corp"}, "admin", http.StatusFound, []string{"admin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aead, err := chacha20poly1305.NewX(cryptutil.NewKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			signer, err := jws.NewHS256Signer(nil, "mock")
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := testAuthenticate()
+			a.sessionStore = &mstore.Store{Session: tt.session}
+			a.provider = identity.MockProvider{GetSignInURLResponse: "https://idp.example.com/auth"}
+			a.cookieCipher = aead
+			a.encryptedEncoder = signer
+
+			r := httptest.NewRequest(http.MethodGet, "/?"+url.Values{urlutil.QueryScope: {tt.scope}}.Encode(), nil)
+			state, _ := a.sessionStore.LoadSession(r)
+			r = r.WithContext(sessions.NewContext(r.Context(), state, nil))
+			w := httptest.NewRecorder()
+			a.VerifySession(fn).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("VerifySession() status = %v, want %v\n%v", w.Code, tt.wantStatus, w.Body.String())
+			}
+
+			// without the csrf middleware, sign ins have an empty nonce
+			var got []string
+			for _, c := range w.Result().Cookies() {
+				if c.Name == signInCookieName(a.signInScopesCookieName(), "") {
+					r := httptest.NewRequest(http.MethodGet, "/oauth/callback", nil)
+					r.AddCookie(c)
+					if got, err = a.popSignInScopes(httptest.NewRecorder(), r, ""); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if diff := cmp.Diff(tt.wantScopes, got); diff != "" {
+				t.Errorf("sign in scopes = %s", diff)
+			}
+		})
+	}
+}
+
+func TestAuthenticate_VerifySessionMaxAge(t *testing.T) {
+	t.Parallel()
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	expiry := jwt.NewNumericDate(time.Now().Add(10 * time.Minute))
+	ago := func(d time.Duration) *jwt.NumericDate { return jwt.NewNumericDate(time.Now().Add(-d)) }
+	tests := []struct {
+		name       string
+		session    *sessions.State
+		maxAge     string
+		wantStatus int
+		wantMaxAge time.Duration
+	}{
+		{"no max age", &sessions.State{Email: "user@test.example", Expiry: expiry}, "", http.StatusOK, 0},
+		{"authenticated within", &sessions.State{Email: "user@test.example", Expiry: expiry, AuthTime: ago(time.Minute)}, "300", http.StatusOK, 0},
+		{"authenticated too long ago", &sessions.State{Email: "user@test.example", Expiry: expiry, AuthTime: ago(time.Hour)}, "300", http.StatusFound, 5 * time.Minute},
+		{"auth time not recorded", &sessions.State{Email: "user@test.example", Expiry: expiry}, "300", http.StatusFound, 5 * time.Minute},
+		{"bad max age", &sessions.State{Email: "user@test.example", Expiry: expiry}, "5m", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			aead, err := chacha20poly1305.NewX(cryptutil.NewKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			signer, err := jws.NewHS256Signer(nil, "mock")
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := testAuthenticate()
+			a.sessionStore = &mstore.Store{Session: tt.session}
+			a.provider = identity.MockProvider{GetSignInURLResponse: "https://idp.example.com/auth"}
+			a.cookieCipher = aead
+			a.encryptedEncoder = signer
+
+			r := httptest.NewRequest(http.MethodGet, "/?"+url.Values{urlutil.QueryMaxAge: {tt.maxAge}}.Encode(), nil)
+			state, _ := a.sessionStore.LoadSession(r)
+			r = r.WithContext(sessions.NewContext(r.Context(), state, nil))
+			w := httptest.NewRecorder()
+			a.VerifySession(fn).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("VerifySession() status = %v, want %v\n%v", w.Code, tt.wantStatus, w.Body.String())
+			}
+
+			// without the csrf middleware, sign ins have an empty nonce
+			var got time.Duration
+			for _, c := range w.Result().Cookies() {
+				if c.Name == signInCookieName(a.signInMaxAgeCookieName(), "") {
+					r := httptest.NewRequest(http.MethodGet, "/oauth/callback", nil)
+					r.AddCookie(c)
+					if got, err = a.popSignInMaxAge(httptest.NewRecorder(), r, ""); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if got != tt.wantMaxAge {
+				t.Errorf("sign in max age = %v, want %v", got, tt.wantMaxAge)
+			}
+		})
+	}
+}
+
 func TestAuthenticate_RefreshAPI(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -403,6 +804,9 @@ func TestAuthenticate_RefreshAPI(t *testing.T) {
 	}{
 		{"good", &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(10 * time.Minute))}}, nil, identity.MockProvider{RefreshResponse: sessions.State{AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Minute)}}}, mock.Encoder{MarshalResponse: []byte("ok")}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusOK},
 		{"refresh error", &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(10 * time.Minute))}}, nil, identity.MockProvider{RefreshError: errors.New("error")}, mock.Encoder{MarshalResponse: []byte("ok")}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusInternalServerError},
+		{"refresh token expired", &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(10 * time.Minute))}}, nil, identity.MockProvider{RefreshError: fmt.Errorf("refresh failed: %w", identity.ErrTokenExpired)}, mock.Encoder{MarshalResponse: []byte("ok")}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusUnauthorized},
+		{"provider unavailable", &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(10 * time.Minute))}}, nil, identity.MockProvider{RefreshError: identity.ErrProviderUnavailable}, mock.Encoder{MarshalResponse: []byte("ok")}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusServiceUnavailable},
+		{"token revoked", &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(10 * time.Minute))}}, nil, identity.MockProvider{RefreshError: identity.ErrTokenRevoked}, mock.Encoder{MarshalResponse: []byte("ok")}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusUnauthorized},
 		{"session is not refreshable error", &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(10 * time.Minute))}}, errors.New("session error"), identity.MockProvider{RefreshResponse: sessions.State{AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Minute)}}}, mock.Encoder{MarshalResponse: []byte("ok")}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusBadRequest},
 		{"secret encoder failed", &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(10 * time.Minute))}}, nil, identity.MockProvider{RefreshResponse: sessions.State{AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Minute)}}}, mock.Encoder{MarshalError: errors.New("error")}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusInternalServerError},
 		{"shared encoder failed", &mstore.Store{Session: &sessions.State{Email: "user@test.example", Expiry: jwt.NewNumericDate(time.Now().Add(10 * time.Minute))}}, nil, identity.MockProvider{RefreshResponse: sessions.State{AccessToken: &oauth2.Token{Expiry: time.Now().Add(10 * time.Minute)}}}, mock.Encoder{MarshalResponse: []byte("ok")}, mock.Encoder{MarshalError: errors.New("error")}, http.StatusInternalServerError},
@@ -440,6 +844,253 @@ func TestAuthenticate_RefreshAPI(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthenticate_refreshSessionAudit(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		provider    identity.MockProvider
+		wantOutcome audit.Outcome
+		wantReason  string
+	}{
+		{"refreshed", identity.MockProvider{RefreshResponse: sessions.State{Subject: "user", SessionID: "session"}}, audit.Success, ""},
+		{"failed", identity.MockProvider{RefreshError: errors.New("invalid_grant")}, audit.Failure, "invalid_grant"},
+	}
+	for _, tt := range tests {
+		sink := &audit.MockSink{}
+		a := testAuthenticate()
+		a.providers = map[string]identity.Authenticator{"corp": tt.provider}
+		a.audit = audit.New(sink)
+		a.refreshSession(context.Background(), &sessions.State{Subject: "user", SessionID: "session", IdentityProvider: "corp"})
+
+		events := sink.Events()
+		if len(events) != 1 {
+			t.Fatalf("%s: refreshSession() audit events = %v, want 1", tt.name, events)
+		}
+		e := events[0]
+		e.Time = time.Time{}
+		want := audit.Event{Type: audit.TokenRefresh, Outcome: tt.wantOutcome, Subject: "user", Provider: "corp", SessionID: "session", Reason: tt.wantReason}
+		if diff := cmp.Diff(want, e); diff != "" {
+			t.Errorf("%s: refreshSession() audit event = %s", tt.name, diff)
+		}
+	}
+}
+
+// patProvider is a mock provider which supports personal access tokens.
+type patProvider struct {
+	identity.MockProvider
+	session sessions.State
+	err     error
+}
+
+func (p patProvider) AuthenticatePersonalAccessToken(ctx context.Context, token string) (*sessions.State, error) {
+	return &p.session, p.err
+}
+
+func TestAuthenticate_PersonalAccessTokenAPI(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		header        string
+		redirectURI   string
+		provider      identity.Authenticator
+		sharedEncoder encoding.MarshalUnmarshaler
+		wantStatus    int
+	}{
+		{"good", "Personal-Access-Token PAT", "https://app.example.com", patProvider{session: sessions.State{Email: "ci@example.com"}}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusOK},
+		{"missing token", "", "https://app.example.com", patProvider{}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusUnauthorized},
+		{"wrong auth type", "Bearer PAT", "https://app.example.com", patProvider{}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusUnauthorized},
+		{"missing redirect uri", "Personal-Access-Token PAT", "", patProvider{}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusBadRequest},
+		{"not supported", "Personal-Access-Token PAT", "https://app.example.com", identity.MockProvider{}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusBadRequest},
+		{"disabled", "Personal-Access-Token PAT", "https://app.example.com", patProvider{err: identity.ErrPersonalAccessTokensDisabled}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusForbidden},
+		{"invalid token", "Personal-Access-Token PAT", "https://app.example.com", patProvider{err: identity.ErrTokenExpired}, mock.Encoder{MarshalResponse: []byte("ok")}, http.StatusUnauthorized},
+		{"shared encoder failed", "Personal-Access-Token PAT", "https://app.example.com", patProvider{}, mock.Encoder{MarshalError: errors.New("error")}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			a := Authenticate{
+				RedirectURL:      uriParseHelper("https://authenticate.corp.beyondperimeter.com"),
+				encryptedEncoder: mock.Encoder{MarshalResponse: []byte("ok")},
+				sharedEncoder:    tt.sharedEncoder,
+				provider:         tt.provider,
+			}
+			uri := &url.URL{Path: "/api/v1/token"}
+			uri.RawQuery = url.Values{urlutil.QueryRedirectURI: {tt.redirectURI}}.Encode()
+			r := httptest.NewRequest(http.MethodGet, uri.String(), nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			r.Header.Set("Accept", "application/json")
+
+			w := httptest.NewRecorder()
+			httputil.HandlerFunc(a.PersonalAccessTokenAPI).ServeHTTP(w, r)
+			if status := w.Code; status != tt.wantStatus {
+				t.Errorf("PersonalAccessTokenAPI() status = %v, want %v\n%v", status, tt.wantStatus, w.Body.String())
+			}
+		})
+	}
+}
+
+// ccProvider is a mock provider which supports the client credentials grant.
+type ccProvider struct {
+	identity.MockProvider
+	err error
+}
+
+func (p ccProvider) AuthenticateClientCredentials(ctx context.Context, clientID, clientSecret string) (*sessions.State, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &sessions.State{Subject: clientID, Email: "ci@example.com"}, nil
+}
+
+func TestAuthenticate_ClientCredentialsAPI(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		basicAuth   bool
+		redirectURI string
+		provider    identity.Authenticator
+		wantStatus  int
+	}{
+		{"good", true, "https://app.example.com", ccProvider{}, http.StatusOK},
+		{"missing credentials", false, "https://app.example.com", ccProvider{}, http.StatusUnauthorized},
+		{"missing redirect uri", true, "", ccProvider{}, http.StatusBadRequest},
+		{"not supported", true, "https://app.example.com", identity.MockProvider{}, http.StatusBadRequest},
+		{"disabled", true, "https://app.example.com", ccProvider{err: identity.ErrClientCredentialsDisabled}, http.StatusForbidden},
+		{"unknown client", true, "https://app.example.com", ccProvider{err: identity.ErrUnknownMachineClient}, http.StatusUnauthorized},
+		{"bad secret", true, "https://app.example.com", ccProvider{err: identity.ErrTokenExpired}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			a := Authenticate{
+				RedirectURL:      uriParseHelper("https://authenticate.corp.beyondperimeter.com"),
+				encryptedEncoder: mock.Encoder{MarshalResponse: []byte("ok")},
+				sharedEncoder:    mock.Encoder{MarshalResponse: []byte("ok")},
+				provider:         tt.provider,
+			}
+			form := url.Values{urlutil.QueryRedirectURI: {tt.redirectURI}}
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/client_credentials", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Accept", "application/json")
+			if tt.basicAuth {
+				r.SetBasicAuth("ci", "secret")
+			}
+
+			w := httptest.NewRecorder()
+			httputil.HandlerFunc(a.ClientCredentialsAPI).ServeHTTP(w, r)
+			if status := w.Code; status != tt.wantStatus {
+				t.Errorf("ClientCredentialsAPI() status = %v, want %v\n%v", status, tt.wantStatus, w.Body.String())
+			}
+		})
+	}
+}
+
+// deviceProvider is a mock provider which supports the device authorization
+// grant.
+type deviceProvider struct {
+	identity.MockProvider
+	err error
+}
+
+func (p deviceProvider) AuthorizeDevice(ctx context.Context) (*identity.DeviceAuthorization, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &identity.DeviceAuthorization{DeviceCode: "device", UserCode: "WDJB-MJHT", VerificationURI: "https://idp.example.com/device", ExpiresIn: 900, Interval: 5}, nil
+}
+
+func (p deviceProvider) AuthenticateDevice(ctx context.Context, deviceCode string) (*sessions.State, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &sessions.State{Subject: "user", Email: "user@example.com"}, nil
+}
+
+func TestAuthenticate_DeviceAuthorizationAPI(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		provider   identity.Authenticator
+		wantStatus int
+		wantBody   string
+	}{
+		{"good", deviceProvider{}, http.StatusOK, `{"device_code":"device","user_code":"WDJB-MJHT","verification_uri":"https://idp.example.com/device","expires_in":900,"interval":5}`},
+		{"not supported", identity.MockProvider{}, http.StatusBadRequest, ""},
+		{"not supported by provider", deviceProvider{err: identity.ErrDeviceAuthorizationNotSupported}, http.StatusBadRequest, ""},
+		{"disabled", deviceProvider{err: identity.ErrDeviceAuthorizationDisabled}, http.StatusForbidden, ""},
+		{"unavailable", deviceProvider{err: identity.ErrProviderUnavailable}, http.StatusServiceUnavailable, ""},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			a := Authenticate{provider: tt.provider}
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/device_authorization", nil)
+			r.Header.Set("Accept", "application/json")
+
+			w := httptest.NewRecorder()
+			httputil.HandlerFunc(a.DeviceAuthorizationAPI).ServeHTTP(w, r)
+			if status := w.Code; status != tt.wantStatus {
+				t.Errorf("DeviceAuthorizationAPI() status = %v, want %v\n%v", status, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("DeviceAuthorizationAPI() body = %s, want %s", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAuthenticate_DeviceTokenAPI(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		deviceCode  string
+		redirectURI string
+		provider    identity.Authenticator
+		wantStatus  int
+		wantBody    string
+	}{
+		{"good", "device", "https://app.example.com", deviceProvider{}, http.StatusOK, ""},
+		{"missing device code", "", "https://app.example.com", deviceProvider{}, http.StatusBadRequest, ""},
+		{"missing redirect uri", "device", "", deviceProvider{}, http.StatusBadRequest, ""},
+		{"not supported", "device", "https://app.example.com", identity.MockProvider{}, http.StatusBadRequest, ""},
+		{"pending", "device", "https://app.example.com", deviceProvider{err: identity.ErrAuthorizationPending}, http.StatusBadRequest, `{"error":"authorization_pending"}` + "\n"},
+		{"slow down", "device", "https://app.example.com", deviceProvider{err: identity.ErrSlowDown}, http.StatusBadRequest, `{"error":"slow_down"}` + "\n"},
+		{"denied", "device", "https://app.example.com", deviceProvider{err: identity.ErrAccessDenied}, http.StatusForbidden, ""},
+		{"expired", "device", "https://app.example.com", deviceProvider{err: identity.ErrDeviceCodeExpired}, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			a := Authenticate{
+				RedirectURL:      uriParseHelper("https://authenticate.corp.beyondperimeter.com"),
+				encryptedEncoder: mock.Encoder{MarshalResponse: []byte("ok")},
+				sharedEncoder:    mock.Encoder{MarshalResponse: []byte("ok")},
+				provider:         tt.provider,
+			}
+			form := url.Values{"device_code": {tt.deviceCode}, urlutil.QueryRedirectURI: {tt.redirectURI}}
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/device_token", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Accept", "application/json")
+
+			w := httptest.NewRecorder()
+			httputil.HandlerFunc(a.DeviceTokenAPI).ServeHTTP(w, r)
+			if status := w.Code; status != tt.wantStatus {
+				t.Errorf("DeviceTokenAPI() status = %v, want %v\n%v", status, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("DeviceTokenAPI() body = %s, want %s", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
 func TestAuthenticate_Refresh(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -491,3 +1142,331 @@ func TestAuthenticate_Refresh(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthenticate_VerifySessionGroupsRefresh(t *testing.T) {
+	t.Parallel()
+	expiry := jwt.NewNumericDate(time.Now().Add(10 * time.Minute))
+	refreshed := sessions.State{Email: "user@test.example", Expiry: expiry, Groups: []string{"new"}, GroupsRefreshedAt: jwt.NewNumericDate(time.Now())}
+	invalidations := &revocation.MockStore{}
+	if err := revocation.InvalidateGroups(context.Background(), invalidations, "", "invalidated", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		interval   time.Duration
+		session    *sessions.State
+		wantGroups []string
+	}{
+		{"fresh", time.Minute, &sessions.State{Email: "user@test.example", Expiry: expiry, Groups: []string{"old"}, GroupsRefreshedAt: jwt.NewNumericDate(time.Now())}, []string{"old"}},
+		{"stale", time.Minute, &sessions.State{Email: "user@test.example", Expiry: expiry, Groups: []string{"old"}, GroupsRefreshedAt: jwt.NewNumericDate(time.Now().Add(-time.Hour))}, []string{"new"}},
+		{"stale, refresh interval disabled", 0, &sessions.State{Email: "user@test.example", Expiry: expiry, Groups: []string{"old"}, GroupsRefreshedAt: jwt.NewNumericDate(time.Now().Add(-time.Hour))}, []string{"old"}},
+		{"invalidated", time.Hour, &sessions.State{Subject: "invalidated", Expiry: expiry, Groups: []string{"old"}, GroupsRefreshedAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}, []string{"new"}},
+		{"invalidated, refresh interval disabled", 0, &sessions.State{Subject: "invalidated", Expiry: expiry, Groups: []string{"old"}, GroupsRefreshedAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}, []string{"new"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			signer, err := jws.NewHS256Signer(nil, "mock")
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := testAuthenticate()
+			a.sessionStore = &mstore.Store{Session: tt.session}
+			a.provider = identity.MockProvider{RefreshResponse: refreshed}
+			a.encryptedEncoder = signer
+			a.groupsRefreshInterval = tt.interval
+			a.revocations = invalidations
+
+			var got []string
+			fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				jwt, err := sessions.FromContext(r.Context())
+				if err != nil {
+					t.Fatal(err)
+				}
+				var s sessions.State
+				if err := signer.Unmarshal([]byte(jwt), &s); err != nil {
+					t.Fatal(err)
+				}
+				got = s.Groups
+			})
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			state, _ := a.sessionStore.LoadSession(r)
+			r = r.WithContext(sessions.NewContext(r.Context(), state, nil))
+			w := httptest.NewRecorder()
+			a.VerifySession(fn).ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("VerifySession() status = %v, want %v\n%v", w.Code, http.StatusOK, w.Body.String())
+			}
+			if diff := cmp.Diff(tt.wantGroups, got); diff != "" {
+				t.Errorf("session groups = %s", diff)
+			}
+		})
+	}
+}
+
+func TestAuthenticate_VerifySessionRevocationLookups(t *testing.T) {
+	t.Parallel()
+	signer, err := jws.NewHS256Signer(nil, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocations := &revocation.MockStore{}
+	if err := revocation.InvalidateGroups(context.Background(), revocations, "", "invalidated", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	expiry := jwt.NewNumericDate(time.Now().Add(10 * time.Minute))
+	a := testAuthenticate()
+	a.sessionStore = &mstore.Store{Session: &sessions.State{Subject: "invalidated", Expiry: expiry, GroupsRefreshedAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}}
+	a.provider = identity.MockProvider{RefreshResponse: sessions.State{Subject: "invalidated", Expiry: expiry, GroupsRefreshedAt: jwt.NewNumericDate(time.Now())}}
+	a.encryptedEncoder = signer
+	a.revocations = revocations
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	state, _ := a.sessionStore.LoadSession(r)
+	r = r.WithContext(sessions.NewContext(r.Context(), state, nil))
+	w := httptest.NewRecorder()
+	a.VerifySession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("VerifySession() status = %v, want %v\n%v", w.Code, http.StatusOK, w.Body.String())
+	}
+	// revocation and groups invalidation are checked together, including
+	// for the session's refresh
+	if revocations.Lookups != 1 {
+		t.Errorf("VerifySession() revocation store lookups = %v, want 1", revocations.Lookups)
+	}
+}
+
+// invalidatingProvider is a mock provider which records whose groups it
+// was asked to invalidate.
+type invalidatingProvider struct {
+	identity.MockProvider
+	invalidated *[]string
+}
+
+func (p invalidatingProvider) InvalidateGroups(ctx context.Context, sub string) {
+	*p.invalidated = append(*p.invalidated, sub)
+}
+
+func TestAuthenticate_InvalidateGroupsAPI(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name            string
+		query           string
+		unsigned        bool
+		storeError      error
+		wantCode        int
+		wantInvalidated []string
+	}{
+		{"good", "user=user", false, nil, http.StatusNoContent, []string{"user"}},
+		{"named provider", "user=user&" + urlutil.QueryIdentityProvider + "=corp", false, nil, http.StatusNoContent, []string{"user"}},
+		{"unsigned", "user=user", true, nil, http.StatusBadRequest, nil},
+		{"missing user", "", false, nil, http.StatusBadRequest, nil},
+		{"unknown provider", "user=user&" + urlutil.QueryIdentityProvider + "=unknown", false, nil, http.StatusBadRequest, nil},
+		{"store error", "user=user", false, errors.New("error"), http.StatusInternalServerError, []string{"user"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var invalidated []string
+			provider := invalidatingProvider{invalidated: &invalidated}
+			revocations := &revocation.MockStore{Error: tt.storeError}
+			a := testAuthenticate()
+			a.provider = provider
+			a.providers = map[string]identity.Authenticator{"corp": provider}
+			a.cookieOptions = &cookie.Options{Name: "name", Expire: time.Hour}
+			a.revocations = revocations
+
+			u, _ := url.Parse("https://auth.example.com" + invalidateGroupsPath + "?" + tt.query)
+			if !tt.unsigned {
+				u, _ = url.Parse(urlutil.NewSignedURL(a.sharedKey, u).String())
+			}
+			r := httptest.NewRequest(http.MethodPost, u.String(), nil)
+			r.Header.Set("Accept", "application/json")
+			w := httptest.NewRecorder()
+			a.Handler().ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("InvalidateGroupsAPI() status = %v, want %v\n%v", w.Code, tt.wantCode, w.Body.String())
+			}
+			if diff := cmp.Diff(tt.wantInvalidated, invalidated); diff != "" {
+				t.Errorf("InvalidateGroups() = %s", diff)
+			}
+			if tt.wantCode != http.StatusNoContent {
+				return
+			}
+			idp := r.URL.Query().Get(urlutil.QueryIdentityProvider)
+			if ttl, ok := revocations.TTL("groups/" + idp + "/user"); !ok || ttl != time.Hour {
+				t.Errorf("InvalidateGroupsAPI() recorded = %v for %v, want recorded for the cookie's expiry", ok, ttl)
+			}
+		})
+	}
+}
+
+func TestAuthenticate_VerifySessionLifetime(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ago := func(d time.Duration) *jwt.NumericDate { return jwt.NewNumericDate(now.Add(-d)) }
+	expiry := jwt.NewNumericDate(now.Add(10 * time.Minute))
+	tests := []struct {
+		name           string
+		session        *sessions.State
+		wantStatus     int
+		wantLastActive bool
+	}{
+		{"active", &sessions.State{Email: "user@test.example", Expiry: expiry, SignedInAt: ago(time.Hour), LastActiveAt: ago(10 * time.Second)}, http.StatusOK, false},
+		{"active a while ago", &sessions.State{Email: "user@test.example", Expiry: expiry, SignedInAt: ago(time.Hour), LastActiveAt: ago(5 * time.Minute)}, http.StatusOK, true},
+		{"idle", &sessions.State{Email: "user@test.example", Expiry: expiry, SignedInAt: ago(time.Hour), LastActiveAt: ago(20 * time.Minute)}, http.StatusUnauthorized, false},
+		{"max duration exceeded", &sessions.State{Email: "user@test.example", Expiry: expiry, SignedInAt: ago(9 * time.Hour), LastActiveAt: ago(10 * time.Second)}, http.StatusUnauthorized, false},
+		{"lifetime not recorded", &sessions.State{Email: "user@test.example", Expiry: expiry}, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			signer, err := jws.NewHS256Signer(nil, "mock")
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := testAuthenticate()
+			a.sessionStore = &mstore.Store{Session: tt.session}
+			a.encryptedEncoder = signer
+			a.sessionMaxDuration = 8 * time.Hour
+			a.sessionIdleTimeout = 15 * time.Minute
+
+			var got sessions.State
+			fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				jwt, err := sessions.FromContext(r.Context())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := signer.Unmarshal([]byte(jwt), &got); err != nil {
+					t.Fatal(err)
+				}
+			})
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("X-Requested-With", "XmlHttpRequest")
+			state, _ := a.sessionStore.LoadSession(r)
+			r = r.WithContext(sessions.NewContext(r.Context(), state, nil))
+			w := httptest.NewRecorder()
+			a.VerifySession(fn).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("VerifySession() status = %v, want %v\n%v", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if touched := got.LastActiveAt != nil && (tt.session.LastActiveAt == nil || got.LastActiveAt.Time().After(tt.session.LastActiveAt.Time())); touched != tt.wantLastActive {
+				t.Errorf("VerifySession() last active at = %v, was %v", got.LastActiveAt, tt.session.LastActiveAt)
+			}
+			if got.SignedInAt == nil {
+				t.Errorf("VerifySession() signed in at not recorded")
+			}
+		})
+	}
+}
+
+func TestAuthenticate_SignOutRevokesSession(t *testing.T) {
+	t.Parallel()
+	signer, err := jws.NewHS256Signer(nil, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &sessions.State{Email: "user@test.example", SessionID: "session", Expiry: jwt.NewNumericDate(time.Now().Add(10 * time.Minute))}
+	revocations := &revocation.MockStore{}
+	a := testAuthenticate()
+	a.sessionStore = &mstore.Store{Session: session}
+	a.provider = identity.MockProvider{}
+	a.encryptedEncoder = signer
+	a.cookieOptions = &cookie.Options{Expire: time.Hour}
+	a.revocations = revocations
+	auditSink := &audit.MockSink{}
+	a.audit = audit.New(auditSink)
+
+	request := func(path string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("X-Requested-With", "XmlHttpRequest")
+		state, _ := a.sessionStore.LoadSession(r)
+		return r.WithContext(sessions.NewContext(r.Context(), state, nil))
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	a.VerifySession(ok).ServeHTTP(w, request("/"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("VerifySession() before sign out status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	w = httptest.NewRecorder()
+	httputil.HandlerFunc(a.SignOut).ServeHTTP(w, request("/sign_out?"+urlutil.QueryRedirectURI+"=https://corp.example"))
+	if w.Code != http.StatusFound {
+		t.Fatalf("SignOut() status = %v, want %v\n%v", w.Code, http.StatusFound, w.Body.String())
+	}
+	if ttl, ok := revocations.TTL("session/session"); !ok || ttl != time.Hour {
+		t.Errorf("SignOut() revoked = %v for %v, want revoked for the cookie's expiry", ok, ttl)
+	}
+	var events []string
+	for _, e := range auditSink.Events() {
+		if e.SessionID != "session" {
+			t.Errorf("SignOut() audit event %s session id = %q, want %q", e.Type, e.SessionID, "session")
+		}
+		events = append(events, string(e.Type)+" "+string(e.Outcome))
+	}
+	if diff := cmp.Diff([]string{"revocation success", "sign_out success"}, events); diff != "" {
+		t.Errorf("SignOut() audit events = %s", diff)
+	}
+
+	w = httptest.NewRecorder()
+	a.VerifySession(ok).ServeHTTP(w, request("/"))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("VerifySession() after sign out status = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthenticate_BackChannelLogout(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		idp         string
+		provider    identity.MockProvider
+		storeError  error
+		wantCode    int
+		wantRevoked string
+	}{
+		{"provider session", "", identity.MockProvider{VerifyLogoutTokenResponse: identity.LogoutToken{Subject: "user", SessionID: "session"}}, nil, http.StatusOK, "sid//session"},
+		{"named provider session", "corp", identity.MockProvider{VerifyLogoutTokenResponse: identity.LogoutToken{SessionID: "session"}}, nil, http.StatusOK, "sid/corp/session"},
+		{"subject", "", identity.MockProvider{VerifyLogoutTokenResponse: identity.LogoutToken{Subject: "user"}}, nil, http.StatusOK, "sub//user"},
+		{"invalid logout token", "", identity.MockProvider{VerifyLogoutTokenError: errors.New("invalid")}, nil, http.StatusBadRequest, ""},
+		{"unknown provider", "unknown", identity.MockProvider{}, nil, http.StatusBadRequest, ""},
+		{"store error", "", identity.MockProvider{VerifyLogoutTokenResponse: identity.LogoutToken{Subject: "user"}}, errors.New("error"), http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			revocations := &revocation.MockStore{Error: tt.storeError}
+			a := testAuthenticate()
+			a.provider = tt.provider
+			a.providers = map[string]identity.Authenticator{"corp": tt.provider}
+			a.cookieOptions = &cookie.Options{Expire: time.Hour}
+			a.revocations = revocations
+
+			params := url.Values{}
+			params.Set("logout_token", "token")
+			r := httptest.NewRequest(http.MethodPost, backChannelLogoutPath+"?"+urlutil.QueryIdentityProvider+"="+tt.idp, strings.NewReader(params.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Accept", "application/json")
+			w := httptest.NewRecorder()
+			httputil.HandlerFunc(a.BackChannelLogout).ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("BackChannelLogout() status = %v, want %v\n%v", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantRevoked == "" {
+				return
+			}
+			if ttl, ok := revocations.TTL(tt.wantRevoked); !ok || ttl != time.Hour {
+				t.Errorf("BackChannelLogout() revoked %q = %v for %v, want revoked for the cookie's expiry", tt.wantRevoked, ok, ttl)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package authenticate
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/identity"
+	"github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+// maxSessionRefreshInterval bounds how often due sessions are looked for.
+const maxSessionRefreshInterval = 30 * time.Second
+
+// defaultSessionIdleTimeout is how long a session which isn't used is kept
+// refreshed if the session cookie has no expiry of its own.
+const defaultSessionIdleTimeout = 14 * time.Hour
+
+// sessionRefresher renews the tokens of active sessions in the background,
+// shortly before they expire, so that a user's request doesn't wait for the
+// identity provider. Refreshes are spread over the second half of the
+// window before expiry so that sessions signed in at the same time, or
+// tokens issued with the same lifetime, don't all refresh at once.
+//
+// Only which sessions to refresh, and when, is kept in memory. Sessions are
+// loaded from the session store before they're refreshed and saved back to
+// it afterwards, keeping the access token id the session was tracked with so
+// that proxies holding it load the refreshed session, and so that a
+// refresh survives a restart and is seen by every replica. A session's
+// cookie catches up the next time it is verified.
+//
+// Sessions are tracked from when they are signed in or refreshed, and are
+// dropped once they are signed out, fail to refresh, or haven't been used
+// for idle.
+type sessionRefresher struct {
+	refresh func(context.Context, *sessions.State) (*sessions.State, error)
+	load    func(ctx context.Context, id string) (*sessions.State, error)
+	save    func(context.Context, *sessions.State) error
+	before  time.Duration
+	idle    time.Duration
+	now     func() time.Time
+	jitter  func(time.Duration) time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*trackedSession
+}
+
+type trackedSession struct {
+	refreshAt time.Time
+	lastSeen  time.Time
+}
+
+func newSessionRefresher(refresh func(context.Context, *sessions.State) (*sessions.State, error), load func(context.Context, string) (*sessions.State, error), save func(context.Context, *sessions.State) error, before, idle time.Duration) *sessionRefresher {
+	if idle <= 0 {
+		idle = defaultSessionIdleTimeout
+	}
+	return &sessionRefresher{
+		refresh:  refresh,
+		load:     load,
+		save:     save,
+		before:   before,
+		idle:     idle,
+		now:      time.Now,
+		jitter:   randomJitter,
+		sessions: make(map[string]*trackedSession),
+	}
+}
+
+func randomJitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// run refreshes due sessions until ctx is done.
+func (r *sessionRefresher) run(ctx context.Context) {
+	interval := r.before / 4
+	if interval > maxSessionRefreshInterval {
+		interval = maxSessionRefreshInterval
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.refreshDue(ctx)
+		}
+	}
+}
+
+// track registers a session to be refreshed before its token expires.
+// Sessions without a refresh token can't be, and are ignored.
+func (r *sessionRefresher) track(s *sessions.State) {
+	if r == nil || s == nil || s.AccessTokenID == "" || s.AccessToken == nil || s.AccessToken.RefreshToken == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.AccessTokenID] = &trackedSession{
+		refreshAt: r.refreshAt(s),
+		lastSeen:  r.now(),
+	}
+}
+
+// forget stops refreshing the session with the given access token id.
+func (r *sessionRefresher) forget(id string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+}
+
+// seen records that a session is in use.
+func (r *sessionRefresher) seen(s *sessions.State) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ts, ok := r.sessions[s.AccessTokenID]; ok {
+		ts.lastSeen = r.now()
+	}
+}
+
+// refreshed returns the session's state as last saved to the session store,
+// if it is newer than s and its token hasn't expired; as it is when the
+// session was refreshed in the background, by this or another replica.
+func (r *sessionRefresher) refreshed(ctx context.Context, s *sessions.State) *sessions.State {
+	if r == nil {
+		return nil
+	}
+	latest, err := r.load(ctx, s.AccessTokenID)
+	if err != nil {
+		if !errors.Is(err, sessions.ErrNoSessionFound) {
+			log.Warn().Err(err).Msg("authenticate: failed to load refreshed session")
+		}
+		return nil
+	}
+	expiry := latest.TokenExpiry()
+	if !expiry.After(s.TokenExpiry()) || !expiry.After(r.now()) {
+		return nil
+	}
+	r.seen(s)
+	return latest
+}
+
+// refreshAt returns when the session should be refreshed; a random point in
+// the second half of the window of length before that ends at its expiry.
+func (r *sessionRefresher) refreshAt(s *sessions.State) time.Time {
+	return s.TokenExpiry().Add(-r.before).Add(r.jitter(r.before / 2))
+}
+
+// refreshDue refreshes the sessions whose time has come, and drops those
+// which are no longer in use.
+func (r *sessionRefresher) refreshDue(ctx context.Context) {
+	now := r.now()
+	var due []string
+	r.mu.Lock()
+	for id, ts := range r.sessions {
+		switch {
+		case now.Sub(ts.lastSeen) > r.idle:
+			delete(r.sessions, id)
+		case !now.Before(ts.refreshAt):
+			due = append(due, id)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, id := range due {
+		newSession, err := r.load(ctx, id)
+		if err == nil {
+			newSession, err = r.refresh(ctx, newSession)
+		}
+		if err == nil {
+			newSession.AccessTokenID = id
+			err = r.save(ctx, newSession)
+		}
+		r.mu.Lock()
+		ts, ok := r.sessions[id]
+		switch {
+		case !ok:
+			// signed out, or refreshed by a request, in the meantime
+		case errors.Is(err, identity.ErrProviderUnavailable):
+			log.Warn().Err(err).Msg("authenticate: background refresh failed, retrying")
+			ts.refreshAt = now.Add(r.jitter(r.before / 2))
+		case err != nil:
+			log.Info().Err(err).Msg("authenticate: background refresh failed")
+			delete(r.sessions, id)
+		default:
+			ts.refreshAt = r.refreshAt(newSession)
+		}
+		r.mu.Unlock()
+	}
+}
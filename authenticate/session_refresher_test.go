@@ -0,0 +1,135 @@
+package authenticate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/identity"
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestSessionRefresher(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	var refreshErr error
+	var refreshes, saves int
+	refresh := func(ctx context.Context, s *sessions.State) (*sessions.State, error) {
+		refreshes++
+		if refreshErr != nil {
+			return nil, refreshErr
+		}
+		s.AccessToken = &oauth2.Token{AccessToken: "new", RefreshToken: "refresh", Expiry: now.Add(time.Hour)}
+		s.AccessTokenID = "rotated"
+		return s, nil
+	}
+	// the session store, shared by replicas
+	store := make(map[string]sessions.State)
+	load := func(ctx context.Context, id string) (*sessions.State, error) {
+		s, ok := store[id]
+		if !ok {
+			return nil, sessions.ErrNoSessionFound
+		}
+		return &s, nil
+	}
+	save := func(ctx context.Context, s *sessions.State) error {
+		saves++
+		if s.AccessTokenID != "id" {
+			t.Errorf("saved access token id = %q, want %q", s.AccessTokenID, "id")
+		}
+		store[s.AccessTokenID] = *s
+		return nil
+	}
+	newRefresher := func() *sessionRefresher {
+		r := newSessionRefresher(refresh, load, save, 10*time.Minute, 2*time.Hour)
+		r.now = func() time.Time { return now }
+		r.jitter = func(d time.Duration) time.Duration { return d / 2 }
+		return r
+	}
+	r := newRefresher()
+	ctx := context.Background()
+
+	s := &sessions.State{
+		AccessTokenID: "id",
+		AccessToken:   &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: now.Add(20 * time.Minute)},
+	}
+	store[s.AccessTokenID] = *s
+	r.track(s)
+	r.track(&sessions.State{AccessTokenID: "no refresh token", AccessToken: &oauth2.Token{AccessToken: "old"}})
+	if len(r.sessions) != 1 {
+		t.Fatalf("tracked %d sessions, want 1", len(r.sessions))
+	}
+
+	// 20m to expiry; refreshed between 10m and 5m before it, here 7.5m
+	now = now.Add(12 * time.Minute)
+	r.refreshDue(ctx)
+	if refreshes != 0 {
+		t.Fatalf("refreshed before due")
+	}
+	now = now.Add(time.Minute)
+	r.refreshDue(ctx)
+	if refreshes != 1 || saves != 1 {
+		t.Fatalf("refreshes = %d, saves = %d, want 1", refreshes, saves)
+	}
+	got := r.refreshed(ctx, s)
+	if got == nil || got.AccessToken.AccessToken != "new" {
+		t.Fatalf("refreshed() = %v, want the refreshed session", got)
+	}
+	if r.refreshed(ctx, got) != nil {
+		t.Error("refreshed() returned a session which isn't newer")
+	}
+	// the refresh is kept in the session store, not the refresher
+	if got := newRefresher().refreshed(ctx, s); got == nil || got.AccessToken.AccessToken != "new" {
+		t.Errorf("refreshed() after a restart = %v, want the refreshed session", got)
+	}
+
+	// transient failures are retried, others stop the session's refreshes
+	refreshErr = identity.ErrProviderUnavailable
+	now = now.Add(time.Hour)
+	r.refreshDue(ctx)
+	if len(r.sessions) != 1 {
+		t.Fatal("session dropped after a transient failure")
+	}
+	refreshErr = errors.New("invalid_grant")
+	now = now.Add(time.Hour)
+	r.seen(s)
+	r.refreshDue(ctx)
+	if len(r.sessions) != 0 {
+		t.Fatal("session kept after failing to refresh")
+	}
+}
+
+func TestSessionRefresherCleanup(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	refresh := func(ctx context.Context, s *sessions.State) (*sessions.State, error) {
+		t.Fatal("unexpected refresh")
+		return nil, nil
+	}
+	r := newSessionRefresher(refresh, nil, nil, time.Minute, time.Hour)
+	r.now = func() time.Time { return now }
+	token := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: now.Add(24 * time.Hour)}
+	active := &sessions.State{AccessTokenID: "active", AccessToken: token}
+	r.track(active)
+	r.track(&sessions.State{AccessTokenID: "idle", AccessToken: token})
+	r.track(&sessions.State{AccessTokenID: "signed out", AccessToken: token})
+	r.forget("signed out")
+
+	now = now.Add(50 * time.Minute)
+	r.seen(active)
+	now = now.Add(20 * time.Minute)
+	r.refreshDue(context.Background())
+	if _, ok := r.sessions["active"]; !ok || len(r.sessions) != 1 {
+		t.Errorf("sessions = %v, want only the active session", r.sessions)
+	}
+
+	// a nil refresher is disabled
+	var disabled *sessionRefresher
+	disabled.track(active)
+	disabled.seen(active)
+	disabled.forget("active")
+	if disabled.refreshed(context.Background(), active) != nil {
+		t.Error("disabled refresher returned a session")
+	}
+}
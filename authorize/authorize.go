@@ -12,6 +12,7 @@ import (
 	"github.com/pomerium/pomerium/authorize/evaluator"
 	"github.com/pomerium/pomerium/authorize/evaluator/opa"
 	"github.com/pomerium/pomerium/config"
+	"github.com/pomerium/pomerium/internal/audit"
 	"github.com/pomerium/pomerium/internal/cryptutil"
 	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/telemetry/metrics"
@@ -21,6 +22,8 @@ import (
 // Authorize struct holds
 type Authorize struct {
 	pe evaluator.Evaluator
+	// audit, if set, records authorization decisions
+	audit *audit.Logger
 }
 
 // New validates and creates a new Authorize service from a set of config options.
@@ -33,6 +36,9 @@ func New(opts config.Options) (*Authorize, error) {
 	if a.pe, err = newPolicyEvaluator(&opts); err != nil {
 		return nil, err
 	}
+	if a.audit, err = audit.NewLogger(opts.AuditLog); err != nil {
+		return nil, err
+	}
 	return &a, nil
 }
 
@@ -93,5 +99,8 @@ func (a *Authorize) UpdateOptions(opts config.Options) error {
 	if a.pe, err = newPolicyEvaluator(&opts); err != nil {
 		return err
 	}
+	if a.audit, err = audit.NewLogger(opts.AuditLog); err != nil {
+		return err
+	}
 	return nil
 }
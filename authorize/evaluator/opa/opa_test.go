@@ -16,6 +16,10 @@ func Test_Eval(t *testing.T) {
 		User              string   `json:"user,omitempty"`
 		Email             string   `json:"email,omitempty"`
 		Groups            []string `json:"groups,omitempty"`
+		Orgs              []string `json:"orgs,omitempty"`
+		ACR               string   `json:"acr,omitempty"`
+		AMR               []string `json:"amr,omitempty"`
+		AuthTime          int64    `json:"auth_time,omitempty"`
 		ImpersonateEmail  string   `json:"impersonate_email,omitempty"`
 		ImpersonateGroups []string `json:"impersonate_groups,omitempty"`
 	}
@@ -37,6 +41,18 @@ func Test_Eval(t *testing.T) {
 		{"invalid empty", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedGroups: []string{"admin"}}}, "from.example", &Identity{Email: "user@example.com", Groups: []string{""}}, nil, "secret", false},
 		{"valid group multiple", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedGroups: []string{"admin"}}}, "from.example", &Identity{Email: "user@example.com", Groups: []string{"everyone", "admin"}}, nil, "secret", true},
 		{"invalid group multiple", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedGroups: []string{"admin"}}}, "from.example", &Identity{Email: "user@example.com", Groups: []string{"everyones", "sadmin"}}, nil, "secret", false},
+		{"valid org", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedOrgs: []string{"pomerium"}}}, "from.example", &Identity{Email: "user@example.com", Orgs: []string{"pomerium"}}, nil, "secret", true},
+		{"org is not a group", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedOrgs: []string{"pomerium"}}}, "from.example", &Identity{Email: "user@example.com", Groups: []string{"pomerium"}}, nil, "secret", false},
+		{"mfa required", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedDomains: []string{"example.com"}, RequiredAMR: []string{"mfa"}}}, "from.example", &Identity{Email: "user@example.com", AMR: []string{"pwd", "mfa"}}, nil, "secret", true},
+		{"mfa required but missing", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedDomains: []string{"example.com"}, RequiredAMR: []string{"mfa"}}}, "from.example", &Identity{Email: "user@example.com", AMR: []string{"pwd"}}, nil, "secret", false},
+		{"mfa required but no amr", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedDomains: []string{"example.com"}, RequiredAMR: []string{"mfa"}}}, "from.example", &Identity{Email: "user@example.com"}, nil, "secret", false},
+		{"allowed acr", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedDomains: []string{"example.com"}, AllowedACRValues: []string{"gold", "silver"}}}, "from.example", &Identity{Email: "user@example.com", ACR: "silver"}, nil, "secret", true},
+		{"acr not allowed", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedDomains: []string{"example.com"}, AllowedACRValues: []string{"gold"}}}, "from.example", &Identity{Email: "user@example.com", ACR: "bronze"}, nil, "secret", false},
+		{"authenticated within max age", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedDomains: []string{"example.com"}, IdentityProviderMaxAge: 5 * time.Minute}}, "from.example", &Identity{Email: "user@example.com", AuthTime: time.Now().Add(-time.Minute).Unix()}, nil, "secret", true},
+		{"authenticated before max age", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedDomains: []string{"example.com"}, IdentityProviderMaxAge: 5 * time.Minute}}, "from.example", &Identity{Email: "user@example.com", AuthTime: time.Now().Add(-time.Hour).Unix()}, nil, "secret", false},
+		{"max age but no auth time", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedDomains: []string{"example.com"}, IdentityProviderMaxAge: 5 * time.Minute}}, "from.example", &Identity{Email: "user@example.com"}, nil, "secret", false},
+		{"acr required but missing", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedDomains: []string{"example.com"}, AllowedACRValues: []string{"gold"}}}, "from.example", &Identity{Email: "user@example.com"}, nil, "secret", false},
+		{"group is not an org", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedGroups: []string{"pomerium"}}}, "from.example", &Identity{Email: "user@example.com", Orgs: []string{"pomerium"}}, nil, "secret", false},
 		{"valid user email", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedUsers: []string{"user@example.com"}}}, "from.example", &Identity{Email: "user@example.com"}, nil, "secret", true},
 		{"invalid user email", []config.Policy{{From: "https://from.example", To: "https://to.example", AllowedUsers: []string{"user@example.com"}}}, "from.example", &Identity{Email: "user2@example.com"}, nil, "secret", false},
 		{"empty everything", []config.Policy{{From: "https://from.example", To: "https://to.example"}}, "from.example", &Identity{Email: "user2@example.com"}, nil, "secret", false},
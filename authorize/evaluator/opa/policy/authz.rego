@@ -23,6 +23,15 @@ allow {
 	count(deny)==0
 }
 
+# allow org
+allow {
+	some route
+	input.host = route_policies[route].source
+	token.payload.orgs[_] = route_policies[route].allowed_orgs[_]
+	token.valid
+	count(deny)==0
+}
+
 # allow by impersonate email
 allow {
 	some route
@@ -83,6 +92,31 @@ deny[sprintf("token has bad audience (aud): %s not in %+v",[input.host,payload.a
 	not element_in_list(payload.aud,input.host)
 }
 
+deny[sprintf("authentication context class (acr) %q not in %v",[acr,route_policies[route].allowed_acr_values])]{
+	some route
+	input.host = route_policies[route].source
+	count(route_policies[route].allowed_acr_values) > 0
+	acr := object.get(token.payload, "acr", "")
+	not element_in_list(route_policies[route].allowed_acr_values, acr)
+}
+
+deny[sprintf("authentication methods (amr) %v missing %v",[amr,missing])]{
+	some route
+	input.host = route_policies[route].source
+	amr := {m | m := token.payload.amr[_]}
+	missing := {m | m := route_policies[route].required_amr[_]} - amr
+	count(missing) > 0
+}
+
+deny[sprintf("authentication time (auth_time) older than max age %vs",[max_age])]{
+	some route
+	input.host = route_policies[route].source
+	max_age := object.get(route_policies[route], "identity_provider_max_age", 0) / 1e9
+	max_age > 0
+	auth_time := object.get(token.payload, "auth_time", 0)
+	time.now_ns()/1e9 - auth_time > max_age
+}
+
 # allow user is admin
 allow {
 	element_in_list(data.admins, token.payload.email)
@@ -10,7 +10,7 @@ import (
 const Rego = "rego" // static asset namespace
 
 func init() {
-	data := "PK\x03\x04\x14\x00\x08\x00\x08\x00\xb5\xbeuP\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\n\x00	\x00authz.regoUT\x05\x00\x01\x06\xa9v^\xbcV_o\xa38\x10\x7f\xf6|\x8a\x91\xabJ\xa0\xe3\xe8\xb5\xd2\x9dth\x91\xf6e?\xc1>F\x11r\xf1$q\x0b6\xc2\xa6I\x16\xe5\xbb\xaflH\xa0iWmw7\xfb\xd2\x861\xf3\x9b\xdf\x1f\x83iD\xf9(\xd6\x84\x8d\xa9\xa9U]\x9d\x8a\xcem\xbe\x01\xa8\xba1\xadC)\x9cH[\xd39*\x1aS\xa9R\x91}\xb6d7\xa2%Y<\xd2\x1e@\xd2Jt\x95CQUf\x8b9\xaeDe	\xe0j,\xdc\xef\x91j\xa1*\x18.{`\xd6\xd4\x84\x01\x1c\x98\xd2M\xe7\xd2\x8d\xb1\x0es|>p\x11.\x97\xa95][\x120g\x1eI\xa7\x8d\xd8WF\xc84`\xfe\xb0'\xcc\"Yt\x96Z\xbb(\x96\xc7\xee'Q)	\xac4\x9dv\x91$\xbd\x8f\xf3\xfc\x1f8Ll\xd7\xad\xe9\x9a\xdfL5`z\x16o\xd2=\xdd\xf9n\xbe\xf7{TuC\xad5Z8\xba\x88\xd33\xfc\xe2B\xae\x9f\xa9\xb8D\x08s\x15\x17\x0eD\x9aZ(\x8d\xbf,`ng1\x80F\xaf<\x04\xf1G\xb8\xcdm\x1e \xff\x00\xcd\x17;\xe8m\xca\xaf\x81\x0e\xad=\xb0\x1df9\xda\xa6Rn\xa8%\xc8?\xf3\xf8\x08\xb3\x8b\xf3;`\xbb\xc5\xed\x12\xf3\xb7\xf2\x1d\x90C\xc0\x07\x98^e\xb4kTKrz\x99\x1d\x0b=0m\xb6\x85\xa5\xd2hi\xb3\xdc\xa9\x9aR_\xd16\x8aon\xe9\x7f`\x8b\x0d	Im\x82\xa3\xfa\x04\x8b\xa5\xe7\xabL\xfa\xb0u\xa9\xa4\xd2H\x8a\x06\x7f\xbd\xba\x18\xd8)\xce]\x83\x9fp6\xc0\x93\xf2\xae,x\xb0\x0b\x95=Q\x8bh\xd7\xc4|\xd9\x03\x1b+\xa7{m\xd3*\xedV\xd1\xd8\xb3\x11\x16\xef\x85D\xd1IE\xba$\x8cD'\xe3\x0c\xaf-j\xe3Pi\xbc\xfe\xeb\x89'\x8b)\xf1\xe4\xc8Gtr\x19\xfb\x11?\xa1\xc9cSE5iW(]T\xca\xbah\x86\x9bL\xe3\xe2\xf9\x16\xf5\xdd^\xa6\x90\xf5|k\x9e#\x85C(\xdcc\x13\xfc\xf83\xc1J\xa3\x9d\x0f\xfe\xc8\xb9\xad\x12\x9e\x1e\xcf\xc2\x9b\x00\xcc\x03/\xb8B\xdf\x85\xda\xe8\xbfC90\xb4\xb8jM\x8d\xa2,\xc9*\xbd\x1e\xd8\x0e[\xcd\x8e\x81\x1d\x85x\x1f\x06\xbce\xff\xba+\xef\xd0\xf2n\xbaC\xe49\xf6|\x84\xe0\xd9\x94\x19\x0ff\xf0\x0c\xc3\xff\x83\xf7u\x11~&x\x96\xef\xcbp\x8b'j\xd5j\x1f\x01cS\xcc\x89\x87`\x8c[*[r<\xc3\xe9\xb3 	\x0b\xa2\xf3\xe3f;\x0b\x18;\x00\x0bT=@\x96?\xd7\xebk\x10D\x9f\xaf\x0c\x07\xdb\xf0:>_\x1b\xaa`\xd5Z\x93,\x1e\xb6.\xcbG\xee\xa4\x03w\xbf\x12\xf5\\Tk\x9e!\xff\xf2\xf5\xee\xdf\xff\xf8\xe1\xcc\xebd\xfc\xb0Qk\xad\xf4\xdaK\x88\x01\xe0<+\xff'		\xc6\xd8\x03\xa2\xbf\x1e\xce\x11_\x83\xc3\xf7\x00\x00\x00\xff\xffPK\x07\x08\xdb\xe3\xb1\x8d\xbd\x02\x00\x00W	\x00\x00PK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\xb5\xbeuP\xdb\xe3\xb1\x8d\xbd\x02\x00\x00W	\x00\x00\n\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xa4\x81\x00\x00\x00\x00authz.regoUT\x05\x00\x01\x06\xa9v^PK\x05\x06\x00\x00\x00\x00\x01\x00\x01\x00A\x00\x00\x00\xfe\x02\x00\x00\x00\x00"
+	data := "PK\x03\x04\x14\x00\x08\x00\x08\x00\x00KN]\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\n\x00	\x00authz.regoUT\x05\x00\x011J\xcfj\xbcW\xddn\xe3\xb8\x0e\xbe\xb6\x9e\x82\xd0\xa0\x80\x8d\xa3q;\x03\x9c\x056X\x0f\xf6f\x9f`/\x83\xc0`-6QkI\x1eIN\x93\xcd\xe6\xdd\x17\x92\xed\xe6\xa7\x9dm\xd0N\xf7*\x16%\x91\x1f\xc9\x8f\xa4\xd2a\xf3\x80K\x82\xcejr\xaa\xd7%\xf6a\xf5\x17cJw\xd6\x05\x90\x18\xb0t\xb6\x0fTw\xb6U\x8d\"\x7f\xb2\xe5W\xe8H\xd6\x0f\xb4eL\xd2\x1d\xf6m\x00l[\xfb\x08\x15\xdca\xeb\x89\xb1O\xa3\xe0v\x0b\xa4Q\xb5lX\xeeX\xe6\xad&H\xcaY\xa6L\xd7\x87re}\x80\nN\x0d\xce\xd3rQz\xdb\xbb\x86X\x16\xec\x03\x99\xb2\xc3mkQ\x96I\xe7\x0f\xef$[$\xeb\xde\x93\xf3\xf3z1\xdd^c\xab$\xcb\x1a\xdb\x9b\x90K2\xdb\xa2\xaan\xd8\xfe\x80v\xe9l\xdf\xfdd\xa8IgD\xf1*\xdc\xa7\x93\x17\xe3\xb5n\xf9\x93\xd1Z\xb7\xbc\x08\xebx\xeeb\xa4\xb7[P\xba#\xe7\xad\xc1@\x1f\xc2\x89#\xfd\xf5\x07\xf1\xe3\xcc\x8b\x8f\xa0\xcb\xb1\x17\x1fI\x9d\xdb-H\xabQ\x19x\xb7\x03\xc7\xe5V\x0fJ\xf3\xd3\xd4\xa4t\x14o%\xcb\xa0\xf2?\x80y\x1c\xfb\x0b!\xbf\xa4t\xb8\xbac\xd9\x06f\x15\xf8\xaeUa\x90	\xe0\xbf\xf3b\"\xd8\xa6\xa8\xbe\xb2l3\xff\xb2\x80\xea\xb5r\x1b\xe0&\xae\xee\xd9\xa1\xe9\xd2\xa6S\x8e\xe4\xa1\xedN\x82\x1d\xcb\x8c}\xac=5\xd6H?\xab\x82\xd2TF\x89\xf1yq\xfd\x85~e\xd9|E(\xc9	\x18\xebG@\xbd\x88x\x95-\xef\x1fC)\xa9\xb1\x92\xf2\x81\xc7\xb1\x91\x16,\x9b*\x8d6\x1d\xfc\x06G\x06\"\xa8\x18\x959Oy\x07\xe5\x9f\xa0\xe5\xb4\xe9\n\xbe\xd8\xb1l\x94<\x9d\xf5\x9dS&\xdc\xe5\xe3\x9d\x15z\xb8E	\xd8KE\xa6!\xc8\xb1\x97\xc5\x0c\xae<\x18\x1b@\x19\xb8\xfa\xdf\x9a\x8b\xf9af\x88	\x0f\xf6rQ,vo\xf2)\xea\xa6\x964\x99P+S\xb7\xca\x87\xfcH\xaf8\x98+\x9e#\x8fc\x93LP\x0d\x06e\x0d4\xd6\x04\xda\x04hZ\xf4\x1erl\\\x01W\xdf\x9f\xe0G\xf4\xd88\xf1\xef\xa9\xc6\xc6\xd5kl{\xf2\x83Oo\x9c\x97\x03U/5U\xc07\xb8a\x196.R\xc0\xde\xdeS\x13\xca%\x85\xd3:\x16\xc0\xb1q\\\x00\xe7?\x88\xdc\xa5\xf6\x04\xc4\xe0\xbc\x1aPMaee\x0c\xa5\x8e\xa1\\\x83V\xde+\xb3\x1cc\xa9\x9d\x18\x05\xef\n\x15\xea\xe4\xf5N\xc3\xdf\xa0\xe3\xd7\x89\xd3%j7\xaf\x17{\x96M\xc6O\xce\xbe\xec\xb1\xa3\xef}${=^\x86\xcf\x80\xdaMY\x19\x15\x0dA\x7f-\x06A\xe9T\x0baU\xc7\xcf\x02l+\xc9AX\xa1\x01\x8d\x1b\x88\xef\xb8\xab\xb5\xe7b\xaeqS\xe3\x92\xde\x15\x8bQ\xc7\x19\x0b^tR\x00W2\x02\x0d\xdb\xbasv\xad$\xb9z\xbc\xcf\x05\xdc\x14p\x0d\xa9\xd3L:\x07\x8aM\x8e\xbcF\xb4\xe9\\R\xc5\xb2g\x1d,\x86\xf4I\xd77\x18\x8d\x1c\x8f\x91\xd8\xb5b+B\xa9\x8f\xc7\xc7y\xb5\xa7\xd7n:\xe3\xc5Y\xea/\x19\x02Y\xaczT\xc6O\xbd\xd2\xb5\x82\x97\xd3\xcb\xfa:)\xe6\x89\xea\xec\x13\xc4[`\xac\xf9\x9c\xc4	\xa1\x87;g5`\xd3P$\xc5\x80v\xc8\x92\x1f\x9b\xea\xe4H\xac\xb8\xb4\x9d\xfa\xe9K\x9d\xeb\x02_.\x86\x9bB\x01\x15\xec\xf8\xd8\x0f\xf9\xec0+xz+\xf1\x19\xa4\xdf}\x1c8\xf3\xf4)\xe0l\xae<\x1f*\xf5\x9a\x9c\xba\xdb\xe6,\x1b\x99\x19\xfd\x13QE\x96qO\x8d\xa3\xc0gp\xf8\x93!\xd2\x06\xf6\xd1\xdcQ\xf7gY\xb6gY\x82\x1a\x15\xcc\xaa\xd3\xdcE\x19KN\x9f\xef$!\x1b\x9eL\xe7{\x83\x94y\xb54$\xeb\xfb\xc70\xabF\xecd\xe2@\xac\xe3N\xbe\xe3\xd8.\xf9\x0c\xf8\x1f\x7f~\xfd\xff/|\x7f\x16k1\xfc\x83\x8aG\x95YF\x17\n\xc6\xd89\xefb\xc2D\xca`\x01;\x06\x10\xd7\xc3[\x8fZ\xd2l\xff\xcf\x00PK\x07\x08\xf6\xf4\xa4\xe0\xd1\x03\x00\x00\xa5\x0d\x00\x00PK\x01\x02\x14\x03\x14\x00\x08\x00\x08\x00\x00KN]\xf6\xf4\xa4\xe0\xd1\x03\x00\x00\xa5\x0d\x00\x00\n\x00	\x00\x00\x00\x00\x00\x00\x00\x00\x00\xb4\x81\x00\x00\x00\x00authz.regoUT\x05\x00\x011J\xcfjPK\x05\x06\x00\x00\x00\x00\x01\x00\x01\x00A\x00\x00\x00\x12\x04\x00\x00\x00\x00"
 		fs.RegisterWithNamespace("rego", data)
 	}
 	
\ No newline at end of file
@@ -4,9 +4,15 @@ package authorize
 
 import (
 	"context"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2/jwt"
 
 	"github.com/pomerium/pomerium/authorize/evaluator"
+	"github.com/pomerium/pomerium/internal/audit"
 	"github.com/pomerium/pomerium/internal/grpc/authorize"
+	"github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/internal/sessions"
 	"github.com/pomerium/pomerium/internal/telemetry/trace"
 )
 
@@ -24,7 +30,76 @@ func (a *Authorize) IsAuthorized(ctx context.Context, in *authorize.IsAuthorized
 		RemoteAddr: in.GetRequestRemoteAddr(),
 		URL:        in.GetRequestUrl(),
 	}
-	return a.pe.IsAuthorized(ctx, req)
+	reply, err := a.pe.IsAuthorized(ctx, req)
+	if err == nil {
+		logGroupsMismatch(req.Host, reply)
+		a.audit.Emit(ctx, authorizationEvent(req, reply))
+	}
+	return reply, err
+}
+
+// authorizationEvent returns the audit event of an authorization decision.
+// The user's identity provider and session id are read from their token,
+// which is only known to be valid if the request was allowed.
+func authorizationEvent(req *evaluator.Request, reply *authorize.IsAuthorizedReply) audit.Event {
+	e := audit.NewEvent(audit.Authorization, audit.Deny, tokenSession(req.User))
+	if reply.GetAllow() {
+		e.Outcome = audit.Allow
+	}
+	e.Subject = reply.GetUser()
+	e.Email = reply.GetEmail()
+	e.Groups = reply.GetGroups()
+	e.Host = req.Host
+	e.Method = req.Method
+	switch {
+	case reply.GetSessionExpired():
+		e.Reason = "session expired"
+	case len(reply.GetDenyReasons()) > 0:
+		e.Reason = strings.Join(reply.GetDenyReasons(), "; ")
+	}
+	return e
+}
+
+// tokenSession returns the unverified session of a user's token, or nil if
+// it isn't one.
+func tokenSession(token string) *sessions.State {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil
+	}
+	var s sessions.State
+	if err := tok.UnsafeClaimsWithoutVerification(&s); err != nil {
+		return nil
+	}
+	return &s
+}
+
+// maxLoggedGroups bounds the number of a user's groups which are logged.
+const maxLoggedGroups = 5
+
+// logGroupsMismatch logs requests which were denied even though the user
+// has groups, their token being otherwise valid. This is typically a policy
+// which refers to groups in a different format than the identity provider
+// returns them in (e.g. GitLab group IDs rather than paths).
+func logGroupsMismatch(host string, reply *authorize.IsAuthorizedReply) {
+	if reply == nil || reply.GetAllow() || reply.GetSessionExpired() || len(reply.GetDenyReasons()) > 0 {
+		return
+	}
+	groups := reply.GetGroups()
+	if len(groups) == 0 {
+		log.Debug().Str("host", host).Str("email", reply.GetEmail()).Msg("authorize: denied, user has no groups")
+		return
+	}
+	sample := groups
+	if len(sample) > maxLoggedGroups {
+		sample = sample[:maxLoggedGroups]
+	}
+	log.Info().
+		Str("host", host).
+		Str("email", reply.GetEmail()).
+		Int("group_count", len(groups)).
+		Strs("groups", sample).
+		Msg("authorize: denied, none of the user's groups matched policy")
 }
 
 type protoHeader map[string]*authorize.IsAuthorizedRequest_Headers
@@ -4,11 +4,16 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/google/go-cmp/cmp"
 	"github.com/pomerium/pomerium/authorize/evaluator/mock_evaluator"
+	"github.com/pomerium/pomerium/internal/audit"
+	"github.com/pomerium/pomerium/internal/cryptutil"
+	"github.com/pomerium/pomerium/internal/encoding/jws"
 	"github.com/pomerium/pomerium/internal/grpc/authorize"
+	"github.com/pomerium/pomerium/internal/sessions"
 )
 
 func TestAuthorize_IsAuthorized(t *testing.T) {
@@ -24,6 +29,7 @@ func TestAuthorize_IsAuthorized(t *testing.T) {
 	}{
 		{"good", &authorize.IsAuthorizedReply{}, nil, context.TODO(), &authorize.IsAuthorizedRequest{UserToken: "good"}, &authorize.IsAuthorizedReply{}, false},
 		{"error", &authorize.IsAuthorizedReply{}, errors.New("error"), context.TODO(), &authorize.IsAuthorizedRequest{UserToken: "good"}, &authorize.IsAuthorizedReply{}, true},
+		{"denied with groups", &authorize.IsAuthorizedReply{Email: "user@example.com", Groups: []string{"1", "2", "3", "4", "5", "6"}}, nil, context.TODO(), &authorize.IsAuthorizedRequest{UserToken: "good"}, &authorize.IsAuthorizedReply{Email: "user@example.com", Groups: []string{"1", "2", "3", "4", "5", "6"}}, false},
 		{"headers", &authorize.IsAuthorizedReply{}, nil, context.TODO(), &authorize.IsAuthorizedRequest{UserToken: "good", RequestHeaders: nil}, &authorize.IsAuthorizedReply{}, false},
 	}
 	for _, tt := range tests {
@@ -47,3 +53,56 @@ func TestAuthorize_IsAuthorized(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthorize_IsAuthorizedAudit(t *testing.T) {
+	signer, err := jws.NewHS256Signer(cryptutil.NewKey(), "authenticate.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signer.Marshal(&sessions.State{Subject: "user", IdentityProvider: "corp", SessionID: "session"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		in    *authorize.IsAuthorizedRequest
+		reply *authorize.IsAuthorizedReply
+		want  audit.Event
+	}{
+		{"allowed",
+			&authorize.IsAuthorizedRequest{UserToken: string(token), RequestHost: "httpbin.example.com", RequestMethod: "GET"},
+			&authorize.IsAuthorizedReply{Allow: true, User: "user", Email: "user@example.com", Groups: []string{"admins"}},
+			audit.Event{Type: audit.Authorization, Outcome: audit.Allow, Subject: "user", Email: "user@example.com", Provider: "corp", SessionID: "session", Groups: []string{"admins"}, Host: "httpbin.example.com", Method: "GET"}},
+		{"denied",
+			&authorize.IsAuthorizedRequest{UserToken: string(token), RequestHost: "httpbin.example.com", RequestMethod: "POST"},
+			&authorize.IsAuthorizedReply{User: "user", DenyReasons: []string{"invalid audience"}},
+			audit.Event{Type: audit.Authorization, Outcome: audit.Deny, Subject: "user", Provider: "corp", SessionID: "session", Host: "httpbin.example.com", Method: "POST", Reason: "invalid audience"}},
+		{"expired",
+			&authorize.IsAuthorizedRequest{UserToken: "not a jwt", RequestHost: "httpbin.example.com"},
+			&authorize.IsAuthorizedReply{SessionExpired: true},
+			audit.Event{Type: audit.Authorization, Outcome: audit.Deny, Host: "httpbin.example.com", Reason: "session expired"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			pe := mock_evaluator.NewMockEvaluator(mockCtrl)
+			pe.EXPECT().IsAuthorized(gomock.Any(), gomock.Any()).Return(tt.reply, nil).AnyTimes()
+
+			sink := &audit.MockSink{}
+			a := &Authorize{pe: pe, audit: audit.New(sink)}
+			if _, err := a.IsAuthorized(context.TODO(), tt.in); err != nil {
+				t.Fatal(err)
+			}
+			events := sink.Events()
+			if len(events) != 1 {
+				t.Fatalf("IsAuthorized() audit events = %v, want 1", events)
+			}
+			got := events[0]
+			got.Time = time.Time{}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("IsAuthorized() audit event = %s", diff)
+			}
+		})
+	}
+}
@@ -45,6 +45,9 @@ func run() error {
 		fmt.Println(version.FullVersion())
 		return nil
 	}
+	if flag.Arg(0) == validateProvidersCommand {
+		return runValidateProviders(*configFile, flag.Args()[1:])
+	}
 	opt, err := config.NewOptionsFromConfig(*configFile)
 	if err != nil {
 		return err
@@ -63,10 +66,13 @@ func run() error {
 	}
 
 	r := newGlobalRouter(opt)
-	_, err = newAuthenticateService(*opt, r)
+	authn, err := newAuthenticateService(*opt, r)
 	if err != nil {
 		return err
 	}
+	if authn != nil {
+		defer authn.Close()
+	}
 	authz, err := newAuthorizeService(*opt)
 	if err != nil {
 		return err
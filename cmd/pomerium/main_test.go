@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,14 +9,17 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/pomerium/pomerium/authenticate"
 	"github.com/pomerium/pomerium/config"
 	"github.com/pomerium/pomerium/internal/httputil"
+	"github.com/pomerium/pomerium/internal/identity"
 )
 
 func Test_newGlobalRouter(t *testing.T) {
@@ -353,3 +357,31 @@ func Test_run(t *testing.T) {
 		})
 	}
 }
+
+func Test_printProviderReports(t *testing.T) {
+	reports := []authenticate.ProviderReport{
+		{Provider: "gitlab", Checks: []identity.CheckResult{
+			{Name: identity.CheckRedirectURL, Detail: "https://authenticate.example/oauth2/callback"},
+			{Name: identity.CheckScopes, Err: errors.New("scopes not supported by the provider: groups")},
+		}},
+		{Name: "contractors", Provider: "oidc", Checks: []identity.CheckResult{
+			{Name: identity.CheckGroups, Skipped: true, Detail: "groups probe not requested"},
+		}},
+	}
+	want := `identity provider "default" (gitlab)
+  PASS  redirect url  https://authenticate.example/oauth2/callback
+  FAIL  scopes        scopes not supported by the provider: groups
+identity provider "contractors" (oidc)
+  SKIP  groups  groups probe not requested
+`
+	var b strings.Builder
+	if printProviderReports(&b, reports) {
+		t.Error("printProviderReports() = true, want false")
+	}
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("printProviderReports() = %s", diff)
+	}
+	if !printProviderReports(ioutil.Discard, reports[1:]) {
+		t.Error("printProviderReports() = false, want true")
+	}
+}
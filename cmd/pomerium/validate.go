@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pomerium/pomerium/authenticate"
+	"github.com/pomerium/pomerium/config"
+)
+
+// validateProvidersCommand checks the configured identity providers and
+// exits, e.g. `pomerium -config config.yaml validate-idp`.
+const validateProvidersCommand = "validate-idp"
+
+func runValidateProviders(configFile string, args []string) error {
+	flags := flag.NewFlagSet(validateProvidersCommand, flag.ExitOnError)
+	probeGroups := flags.Bool("probe-groups", false, "look up groups with a client credentials token")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	opt, err := config.NewOptionsFromConfig(configFile)
+	if err != nil {
+		return err
+	}
+	reports := authenticate.ValidateProviders(context.Background(), *opt, *probeGroups)
+	if !printProviderReports(os.Stdout, reports) {
+		return errors.New("cmd/pomerium: identity provider validation failed")
+	}
+	return nil
+}
+
+// printProviderReports writes a pass/fail line for each check, grouped by
+// identity provider, and reports whether every check passed.
+func printProviderReports(w io.Writer, reports []authenticate.ProviderReport) bool {
+	passed := true
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, r := range reports {
+		name := r.Name
+		if name == "" {
+			name = "default"
+		}
+		fmt.Fprintf(tw, "identity provider %q (%s)\n", name, r.Provider)
+		for _, c := range r.Checks {
+			status, detail := "PASS", c.Detail
+			switch {
+			case c.Err != nil:
+				status, detail = "FAIL", c.Err.Error()
+			case c.Skipped:
+				status = "SKIP"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", status, c.Name, detail)
+		}
+		passed = passed && r.Passed()
+	}
+	tw.Flush()
+	return passed
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// IdentityProviderClaimHeaders returns the claim to header mapping of the
+// named identity provider. Named providers which don't set their own, and
+// the default provider, whose name is empty, use the default's.
+func (o *Options) IdentityProviderClaimHeaders(name string) map[string]string {
+	for _, idp := range o.IdentityProviders {
+		if idp.Name == name && len(idp.ClaimHeaders) != 0 {
+			return idp.ClaimHeaders
+		}
+	}
+	return o.ClaimHeaders
+}
+
+// validateClaimHeaders ensures each claim is mapped to a valid header, and
+// that no two claims are mapped to the same one.
+func validateClaimHeaders(claimHeaders map[string]string) error {
+	headers := make(map[string]string, len(claimHeaders))
+	for claim, header := range claimHeaders {
+		if claim == "" {
+			return errors.New("claim cannot be empty")
+		}
+		if !httpguts.ValidHeaderFieldName(header) {
+			return fmt.Errorf("claim %q has an invalid header %q", claim, header)
+		}
+		canonical := http.CanonicalHeaderKey(header)
+		if other, ok := headers[canonical]; ok {
+			return fmt.Errorf("claims %q and %q are both mapped to header %q", other, claim, header)
+		}
+		headers[canonical] = claim
+	}
+	return nil
+}
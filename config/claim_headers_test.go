@@ -0,0 +1,56 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_validateClaimHeaders(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name         string
+		claimHeaders map[string]string
+		wantErr      bool
+	}{
+		{"none", nil, false},
+		{"good", map[string]string{"email": "X-Email", "groups": "X-Groups"}, false},
+		{"missing claim", map[string]string{"": "X-Email"}, true},
+		{"missing header", map[string]string{"email": ""}, true},
+		{"invalid header", map[string]string{"email": "X Email"}, true},
+		{"shared header", map[string]string{"email": "X-User", "preferred_username": "x-user"}, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if err := validateClaimHeaders(tt.claimHeaders); (err != nil) != tt.wantErr {
+				t.Errorf("validateClaimHeaders() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOptions_IdentityProviderClaimHeaders(t *testing.T) {
+	t.Parallel()
+	o := &Options{
+		ClaimHeaders: map[string]string{"email": "X-Email"},
+		IdentityProviders: []IdentityProviderOptions{
+			{Name: "corp", ClaimHeaders: map[string]string{"upn": "X-User"}},
+			{Name: "partners"},
+		},
+	}
+	tests := []struct {
+		name string
+		want map[string]string
+	}{
+		{"", map[string]string{"email": "X-Email"}},
+		{"corp", map[string]string{"upn": "X-User"}},
+		{"partners", map[string]string{"email": "X-Email"}},
+	}
+	for _, tt := range tests {
+		if diff := cmp.Diff(tt.want, o.IdentityProviderClaimHeaders(tt.name)); diff != "" {
+			t.Errorf("IdentityProviderClaimHeaders(%q) = %s", tt.name, diff)
+		}
+	}
+}
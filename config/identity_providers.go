@@ -0,0 +1,186 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pomerium/pomerium/internal/identity"
+	"github.com/pomerium/pomerium/internal/urlutil"
+)
+
+// IdentityProviderOptions configures an additional, named identity provider
+// which can be used alongside the default provider. Group, cache, and
+// certificate authority settings are shared with the default provider.
+type IdentityProviderOptions struct {
+	// Name uniquely identifies the identity provider. It is used by routes
+	// and the sign in flow to select the provider, and is stored in the
+	// user's session.
+	Name string `mapstructure:"name" yaml:"name"`
+
+	ClientID       string   `mapstructure:"client_id" yaml:"client_id,omitempty"`
+	ClientSecret   string   `mapstructure:"client_secret" yaml:"client_secret,omitempty"`
+	Provider       string   `mapstructure:"provider" yaml:"provider,omitempty"`
+	ProviderURL    string   `mapstructure:"provider_url" yaml:"provider_url,omitempty"`
+	Scopes         []string `mapstructure:"scopes" yaml:"scopes,omitempty"`
+	ServiceAccount string   `mapstructure:"service_account" yaml:"service_account,omitempty"`
+
+	// AllowedAudiences are the audiences, besides the client id, accepted
+	// in the identity provider's id tokens.
+	AllowedAudiences []string `mapstructure:"allowed_audiences" yaml:"allowed_audiences,omitempty"`
+
+	// AllowedIssuers, if set, are the only issuers whose tokens are
+	// accepted from the identity provider.
+	AllowedIssuers []string `mapstructure:"allowed_issuers" yaml:"allowed_issuers,omitempty"`
+
+	// EnableRefresh, if set, overrides whether the default identity
+	// provider's EnableRefresh applies to this one.
+	EnableRefresh *bool `mapstructure:"enable_refresh" yaml:"enable_refresh,omitempty"`
+
+	// AuthURLParams are additional query parameters added to the identity
+	// provider's authorization url.
+	AuthURLParams map[string]string `mapstructure:"auth_url_params" yaml:"auth_url_params,omitempty"`
+
+	// EmailDomains is the set of email domains whose users are sent to this
+	// identity provider when a login hint is supplied at sign in.
+	EmailDomains []string `mapstructure:"email_domains" yaml:"email_domains,omitempty"`
+
+	// ClaimHeaders, if set, replaces the default identity provider's claim
+	// to header mapping for users of this identity provider.
+	ClaimHeaders map[string]string `mapstructure:"claim_headers" yaml:"claim_headers,omitempty"`
+}
+
+// Validate checks that the identity provider is complete.
+func (p *IdentityProviderOptions) Validate() error {
+	if p.Name == "" {
+		return errors.New("config: identity provider name cannot be empty")
+	}
+	if strings.Contains(p.Name, "|") {
+		return fmt.Errorf("config: identity provider name %q cannot contain '|'", p.Name)
+	}
+	if p.Provider == "" {
+		return fmt.Errorf("config: identity provider %q is missing a provider", p.Name)
+	}
+	if p.ClientID == "" {
+		return fmt.Errorf("config: identity provider %q is missing a client id", p.Name)
+	}
+	if p.ClientSecret == "" {
+		return fmt.Errorf("config: identity provider %q is missing a client secret", p.Name)
+	}
+	if err := validateClaimHeaders(p.ClaimHeaders); err != nil {
+		return fmt.Errorf("config: identity provider %q has bad claim headers: %w", p.Name, err)
+	}
+	if err := validateAllowedIssuers(p.AllowedIssuers); err != nil {
+		return fmt.Errorf("config: identity provider %q has bad allowed issuers: %w", p.Name, err)
+	}
+	if err := identity.ValidateAuthURLParams(p.AuthURLParams); err != nil {
+		return fmt.Errorf("config: identity provider %q has bad auth url params: %w", p.Name, err)
+	}
+	for i, domain := range p.EmailDomains {
+		p.EmailDomains[i] = strings.ToLower(strings.TrimPrefix(domain, "@"))
+	}
+	return nil
+}
+
+// validateIdentityProviders ensures each additional identity provider is
+// valid, that names and email domains are not reused, and that routes only
+// reference configured providers.
+func (o *Options) validateIdentityProviders() error {
+	names := make(map[string]struct{}, len(o.IdentityProviders))
+	domains := make(map[string]string)
+	for i := range o.IdentityProviders {
+		p := &o.IdentityProviders[i]
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if _, ok := names[p.Name]; ok {
+			return fmt.Errorf("config: duplicate identity provider name %q", p.Name)
+		}
+		names[p.Name] = struct{}{}
+		for _, domain := range p.EmailDomains {
+			if other, ok := domains[domain]; ok {
+				return fmt.Errorf("config: email domain %q is used by identity providers %q and %q", domain, other, p.Name)
+			}
+			domains[domain] = p.Name
+		}
+	}
+	for _, policy := range o.Policies {
+		if policy.IdentityProvider == "" {
+			continue
+		}
+		if _, ok := names[policy.IdentityProvider]; !ok {
+			return fmt.Errorf("config: route %s uses unknown identity provider %q", policy.From, policy.IdentityProvider)
+		}
+	}
+	return nil
+}
+
+// IdentityProviderAllowedAudiences returns the audiences, besides its client
+// id, the named identity provider's id tokens may be issued for. They're
+// particular to a client, so named providers don't share the default's.
+func (o *Options) IdentityProviderAllowedAudiences(name string) []string {
+	if name == "" {
+		return o.AllowedAudiences
+	}
+	for _, idp := range o.IdentityProviders {
+		if idp.Name == name {
+			return idp.AllowedAudiences
+		}
+	}
+	return nil
+}
+
+// IdentityProviderAllowedIssuers returns the issuers the named identity
+// provider's tokens must be issued by, if they're pinned. Like audiences,
+// they're particular to a provider, so named providers don't share the
+// default's.
+func (o *Options) IdentityProviderAllowedIssuers(name string) []string {
+	if name == "" {
+		return o.AllowedIssuers
+	}
+	for _, idp := range o.IdentityProviders {
+		if idp.Name == name {
+			return idp.AllowedIssuers
+		}
+	}
+	return nil
+}
+
+// validateAllowedIssuers checks that each allowed issuer is a url, as
+// OpenID Connect issuers are.
+func validateAllowedIssuers(issuers []string) error {
+	for _, issuer := range issuers {
+		if _, err := urlutil.ParseAndValidateURL(issuer); err != nil {
+			return fmt.Errorf("issuer %q: %w", issuer, err)
+		}
+	}
+	return nil
+}
+
+// IdentityProviderAuthURLParams returns the additional authorization url
+// parameters of the named identity provider. Like issuers, they're usually
+// particular to a provider's tenant, so named providers don't share the
+// default's.
+func (o *Options) IdentityProviderAuthURLParams(name string) map[string]string {
+	if name == "" {
+		return o.AuthURLParams
+	}
+	for _, idp := range o.IdentityProviders {
+		if idp.Name == name {
+			return idp.AuthURLParams
+		}
+	}
+	return nil
+}
+
+// IdentityProviderEnableRefresh returns whether the named identity provider
+// requests the offline_access scope. Named providers follow the default's
+// setting unless they set their own.
+func (o *Options) IdentityProviderEnableRefresh(name string) bool {
+	for _, idp := range o.IdentityProviders {
+		if name != "" && idp.Name == name && idp.EnableRefresh != nil {
+			return *idp.EnableRefresh
+		}
+	}
+	return o.EnableRefresh
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_validateIdentityProviders(t *testing.T) {
+	t.Parallel()
+
+	good := IdentityProviderOptions{Name: "contractors", Provider: "okta", ClientID: "id", ClientSecret: "secret", EmailDomains: []string{"@Contractor.Example"}}
+	other := IdentityProviderOptions{Name: "partners", Provider: "github", ClientID: "id", ClientSecret: "secret", EmailDomains: []string{"partner.example"}}
+
+	tests := []struct {
+		name      string
+		providers []IdentityProviderOptions
+		policies  []Policy
+		wantErr   bool
+	}{
+		{"none", nil, nil, false},
+		{"good", []IdentityProviderOptions{good, other}, []Policy{{From: "https://httpbin.corp.example", IdentityProvider: "partners"}}, false},
+		{"missing name", []IdentityProviderOptions{{Provider: "okta", ClientID: "id", ClientSecret: "secret"}}, nil, true},
+		{"name has separator", []IdentityProviderOptions{{Name: "a|b", Provider: "okta", ClientID: "id", ClientSecret: "secret"}}, nil, true},
+		{"missing provider", []IdentityProviderOptions{{Name: "contractors", ClientID: "id", ClientSecret: "secret"}}, nil, true},
+		{"missing client id", []IdentityProviderOptions{{Name: "contractors", Provider: "okta", ClientSecret: "secret"}}, nil, true},
+		{"missing client secret", []IdentityProviderOptions{{Name: "contractors", Provider: "okta", ClientID: "id"}}, nil, true},
+		{"duplicate name", []IdentityProviderOptions{good, {Name: "contractors", Provider: "github", ClientID: "id", ClientSecret: "secret"}}, nil, true},
+		{"duplicate email domain", []IdentityProviderOptions{good, {Name: "other", Provider: "github", ClientID: "id", ClientSecret: "secret", EmailDomains: []string{"contractor.example"}}}, nil, true},
+		{"allowed issuers", []IdentityProviderOptions{{Name: "contractors", Provider: "okta", ClientID: "id", ClientSecret: "secret", AllowedIssuers: []string{"https://contractors.okta.com"}}}, nil, false},
+		{"bad allowed issuer", []IdentityProviderOptions{{Name: "contractors", Provider: "okta", ClientID: "id", ClientSecret: "secret", AllowedIssuers: []string{"contractors.okta.com"}}}, nil, true},
+		{"auth url params", []IdentityProviderOptions{{Name: "contractors", Provider: "oidc", ClientID: "id", ClientSecret: "secret", AuthURLParams: map[string]string{"organization": "org_123"}}}, nil, false},
+		{"reserved auth url param", []IdentityProviderOptions{{Name: "contractors", Provider: "oidc", ClientID: "id", ClientSecret: "secret", AuthURLParams: map[string]string{"redirect_uri": "https://evil.example.com"}}}, nil, true},
+		{"route uses unknown provider", []IdentityProviderOptions{good}, []Policy{{From: "https://httpbin.corp.example", IdentityProvider: "partners"}}, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			providers := make([]IdentityProviderOptions, len(tt.providers))
+			for i, p := range tt.providers {
+				p.EmailDomains = append([]string(nil), p.EmailDomains...)
+				providers[i] = p
+			}
+			o := &Options{IdentityProviders: providers, Policies: tt.policies}
+			err := o.validateIdentityProviders()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateIdentityProviders() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIdentityProviderOptions_Validate_emailDomains(t *testing.T) {
+	p := IdentityProviderOptions{Name: "contractors", Provider: "okta", ClientID: "id", ClientSecret: "secret", EmailDomains: []string{"@Contractor.Example", "other.example"}}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"contractor.example", "other.example"}
+	if diff := cmp.Diff(want, p.EmailDomains); diff != "" {
+		t.Errorf("Validate() email domains mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestOptions_IdentityProviderEnableRefresh(t *testing.T) {
+	t.Parallel()
+	enabled, disabled := true, false
+	o := &Options{
+		EnableRefresh: true,
+		IdentityProviders: []IdentityProviderOptions{
+			{Name: "contractors"},
+			{Name: "partners", EnableRefresh: &disabled},
+			{Name: "vendors", EnableRefresh: &enabled},
+		},
+	}
+	tests := []struct {
+		name     string
+		provider string
+		want     bool
+	}{
+		{"default", "", true},
+		{"inherited", "contractors", true},
+		{"disabled", "partners", false},
+		{"enabled", "vendors", true},
+		{"unknown", "unknown", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := o.IdentityProviderEnableRefresh(tt.provider); got != tt.want {
+				t.Errorf("IdentityProviderEnableRefresh(%q) = %v, want %v", tt.provider, got, tt.want)
+			}
+		})
+	}
+}
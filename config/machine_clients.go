@@ -0,0 +1,36 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MachineClientOptions configures an OAuth 2.0 client which may authenticate
+// with the client credentials grant. Machine clients have no user at the
+// identity provider, so the email and groups policies match them by are set
+// here.
+type MachineClientOptions struct {
+	ClientID string   `mapstructure:"client_id" yaml:"client_id"`
+	Email    string   `mapstructure:"email" yaml:"email,omitempty"`
+	Groups   []string `mapstructure:"groups" yaml:"groups,omitempty"`
+	Scopes   []string `mapstructure:"scopes" yaml:"scopes,omitempty"`
+}
+
+// validateMachineClients ensures each machine client has a unique client id
+// and an identity for policies to match.
+func (o *Options) validateMachineClients() error {
+	ids := make(map[string]struct{}, len(o.MachineClients))
+	for _, c := range o.MachineClients {
+		if c.ClientID == "" {
+			return errors.New("config: machine client id cannot be empty")
+		}
+		if _, ok := ids[c.ClientID]; ok {
+			return fmt.Errorf("config: duplicate machine client %q", c.ClientID)
+		}
+		ids[c.ClientID] = struct{}{}
+		if c.Email == "" && len(c.Groups) == 0 {
+			return fmt.Errorf("config: machine client %q needs an email or groups", c.ClientID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package config
+
+import "testing"
+
+func Test_validateMachineClients(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		clients []MachineClientOptions
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"good", []MachineClientOptions{{ClientID: "ci", Email: "ci@example.com"}, {ClientID: "backup", Groups: []string{"backups"}}}, false},
+		{"missing client id", []MachineClientOptions{{Email: "ci@example.com"}}, true},
+		{"duplicate client id", []MachineClientOptions{{ClientID: "ci", Email: "ci@example.com"}, {ClientID: "ci", Groups: []string{"ci"}}}, true},
+		{"missing identity", []MachineClientOptions{{ClientID: "ci"}}, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			o := &Options{MachineClients: tt.clients}
+			if err := o.validateMachineClients(); (err != nil) != tt.wantErr {
+				t.Errorf("validateMachineClients() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -6,11 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
 	"reflect"
 	"strings"
 	"time"
 
+	"github.com/pomerium/pomerium/internal/audit"
 	"github.com/pomerium/pomerium/internal/cryptutil"
+	"github.com/pomerium/pomerium/internal/encoding/ecjson"
+	"github.com/pomerium/pomerium/internal/identity"
 	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/telemetry/metrics"
 	"github.com/pomerium/pomerium/internal/urlutil"
@@ -30,6 +34,10 @@ const DisableHeaderKey = "disable"
 // gRPC server, or is used for healthchecks (authorize only service)
 const DefaultAlternativeAddr = ":5443"
 
+// DevModeEnv is the environment variable which must be set to `true` for
+// options which are only safe for local development to be accepted.
+const DevModeEnv = "POMERIUM_DEV_MODE"
+
 // Options are the global environmental flags used to set up pomerium's services.
 // Use NewXXXOptions() methods for a safely initialized data structure.
 type Options struct {
@@ -40,10 +48,19 @@ type Options struct {
 	// Possible options are "info","warn", and "error". Defaults to "debug".
 	LogLevel string `mapstructure:"log_level" yaml:"log_level,omitempty"`
 
+	// AuditLog is where audit events, such as sign ins and authorization
+	// decisions, are written: "stdout" or "stderr". If unset, they aren't.
+	AuditLog string `mapstructure:"audit_log" yaml:"audit_log,omitempty"`
+
 	// SharedKey is the shared secret authorization key used to mutually authenticate
 	// requests between services.
 	SharedKey string `mapstructure:"shared_secret" yaml:"shared_secret,omitempty"`
 
+	// PreviousSharedKeys are shared secrets which SharedKey replaced. Data
+	// encrypted at rest with them, such as cached groups, can still be read
+	// while the new secret is rolled out.
+	PreviousSharedKeys []string `mapstructure:"previous_shared_secrets" yaml:"previous_shared_secrets,omitempty"`
+
 	// Services is a list enabled service mode. If none are selected, "all" is used.
 	// Available options are : "all", "authenticate", "proxy".
 	Services string `mapstructure:"services" yaml:"services,omitempty"`
@@ -103,6 +120,11 @@ type Options struct {
 	CookieHTTPOnly bool          `mapstructure:"cookie_http_only" yaml:"cookie_http_only,omitempty"`
 	CookieExpire   time.Duration `mapstructure:"cookie_expire" yaml:"cookie_expire,omitempty"`
 
+	// CookieCompressionThreshold is the size of a session above which it is
+	// compressed before being encrypted into its cookie. Negative disables
+	// compression.
+	CookieCompressionThreshold int `mapstructure:"cookie_compression_threshold" yaml:"cookie_compression_threshold,omitempty"`
+
 	// Identity provider configuration variables as specified by RFC6749
 	// https://openid.net/specs/openid-connect-basic-1_0.html#RFC6749
 	ClientID       string   `mapstructure:"idp_client_id" yaml:"idp_client_id,omitempty"`
@@ -112,6 +134,222 @@ type Options struct {
 	Scopes         []string `mapstructure:"idp_scopes" yaml:"idp_scopes,omitempty"`
 	ServiceAccount string   `mapstructure:"idp_service_account" yaml:"idp_service_account,omitempty"`
 
+	// AllowedAudiences are the audiences, besides the client id, accepted
+	// in id tokens, for clients which share tokens with others.
+	AllowedAudiences []string `mapstructure:"idp_allowed_audiences" yaml:"idp_allowed_audiences,omitempty"`
+
+	// AllowedIssuers, if set, are the only issuers whose tokens are
+	// accepted, in place of the issuer the provider's discovery document
+	// names.
+	AllowedIssuers []string `mapstructure:"idp_allowed_issuers" yaml:"idp_allowed_issuers,omitempty"`
+
+	// EnableRefresh requests the offline_access scope, so that sessions can
+	// be refreshed by providers which only issue refresh tokens for it.
+	EnableRefresh bool `mapstructure:"idp_enable_refresh" yaml:"idp_enable_refresh,omitempty"`
+
+	// ACRValues are the authentication context classes requested from the
+	// identity provider at sign in. If RequireACR is set, sign ins which
+	// satisfy none of them fail.
+	ACRValues  []string `mapstructure:"idp_acr_values" yaml:"idp_acr_values,omitempty"`
+	RequireACR bool     `mapstructure:"idp_require_acr" yaml:"idp_require_acr,omitempty"`
+
+	// AuthURLParams are additional query parameters added to the identity
+	// provider's authorization url, such as a tenant or audience.
+	AuthURLParams map[string]string `mapstructure:"idp_auth_url_params" yaml:"idp_auth_url_params,omitempty"`
+
+	// GroupFormat selects the group attribute used to identify a user's
+	// groups, for those providers that support it.
+	// Options are : "id", "path", "full_path", "name", and "id_and_name".
+	// Default is "id".
+	GroupFormat string `mapstructure:"idp_group_format" yaml:"idp_group_format,omitempty"`
+
+	// MinGroupAccessLevel limits a user's groups to those where they have at
+	// least the given access level, for those providers that support it.
+	// For GitLab, options are : 10, 20, 30, 40, and 50. Default is all groups.
+	MinGroupAccessLevel int `mapstructure:"idp_min_group_access_level" yaml:"idp_min_group_access_level,omitempty"`
+
+	// GroupsPageSize is the number of groups requested per page from
+	// identity providers with a paginated groups API (e.g. GitLab).
+	GroupsPageSize int `mapstructure:"idp_groups_page_size" yaml:"idp_groups_page_size,omitempty"`
+
+	// IncludeParentGroups adds the ancestors of a user's groups to their
+	// groups, for identity providers with nested groups (e.g. GitLab).
+	IncludeParentGroups bool `mapstructure:"idp_include_parent_groups" yaml:"idp_include_parent_groups,omitempty"`
+
+	// GitLabGroupScope selects which GitLab groups are a user's groups.
+	// Options are : "all_visible" and "member_only". Default is GitLab's
+	// own, which for administrators is every group.
+	GitLabGroupScope string `mapstructure:"idp_gitlab_group_scope" yaml:"idp_gitlab_group_scope,omitempty"`
+
+	// GroupsGraphQL retrieves a user's groups with the identity provider's
+	// GraphQL API, for providers that support it (e.g. GitLab).
+	GroupsGraphQL bool `mapstructure:"idp_groups_graphql" yaml:"idp_groups_graphql,omitempty"`
+
+	// IncludeProjects adds the projects a user is a member of to their
+	// groups, for providers that support it (e.g. GitLab).
+	IncludeProjects bool `mapstructure:"idp_include_projects" yaml:"idp_include_projects,omitempty"`
+
+	// EmailDomainGroup adds the domain of a user's verified email to their
+	// groups as `domain:<domain>`, for domain based policies.
+	EmailDomainGroup bool `mapstructure:"idp_email_domain_group" yaml:"idp_email_domain_group,omitempty"`
+
+	// GroupsNamePrefix limits a user's groups to those whose name starts
+	// with it, for groups read from the ID token and for providers which
+	// support it (e.g. Okta).
+	GroupsNamePrefix string `mapstructure:"idp_groups_name_prefix" yaml:"idp_groups_name_prefix,omitempty"`
+
+	// GroupAliases maps the group identifiers returned by the identity
+	// provider to the names used in policies. Unmatched groups are kept as
+	// they are.
+	GroupAliases map[string]string `mapstructure:"idp_group_aliases" yaml:"idp_group_aliases,omitempty"`
+
+	// GroupsCaseInsensitive lowercases users' groups, and the groups
+	// policies allow, so that they match whatever their case.
+	GroupsCaseInsensitive bool `mapstructure:"idp_groups_case_insensitive" yaml:"idp_groups_case_insensitive,omitempty"`
+
+	// RoleSource selects which roles are used as a user's groups, for those
+	// providers that support it.
+	// For Keycloak, options are : "realm", "client", and "all". Default is "all".
+	RoleSource string `mapstructure:"idp_role_source" yaml:"idp_role_source,omitempty"`
+
+	// GroupsClaim is the ID token claim a user's groups are read from, for
+	// OpenID Connect based providers. Default is "groups".
+	GroupsClaim string `mapstructure:"idp_groups_claim" yaml:"idp_groups_claim,omitempty"`
+
+	// GroupsURL, if set, is a groups API the generic OpenID Connect provider
+	// retrieves a user's groups from. GroupsIDField is the JSON field of
+	// each group its identifier is read from. Default is "id".
+	GroupsURL     string `mapstructure:"idp_groups_url" yaml:"idp_groups_url,omitempty"`
+	GroupsIDField string `mapstructure:"idp_groups_id_field" yaml:"idp_groups_id_field,omitempty"`
+
+	// GroupsCacheTTL is the duration a user's group membership is cached
+	// before the identity provider is queried again.
+	GroupsCacheTTL time.Duration `mapstructure:"idp_groups_cache_ttl" yaml:"idp_groups_cache_ttl,omitempty"`
+
+	// GroupsRefreshInterval, if set, is how often the groups in a user's
+	// session are refreshed from the identity provider, so that changes to
+	// their membership are picked up before the session expires.
+	GroupsRefreshInterval time.Duration `mapstructure:"idp_groups_refresh_interval" yaml:"idp_groups_refresh_interval,omitempty"`
+
+	// GroupsCacheRedisURL, if set, stores users' group membership in redis
+	// so that it is shared between replicas of the authenticate service.
+	GroupsCacheRedisURL string `mapstructure:"idp_groups_cache_redis_url" yaml:"idp_groups_cache_redis_url,omitempty"`
+
+	// GroupsBestEffort skips group sources which fail, rather than failing
+	// the user's group lookup, for providers which combine groups from
+	// several sources, and keeps the groups retrieved before a later page
+	// of a paginated source fails.
+	GroupsBestEffort bool `mapstructure:"idp_groups_best_effort" yaml:"idp_groups_best_effort,omitempty"`
+
+	// GroupsRequestTimeout bounds how long a user's group membership lookup
+	// against the identity provider may take.
+	GroupsRequestTimeout time.Duration `mapstructure:"idp_groups_request_timeout" yaml:"idp_groups_request_timeout,omitempty"`
+
+	// GroupsCircuitBreakerThreshold is the number of consecutive failed
+	// group lookups after which lookups against the identity provider are
+	// suspended for GroupsCircuitBreakerCooldown. A negative threshold
+	// disables the circuit breaker.
+	GroupsCircuitBreakerThreshold int           `mapstructure:"idp_groups_circuit_breaker_threshold" yaml:"idp_groups_circuit_breaker_threshold,omitempty"`
+	GroupsCircuitBreakerCooldown  time.Duration `mapstructure:"idp_groups_circuit_breaker_cooldown" yaml:"idp_groups_circuit_breaker_cooldown,omitempty"`
+
+	// GroupsCircuitBreakerFallback selects how group lookups are answered
+	// while suspended: "deny" fails them, "cache" serves a user's last known
+	// groups.
+	GroupsCircuitBreakerFallback string `mapstructure:"idp_groups_circuit_breaker_fallback" yaml:"idp_groups_circuit_breaker_fallback,omitempty"`
+
+	// GroupsMaxStale, if set, serves a user's last known groups, as long as
+	// they're no older than this, when the identity provider is unavailable.
+	GroupsMaxStale time.Duration `mapstructure:"idp_groups_max_stale" yaml:"idp_groups_max_stale,omitempty"`
+
+	// JWKSRefreshInterval is how often the identity provider's signing keys
+	// are refetched from its jwks_uri, so that rotated keys are picked up
+	// without a restart.
+	JWKSRefreshInterval time.Duration `mapstructure:"idp_jwks_refresh_interval" yaml:"idp_jwks_refresh_interval,omitempty"`
+
+	// InsecureSkipVerify skips checking the signature and issuer of the
+	// identity provider's id tokens, for local development against a mock
+	// identity provider which doesn't sign them. Anyone could then forge a
+	// token for any user, so it is refused unless DevModeEnv is also set.
+	InsecureSkipVerify bool `mapstructure:"idp_insecure_skip_verify" yaml:"idp_insecure_skip_verify,omitempty"`
+
+	// AllowPersonalAccessTokens lets non-interactive clients authenticate
+	// with an identity provider issued personal access token, for those
+	// providers that support it (e.g. GitLab).
+	AllowPersonalAccessTokens bool `mapstructure:"idp_allow_personal_access_tokens" yaml:"idp_allow_personal_access_tokens,omitempty"`
+
+	// AllowDeviceAuthorization lets users sign in to devices which can't
+	// open a browser, such as command line tools, with the OAuth 2.0 device
+	// authorization grant, for providers that support it.
+	AllowDeviceAuthorization bool `mapstructure:"idp_allow_device_authorization" yaml:"idp_allow_device_authorization,omitempty"`
+
+	// MachineClients are the OAuth 2.0 clients which may authenticate with
+	// the client credentials grant for service to service requests, and the
+	// identity their sessions are given.
+	MachineClients []MachineClientOptions `mapstructure:"idp_machine_clients" yaml:"idp_machine_clients,omitempty"`
+
+	// ProviderCA and ProviderCAFile set a custom certificate authority which
+	// is trusted, along with the system's, when connecting to the identity
+	// provider (e.g. a self-hosted GitLab behind an internal CA).
+	ProviderCA     string `mapstructure:"idp_certificate_authority" yaml:"idp_certificate_authority,omitempty"`
+	ProviderCAFile string `mapstructure:"idp_certificate_authority_file" yaml:"idp_certificate_authority_file,omitempty"`
+
+	// ProviderTLSMinVersion and ProviderTLSCipherSuites restrict the TLS
+	// versions and cipher suites connections to the identity provider may
+	// use, for deployments which must meet a compliance baseline.
+	ProviderTLSMinVersion   string   `mapstructure:"idp_tls_min_version" yaml:"idp_tls_min_version,omitempty"`
+	ProviderTLSCipherSuites []string `mapstructure:"idp_tls_cipher_suites" yaml:"idp_tls_cipher_suites,omitempty"`
+
+	// ProviderClientCert and ProviderClientKey, or their file based
+	// alternatives, are the client certificate presented to identity
+	// providers which require mutual TLS.
+	ProviderClientCert     string `mapstructure:"idp_client_certificate" yaml:"idp_client_certificate,omitempty"`
+	ProviderClientKey      string `mapstructure:"idp_client_certificate_key" yaml:"idp_client_certificate_key,omitempty"`
+	ProviderClientCertFile string `mapstructure:"idp_client_certificate_file" yaml:"idp_client_certificate_file,omitempty"`
+	ProviderClientKeyFile  string `mapstructure:"idp_client_certificate_key_file" yaml:"idp_client_certificate_key_file,omitempty"`
+
+	// ProviderProxyURL is an HTTP proxy, optionally with credentials, that
+	// requests to the identity provider are made through. ProviderNoProxy
+	// lists hosts which are connected to directly, as NO_PROXY does.
+	ProviderProxyURL string `mapstructure:"idp_proxy_url" yaml:"idp_proxy_url,omitempty"`
+	ProviderNoProxy  string `mapstructure:"idp_no_proxy" yaml:"idp_no_proxy,omitempty"`
+
+	// ProviderDialTimeout, ProviderTLSHandshakeTimeout and
+	// ProviderResponseHeaderTimeout bound the phases of a connection to the
+	// identity provider, so that a stalled network is given up on quickly.
+	ProviderDialTimeout           time.Duration `mapstructure:"idp_dial_timeout" yaml:"idp_dial_timeout,omitempty"`
+	ProviderTLSHandshakeTimeout   time.Duration `mapstructure:"idp_tls_handshake_timeout" yaml:"idp_tls_handshake_timeout,omitempty"`
+	ProviderResponseHeaderTimeout time.Duration `mapstructure:"idp_response_header_timeout" yaml:"idp_response_header_timeout,omitempty"`
+
+	// ProviderDiscoveryRetries and ProviderDiscoveryTimeout bound how long
+	// fetching the identity provider's discovery document is retried at
+	// startup, so that a briefly unavailable provider doesn't fail it.
+	ProviderDiscoveryRetries int           `mapstructure:"idp_discovery_retries" yaml:"idp_discovery_retries,omitempty"`
+	ProviderDiscoveryTimeout time.Duration `mapstructure:"idp_discovery_timeout" yaml:"idp_discovery_timeout,omitempty"`
+
+	// ProviderUserAgent overrides the User-Agent sent to the identity
+	// provider, for providers whose firewall filters by user agent.
+	ProviderUserAgent string `mapstructure:"idp_user_agent" yaml:"idp_user_agent,omitempty"`
+
+	// ProviderPKCE protects the authorization code flow with PKCE (RFC 7636),
+	// so that an intercepted authorization code can't be redeemed.
+	ProviderPKCE bool `mapstructure:"idp_pkce" yaml:"idp_pkce,omitempty"`
+
+	// ProviderEndSession also signs users out of an OpenID Connect identity
+	// provider which has an end_session_endpoint when they sign out.
+	ProviderEndSession bool `mapstructure:"idp_end_session" yaml:"idp_end_session,omitempty"`
+
+	// IdentityProviders are additional, named identity providers which can
+	// be selected per route or at sign in, alongside the default provider.
+	IdentityProviders []IdentityProviderOptions `mapstructure:"idp_providers" yaml:"idp_providers,omitempty"`
+
+	// IssuerDiscovery enables WebFinger discovery of the issuer of named
+	// identity providers without a provider url, from their email domains,
+	// and of the issuer of a login hint's domain at sign in, if it's one of
+	// IssuerDiscoveryDomains. Results are cached for IssuerDiscoveryTTL.
+	IssuerDiscovery        bool          `mapstructure:"idp_issuer_discovery" yaml:"idp_issuer_discovery,omitempty"`
+	IssuerDiscoveryTTL     time.Duration `mapstructure:"idp_issuer_discovery_ttl" yaml:"idp_issuer_discovery_ttl,omitempty"`
+	IssuerDiscoveryDomains []string      `mapstructure:"idp_issuer_discovery_domains" yaml:"idp_issuer_discovery_domains,omitempty"`
+
 	// Administrators contains a set of emails with users who have super user
 	// (sudo) access including the ability to impersonate other users' access
 	Administrators []string `mapstructure:"administrators" yaml:"administrators,omitempty"`
@@ -135,12 +373,55 @@ type Options struct {
 	HeadersEnv string            `yaml:",omitempty"`
 	Headers    map[string]string `yaml:",omitempty"`
 
+	// ClaimHeaders maps the identity provider's claims to the headers they
+	// are set as on proxied requests.
+	ClaimHeaders map[string]string `mapstructure:"idp_claim_headers" yaml:"idp_claim_headers,omitempty"`
+
+	// AttributesURL, if set, is an HTTP API additional attributes of a user
+	// (e.g. their department) are retrieved from after they sign in. Those
+	// named by ClaimHeaders are kept with the identity provider's claims,
+	// so that they can be set as headers. AttributesHeaders are sent with its
+	// requests.
+	AttributesURL     string            `mapstructure:"idp_attributes_url" yaml:"idp_attributes_url,omitempty"`
+	AttributesHeaders map[string]string `mapstructure:"idp_attributes_headers" yaml:"idp_attributes_headers,omitempty"`
+
+	// AttributesFailOpen signs users in without their attributes, rather
+	// than failing, if AttributesURL can't be queried.
+	AttributesFailOpen bool `mapstructure:"idp_attributes_fail_open" yaml:"idp_attributes_fail_open,omitempty"`
+
 	// List of JWT claims to insert as x-pomerium-claim-* headers on proxied requests
 	JWTClaimsHeaders []string `mapstructure:"jwt_claims_headers" yaml:"jwt_claims_headers,omitempty"`
 
 	// RefreshCooldown limits the rate a user can refresh her session
 	RefreshCooldown time.Duration `mapstructure:"refresh_cooldown" yaml:"refresh_cooldown,omitempty"`
 
+	// ReauthenticateBeforeExpiry, if set, sends a user to sign in again once
+	// their session's token is within this duration of expiring and can't
+	// be refreshed, rather than letting the session expire mid-use.
+	ReauthenticateBeforeExpiry time.Duration `mapstructure:"reauthenticate_before_expiry" yaml:"reauthenticate_before_expiry,omitempty"`
+
+	// RefreshBeforeExpiry, if set, refreshes active sessions which have a
+	// refresh token in the background, within this duration of their token
+	// expiring, rather than when they are next used after it has.
+	RefreshBeforeExpiry time.Duration `mapstructure:"refresh_before_expiry" yaml:"refresh_before_expiry,omitempty"`
+
+	// SessionMaxDuration, if set, is how long after signing in a user must
+	// sign in again, and SessionIdleTimeout how long a session may go unused
+	// before they must, however long the identity provider's tokens are
+	// valid for.
+	SessionMaxDuration time.Duration `mapstructure:"session_max_duration" yaml:"session_max_duration,omitempty"`
+	SessionIdleTimeout time.Duration `mapstructure:"session_idle_timeout" yaml:"session_idle_timeout,omitempty"`
+
+	// SessionRevocationRedisURL, if set, records signed out sessions in
+	// redis, so that every replica of the authenticate and proxy services
+	// rejects them, not just the one they signed out from.
+	SessionRevocationRedisURL string `mapstructure:"session_revocation_redis_url" yaml:"session_revocation_redis_url,omitempty"`
+
+	// SessionDatabaseURL, if set, keeps the authenticate service's sessions
+	// in a PostgreSQL database shared by its replicas, so that the session
+	// cookie only holds an opaque session id rather than the user's tokens.
+	SessionDatabaseURL string `mapstructure:"session_database_url" yaml:"session_database_url,omitempty"`
+
 	//Routes                 map[string]string `mapstructure:"routes" yaml:"routes,omitempty"`
 	DefaultUpstreamTimeout time.Duration `mapstructure:"default_upstream_timeout" yaml:"default_upstream_timeout,omitempty"`
 
@@ -230,6 +511,10 @@ var defaultOptions = Options{
 	WriteTimeout:                    0, // support streaming by default
 	IdleTimeout:                     5 * time.Minute,
 	RefreshCooldown:                 5 * time.Minute,
+	GroupsCacheTTL:                  5 * time.Minute,
+	GroupsRequestTimeout:            10 * time.Second,
+	JWKSRefreshInterval:             time.Hour,
+	CookieCompressionThreshold:      ecjson.DefaultCompressionThreshold,
 	GRPCAddr:                        ":443",
 	GRPCClientTimeout:               10 * time.Second, // Try to withstand transient service failures for a single request
 	GRPCClientDNSRoundRobin:         true,
@@ -323,6 +608,11 @@ func (o *Options) parsePolicy() error {
 		if err := (&o.Policies[i]).Validate(); err != nil {
 			return err
 		}
+		if o.GroupsCaseInsensitive {
+			for j, group := range o.Policies[i].AllowedGroups {
+				o.Policies[i].AllowedGroups[j] = strings.ToLower(group)
+			}
+		}
 	}
 	return nil
 }
@@ -452,6 +742,12 @@ func (o *Options) Validate() error {
 		return errors.New("config: shared-key contains whitespace")
 	}
 
+	for _, key := range o.PreviousSharedKeys {
+		if _, err := cryptutil.NewAEADCipherFromBase64(key); err != nil {
+			return fmt.Errorf("config: bad previous shared secret: %w", err)
+		}
+	}
+
 	if o.AuthenticateURLString != "" {
 		u, err := urlutil.ParseAndValidateURL(o.AuthenticateURLString)
 		if err != nil {
@@ -491,6 +787,75 @@ func (o *Options) Validate() error {
 		return fmt.Errorf("config: failed to parse policy: %w", err)
 	}
 
+	if err := validateAllowedIssuers(o.AllowedIssuers); err != nil {
+		return fmt.Errorf("config: bad idp allowed issuers: %w", err)
+	}
+
+	if err := o.validateIdentityProviders(); err != nil {
+		return err
+	}
+
+	if err := o.validateMachineClients(); err != nil {
+		return err
+	}
+
+	if err := validateClaimHeaders(o.ClaimHeaders); err != nil {
+		return fmt.Errorf("config: bad idp claim headers: %w", err)
+	}
+
+	if o.InsecureSkipVerify {
+		if os.Getenv(DevModeEnv) != "true" {
+			return fmt.Errorf("config: idp_insecure_skip_verify is only allowed for development, with %s=true", DevModeEnv)
+		}
+		log.Warn().Msg("config: INSECURE: identity provider token signatures are not verified; never use idp_insecure_skip_verify in production")
+	}
+
+	if o.GroupsURL != "" {
+		if _, err := urlutil.ParseAndValidateURL(o.GroupsURL); err != nil {
+			return fmt.Errorf("config: bad idp groups url %s : %w", o.GroupsURL, err)
+		}
+	}
+
+	if o.AttributesURL != "" {
+		if _, err := urlutil.ParseAndValidateURL(o.AttributesURL); err != nil {
+			return fmt.Errorf("config: bad idp attributes url %s : %w", o.AttributesURL, err)
+		}
+	}
+
+	for group, alias := range o.GroupAliases {
+		if group == "" || alias == "" {
+			return fmt.Errorf("config: bad idp group alias %q: %q", group, alias)
+		}
+	}
+
+	for _, v := range o.ACRValues {
+		if fields := strings.Fields(v); len(fields) != 1 || fields[0] != v {
+			return fmt.Errorf("config: bad idp acr value %q", v)
+		}
+	}
+	if o.RequireACR && len(o.ACRValues) == 0 {
+		return errors.New("config: idp_require_acr requires idp_acr_values")
+	}
+	if _, err := audit.NewLogger(o.AuditLog); err != nil {
+		return fmt.Errorf("config: bad audit log: %w", err)
+	}
+
+	if err := identity.ValidateAuthURLParams(o.AuthURLParams); err != nil {
+		return fmt.Errorf("config: bad idp auth url params: %w", err)
+	}
+
+	if o.GroupsMaxStale < 0 {
+		return fmt.Errorf("config: idp_groups_max_stale %s must not be negative", o.GroupsMaxStale)
+	}
+
+	if o.SessionMaxDuration < 0 {
+		return fmt.Errorf("config: session_max_duration %s must not be negative", o.SessionMaxDuration)
+	}
+	// session activity is only recorded to the minute
+	if o.SessionIdleTimeout != 0 && o.SessionIdleTimeout < time.Minute {
+		return fmt.Errorf("config: session_idle_timeout %s must be at least a minute", o.SessionIdleTimeout)
+	}
+
 	if err := o.parseHeaders(); err != nil {
 		return fmt.Errorf("config: failed to parse headers: %w", err)
 	}
@@ -13,6 +13,8 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/spf13/viper"
+
+	"github.com/pomerium/pomerium/internal/cryptutil"
 )
 
 var cmpOptIgnoreUnexported = cmpopts.IgnoreUnexported(Options{})
@@ -39,6 +41,46 @@ func Test_Validate(t *testing.T) {
 
 	badPolicyFile := testOptions()
 	badPolicyFile.PolicyFile = "file"
+	previousSecret := testOptions()
+	previousSecret.PreviousSharedKeys = []string{cryptutil.NewBase64Key()}
+	badPreviousSecret := testOptions()
+	badPreviousSecret.PreviousSharedKeys = []string{"not base64"}
+	requireACR := testOptions()
+	requireACR.ACRValues = []string{"urn:example:mfa"}
+	requireACR.RequireACR = true
+	badACRValue := testOptions()
+	badACRValue.ACRValues = []string{"mfa pwd"}
+	requireNoACR := testOptions()
+	requireNoACR.RequireACR = true
+	sessionLifetime := testOptions()
+	sessionLifetime.SessionMaxDuration = 8 * time.Hour
+	sessionLifetime.SessionIdleTimeout = 15 * time.Minute
+	badGroupsMaxStale := testOptions()
+	badGroupsMaxStale.GroupsMaxStale = -time.Minute
+	badSessionMaxDuration := testOptions()
+	badSessionMaxDuration.SessionMaxDuration = -time.Hour
+	badSessionIdleTimeout := testOptions()
+	badSessionIdleTimeout.SessionIdleTimeout = 30 * time.Second
+	groupAliases := testOptions()
+	groupAliases.GroupAliases = map[string]string{"4821": "backend", "5102": "platform"}
+	badGroupAlias := testOptions()
+	badGroupAlias.GroupAliases = map[string]string{"4821": ""}
+	attributesURL := testOptions()
+	attributesURL.AttributesURL = "https://hr.example.com/attributes"
+	badAttributesURL := testOptions()
+	badAttributesURL.AttributesURL = "hr.example.com"
+	allowedIssuers := testOptions()
+	allowedIssuers.AllowedIssuers = []string{"https://idp.example.com", "https://tenant.idp.example.com"}
+	badAllowedIssuers := testOptions()
+	badAllowedIssuers.AllowedIssuers = []string{"https://idp.example.com", "idp.example.com"}
+	badAuditLog := testOptions()
+	badAuditLog.AuditLog = "syslog"
+	badAuthURLParams := testOptions()
+	badAuthURLParams.AuthURLParams = map[string]string{"audience": "https://api.example.com", "client_id": "other"}
+	groupsURL := testOptions()
+	groupsURL.GroupsURL = "https://idp.example.com/api/groups"
+	badGroupsURL := testOptions()
+	badGroupsURL.GroupsURL = "idp.example.com/api/groups"
 
 	tests := []struct {
 		name     string
@@ -50,6 +92,25 @@ func Test_Validate(t *testing.T) {
 		{"missing shared secret", badSecret, true},
 		{"missing shared secret but all service", badSecretAllServices, false},
 		{"policy file specified", badPolicyFile, true},
+		{"previous shared secret", previousSecret, false},
+		{"bad previous shared secret", badPreviousSecret, true},
+		{"required acr values", requireACR, false},
+		{"acr value with whitespace", badACRValue, true},
+		{"acr required without acr values", requireNoACR, true},
+		{"session lifetime", sessionLifetime, false},
+		{"negative groups max stale", badGroupsMaxStale, true},
+		{"negative session max duration", badSessionMaxDuration, true},
+		{"session idle timeout under a minute", badSessionIdleTimeout, true},
+		{"group aliases", groupAliases, false},
+		{"empty group alias", badGroupAlias, true},
+		{"attributes url", attributesURL, false},
+		{"bad attributes url", badAttributesURL, true},
+		{"allowed issuers", allowedIssuers, false},
+		{"bad allowed issuers", badAllowedIssuers, true},
+		{"bad audit log", badAuditLog, true},
+		{"bad auth url params", badAuthURLParams, true},
+		{"groups url", groupsURL, false},
+		{"bad groups url", badGroupsURL, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -62,6 +123,33 @@ func Test_Validate(t *testing.T) {
 	}
 }
 
+func Test_ValidateInsecureSkipVerify(t *testing.T) {
+	defer os.Unsetenv(DevModeEnv)
+	tests := []struct {
+		name    string
+		devMode string
+		wantErr bool
+	}{
+		{"not in dev mode", "", true},
+		{"dev mode not true", "1", true},
+		{"dev mode", "true", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(DevModeEnv, tt.devMode)
+			o := NewDefaultOptions()
+			o.SharedKey = "test"
+			o.Services = "all"
+			o.CertFile = "./testdata/example-cert.pem"
+			o.KeyFile = "./testdata/example-key.pem"
+			o.InsecureSkipVerify = true
+			if err := o.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func Test_bindEnvs(t *testing.T) {
 	o := new(Options)
 	o.viper = viper.New()
@@ -183,6 +271,32 @@ func Test_parsePolicyFile(t *testing.T) {
 	}
 }
 
+func Test_parsePolicyGroupsCaseInsensitive(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		want            []string
+	}{
+		{"case insensitive", true, []string{"backend", "admins"}},
+		{"case sensitive", false, []string{"Backend", "admins"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			o := &Options{viper: viper.New(), GroupsCaseInsensitive: tt.caseInsensitive}
+			o.viperSet("policy", []map[string]interface{}{{"from": "https://pomerium.io", "to": "https://httpbin.org", "allowed_groups": []string{"Backend", "admins"}}})
+			if err := o.parsePolicy(); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, o.Policies[0].AllowedGroups); diff != "" {
+				t.Errorf("parsePolicy() allowed groups = %s", diff)
+			}
+		})
+	}
+}
+
 func Test_Checksum(t *testing.T) {
 	o := NewDefaultOptions()
 
@@ -228,6 +342,10 @@ func TestOptionsFromViper(t *testing.T) {
 				GRPCServerMaxConnectionAge:      5 * time.Minute,
 				GRPCServerMaxConnectionAgeGrace: 5 * time.Minute,
 				AuthenticateCallbackPath:        "/oauth2/callback",
+				GroupsCacheTTL:                  5 * time.Minute,
+				GroupsRequestTimeout:            10 * time.Second,
+				JWKSRefreshInterval:             time.Hour,
+				CookieCompressionThreshold:      512,
 				Headers: map[string]string{
 					"Strict-Transport-Security": "max-age=31536000; includeSubDomains; preload",
 					"X-Frame-Options":           "SAMEORIGIN",
@@ -245,6 +363,10 @@ func TestOptionsFromViper(t *testing.T) {
 				InsecureServer:                  true,
 				GRPCServerMaxConnectionAge:      5 * time.Minute,
 				GRPCServerMaxConnectionAgeGrace: 5 * time.Minute,
+				GroupsCacheTTL:                  5 * time.Minute,
+				GroupsRequestTimeout:            10 * time.Second,
+				JWKSRefreshInterval:             time.Hour,
+				CookieCompressionThreshold:      512,
 				Headers:                         map[string]string{}},
 			false},
 		{"bad url", []byte(`{"policy":[{"from": "https://","to":"https://to.example"}]}`), nil, true},
@@ -6,9 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/pomerium/pomerium/internal/cryptutil"
+	"github.com/pomerium/pomerium/internal/identity"
 	"github.com/pomerium/pomerium/internal/urlutil"
 )
 
@@ -20,10 +22,39 @@ type Policy struct {
 	AllowedUsers   []string `mapstructure:"allowed_users" yaml:"allowed_users,omitempty" json:"allowed_users,omitempty"`
 	AllowedGroups  []string `mapstructure:"allowed_groups" yaml:"allowed_groups,omitempty" json:"allowed_groups,omitempty"`
 	AllowedDomains []string `mapstructure:"allowed_domains" yaml:"allowed_domains,omitempty" json:"allowed_domains,omitempty"`
+	// AllowedOrgs are organizations, as distinct from groups by identity
+	// providers which have both, such as GitHub organizations.
+	AllowedOrgs []string `mapstructure:"allowed_orgs" yaml:"allowed_orgs,omitempty" json:"allowed_orgs,omitempty"`
+
+	// AllowedACRValues and RequiredAMR further restrict the route to users
+	// who signed in with one of the given authentication context classes,
+	// and with all of the given authentication methods (e.g. `mfa`).
+	AllowedACRValues []string `mapstructure:"allowed_acr_values" yaml:"allowed_acr_values,omitempty" json:"allowed_acr_values,omitempty"`
+	RequiredAMR      []string `mapstructure:"required_amr" yaml:"required_amr,omitempty" json:"required_amr,omitempty"`
 
 	Source      *HostnameURL `yaml:",omitempty" json:"source,omitempty"`
 	Destination *url.URL     `yaml:",omitempty" json:"destination,omitempty"`
 
+	// IdentityProvider is the name of the identity provider users are sent to
+	// when signing in to this route. If unset, the default provider is used.
+	IdentityProvider string `mapstructure:"identity_provider" yaml:"identity_provider,omitempty" json:"identity_provider,omitempty"`
+
+	// IdentityProviderPrompt is the OpenID Connect prompt users signing in to
+	// this route are sent to the identity provider with; for example, `login`
+	// forces them to re-authenticate.
+	IdentityProviderPrompt string `mapstructure:"identity_provider_prompt" yaml:"identity_provider_prompt,omitempty" json:"identity_provider_prompt,omitempty"`
+
+	// IdentityProviderScopes are oauth2 scopes, beyond those requested at
+	// sign in, that users must have granted to access this route. Users
+	// who haven't are asked to grant them by the identity provider.
+	IdentityProviderScopes []string `mapstructure:"identity_provider_scopes" yaml:"identity_provider_scopes,omitempty" json:"identity_provider_scopes,omitempty"`
+
+	// IdentityProviderMaxAge is how long ago users may have last
+	// authenticated with the identity provider to access this route. Users
+	// who authenticated longer ago are sent back to authenticate again, with
+	// the OpenID Connect max_age parameter.
+	IdentityProviderMaxAge time.Duration `mapstructure:"identity_provider_max_age" yaml:"identity_provider_max_age,omitempty" json:"identity_provider_max_age,omitempty"`
+
 	// Allow unauthenticated HTTP OPTIONS requests as per the CORS spec
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/CORS#Preflighted_requests
 	CORSAllowPreflight bool `mapstructure:"cors_allow_preflight" yaml:"cors_allow_preflight,omitempty"`
@@ -93,10 +124,25 @@ func (p *Policy) Validate() error {
 	}
 
 	// Only allow public access if no other whitelists are in place
-	if p.AllowPublicUnauthenticatedAccess && (p.AllowedDomains != nil || p.AllowedGroups != nil || p.AllowedUsers != nil) {
+	if p.AllowPublicUnauthenticatedAccess && (p.AllowedDomains != nil || p.AllowedGroups != nil || p.AllowedOrgs != nil || p.AllowedUsers != nil) {
 		return fmt.Errorf("config: policy route marked as public but contains whitelists")
 	}
 
+	if err := identity.ValidatePrompt(p.IdentityProviderPrompt); err != nil {
+		return fmt.Errorf("config: policy bad identity provider prompt %w", err)
+	}
+
+	for _, scope := range p.IdentityProviderScopes {
+		if fields := strings.Fields(scope); len(fields) != 1 || fields[0] != scope {
+			return fmt.Errorf("config: policy bad identity provider scope %q", scope)
+		}
+	}
+
+	// max_age is sent in seconds
+	if p.IdentityProviderMaxAge < 0 || (p.IdentityProviderMaxAge > 0 && p.IdentityProviderMaxAge < time.Second) {
+		return fmt.Errorf("config: policy identity provider max age must be at least a second, got %s", p.IdentityProviderMaxAge)
+	}
+
 	if (p.TLSClientCert == "" && p.TLSClientKey != "") || (p.TLSClientCert != "" && p.TLSClientKey == "") ||
 		(p.TLSClientCertFile == "" && p.TLSClientKeyFile != "") || (p.TLSClientCertFile != "" && p.TLSClientKeyFile == "") {
 		return fmt.Errorf("config: client certificate key and cert both must be non-empty")
@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -20,6 +21,13 @@ func Test_PolicyValidate(t *testing.T) {
 		{"empty from host", Policy{From: "https://", To: "https://httpbin.corp.example"}, true},
 		{"empty from scheme", Policy{From: "httpbin.corp.example", To: "https://httpbin.corp.example"}, true},
 		{"empty to scheme", Policy{From: "https://httpbin.corp.example", To: "//httpbin.corp.example"}, true},
+		{"good prompt", Policy{From: "https://httpbin.corp.example", To: "https://httpbin.corp.notatld", IdentityProviderPrompt: "login consent"}, false},
+		{"bad prompt", Policy{From: "https://httpbin.corp.example", To: "https://httpbin.corp.notatld", IdentityProviderPrompt: "none login"}, true},
+		{"good scopes", Policy{From: "https://httpbin.corp.example", To: "https://httpbin.corp.notatld", IdentityProviderScopes: []string{"admin", "https://www.googleapis.com/auth/drive"}}, false},
+		{"bad scopes", Policy{From: "https://httpbin.corp.example", To: "https://httpbin.corp.notatld", IdentityProviderScopes: []string{"admin billing"}}, true},
+		{"good max age", Policy{From: "https://httpbin.corp.example", To: "https://httpbin.corp.notatld", IdentityProviderMaxAge: 5 * time.Minute}, false},
+		{"negative max age", Policy{From: "https://httpbin.corp.example", To: "https://httpbin.corp.notatld", IdentityProviderMaxAge: -time.Minute}, true},
+		{"sub-second max age", Policy{From: "https://httpbin.corp.example", To: "https://httpbin.corp.notatld", IdentityProviderMaxAge: time.Millisecond}, true},
 		{"cors policy", Policy{From: "https://httpbin.corp.example", To: "https://httpbin.corp.notatld", CORSAllowPreflight: true}, false},
 		{"public policy", Policy{From: "https://httpbin.corp.example", To: "https://httpbin.corp.notatld", AllowPublicUnauthenticatedAccess: true}, false},
 		{"public and whitelist", Policy{From: "https://httpbin.corp.example", To: "https://httpbin.corp.notatld", AllowPublicUnauthenticatedAccess: true, AllowedUsers: []string{"test@domain.example"}}, true},
@@ -86,12 +86,16 @@ module.exports = {
           children: [
             "identity-providers/",
             "identity-providers/azure",
+            "identity-providers/bitbucket",
             "identity-providers/cognito",
             "identity-providers/gitlab",
             "identity-providers/github",
             "identity-providers/google",
+            "identity-providers/keycloak",
             "identity-providers/okta",
-            "identity-providers/one-login"
+            "identity-providers/one-login",
+            "identity-providers/ping",
+            "identity-providers/slack"
           ]
         },
         {
@@ -0,0 +1,224 @@
+// Package integration tests pomerium's services running together in one
+// process, rather than each through its own unit tests.
+package integration
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/pomerium/pomerium/authenticate"
+	"github.com/pomerium/pomerium/cache"
+	"github.com/pomerium/pomerium/config"
+	"github.com/pomerium/pomerium/internal/cryptutil"
+	"github.com/pomerium/pomerium/internal/encoding/ecjson"
+	"github.com/pomerium/pomerium/internal/encoding/jws"
+	pgrpc "github.com/pomerium/pomerium/internal/grpc"
+	pbAuthorize "github.com/pomerium/pomerium/internal/grpc/authorize"
+	authorizeClient "github.com/pomerium/pomerium/internal/grpc/authorize/client"
+	pbCache "github.com/pomerium/pomerium/internal/grpc/cache"
+	cacheClient "github.com/pomerium/pomerium/internal/grpc/cache/client"
+	"github.com/pomerium/pomerium/internal/httputil"
+	"github.com/pomerium/pomerium/internal/sessions"
+	sessionCache "github.com/pomerium/pomerium/internal/sessions/cache"
+	mstore "github.com/pomerium/pomerium/internal/sessions/mock"
+	"github.com/pomerium/pomerium/internal/urlutil"
+	"github.com/pomerium/pomerium/proxy"
+)
+
+// newIdentityProvider serves just enough of OpenID Connect discovery for
+// the authenticate service to be created.
+func newIdentityProvider(t *testing.T) *httptest.Server {
+	t.Helper()
+	var idp *httptest.Server
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                 idp.URL,
+				"authorization_endpoint": idp.URL + "/auth",
+				"token_endpoint":         idp.URL + "/token",
+				"jwks_uri":               idp.URL + "/keys",
+			})
+		case "/keys":
+			w.Write([]byte(`{"keys":[]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return idp
+}
+
+// newCacheService runs the cache service on a local port.
+func newCacheService(t *testing.T, sharedKey string) (*url.URL, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "pomerium-integration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheURL := &url.URL{Scheme: "http", Host: lis.Addr().String()}
+	c, err := cache.New(config.Options{
+		CacheStore:     "bolt",
+		CacheStorePath: filepath.Join(dir, "bolt.db"),
+		SharedKey:      sharedKey,
+		CacheURL:       cacheURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pbCache.RegisterCacheServer(srv, c)
+	go srv.Serve(lis)
+	return cacheURL, func() {
+		srv.Stop()
+		c.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestProxyRefreshKeepsAuthenticateSessionActive(t *testing.T) {
+	// the proxy calls the authenticate service with the shared http client
+	defer func(c *http.Client) { httputil.DefaultClient = c }(httputil.DefaultClient)
+
+	now := time.Now()
+	ago := func(d time.Duration) *jwt.NumericDate { return jwt.NewNumericDate(now.Add(-d)) }
+	// the idle timeout is shorter than the user's tokens last, so the route
+	// is refreshed by the proxy while the user is still using it
+	const idleTimeout = 15 * time.Minute
+	tests := []struct {
+		name            string
+		session         sessions.State
+		routeLastActive *jwt.NumericDate
+		wantStatus      int
+	}{
+		{"active on the route", sessions.State{SignedInAt: ago(time.Hour), LastActiveAt: ago(10 * time.Minute)}, ago(30 * time.Second), http.StatusOK},
+		{"lifetime not recorded", sessions.State{}, nil, http.StatusOK},
+		{"idle at authenticate", sessions.State{SignedInAt: ago(time.Hour), LastActiveAt: ago(20 * time.Minute)}, ago(30 * time.Second), http.StatusFound},
+		{"idle on the route", sessions.State{SignedInAt: ago(time.Hour), LastActiveAt: ago(10 * time.Minute)}, ago(20 * time.Minute), http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sharedKey := cryptutil.NewBase64Key()
+			idp := newIdentityProvider(t)
+			defer idp.Close()
+			cacheURL, stopCache := newCacheService(t, sharedKey)
+			defer stopCache()
+			authenticateSrv := httptest.NewUnstartedServer(nil)
+			defer authenticateSrv.Close()
+
+			opts := config.NewDefaultOptions()
+			opts.AuthenticateURLString = "https://" + authenticateSrv.Listener.Addr().String()
+			opts.AuthorizeURLString = "https://authorize.example"
+			opts.CacheURLString = cacheURL.String()
+			opts.GRPCInsecure = true
+			opts.InsecureServer = true
+			opts.Policies = []config.Policy{{From: "https://corp.example", To: "https://example.example"}}
+			opts.SharedKey = sharedKey
+			opts.CookieSecret = cryptutil.NewBase64Key()
+			opts.Provider = "oidc"
+			opts.ProviderURL = idp.URL
+			opts.ProviderDiscoveryRetries = -1
+			opts.ClientID = "client-id"
+			opts.ClientSecret = "client-secret"
+			opts.SessionIdleTimeout = idleTimeout
+			if err := opts.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			a, err := authenticate.New(*opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			authenticateSrv.Config.Handler = a.Handler()
+			authenticateSrv.StartTLS()
+			httputil.DefaultClient = authenticateSrv.Client()
+
+			p, err := proxy.New(*opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// authorize asks for the route's session to be refreshed
+			p.AuthorizeClient = authorizeClient.MockAuthorize{AuthorizeResponse: &pbAuthorize.IsAuthorizedReply{Allow: true, SessionExpired: true}}
+
+			// the authenticate service's session, as kept in the cache
+			conn, err := pgrpc.NewGRPCClientConn(&pgrpc.Options{Addr: cacheURL, WithInsecure: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			cacher := cacheClient.New(conn)
+			cookieSecret, _ := base64.StdEncoding.DecodeString(opts.CookieSecret)
+			cookieCipher, err := cryptutil.NewAEADCipher(cookieSecret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encryptedEncoder := ecjson.New(cookieCipher)
+			cacheStore := sessionCache.NewStore(&sessionCache.Options{
+				Cache:        cacher,
+				Encoder:      encryptedEncoder,
+				QueryParam:   urlutil.QueryAccessTokenID,
+				WrappedStore: &mstore.Store{}})
+			session := tt.session
+			session.Email = "user@test.example"
+			session.AccessTokenID = "token"
+			session.Expiry = jwt.NewNumericDate(now.Add(time.Hour))
+			if err := cacheStore.SaveState(context.Background(), &session); err != nil {
+				t.Fatal(err)
+			}
+
+			// the route's session, as the authenticate service last refreshed it
+			encoder, err := jws.NewHS256Signer([]byte(sharedKey), opts.AuthenticateURL.Host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			routeSession := session.NewSession(opts.AuthenticateURL.Host, []string{"corp.example"})
+			routeSession.AccessTokenID = session.AccessTokenID
+			routeSession.LastActiveAt = tt.routeLastActive
+			routeJWT, err := encoder.Marshal(routeSession.RouteSession())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "https://corp.example/", nil)
+			r = r.WithContext(sessions.NewContext(r.Context(), string(routeJWT), nil))
+			w := httptest.NewRecorder()
+			p.AuthorizeSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("AuthorizeSession() status = %v, want %v\n%v", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			// the authenticate service's session records the route's activity
+			_, data, err := cacher.Get(context.Background(), session.AccessTokenID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got sessions.State
+			if err := encryptedEncoder.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.LastActiveAt == nil || now.Sub(got.LastActiveAt.Time()) > time.Minute {
+				t.Errorf("authenticate session last active at = %v, want the route's last activity", got.LastActiveAt)
+			}
+		})
+	}
+}
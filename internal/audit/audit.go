@@ -0,0 +1,171 @@
+// Package audit records an audit trail of authentication and authorization
+// events, such as who signed in, with which identity provider and groups,
+// and which requests they were allowed or denied. Audit events are kept
+// apart from the debug logs, and are written to a configurable sink.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+// EventType is the kind of event an audit event records.
+type EventType string
+
+// The audit event types.
+const (
+	SignIn          EventType = "sign_in"
+	SignOut         EventType = "sign_out"
+	GroupResolution EventType = "group_resolution"
+	// GroupInvalidation records an admin dropping a user's groups, so that
+	// they're fetched again.
+	GroupInvalidation EventType = "group_invalidation"
+	TokenRefresh      EventType = "token_refresh"
+	Revocation        EventType = "revocation"
+	Authorization     EventType = "authorization"
+)
+
+// Outcome is the result of the event an audit event records.
+type Outcome string
+
+// The audit event outcomes. Authorization events are allowed or denied;
+// the others succeed or fail.
+const (
+	Success Outcome = "success"
+	Failure Outcome = "failure"
+	Allow   Outcome = "allow"
+	Deny    Outcome = "deny"
+)
+
+// Event is an audit event. Subject, provider, session id, timestamp, and
+// outcome are recorded for every type of event, where known, so that a
+// user's sign in can be followed through its refreshes and the requests
+// made with it.
+type Event struct {
+	Time      time.Time `json:"timestamp"`
+	Type      EventType `json:"event"`
+	Outcome   Outcome   `json:"outcome"`
+	Subject   string    `json:"subject,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Provider  string    `json:"provider,omitempty"`
+	SessionID string    `json:"session_id,omitempty"`
+	Groups    []string  `json:"groups,omitempty"`
+	// Host and Method are those of the request an authorization event
+	// records the decision for.
+	Host   string `json:"host,omitempty"`
+	Method string `json:"method,omitempty"`
+	// Reason is why the event failed or was denied.
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewEvent returns an event of the user of session s, which may be nil.
+func NewEvent(typ EventType, outcome Outcome, s *sessions.State) Event {
+	e := Event{Type: typ, Outcome: outcome}
+	if s != nil {
+		e.Subject = s.Subject
+		e.Email = s.Email
+		e.Provider = s.IdentityProvider
+		e.SessionID = s.SessionID
+		e.Groups = s.Groups
+	}
+	return e
+}
+
+// WithReason returns e with err as the reason it failed.
+func (e Event) WithReason(err error) Event {
+	if err != nil {
+		e.Reason = err.Error()
+	}
+	return e
+}
+
+// Sink is where audit events are written.
+type Sink interface {
+	Write(ctx context.Context, e *Event) error
+}
+
+// writerSink writes events to a writer as lines of JSON.
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink returns a Sink which writes each event to w as a line of
+// JSON.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) Write(_ context.Context, e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// The audit log destinations.
+const (
+	DestinationStdout = "stdout"
+	DestinationStderr = "stderr"
+)
+
+// NewSink returns the sink of the named destination.
+func NewSink(destination string) (Sink, error) {
+	switch destination {
+	case DestinationStdout:
+		return NewWriterSink(os.Stdout), nil
+	case DestinationStderr:
+		return NewWriterSink(os.Stderr), nil
+	default:
+		return nil, fmt.Errorf("internal/audit: unknown audit log destination %q", destination)
+	}
+}
+
+// Logger emits audit events to a sink. A nil Logger emits nothing, so
+// that audit logging can be left unconfigured.
+type Logger struct {
+	sink Sink
+	now  func() time.Time
+}
+
+// New returns a Logger which emits events to sink.
+func New(sink Sink) *Logger {
+	return &Logger{sink: sink, now: time.Now}
+}
+
+// NewLogger returns a Logger which emits events to the named destination
+// or, if it's empty, nil, which emits nothing.
+func NewLogger(destination string) (*Logger, error) {
+	if destination == "" {
+		return nil, nil
+	}
+	sink, err := NewSink(destination)
+	if err != nil {
+		return nil, err
+	}
+	return New(sink), nil
+}
+
+// Emit writes e, timestamped now, to the logger's sink. Events which
+// can't be written are logged, rather than failing what they record.
+func (l *Logger) Emit(ctx context.Context, e Event) {
+	if l == nil || l.sink == nil {
+		return
+	}
+	e.Time = l.now().UTC()
+	if err := l.sink.Write(ctx, &e); err != nil {
+		log.Error().Err(err).Str("event", string(e.Type)).Msg("internal/audit: failed to write audit event")
+	}
+}
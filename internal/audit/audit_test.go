@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestLoggerEmit(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	l := New(NewWriterSink(&buf))
+	l.now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	s := &sessions.State{Subject: "user", Email: "user@example.com", IdentityProvider: "contractors", SessionID: "session", Groups: []string{"admins"}}
+	l.Emit(context.Background(), NewEvent(SignIn, Success, s))
+	l.Emit(context.Background(), NewEvent(TokenRefresh, Failure, s).WithReason(errors.New("invalid_grant")))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Emit() wrote %d lines, want 2: %s", len(lines), buf.String())
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"timestamp":  "2020-01-02T03:04:05Z",
+		"event":      "token_refresh",
+		"outcome":    "failure",
+		"subject":    "user",
+		"email":      "user@example.com",
+		"provider":   "contractors",
+		"session_id": "session",
+		"groups":     []interface{}{"admins"},
+		"reason":     "invalid_grant",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Emit() = %s", diff)
+	}
+}
+
+func TestLoggerNil(t *testing.T) {
+	t.Parallel()
+	var l *Logger
+	l.Emit(context.Background(), NewEvent(SignIn, Success, nil))
+}
+
+func TestLoggerSinkError(t *testing.T) {
+	t.Parallel()
+	sink := &MockSink{Error: errors.New("unavailable")}
+	New(sink).Emit(context.Background(), NewEvent(SignIn, Success, nil))
+	if len(sink.Events()) != 0 {
+		t.Errorf("Emit() events = %v, want none", sink.Events())
+	}
+}
+
+func TestNewSink(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		destination string
+		wantErr     bool
+	}{
+		{DestinationStdout, false},
+		{DestinationStderr, false},
+		{"syslog", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		if _, err := NewSink(tt.destination); (err != nil) != tt.wantErr {
+			t.Errorf("NewSink(%q) error = %v, wantErr %v", tt.destination, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package audit
+
+import (
+	"context"
+	"sync"
+)
+
+var _ Sink = &MockSink{}
+
+// MockSink is a mock implementation of Sink, which keeps the events written
+// to it in memory.
+type MockSink struct {
+	Error error
+
+	mu     sync.Mutex
+	events []Event
+}
+
+// Write is a mock implementation of Sink.
+func (ms *MockSink) Write(_ context.Context, e *Event) error {
+	if ms.Error != nil {
+		return ms.Error
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.events = append(ms.events, *e)
+	return nil
+}
+
+// Events returns the events written, in order.
+func (ms *MockSink) Events() []Event {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return append([]Event(nil), ms.events...)
+}
@@ -3,10 +3,12 @@ package ecjson
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
 	"crypto/cipher"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 
@@ -14,16 +16,41 @@ import (
 	"github.com/pomerium/pomerium/internal/encoding"
 )
 
+// DefaultCompressionThreshold is the size of JSON above which it is
+// compressed before being encrypted. Smaller values are rarely made smaller
+// by compressing them.
+const DefaultCompressionThreshold = 512
+
+// The first byte of the plaintext which is encrypted says how the JSON was
+// encoded. Values encoded before the format byte was added are gzipped, and
+// start with gzip's magic number instead.
+const (
+	formatRaw   byte = 0x00
+	formatFlate byte = 0x01
+	gzipMagic   byte = 0x1f
+)
+
 // EncryptedCompressedJSON implements SecureEncoder for JSON using an AEAD cipher.
 //
 // See https://en.wikipedia.org/wiki/Authenticated_encryption
 type EncryptedCompressedJSON struct {
 	aead cipher.AEAD
+	// threshold is the size of JSON above which it is compressed, or
+	// negative if it never is.
+	threshold int
 }
 
 // New takes a base64 encoded secret key and returns a new XChacha20poly1305 cipher.
 func New(aead cipher.AEAD) encoding.MarshalUnmarshaler {
-	return &EncryptedCompressedJSON{aead: aead}
+	return NewWithCompressionThreshold(aead, DefaultCompressionThreshold)
+}
+
+// NewWithCompressionThreshold returns an encoder, as New does, which
+// compresses JSON larger than threshold bytes before encrypting it. A
+// negative threshold disables compression. Values are decoded however they
+// were encoded, whatever the threshold.
+func NewWithCompressionThreshold(aead cipher.AEAD, threshold int) encoding.MarshalUnmarshaler {
+	return &EncryptedCompressedJSON{aead: aead, threshold: threshold}
 }
 
 // Marshal marshals the interface state as JSON, encrypts the JSON using the cipher
@@ -37,17 +64,16 @@ func (c *EncryptedCompressedJSON) Marshal(s interface{}) ([]byte, error) {
 		return nil, err
 	}
 
-	// compress the plaintext bytes
-	compressed, err := compress(plaintext)
+	// compress the plaintext bytes, if they're large enough to be worth it
+	encoded, err := c.encode(plaintext)
 	if err != nil {
 		return nil, err
 	}
 	// encrypt the compressed JSON bytes
-	ciphertext := cryptutil.Encrypt(c.aead, compressed, nil)
+	ciphertext := cryptutil.Encrypt(c.aead, encoded, nil)
 
 	// base64-encode the result
-	encoded := base64.RawURLEncoding.EncodeToString(ciphertext)
-	return []byte(encoded), nil
+	return []byte(base64.RawURLEncoding.EncodeToString(ciphertext)), nil
 }
 
 // Unmarshal takes the marshaled string, base64-decodes into a byte slice, decrypts the
@@ -64,7 +90,7 @@ func (c *EncryptedCompressedJSON) Unmarshal(data []byte, s interface{}) error {
 		return err
 	}
 	// decompress the unencrypted bytes
-	plaintext, err := decompress(compressed)
+	plaintext, err := decode(compressed)
 	if err != nil {
 		return err
 	}
@@ -77,15 +103,45 @@ func (c *EncryptedCompressedJSON) Unmarshal(data []byte, s interface{}) error {
 
 }
 
-// compress gzips a set of bytes
+// encode prefixes plaintext with its format byte, compressing it if it's
+// larger than the threshold and compressing makes it smaller.
+func (c *EncryptedCompressedJSON) encode(plaintext []byte) ([]byte, error) {
+	if c.threshold >= 0 && len(plaintext) > c.threshold {
+		compressed, err := compress(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(plaintext) {
+			return append([]byte{formatFlate}, compressed...), nil
+		}
+	}
+	return append([]byte{formatRaw}, plaintext...), nil
+}
+
+// decode returns the plaintext of data encoded by encode, or gzipped by
+// earlier versions.
+func decode(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("cryptutil: empty plaintext")
+	}
+	switch data[0] {
+	case formatRaw:
+		return data[1:], nil
+	case formatFlate:
+		return decompress(data[1:])
+	case gzipMagic:
+		return gunzip(data)
+	default:
+		return nil, fmt.Errorf("cryptutil: unknown encoding format %#x", data[0])
+	}
+}
+
+// compress deflates a set of bytes
 func compress(data []byte) ([]byte, error) {
 	var buf bytes.Buffer
-	writer, err := gzip.NewWriterLevel(&buf, gzip.DefaultCompression)
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
 	if err != nil {
-		return nil, fmt.Errorf("cryptutil: failed to create a gzip writer: %w", err)
-	}
-	if writer == nil {
-		return nil, fmt.Errorf("cryptutil: failed to create a gzip writer")
+		return nil, fmt.Errorf("cryptutil: failed to create a flate writer: %w", err)
 	}
 	if _, err = writer.Write(data); err != nil {
 		return nil, fmt.Errorf("cryptutil: failed to compress data with err: %w", err)
@@ -96,8 +152,19 @@ func compress(data []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// decompress un-gzips a set of bytes
+// decompress inflates a set of bytes
 func decompress(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, reader); err != nil {
+		return nil, fmt.Errorf("cryptutil: failed to decompress data with err: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// gunzip un-gzips a set of bytes
+func gunzip(data []byte) ([]byte, error) {
 	reader, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
 		return nil, fmt.Errorf("cryptutil: failed to create a gzip reader: %w", err)
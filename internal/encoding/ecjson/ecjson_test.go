@@ -0,0 +1,137 @@
+package ecjson
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pomerium/pomerium/internal/cryptutil"
+)
+
+type testValue struct {
+	Groups []string `json:"groups"`
+}
+
+// valueOfSize returns a value whose JSON is n bytes, n >= len(`{"groups":[""]}`).
+func valueOfSize(n int) testValue {
+	return testValue{Groups: []string{strings.Repeat("a", n-len(`{"groups":[""]}`))}}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	t.Parallel()
+	aead, err := cryptutil.NewAEADCipher(cryptutil.NewKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		threshold  int
+		size       int
+		wantFormat byte
+	}{
+		{"small", 256, 32, formatRaw},
+		{"at threshold", 256, 256, formatRaw},
+		{"above threshold", 256, 257, formatFlate},
+		{"large", DefaultCompressionThreshold, 4096, formatFlate},
+		{"disabled", -1, 4096, formatRaw},
+		{"zero threshold", 0, 257, formatFlate},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewWithCompressionThreshold(aead, tt.threshold)
+			in := valueOfSize(tt.size)
+			if plaintext, _ := json.Marshal(in); len(plaintext) != tt.size {
+				t.Fatalf("test value is %d bytes, want %d", len(plaintext), tt.size)
+			}
+			data, err := c.Marshal(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := format(t, aead, data); got != tt.wantFormat {
+				t.Errorf("Marshal() format = %#x, want %#x", got, tt.wantFormat)
+			}
+			var out testValue
+			if err := c.Unmarshal(data, &out); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(in, out); diff != "" {
+				t.Errorf("Unmarshal() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestMarshalIncompressible(t *testing.T) {
+	t.Parallel()
+	aead, err := cryptutil.NewAEADCipher(cryptutil.NewKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewWithCompressionThreshold(aead, 0)
+	// random bytes don't compress, so are kept as they are
+	data, err := c.Marshal(cryptutil.NewRandomStringN(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := format(t, aead, data); got != formatRaw {
+		t.Errorf("Marshal() format = %#x, want %#x", got, formatRaw)
+	}
+}
+
+func TestUnmarshalGzipped(t *testing.T) {
+	t.Parallel()
+	aead, err := cryptutil.NewAEADCipher(cryptutil.NewKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as encoded before the format byte was added
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(`{"groups":["admins"]}`))
+	w.Close()
+	data := []byte(base64.RawURLEncoding.EncodeToString(cryptutil.Encrypt(aead, buf.Bytes(), nil)))
+
+	var out testValue
+	if err := New(aead).Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(testValue{Groups: []string{"admins"}}, out); diff != "" {
+		t.Errorf("Unmarshal() = %s", diff)
+	}
+}
+
+func TestUnmarshalUnknownFormat(t *testing.T) {
+	t.Parallel()
+	aead, err := cryptutil.NewAEADCipher(cryptutil.NewKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range [][]byte{{0x7f, '{', '}'}, {}} {
+		data := []byte(base64.RawURLEncoding.EncodeToString(cryptutil.Encrypt(aead, plaintext, nil)))
+		var out testValue
+		if err := New(aead).Unmarshal(data, &out); err == nil {
+			t.Errorf("Unmarshal(%q) expected an error", plaintext)
+		}
+	}
+}
+
+// format returns the format byte of encoded data.
+func format(t *testing.T, aead cipher.AEAD, data []byte) byte {
+	t.Helper()
+	ciphertext, err := base64.RawURLEncoding.DecodeString(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := cryptutil.Decrypt(aead, ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plaintext[0]
+}
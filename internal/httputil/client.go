@@ -10,27 +10,163 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"go.opencensus.io/plugin/ochttp"
+
+	"github.com/pomerium/pomerium/internal/log"
 )
 
 // ErrTokenRevoked signifies a token revokation or expiration error
 var ErrTokenRevoked = errors.New("token expired or revoked")
 
+// ErrInsufficientScope signifies that a request was refused because the
+// access token it was made with lacks a required scope.
+var ErrInsufficientScope = errors.New("insufficient scope")
+
+// ErrInvalidToken signifies that a request was refused because its bearer
+// token is invalid, usually because it was revoked.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrRateLimited signifies that a request was refused because the client
+// exceeded the upstream's rate limit. The error is a *RateLimitError.
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimitError is returned, matching ErrRateLimited, when the upstream
+// responds that the client is rate limited.
+type RateLimitError struct {
+	// RetryAfter is how long until requests may be made again, if the
+	// upstream said.
+	RetryAfter time.Duration
+	// Known is true if RetryAfter was given by the upstream.
+	Known bool
+
+	snippet string
+}
+
+// Error implements the `error` interface.
+func (e *RateLimitError) Error() string {
+	msg := ErrRateLimited.Error()
+	if e.Known {
+		msg += fmt.Sprintf(", retry after %s", e.RetryAfter)
+	}
+	if e.snippet != "" {
+		msg += ": " + e.snippet
+	}
+	return msg
+}
+
+// Is reports whether target is ErrRateLimited.
+func (e *RateLimitError) Is(target error) bool { return target == ErrRateLimited }
+
+// ErrResponseTooLarge is returned when a response body exceeds the maximum
+// size a client is willing to read.
+var ErrResponseTooLarge = errors.New("response body too large")
+
+// DefaultMaxResponseBodySize is the largest response body read by Client and
+// its variants unless ClientOptions specifies otherwise.
+const DefaultMaxResponseBodySize = 4 << 20 // 4 MiB
+
+// The defaults for the connection pool of NewPooledTransport. Clients make
+// many requests to few hosts (e.g. an identity provider's API), so far more
+// idle connections are kept per host than http.DefaultTransport's two.
+const (
+	DefaultMaxIdleConnsPerHost = 32
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// maxDrainSize is how much of an unread response body is read, so that its
+// connection can be reused, before giving up and closing the connection.
+const maxDrainSize = 256 << 10 // 256 KiB
+
 // DefaultClient avoids leaks by setting an upper limit for timeouts.
 var DefaultClient = &http.Client{
 	Timeout: 1 * time.Minute,
 	//todo(bdd): incorporate metrics.HTTPMetricsRoundTripper
-	Transport: &ochttp.Transport{},
+	Transport: &RequestIDTransport{Base: &ochttp.Transport{Base: NewPooledTransport()}},
+}
+
+// NewPooledTransport returns a copy of http.DefaultTransport which keeps up
+// to DefaultMaxIdleConnsPerHost idle connections to each host, for up to
+// DefaultIdleConnTimeout, so that concurrent requests to the same host reuse
+// connections rather than each opening their own.
+func NewPooledTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	if transport.MaxIdleConns < DefaultMaxIdleConnsPerHost {
+		transport.MaxIdleConns = DefaultMaxIdleConnsPerHost
+	}
+	transport.IdleConnTimeout = DefaultIdleConnTimeout
+	return transport
+}
+
+// DrainAndClose reads what's left of a response body, up to a limit, and
+// closes it. A body closed before it's read to the end can't return its
+// connection to the pool to be reused. Recent versions of net/http drain
+// small bodies on close themselves, but older ones don't.
+func DrainAndClose(body io.ReadCloser) error {
+	io.Copy(ioutil.Discard, io.LimitReader(body, maxDrainSize))
+	return body.Close()
+}
+
+// RequestIDTransport is an http.RoundTripper which sets the HeaderRequestID
+// header of each request to the id associated with the request's context, as
+// set by log.RequestIDHandler, generating one if there is none. The request is
+// logged with the same id, so that the other service's logs can be correlated
+// with Pomerium's. A header already set on the request is kept.
+//
+// Trace context is propagated by an ochttp.Transport Base.
+type RequestIDTransport struct {
+	// Base is the transport requests are made with. If nil,
+	// http.DefaultTransport is used.
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *RequestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := req.Header.Get(HeaderRequestID)
+	if id == "" {
+		_, id = log.ContextWithID(req.Context())
+		// a RoundTripper must not modify the request it is given
+		req = req.Clone(req.Context())
+		req.Header.Set(HeaderRequestID, id)
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	l := log.Debug().Str("req_id", id).Str("method", req.Method).Str("host", req.URL.Host).Str("path", req.URL.Path)
+	if err != nil {
+		l.Err(err).Msg("httputil: outbound request failed")
+		return nil, err
+	}
+	l.Int("status", resp.StatusCode).Msg("httputil: outbound request")
+	return resp, nil
 }
 
 // Client provides a simple helper interface to make HTTP requests
 func Client(ctx context.Context, method, endpoint, userAgent string, headers map[string]string, params url.Values, response interface{}) error {
-	var body io.Reader
+	_, err := ClientWithHeaders(ctx, method, endpoint, userAgent, headers, params, response)
+	return err
+}
+
+// ClientWithHeaders behaves like Client, but also returns the response's
+// headers which callers can use to follow paginated results.
+func ClientWithHeaders(ctx context.Context, method, endpoint, userAgent string, headers map[string]string, params url.Values, response interface{}) (http.Header, error) {
+	return ClientWithOptions(ctx, nil, method, endpoint, userAgent, headers, params, response)
+}
+
+// ClientWithOptions behaves like ClientWithHeaders, with its behavior
+// customized by opts. A nil opts makes a single attempt.
+func ClientWithOptions(ctx context.Context, opts *ClientOptions, method, endpoint, userAgent string, headers map[string]string, params url.Values, response interface{}) (http.Header, error) {
+	if opts == nil {
+		opts = &ClientOptions{}
+	}
 	switch method {
 	case http.MethodPost:
-		body = bytes.NewBufferString(params.Encode())
 	case http.MethodGet:
 		// error checking skipped because we are just parsing in
 		// order to make a copy of an existing URL
@@ -40,11 +176,41 @@ func Client(ctx context.Context, method, endpoint, userAgent string, headers map
 			endpoint = u.String()
 		}
 	default:
-		return fmt.Errorf(http.StatusText(http.StatusBadRequest))
+		return nil, fmt.Errorf(http.StatusText(http.StatusBadRequest))
+	}
+
+	// retries share the request's id
+	ctx, _ = log.ContextWithID(ctx)
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := doRequest(ctx, opts.httpClient(), opts.maxResponseBodySize(), method, endpoint, userAgent, headers, params, response)
+		opts.observe(start, resp, err)
+		if err == nil {
+			return resp.Header, nil
+		}
+		if attempt >= opts.MaxRetries || !opts.retryable(ctx, method, resp) {
+			return nil, err
+		}
+		t := time.NewTimer(opts.backoff(attempt, resp))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		case <-t.C:
+		}
+	}
+}
+
+// doRequest makes a single request. The returned response, if any, has had
+// its body consumed and closed, returning its connection to the pool.
+func doRequest(ctx context.Context, client *http.Client, maxBodySize int64, method, endpoint, userAgent string, headers map[string]string, params url.Values, response interface{}) (*http.Response, error) {
+	var body io.Reader
+	if method == http.MethodPost {
+		body = bytes.NewBufferString(params.Encode())
 	}
 	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("User-Agent", userAgent)
@@ -52,38 +218,151 @@ func Client(ctx context.Context, method, endpoint, userAgent string, headers map
 		req.Header.Set(k, v)
 	}
 
-	resp, err := DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer DrainAndClose(resp.Body)
 
 	var respBody []byte
-	respBody, err = ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
+	// read one byte beyond the limit to tell a body of exactly maxBodySize
+	// apart from one which was truncated
+	respBody, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
 	if err != nil {
-		return err
+		return resp, err
 	}
+	truncated := int64(len(respBody)) > maxBodySize
 	if resp.StatusCode != http.StatusOK {
-		switch resp.StatusCode {
-		case http.StatusBadRequest:
-			var response struct {
-				Error            string `json:"error"`
-				ErrorDescription string `json:"error_description"`
-			}
-			e := json.Unmarshal(respBody, &response)
-			if e == nil && response.ErrorDescription == "Token expired or revoked" {
-				return ErrTokenRevoked
-			}
-			return fmt.Errorf(http.StatusText(http.StatusBadRequest))
-		default:
-			return fmt.Errorf(http.StatusText(resp.StatusCode))
-		}
+		return resp, statusError(resp, respBody, truncated)
+	}
+	if truncated {
+		return resp, fmt.Errorf("%w: exceeds %d bytes", ErrResponseTooLarge, maxBodySize)
 	}
 	if response != nil {
 		err := json.Unmarshal(respBody, &response)
 		if err != nil {
-			return err
+			return resp, err
+		}
+	}
+	return resp, nil
+}
+
+// statusError returns the error for a non-200 response. A 400 carrying an
+// OAuth "Token expired or revoked" description is reported as
+// ErrTokenRevoked, a 401 carrying an OAuth "invalid_token" error, in its
+// body or WWW-Authenticate header, wraps ErrInvalidToken, a 403 carrying an
+// OAuth "insufficient_scope" error wraps ErrInsufficientScope, and a 429, or
+// a 403 with no requests remaining in the rate limit (as GitHub responds),
+// is a *RateLimitError. Errors include the start of the response body, which
+// is usually where the upstream explains what went wrong. The whole body, as
+// far as it was read, is logged at debug level.
+func statusError(resp *http.Response, body []byte, truncated bool) error {
+	var response struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	oauthErr := json.Unmarshal(body, &response) == nil
+	if oauthErr && resp.StatusCode == http.StatusBadRequest && response.ErrorDescription == "Token expired or revoked" {
+		return ErrTokenRevoked
+	}
+
+	var endpoint string
+	if resp.Request != nil && resp.Request.URL != nil {
+		// the query is left out as it may carry credentials
+		endpoint = resp.Request.URL.Scheme + "://" + resp.Request.URL.Host + resp.Request.URL.Path
+	}
+	log.Debug().
+		Str("endpoint", endpoint).
+		Int("status", resp.StatusCode).
+		Bool("truncated", truncated).
+		Bytes("body", body).
+		Msg("httputil: unexpected response")
+
+	snippet := bodySnippet(body, truncated)
+	if resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0") {
+		d, ok := rateLimitReset(resp.Header)
+		return &RateLimitError{RetryAfter: d, Known: ok, snippet: snippet}
+	}
+	if oauthErr && resp.StatusCode == http.StatusForbidden && response.Error == "insufficient_scope" {
+		return fmt.Errorf("%w: %s", ErrInsufficientScope, snippet)
+	}
+	if resp.StatusCode == http.StatusUnauthorized && ((oauthErr && response.Error == "invalid_token") ||
+		strings.Contains(resp.Header.Get("WWW-Authenticate"), `error="invalid_token"`)) {
+		return fmt.Errorf("%w: %s", ErrInvalidToken, snippet)
+	}
+	if snippet == "" {
+		return errors.New(http.StatusText(resp.StatusCode))
+	}
+	return fmt.Errorf("%s: %s", http.StatusText(resp.StatusCode), snippet)
+}
+
+// maxErrorBodySnippet is the most of a response body included in an error.
+const maxErrorBodySnippet = 512
+
+// bodySnippet returns the start of body on a single line, suitable for
+// including in an error message.
+func bodySnippet(body []byte, truncated bool) string {
+	snippet := strings.Join(strings.Fields(string(body)), " ")
+	if len(snippet) > maxErrorBodySnippet {
+		// don't cut a multi-byte character in half
+		cut := maxErrorBodySnippet
+		for cut > 0 && !utf8.RuneStart(snippet[cut]) {
+			cut--
+		}
+		snippet = snippet[:cut]
+		truncated = true
+	}
+	if truncated && snippet != "" {
+		snippet += "..."
+	}
+	return snippet
+}
+
+// ErrForeignNextPage is returned when a response's next page is on another
+// host than the request, which the request's credentials aren't sent to.
+var ErrForeignNextPage = errors.New("next page is on another host")
+
+// NextPage returns the next page after endpoint, as linked to by its
+// response's Link header, or an empty string if there are no more pages.
+// Relative links are resolved against endpoint. Links to another host are
+// an ErrForeignNextPage, as the next page is requested with the same
+// credentials.
+func NextPage(endpoint string, h http.Header) (string, error) {
+	next := NextPageURL(h)
+	if next == "" {
+		return "", nil
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	u, err := base.Parse(next)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != base.Scheme || u.Host != base.Host {
+		return "", fmt.Errorf("%w: %s", ErrForeignNextPage, u.Host)
+	}
+	return u.String(), nil
+}
+
+// NextPageURL returns the target of the `rel="next"` link found in a
+// response's Link header, or an empty string if there are no more pages.
+//
+// https://tools.ietf.org/html/rfc5988
+func NextPageURL(h http.Header) string {
+	for _, link := range strings.Split(h.Get("Link"), ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.Replace(strings.TrimSpace(param), " ", "", -1)
+			if param == `rel="next"` || param == "rel=next" {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
 		}
 	}
-	return nil
+	return ""
 }
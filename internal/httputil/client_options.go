@@ -0,0 +1,187 @@
+package httputil
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultMinRetryBackoff is the delay before the first retry.
+	DefaultMinRetryBackoff = 250 * time.Millisecond
+	// DefaultMaxRetryBackoff is the upper bound on the delay between retries.
+	DefaultMaxRetryBackoff = 5 * time.Second
+)
+
+// ClientOptions customizes the requests made by ClientWithOptions.
+type ClientOptions struct {
+	// MaxRetries is the number of times a request which failed with a
+	// connection error, or a 429, 502, 503, or 504 response, is retried.
+	// Zero disables retries.
+	MaxRetries int
+	// MinRetryBackoff and MaxRetryBackoff bound the exponential backoff
+	// between retries. A Retry-After header on 429 and 503 responses, or a
+	// rate limit reset header on 429 responses, takes precedence, up to
+	// MaxRetryBackoff; a rate limited request which may only be retried
+	// after MaxRetryBackoff isn't retried.
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+	// RetryNonIdempotent allows POST requests to be retried. It should only
+	// be set when repeating the request has no additional side effects.
+	RetryNonIdempotent bool
+	// MaxResponseBodySize is the largest response body, in bytes, which will
+	// be read. Defaults to DefaultMaxResponseBodySize.
+	MaxResponseBodySize int64
+	// HTTPClient is the client requests are made with. Defaults to
+	// DefaultClient.
+	HTTPClient *http.Client
+	// Observe, if set, is called after every attempt with the response's
+	// status code, or zero if no response was received, how long the attempt
+	// took, and its error.
+	Observe func(status int, duration time.Duration, err error)
+}
+
+func (o *ClientOptions) observe(start time.Time, resp *http.Response, err error) {
+	if o.Observe == nil {
+		return
+	}
+	var status int
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	o.Observe(status, time.Since(start), err)
+}
+
+func (o *ClientOptions) maxResponseBodySize() int64 {
+	if o.MaxResponseBodySize <= 0 {
+		return DefaultMaxResponseBodySize
+	}
+	return o.MaxResponseBodySize
+}
+
+func (o *ClientOptions) httpClient() *http.Client {
+	if o.HTTPClient == nil {
+		return DefaultClient
+	}
+	return o.HTTPClient
+}
+
+// retryable reports whether a failed request should be attempted again.
+func (o *ClientOptions) retryable(ctx context.Context, method string, resp *http.Response) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if method != http.MethodGet && !o.RetryNonIdempotent {
+		return false
+	}
+	if resp == nil {
+		// the request never received a response, e.g. the connection was reset
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		// waiting out a long rate limit would hold up the caller, who is
+		// better placed to back off
+		d, ok := rateLimitReset(resp.Header)
+		return !ok || d <= o.maxBackoff()
+	case http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns how long to wait before retrying the given attempt. Waits
+// the server asks for are honored up to MaxRetryBackoff, so that a server
+// can't hold up the caller for longer.
+func (o *ClientOptions) backoff(attempt int, resp *http.Response) time.Duration {
+	min, max := o.MinRetryBackoff, o.maxBackoff()
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if d, ok := rateLimitReset(resp.Header); ok {
+			return minDuration(d, max)
+		}
+	}
+	if resp != nil && resp.StatusCode == http.StatusServiceUnavailable {
+		if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			return minDuration(d, max)
+		}
+	}
+	if min <= 0 {
+		min = DefaultMinRetryBackoff
+	}
+	d := min << uint(attempt)
+	if d > max || d <= 0 {
+		d = max
+	}
+	// "equal jitter": wait at least half of the backoff
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (o *ClientOptions) maxBackoff() time.Duration {
+	if o.MaxRetryBackoff <= 0 {
+		return DefaultMaxRetryBackoff
+	}
+	return o.MaxRetryBackoff
+}
+
+// rateLimitReset returns how long until a rate limited client may make
+// requests again, from the response's Retry-After header or, failing that,
+// the time its rate limit resets. Reset headers are either a unix time, as
+// GitLab's RateLimit-Reset and GitHub's X-RateLimit-Reset are, or a number
+// of seconds.
+func rateLimitReset(h http.Header) (time.Duration, bool) {
+	if d, ok := retryAfter(h.Get("Retry-After")); ok {
+		return d, true
+	}
+	for _, key := range []string{"RateLimit-Reset", "X-RateLimit-Reset"} {
+		v, err := strconv.ParseInt(h.Get(key), 10, 64)
+		if err != nil || v < 0 {
+			continue
+		}
+		// no rate limit lasts anywhere near this many seconds
+		if v > 1e9 {
+			d := time.Until(time.Unix(v, 0))
+			if d < 0 {
+				d = 0
+			}
+			return d, true
+		}
+		return time.Duration(v) * time.Second, true
+	}
+	return 0, false
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date.
+//
+// https://tools.ietf.org/html/rfc7231#section-7.1.3
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	d := time.Until(t)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
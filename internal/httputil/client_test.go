@@ -0,0 +1,418 @@
+package httputil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/log"
+)
+
+func TestNextPageURL(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+		want string
+	}{
+		{"empty", "", ""},
+		{"next only", `<https://gitlab.example/api/v4/groups?page=2>; rel="next"`, "https://gitlab.example/api/v4/groups?page=2"},
+		{"next among others",
+			`<https://gitlab.example/api/v4/groups?page=1>; rel="prev", <https://gitlab.example/api/v4/groups?page=3>; rel="next", <https://gitlab.example/api/v4/groups?page=1>; rel="first"`,
+			"https://gitlab.example/api/v4/groups?page=3"},
+		{"last page", `<https://gitlab.example/api/v4/groups?page=1>; rel="first", <https://gitlab.example/api/v4/groups?page=5>; rel="last"`, ""},
+		{"unquoted rel", `<https://api.example/next>; rel=next`, "https://api.example/next"},
+		{"malformed", `https://api.example/next`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.link != "" {
+				h.Set("Link", tt.link)
+			}
+			if got := NextPageURL(h); got != tt.want {
+				t.Errorf("NextPageURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextPage(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		link     string
+		want     string
+		wantErr  error
+	}{
+		{"no more pages", "https://api.example/teams", "", "", nil},
+		{"same host", "https://api.example/teams", `<https://api.example/teams?page=2>; rel="next"`, "https://api.example/teams?page=2", nil},
+		{"relative", "https://api.example/teams?page=2", `</teams?page=3>; rel="next"`, "https://api.example/teams?page=3", nil},
+		{"other host", "https://api.example/teams", `<https://evil.example/teams?page=2>; rel="next"`, "", ErrForeignNextPage},
+		{"other port", "https://api.example/teams", `<https://api.example:8443/teams?page=2>; rel="next"`, "", ErrForeignNextPage},
+		{"downgraded scheme", "https://api.example/teams", `<http://api.example/teams?page=2>; rel="next"`, "", ErrForeignNextPage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.link != "" {
+				h.Set("Link", tt.link)
+			}
+			got, err := NextPage(tt.endpoint, h)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NextPage() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("NextPage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientWithOptionsRetry(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name         string
+		method       string
+		opts         *ClientOptions
+		failures     int32
+		status       int
+		retryAfter   string
+		wantErr      bool
+		wantAttempts int32
+	}{
+		{"no options", http.MethodGet, nil, 1, http.StatusServiceUnavailable, "", true, 1},
+		{"recovers", http.MethodGet, &ClientOptions{MaxRetries: 3}, 2, http.StatusBadGateway, "", false, 3},
+		{"gives up", http.MethodGet, &ClientOptions{MaxRetries: 2}, 5, http.StatusServiceUnavailable, "", true, 3},
+		{"retry after", http.MethodGet, &ClientOptions{MaxRetries: 1}, 1, http.StatusTooManyRequests, "0", false, 2},
+		{"long rate limit not retried", http.MethodGet, &ClientOptions{MaxRetries: 3}, 1, http.StatusTooManyRequests, "60", true, 1},
+		{"not retryable", http.MethodGet, &ClientOptions{MaxRetries: 3}, 1, http.StatusUnauthorized, "", true, 1},
+		{"post not retried", http.MethodPost, &ClientOptions{MaxRetries: 3}, 1, http.StatusServiceUnavailable, "", true, 1},
+		{"post retry allowed", http.MethodPost, &ClientOptions{MaxRetries: 3, RetryNonIdempotent: true}, 1, http.StatusServiceUnavailable, "", false, 2},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var attempts int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) <= tt.failures {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Write([]byte(`{}`))
+			}))
+			defer srv.Close()
+			if tt.opts != nil {
+				tt.opts.MinRetryBackoff = time.Millisecond
+				tt.opts.MaxRetryBackoff = time.Millisecond
+			}
+			var resp struct{}
+			_, err := ClientWithOptions(context.Background(), tt.opts, tt.method, srv.URL, "test", nil, nil, &resp)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ClientWithOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt32(&attempts); got != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestClientWithOptionsRetryCanceled(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	opts := &ClientOptions{MaxRetries: 100, MinRetryBackoff: time.Hour, MaxRetryBackoff: time.Hour}
+	start := time.Now()
+	if _, err := ClientWithOptions(ctx, opts, http.MethodGet, srv.URL, "test", nil, nil, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("retry loop did not respect context cancellation")
+	}
+}
+
+func TestClientOptionsBackoff(t *testing.T) {
+	t.Parallel()
+	opts := &ClientOptions{MinRetryBackoff: time.Second, MaxRetryBackoff: 10 * time.Second}
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		want       time.Duration
+	}{
+		{"unavailable", http.StatusServiceUnavailable, "5", 5 * time.Second},
+		{"unavailable for too long", http.StatusServiceUnavailable, "3600", 10 * time.Second},
+		{"rate limited", http.StatusTooManyRequests, "5", 5 * time.Second},
+		{"rate limited for too long", http.StatusTooManyRequests, "3600", 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{"Retry-After": {tt.retryAfter}}}
+			if got := opts.backoff(0, resp); got != tt.want {
+				t.Errorf("backoff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"empty", "", 0, false},
+		{"seconds", "2", 2 * time.Second, true},
+		{"negative", "-1", 0, false},
+		{"past date", "Wed, 21 Oct 2015 07:28:00 GMT", 0, true},
+		{"garbage", "soon", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := retryAfter(tt.value)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("retryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRateLimitReset(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+		wantOK  bool
+	}{
+		{"none", nil, 0, false},
+		{"retry after", map[string]string{"Retry-After": "30", "RateLimit-Reset": "10"}, 30 * time.Second, true},
+		{"gitlab reset time", map[string]string{"RateLimit-Reset": "1445412480"}, 0, true},
+		{"reset seconds", map[string]string{"X-RateLimit-Reset": "10"}, 10 * time.Second, true},
+		{"garbage", map[string]string{"RateLimit-Reset": "soon"}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := make(http.Header)
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			got, ok := rateLimitReset(h)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("rateLimitReset(%v) = %v, %v, want %v, %v", tt.headers, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestClientRateLimited(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		status      int
+		headers     map[string]string
+		wantKnown   bool
+		wantRetry   time.Duration
+		wantLimited bool
+	}{
+		{"429 with retry after", http.StatusTooManyRequests, map[string]string{"Retry-After": "120"}, true, 2 * time.Minute, true},
+		{"429 without reset", http.StatusTooManyRequests, nil, false, 0, true},
+		{"github 403 with no requests remaining", http.StatusForbidden, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "60"}, true, time.Minute, true},
+		{"403 with requests remaining", http.StatusForbidden, map[string]string{"X-RateLimit-Remaining": "10"}, false, 0, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.headers {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"message":"slow down"}`))
+			}))
+			defer srv.Close()
+			_, err := ClientWithOptions(context.Background(), &ClientOptions{MaxRetries: 1, MaxRetryBackoff: time.Millisecond}, http.MethodGet, srv.URL, "test", nil, nil, nil)
+			if got := errors.Is(err, ErrRateLimited); got != tt.wantLimited {
+				t.Fatalf("ClientWithOptions() error = %v, rate limited %v, want %v", err, got, tt.wantLimited)
+			}
+			var rle *RateLimitError
+			if !errors.As(err, &rle) {
+				return
+			}
+			if rle.Known != tt.wantKnown || rle.RetryAfter != tt.wantRetry {
+				t.Errorf("RateLimitError = %v, %v, want %v, %v", rle.RetryAfter, rle.Known, tt.wantRetry, tt.wantKnown)
+			}
+		})
+	}
+}
+
+func TestClientMaxResponseBodySize(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// stream a JSON array larger than the limit without buffering it
+		w.Write([]byte("["))
+		for i := 0; i < 1<<15; i++ {
+			fmt.Fprintf(w, "%d,", i)
+		}
+		w.Write([]byte("0]"))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		opts    *ClientOptions
+		wantErr error
+	}{
+		{"default limit", nil, nil},
+		{"above limit", &ClientOptions{MaxResponseBodySize: 1024}, ErrResponseTooLarge},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var resp []int
+			_, err := ClientWithOptions(context.Background(), tt.opts, http.MethodGet, srv.URL, "test", nil, nil, &resp)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ClientWithOptions() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && len(resp) != 1<<15+1 {
+				t.Errorf("got %d elements", len(resp))
+			}
+		})
+	}
+}
+
+func TestClientReusesConnections(t *testing.T) {
+	t.Parallel()
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte(`["` + strings.Repeat("a", 64<<10) + `"]`))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewPooledTransport()}
+	// responses which are truncated, or are errors, aren't read in full
+	opts := &ClientOptions{HTTPClient: client, MaxResponseBodySize: 1024}
+	for i := 0; i < 10; i++ {
+		for _, path := range []string{"/", "/error"} {
+			if _, err := ClientWithOptions(context.Background(), opts, http.MethodGet, srv.URL+path, "test", nil, nil, nil); err == nil {
+				t.Fatalf("ClientWithOptions(%s) expected an error", path)
+			}
+		}
+	}
+	if got := atomic.LoadInt32(&conns); got != 1 {
+		t.Errorf("opened %d connections, want 1", got)
+	}
+}
+
+func TestClientErrorBody(t *testing.T) {
+	t.Parallel()
+	long := strings.Repeat("x", maxErrorBodySnippet+100)
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		opts    *ClientOptions
+		wantErr string
+	}{
+		{"no body", http.StatusNotFound, "", nil, "Not Found"},
+		{"json body", http.StatusForbidden, `{"message":"403 Forbidden - insufficient scope"}`, nil, `Forbidden: {"message":"403 Forbidden - insufficient scope"}`},
+		{"whitespace collapsed", http.StatusInternalServerError, "upstream\n  failure\n", nil, "Internal Server Error: upstream failure"},
+		{"long body truncated", http.StatusBadGateway, long, nil, "Bad Gateway: " + long[:maxErrorBodySnippet] + "..."},
+		{"multi-byte rune not split", http.StatusBadGateway, "x" + strings.Repeat("é", maxErrorBodySnippet), nil, "Bad Gateway: x" + strings.Repeat("é", maxErrorBodySnippet/2-1) + "..."},
+		{"body above limit", http.StatusBadRequest, `{"error":"invalid_request"}`, &ClientOptions{MaxResponseBodySize: 10}, `Bad Request: {"error":"i...`},
+		{"bad request", http.StatusBadRequest, `{"error":"invalid_grant"}`, nil, `Bad Request: {"error":"invalid_grant"}`},
+		{"token revoked", http.StatusBadRequest, `{"error":"invalid_grant","error_description":"Token expired or revoked"}`, nil, ErrTokenRevoked.Error()},
+		{"insufficient scope", http.StatusForbidden, `{"error":"insufficient_scope","scope":"api"}`, nil, `insufficient scope: {"error":"insufficient_scope","scope":"api"}`},
+		{"invalid token", http.StatusUnauthorized, `{"error":"invalid_token","error_description":"Token was revoked"}`, nil, `invalid token: {"error":"invalid_token","error_description":"Token was revoked"}`},
+		{"unauthorized", http.StatusUnauthorized, `{"message":"401 Unauthorized"}`, nil, `Unauthorized: {"message":"401 Unauthorized"}`},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			_, err := ClientWithOptions(context.Background(), tt.opts, http.MethodGet, srv.URL, "test", nil, nil, nil)
+			if err == nil {
+				t.Fatal("ClientWithOptions() expected error")
+			}
+			if err.Error() != tt.wantErr {
+				t.Errorf("ClientWithOptions() error = %q, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientRequestID(t *testing.T) {
+	t.Parallel()
+	ctxWithID, id := log.ContextWithID(context.Background())
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		headers map[string]string
+		want    string
+	}{
+		{"from context", ctxWithID, nil, id},
+		{"generated", context.Background(), nil, ""},
+		{"caller's header kept", ctxWithID, map[string]string{HeaderRequestID: "upstream"}, "upstream"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var ids []string
+			var mu sync.Mutex
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				ids = append(ids, r.Header.Get(HeaderRequestID))
+				if len(ids) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write([]byte(`{}`))
+			}))
+			defer srv.Close()
+			opts := &ClientOptions{MaxRetries: 1, MinRetryBackoff: time.Millisecond, MaxRetryBackoff: time.Millisecond}
+			if _, err := ClientWithOptions(tt.ctx, opts, http.MethodGet, srv.URL, "test", tt.headers, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != 2 || ids[0] == "" || ids[0] != ids[1] {
+				t.Fatalf("%s = %q, want the same id on each attempt", HeaderRequestID, ids)
+			}
+			if tt.want != "" && ids[0] != tt.want {
+				t.Errorf("%s = %q, want %q", HeaderRequestID, ids[0], tt.want)
+			}
+		})
+	}
+}
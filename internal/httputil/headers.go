@@ -9,6 +9,10 @@ const (
 	HeaderPomeriumResponse = "x-pomerium-intercepted-response"
 	// HeaderPomeriumJWTAssertion is the header key containing JWT signed user details.
 	HeaderPomeriumJWTAssertion = "x-pomerium-jwt-assertion"
+	// HeaderRequestID is set on outbound requests, such as those made to an
+	// identity provider, to the id of the request which caused them so that
+	// they can be correlated with the other system's logs.
+	HeaderRequestID = "X-Request-Id"
 )
 
 // HeadersContentSecurityPolicy are the content security headers added to the service's handlers
@@ -0,0 +1,92 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/httputil"
+	"github.com/pomerium/pomerium/internal/sessions"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+)
+
+// userAttributeFunc retrieves attributes of a user, by name, from outside
+// the identity provider (e.g. an HR system's department and cost center).
+type userAttributeFunc func(context.Context, *sessions.State) (map[string]interface{}, error)
+
+// updateAttributes merges those of the attributes UserAttributeFn returns
+// named by ForwardedClaims into the session's forwarded claims, taking
+// precedence over the identity provider's claims of the same name. Other
+// attributes aren't kept in the session. The lookup is bounded by
+// GroupsRequestTimeout, as group lookups are.
+//
+// If the lookup fails, sign in fails unless AttributesFailOpen is set, in
+// which case the failure is logged and the session keeps any attributes it
+// already had.
+func (p *Provider) updateAttributes(ctx context.Context, s *sessions.State) error {
+	if p.UserAttributeFn == nil {
+		return nil
+	}
+	ctx = p.logContext(ctx, opUserAttributes, s)
+	timeout := durationOrDefault(p.GroupsRequestTimeout, DefaultGroupsRequestTimeout)
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	attributes, err := p.UserAttributeFn(tctx, s)
+	if err != nil {
+		err = fmt.Errorf("internal/identity: could not retrieve attributes %w", err)
+		if !p.AttributesFailOpen {
+			return err
+		}
+		logFrom(ctx).Warn().Err(err).Msg("internal/identity: continuing without the user's attributes")
+		return nil
+	}
+	for _, name := range p.ForwardedClaims {
+		v, ok := attributes[name]
+		if !ok {
+			continue
+		}
+		if s.ForwardedClaims == nil {
+			s.ForwardedClaims = make(map[string]interface{}, len(p.ForwardedClaims))
+		}
+		s.ForwardedClaims[name] = v
+	}
+	return nil
+}
+
+// attributesFromURL retrieves a user's attributes from AttributesURL, which
+// is sent the user's subject and email as the `sub` and `email` query
+// parameters, and AttributesHeaders, and must respond with a JSON object.
+// Requests are retried and recorded as those to the identity provider's API
+// are, though, as the API isn't the provider's, a rejected request doesn't
+// expire the user's session.
+func (p *Provider) attributesFromURL(ctx context.Context, s *sessions.State) (map[string]interface{}, error) {
+	if s == nil {
+		return nil, ErrMissingSession
+	}
+	params := url.Values{"sub": []string{s.Subject}, "email": []string{s.Email}}
+	var status int
+	opts := &httputil.ClientOptions{
+		MaxRetries: apiRetries,
+		Observe: func(code int, d time.Duration, err error) {
+			status = code
+			metrics.RecordIdentityAPIRequest(ctx, p.ProviderName, opUserAttributes, code, d, err)
+		},
+	}
+	var attributes map[string]interface{}
+	if _, err := httputil.ClientWithOptions(ctx, opts, http.MethodGet, p.AttributesURL, p.userAgent(), p.AttributesHeaders, params, &attributes); err != nil {
+		return nil, attributesError(status, err)
+	}
+	return attributes, nil
+}
+
+// attributesError classifies attribute API errors which are likely to pass
+// as ErrProviderUnavailable. Others are returned as they are, rather than as
+// classifyError would, since the user's token isn't what the API rejected.
+func attributesError(status int, err error) error {
+	if status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError {
+		return newProviderError(ErrProviderUnavailable, err)
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestProviderUpdateAttributes(t *testing.T) {
+	t.Parallel()
+	errHR := errors.New("hr system is down")
+	attributes := func(ctx context.Context, s *sessions.State) (map[string]interface{}, error) {
+		return map[string]interface{}{"department": "engineering", "name": "From HR", "salary": 100000}, nil
+	}
+	failing := func(ctx context.Context, s *sessions.State) (map[string]interface{}, error) {
+		return nil, errHR
+	}
+	slow := func(ctx context.Context, s *sessions.State) (map[string]interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	tests := []struct {
+		name     string
+		fn       userAttributeFunc
+		failOpen bool
+		claims   map[string]interface{}
+		want     map[string]interface{}
+		wantErr  error
+	}{
+		{"no attribute source", nil, false, map[string]interface{}{"name": "From IdP"}, map[string]interface{}{"name": "From IdP"}, nil},
+		{"merged into claims", attributes, false, map[string]interface{}{"name": "From IdP", "locale": "en"}, map[string]interface{}{"department": "engineering", "name": "From HR", "locale": "en"}, nil},
+		{"no claims", attributes, false, nil, map[string]interface{}{"department": "engineering", "name": "From HR"}, nil},
+		{"fail closed", failing, false, nil, nil, errHR},
+		{"fail open", failing, true, map[string]interface{}{"department": "sales"}, map[string]interface{}{"department": "sales"}, nil},
+		{"timeout", slow, false, nil, nil, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			p := &Provider{
+				ProviderName:         OIDCProviderName,
+				ForwardedClaims:      []string{"department", "name"},
+				UserAttributeFn:      tt.fn,
+				AttributesFailOpen:   tt.failOpen,
+				GroupsRequestTimeout: 10 * time.Millisecond,
+			}
+			s := &sessions.State{Subject: "user", ForwardedClaims: tt.claims}
+			err := p.updateAttributes(context.Background(), s)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("updateAttributes() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(tt.want, s.ForwardedClaims); diff != "" {
+				t.Errorf("updateAttributes() claims = %s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderAttributesFromURL(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("sub") {
+		case "unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "invalid":
+			w.Write([]byte(`["not", "an", "object"]`))
+		default:
+			if r.URL.Query().Get("email") != "user@example.com" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"department":"engineering","cost_center":4200,"teams":["api","web"]}`))
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name            string
+		subject         string
+		apiKey          string
+		want            map[string]interface{}
+		wantErr         bool
+		wantUnavailable bool
+	}{
+		{"good", "user", "secret", map[string]interface{}{"department": "engineering", "cost_center": float64(4200), "teams": []interface{}{"api", "web"}}, false, false},
+		{"forbidden", "user", "wrong", nil, true, false},
+		{"unavailable", "unavailable", "secret", nil, true, true},
+		{"not an object", "invalid", "secret", nil, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provider{
+				ProviderName:      OIDCProviderName,
+				AttributesURL:     srv.URL + "/attributes",
+				AttributesHeaders: map[string]string{"X-Api-Key": tt.apiKey},
+			}
+			got, err := p.attributesFromURL(context.Background(), &sessions.State{Subject: tt.subject, Email: "user@example.com"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("attributesFromURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrProviderUnavailable) != tt.wantUnavailable {
+				t.Errorf("attributesFromURL() error = %v, want unavailable %v", err, tt.wantUnavailable)
+			}
+			if errors.Is(err, ErrTokenExpired) {
+				t.Errorf("attributesFromURL() error = %v, should not expire the session", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("attributesFromURL() = %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+const (
+	defaultBitbucketProviderURL = "https://bitbucket.org"
+	bitbucketAuthURL            = "/site/oauth2/authorize"
+	bitbucketTokenURL           = "/site/oauth2/access_token"
+
+	bitbucketUserURL       = "https://api.bitbucket.org/2.0/user"
+	bitbucketUserEmailURL  = "https://api.bitbucket.org/2.0/user/emails"
+	bitbucketWorkspacesURL = "https://api.bitbucket.org/2.0/workspaces"
+
+	// bitbucketPageLen is the largest page size the Bitbucket API allows.
+	bitbucketPageLen = 100
+	// bitbucketMaxPages bounds the number of workspace pages that are followed.
+	bitbucketMaxPages = 50
+)
+
+// BitbucketProvider is an implementation of the OAuth Provider for Bitbucket
+// Cloud. Bitbucket does not implement OpenID Connect, so user information is
+// retrieved from the Bitbucket REST API following the OAuth 2.0 code exchange.
+//
+// https://developer.atlassian.com/bitbucket/api/2/reference/meta/authentication
+type BitbucketProvider struct {
+	*Provider
+
+	authURL      string
+	tokenURL     string
+	userEndpoint string
+}
+
+// NewBitbucketProvider returns a new BitbucketProvider.
+func NewBitbucketProvider(p *Provider) (*BitbucketProvider, error) {
+	if p.ProviderURL == "" {
+		p.ProviderURL = defaultBitbucketProviderURL
+	}
+	bp := &BitbucketProvider{
+		authURL:      p.ProviderURL + bitbucketAuthURL,
+		tokenURL:     p.ProviderURL + bitbucketTokenURL,
+		userEndpoint: bitbucketUserURL,
+	}
+
+	p.Scopes = requireScopes(p.Scopes,
+		[]string{"account", "email"},
+		[]string{"account", "email"})
+
+	p.oauth = &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  bp.authURL,
+			TokenURL: bp.tokenURL,
+		},
+		RedirectURL: p.RedirectURL.String(),
+		Scopes:      p.Scopes,
+	}
+	bp.Provider = p
+	bp.UserGroupFn = bp.UserGroups
+	return bp, nil
+}
+
+// Authenticate creates an identity session with bitbucket from a authorization
+// code, and follows up with calls to the user, email, and workspace endpoints.
+func (p *BitbucketProvider) Authenticate(ctx context.Context, code, codeVerifier string) (*sessions.State, error) {
+	token, err := p.oauth.Exchange(p.clientContext(ctx), code, codeVerifierOptions(codeVerifier)...)
+	if err != nil {
+		return nil, fmt.Errorf("identity/bitbucket: token exchange failed %w", err)
+	}
+	s := &sessions.State{
+		AccessToken:   token,
+		AccessTokenID: token.AccessToken,
+	}
+	if err := p.updateSessionState(ctx, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Refresh renews a user's session. Bitbucket access tokens are short lived,
+// so if a refresh token is available the access token is renewed before the
+// user's information is requested again.
+//
+// https://developer.atlassian.com/bitbucket/api/2/reference/meta/authentication#refresh-tokens
+func (p *BitbucketProvider) Refresh(ctx context.Context, s *sessions.State) (*sessions.State, error) {
+	if s.AccessToken == nil {
+		return nil, newProviderError(ErrMissingSession, errors.New("missing oauth2 access token"))
+	}
+	if s.AccessToken.RefreshToken != "" {
+		token, err := p.renewToken(ctx, s.AccessToken.RefreshToken)
+		if err != nil {
+			return nil, fmt.Errorf("identity/bitbucket: refresh failed %w", err)
+		}
+		s.AccessToken = token
+		s.AccessTokenID = token.AccessToken
+	}
+	if err := p.updateSessionState(ctx, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Revoke is not supported as Bitbucket does not offer a token revocation
+// endpoint; access tokens expire on their own after two hours.
+func (p *BitbucketProvider) Revoke(ctx context.Context, token *oauth2.Token) error {
+	return ErrRevokeNotImplemented
+}
+
+// updateSessionState retrieves the user's profile, email, and workspaces from
+// bitbucket and stores them in the session.
+func (p *BitbucketProvider) updateSessionState(ctx context.Context, s *sessions.State) error {
+	if s == nil || s.AccessToken == nil {
+		return ErrMissingSession
+	}
+	if err := p.userInfo(ctx, s); err != nil {
+		return fmt.Errorf("identity/bitbucket: could not retrieve user info %w", err)
+	}
+	if err := p.userEmail(ctx, s); err != nil {
+		return fmt.Errorf("identity/bitbucket: could not retrieve user email %w", err)
+	}
+	// both signing in and refreshing pick up the user's latest workspaces
+	p.groupsCache.invalidate(ctx, s)
+	groups, err := p.UserGroupFn(ctx, s)
+	if err != nil {
+		return p.groupsFailed(ctx, s, fmt.Errorf("identity/bitbucket: could not retrieve groups %w", err))
+	}
+	p.setGroups(ctx, s, groups)
+	return p.updateAttributes(ctx, s)
+}
+
+// UserGroups returns the slugs of the workspaces the user is a member of.
+//
+// https://developer.atlassian.com/bitbucket/api/2/reference/resource/workspaces
+func (p *BitbucketProvider) UserGroups(ctx context.Context, s *sessions.State) ([]string, error) {
+	if s == nil || s.AccessToken == nil {
+		return nil, ErrMissingSession
+	}
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", s.AccessToken.AccessToken)}
+	params := url.Values{
+		"role":    []string{"member"},
+		"pagelen": []string{strconv.Itoa(bitbucketPageLen)},
+	}
+
+	var groups []string
+	endpoint := bitbucketWorkspacesURL
+	for page := 0; endpoint != ""; page++ {
+		if page >= bitbucketMaxPages {
+			logFrom(ctx).Debug().Int("max-pages", bitbucketMaxPages).Msg("identity/bitbucket: workspace page limit reached")
+			break
+		}
+		var response struct {
+			Values []struct {
+				UUID string `json:"uuid"`
+				Slug string `json:"slug"`
+				Name string `json:"name"`
+			} `json:"values"`
+			Next string `json:"next,omitempty"`
+		}
+		_, err := p.apiRequest(ctx, opUserGroups, http.MethodGet, endpoint, headers, params, &response)
+		if err != nil {
+			return nil, err
+		}
+		logFrom(ctx).Debug().Interface("workspaces", response.Values).Msg("identity/bitbucket: workspaces")
+		for _, workspace := range response.Values {
+			groups = append(groups, workspace.Slug)
+		}
+		// next links already include the original query parameters
+		params = nil
+		endpoint = response.Next
+	}
+	return groups, nil
+}
+
+// userEmail sets the primary, confirmed email of the user.
+//
+// https://developer.atlassian.com/bitbucket/api/2/reference/resource/user/emails
+func (p *BitbucketProvider) userEmail(ctx context.Context, s *sessions.State) error {
+	var response struct {
+		Values []struct {
+			Email       string `json:"email"`
+			IsPrimary   bool   `json:"is_primary"`
+			IsConfirmed bool   `json:"is_confirmed"`
+		} `json:"values"`
+	}
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", s.AccessToken.AccessToken)}
+	_, err := p.apiRequest(ctx, opUserEmail, http.MethodGet, bitbucketUserEmailURL, headers, nil, &response)
+	if err != nil {
+		return err
+	}
+	for _, email := range response.Values {
+		if email.IsPrimary && email.IsConfirmed {
+			s.Email = email.Email
+			s.EmailVerified = true
+			return nil
+		}
+	}
+	return nil
+}
+
+// userInfo sets the user's identity from the authenticated user endpoint.
+//
+// https://developer.atlassian.com/bitbucket/api/2/reference/resource/user
+func (p *BitbucketProvider) userInfo(ctx context.Context, s *sessions.State) error {
+	var response struct {
+		UUID        string `json:"uuid"`
+		AccountID   string `json:"account_id"`
+		Username    string `json:"username"`
+		DisplayName string `json:"display_name"`
+		Links       struct {
+			Avatar struct {
+				Href string `json:"href"`
+			} `json:"avatar"`
+		} `json:"links"`
+	}
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", s.AccessToken.AccessToken)}
+	_, err := p.apiRequest(ctx, opUserInfo, http.MethodGet, p.userEndpoint, headers, nil, &response)
+	if err != nil {
+		return err
+	}
+	s.Subject = response.AccountID
+	s.User = response.Username
+	s.Name = response.DisplayName
+	s.Picture = response.Links.Avatar.Href
+	// bitbucket access tokens are valid for two hours, fall back to the same
+	// deadline as github if the token response didn't include an expiry
+	expiry := s.AccessToken.Expiry
+	if expiry.IsZero() {
+		expiry = time.Now().Add(refreshDeadline)
+	}
+	s.Expiry = jwt.NewNumericDate(expiry)
+	return nil
+}
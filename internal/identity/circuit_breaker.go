@@ -0,0 +1,196 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/internal/sessions"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+)
+
+// DefaultGroupsCircuitBreakerThreshold is the default number of consecutive
+// failed group lookups after which the circuit breaker opens.
+const DefaultGroupsCircuitBreakerThreshold = 5
+
+// DefaultGroupsCircuitBreakerCooldown is the default duration the circuit
+// breaker stays open before a group lookup is let through to probe whether
+// the identity provider has recovered.
+const DefaultGroupsCircuitBreakerCooldown = 30 * time.Second
+
+// Policies for group lookups made while the circuit breaker is open.
+const (
+	// GroupsCircuitBreakerDeny fails group lookups with ErrGroupsCircuitOpen.
+	GroupsCircuitBreakerDeny = "deny"
+	// GroupsCircuitBreakerCache returns the groups last retrieved for the
+	// user, even if their cache entry has expired, and fails the lookup only
+	// if there are none.
+	GroupsCircuitBreakerCache = "cache"
+)
+
+// groupsStaleTTL bounds how long a user's last known groups are kept for the
+// cache fallback, or MaxStaleGroups if it's shorter, so a user removed from
+// a group during a long outage doesn't keep it indefinitely.
+const groupsStaleTTL = 24 * time.Hour
+
+type breakerState int64
+
+// Breaker states, as recorded by metrics.RecordGroupsCircuitBreakerState.
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// groupsCircuitBreaker stops calling the identity provider for groups once
+// lookups have failed threshold times in a row, so that an outage fails
+// requests fast rather than each one waiting for its own timeout. After
+// cooldown a single lookup is let through; if it succeeds the breaker closes,
+// otherwise it opens again.
+//
+// Only failures which suggest the provider is unavailable count; errors such
+// as an expired token are specific to a user.
+type groupsCircuitBreaker struct {
+	provider  string
+	threshold int
+	cooldown  time.Duration
+	// fallback, if set, is asked for a user's groups while the breaker is
+	// open.
+	fallback func(context.Context, *sessions.State) ([]string, bool)
+	now      func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	// retryAt is when an open breaker lets a probe through.
+	retryAt time.Time
+	// probing is set while the half-open state's lookup is in flight.
+	probing bool
+}
+
+func newGroupsCircuitBreaker(provider string, threshold int, cooldown time.Duration) *groupsCircuitBreaker {
+	if threshold == 0 {
+		threshold = DefaultGroupsCircuitBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultGroupsCircuitBreakerCooldown
+	}
+	return &groupsCircuitBreaker{
+		provider:  provider,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// wrap returns a UserGroupFn which calls fn unless the breaker is open.
+func (b *groupsCircuitBreaker) wrap(fn userGroupFunc) userGroupFunc {
+	return func(ctx context.Context, s *sessions.State) ([]string, error) {
+		if !b.allow(ctx) {
+			if b.fallback != nil {
+				if groups, ok := b.fallback(ctx, s); ok {
+					return groups, nil
+				}
+			}
+			return nil, newProviderError(ErrProviderUnavailable, ErrGroupsCircuitOpen)
+		}
+		groups, err := fn(ctx, s)
+		b.record(ctx, err)
+		return groups, err
+	}
+}
+
+// allow reports whether a lookup may be made, moving an open breaker whose
+// cooldown has passed to half-open.
+func (b *groupsCircuitBreaker) allow(ctx context.Context) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Before(b.retryAt) {
+			return false
+		}
+		b.setState(ctx, breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the result of a lookup.
+func (b *groupsCircuitBreaker) record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probe := b.probing
+	b.probing = false
+	switch {
+	case ctx.Err() != nil:
+		// the caller gave up, which says nothing about the provider; if this
+		// was the probe, the next lookup probes instead
+	case err == nil || !isUnavailable(err):
+		b.failures = 0
+		if b.state != breakerClosed {
+			log.Info().Str("provider", b.provider).Msg("internal/identity: groups lookups recovered, closing circuit breaker")
+			b.setState(ctx, breakerClosed)
+		}
+	case probe:
+		b.open(ctx, err)
+	case errors.Is(err, ErrRateLimited):
+		// further lookups are bound to be refused too, so there's no
+		// point waiting for the threshold
+		b.open(ctx, err)
+	default:
+		b.failures++
+		if b.state == breakerClosed && b.failures >= b.threshold {
+			b.open(ctx, err)
+		}
+	}
+}
+
+// open suspends lookups for the cooldown or, if the provider is rate
+// limiting them and said for how long, until the rate limit resets.
+func (b *groupsCircuitBreaker) open(ctx context.Context, err error) {
+	cooldown := b.cooldown
+	if d, ok := RetryAfter(err); ok {
+		cooldown = d
+	}
+	log.Warn().Err(err).
+		Str("provider", b.provider).
+		Int("failures", b.failures).
+		Dur("cooldown", cooldown).
+		Msg("internal/identity: groups lookups failing, opening circuit breaker")
+	b.retryAt = b.now().Add(cooldown)
+	b.setState(ctx, breakerOpen)
+}
+
+func (b *groupsCircuitBreaker) setState(ctx context.Context, state breakerState) {
+	b.state = state
+	metrics.RecordGroupsCircuitBreakerState(ctx, b.provider, int64(state))
+}
+
+// isUnavailable reports whether err suggests the identity provider is
+// unavailable, rather than rejecting a particular user's lookup.
+func isUnavailable(err error) bool {
+	return errors.Is(err, ErrProviderUnavailable) || errors.Is(err, ErrGroupsRequestTimeout)
+}
+
+// validateGroupsCircuitBreakerFallback checks that policy is one of the
+// circuit breaker's fallback policies, or empty for the default.
+func validateGroupsCircuitBreakerFallback(policy string) error {
+	switch policy {
+	case "", GroupsCircuitBreakerDeny, GroupsCircuitBreakerCache:
+		return nil
+	default:
+		return fmt.Errorf("internal/identity: unknown groups circuit breaker fallback %q", policy)
+	}
+}
@@ -0,0 +1,165 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pomerium/pomerium/internal/httputil"
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestGroupsCircuitBreaker(t *testing.T) {
+	unavailable := newProviderError(ErrProviderUnavailable, errors.New("503 Service Unavailable"))
+	expired := newProviderError(ErrTokenExpired, errors.New("401 Unauthorized"))
+
+	var calls int
+	var result error
+	fn := func(ctx context.Context, s *sessions.State) ([]string, error) {
+		calls++
+		if result != nil {
+			return nil, result
+		}
+		return []string{"group"}, nil
+	}
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := newGroupsCircuitBreaker("test", 2, time.Minute)
+	b.now = func() time.Time { return now }
+	breaker := b.wrap(fn)
+	ctx := context.Background()
+	s := &sessions.State{Subject: "user"}
+
+	tests := []struct {
+		name      string
+		advance   time.Duration
+		result    error
+		wantErr   error
+		wantCalls int
+		wantState breakerState
+	}{
+		{"ok", 0, nil, nil, 1, breakerClosed},
+		{"first failure", 0, unavailable, ErrProviderUnavailable, 2, breakerClosed},
+		{"user error resets failures", 0, expired, ErrTokenExpired, 3, breakerClosed},
+		{"failure after reset", 0, unavailable, ErrProviderUnavailable, 4, breakerClosed},
+		{"threshold opens", 0, ErrGroupsRequestTimeout, ErrGroupsRequestTimeout, 5, breakerOpen},
+		{"open fails fast", 30 * time.Second, nil, ErrGroupsCircuitOpen, 5, breakerOpen},
+		{"failed probe reopens", 30 * time.Second, unavailable, ErrProviderUnavailable, 6, breakerOpen},
+		{"reopened fails fast", 30 * time.Second, nil, ErrGroupsCircuitOpen, 6, breakerOpen},
+		{"probe closes", 30 * time.Second, nil, nil, 7, breakerClosed},
+		{"closed", 0, nil, nil, 8, breakerClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			result = tt.result
+			_, err := breaker(ctx, s)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("UserGroupFn() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("UserGroupFn() calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if b.state != tt.wantState {
+				t.Errorf("state = %d, want %d", b.state, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestGroupsCircuitBreakerHalfOpen(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := newGroupsCircuitBreaker("test", 1, time.Minute)
+	b.now = func() time.Time { return now }
+	ctx := context.Background()
+	b.record(ctx, ErrGroupsRequestTimeout)
+	now = now.Add(time.Minute)
+
+	// only one lookup probes the provider while half-open
+	if !b.allow(ctx) {
+		t.Fatal("allow() = false, want the probe to be allowed")
+	}
+	if b.allow(ctx) {
+		t.Fatal("allow() = true while the probe is in flight")
+	}
+	// a probe whose caller gave up leaves the breaker half-open
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	b.record(cctx, context.Canceled)
+	if b.state != breakerHalfOpen {
+		t.Fatalf("state = %d, want %d", b.state, breakerHalfOpen)
+	}
+	if !b.allow(ctx) {
+		t.Fatal("allow() = false, want a new probe to be allowed")
+	}
+}
+
+func TestGroupsCircuitBreakerRateLimited(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := newGroupsCircuitBreaker("test", 5, time.Minute)
+	b.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// a rate limited lookup opens the breaker straight away, until the
+	// rate limit resets rather than for the cooldown
+	b.record(ctx, classifyError(http.StatusTooManyRequests, &httputil.RateLimitError{RetryAfter: 2 * time.Minute, Known: true}))
+	if b.state != breakerOpen {
+		t.Fatalf("state = %d, want %d", b.state, breakerOpen)
+	}
+	now = now.Add(time.Minute)
+	if b.allow(ctx) {
+		t.Fatal("allow() = true before the rate limit resets")
+	}
+	now = now.Add(time.Minute)
+	if !b.allow(ctx) {
+		t.Fatal("allow() = false once the rate limit reset")
+	}
+	b.record(ctx, nil)
+
+	// without a reset time, the cooldown applies
+	b.record(ctx, classifyError(http.StatusTooManyRequests, &httputil.RateLimitError{}))
+	now = now.Add(time.Minute)
+	if !b.allow(ctx) {
+		t.Fatal("allow() = false after the cooldown")
+	}
+}
+
+func TestGroupsCircuitBreakerCacheFallback(t *testing.T) {
+	fail := false
+	fn := func(ctx context.Context, s *sessions.State) ([]string, error) {
+		if fail {
+			return nil, ErrGroupsRequestTimeout
+		}
+		return []string{"group1", "group2"}, nil
+	}
+	c := newGroupsCache("test", "client", time.Nanosecond, nil)
+	c.staleTTL = groupsStaleTTL
+	b := newGroupsCircuitBreaker("test", 1, time.Hour)
+	b.fallback = c.stale
+	lookup := c.wrap(b.wrap(fn))
+	ctx := context.Background()
+
+	known := &sessions.State{Subject: "known"}
+	if _, err := lookup(ctx, known); err != nil {
+		t.Fatal(err)
+	}
+	fail = true
+	if _, err := lookup(ctx, &sessions.State{Subject: "other"}); !errors.Is(err, ErrGroupsRequestTimeout) {
+		t.Fatalf("UserGroupFn() error = %v, want %v", err, ErrGroupsRequestTimeout)
+	}
+
+	// the breaker is open, and the known user's cache entry has expired
+	got, err := lookup(ctx, known)
+	if err != nil {
+		t.Fatalf("UserGroupFn() error = %v", err)
+	}
+	if diff := cmp.Diff([]string{"group1", "group2"}, got); diff != "" {
+		t.Errorf("UserGroupFn() = %s", diff)
+	}
+	if _, err := lookup(ctx, &sessions.State{Subject: "unknown"}); !errors.Is(err, ErrGroupsCircuitOpen) {
+		t.Errorf("UserGroupFn() error = %v, want %v", err, ErrGroupsCircuitOpen)
+	}
+}
@@ -0,0 +1,44 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+// claimsSource is a verified id token, or user info response, whose claims
+// can be read.
+type claimsSource interface {
+	Claims(v interface{}) error
+}
+
+// updateClaims copies the provider's ForwardedClaims from sources into the
+// session, later sources taking precedence. Claims none of them have keep
+// the value they had, as refreshed id tokens often carry fewer claims.
+func (p *Provider) updateClaims(s *sessions.State, sources ...claimsSource) error {
+	if len(p.ForwardedClaims) == 0 {
+		return nil
+	}
+	for _, source := range sources {
+		var claims map[string]json.RawMessage
+		if err := source.Claims(&claims); err != nil {
+			return fmt.Errorf("internal/identity: couldn't unmarshal claims: %w", err)
+		}
+		for _, name := range p.ForwardedClaims {
+			raw, ok := claims[name]
+			if !ok {
+				continue
+			}
+			var v interface{}
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return fmt.Errorf("internal/identity: invalid %q claim: %w", name, err)
+			}
+			if s.ForwardedClaims == nil {
+				s.ForwardedClaims = make(map[string]interface{}, len(p.ForwardedClaims))
+			}
+			s.ForwardedClaims[name] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package identity
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestProviderUpdateClaims(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		claims   []string
+		previous map[string]interface{}
+		idToken  map[string]interface{}
+		userInfo map[string]interface{}
+		want     map[string]interface{}
+	}{
+		{"id token", []string{"email", "roles"}, nil,
+			map[string]interface{}{"email": "user@example.com", "roles": []string{"admin", "dev"}, "other": "x"}, nil,
+			map[string]interface{}{"email": "user@example.com", "roles": []interface{}{"admin", "dev"}}},
+		{"user info takes precedence", []string{"email", "department"}, nil,
+			map[string]interface{}{"email": "old@example.com"},
+			map[string]interface{}{"email": "user@example.com", "department": "eng"},
+			map[string]interface{}{"email": "user@example.com", "department": "eng"}},
+		{"missing claims keep their value", []string{"email", "department"}, map[string]interface{}{"department": "eng"},
+			map[string]interface{}{"email": "user@example.com"}, nil,
+			map[string]interface{}{"email": "user@example.com", "department": "eng"}},
+		{"no forwarded claims", nil, nil, map[string]interface{}{"email": "user@example.com"}, nil, nil},
+		{"no matching claims", []string{"department"}, nil, map[string]interface{}{"email": "user@example.com"}, nil, nil},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provider{ForwardedClaims: tt.claims}
+			s := &sessions.State{ForwardedClaims: tt.previous}
+			sources := []claimsSource{newTestIDToken(t, tt.idToken)}
+			if tt.userInfo != nil {
+				sources = append(sources, newTestIDToken(t, tt.userInfo))
+			}
+			if err := p.updateClaims(s, sources...); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, s.ForwardedClaims); diff != "" {
+				t.Errorf("updateClaims() = %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package identity
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"go.opencensus.io/plugin/ochttp"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/httputil"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+	"github.com/pomerium/pomerium/internal/version"
+)
+
+// The defaults bounding each phase of a connection to the identity provider,
+// so that a stalled network or an unresponsive provider is given up on well
+// before a request's overall timeout.
+const (
+	DefaultDialTimeout           = 5 * time.Second
+	DefaultTLSHandshakeTimeout   = 5 * time.Second
+	DefaultResponseHeaderTimeout = 10 * time.Second
+)
+
+// apiRetries is the number of times an idempotent request to an identity
+// provider's API is retried after a transient failure.
+const apiRetries = 2
+
+// The operations identity provider API requests are recorded under.
+const (
+	opUserGroups          = "user_groups"
+	opUserOrgs            = "user_orgs"
+	opUserAttributes      = "user_attributes"
+	opUserInfo            = "user_info"
+	opUserEmail           = "user_email"
+	opRevoke              = "revoke"
+	opTokenRefresh        = "token_refresh"
+	opCodeExchange        = "code_exchange"
+	opClientToken         = "client_credentials"
+	opHealthCheck         = "health_check"
+	opDeviceAuthorization = "device_authorization"
+	opDeviceToken         = "device_token"
+)
+
+// apiRequest makes a request to the identity provider's API, recording its
+// latency and outcome under the given operation. Idempotent requests which
+// fail transiently are retried; POSTs such as token revocation are attempted
+// once.
+func (p *Provider) apiRequest(ctx context.Context, op, method, endpoint string, headers map[string]string, params url.Values, response interface{}) (http.Header, error) {
+	var status int
+	opts := &httputil.ClientOptions{
+		MaxRetries: apiRetries,
+		HTTPClient: p.HTTPClient,
+		Observe: func(code int, d time.Duration, err error) {
+			status = code
+			metrics.RecordIdentityAPIRequest(ctx, p.ProviderName, op, code, d, err)
+		},
+	}
+	h, err := httputil.ClientWithOptions(ctx, opts, method, endpoint, p.userAgent(), headers, params, response)
+	return h, classifyError(status, err)
+}
+
+// userAgent returns the User-Agent requests to the identity provider are
+// made with.
+func (p *Provider) userAgent() string {
+	if p.UserAgent != "" {
+		return p.UserAgent
+	}
+	return version.UserAgent()
+}
+
+// classifyError attaches ErrTokenExpired, ErrInsufficientScope or
+// ErrProviderUnavailable to err based on the response, if any, which caused
+// it. Rate limited requests are also ErrRateLimited, and invalid tokens
+// ErrTokenRevoked. Only an OAuth invalid_token error, or a revoked token, is
+// ErrTokenExpired; other 401s are returned unchanged.
+func classifyError(status int, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, httputil.ErrInvalidToken):
+		return newProviderError(ErrTokenExpired, newProviderError(ErrTokenRevoked, err))
+	case errors.Is(err, httputil.ErrTokenRevoked):
+		return newProviderError(ErrTokenExpired, err)
+	case errors.Is(err, httputil.ErrInsufficientScope):
+		return newProviderError(ErrInsufficientScope, err)
+	case errors.Is(err, httputil.ErrRateLimited):
+		return newProviderError(ErrProviderUnavailable, newProviderError(ErrRateLimited, err))
+	case status == 0, status == http.StatusTooManyRequests, status >= http.StatusInternalServerError:
+		return newProviderError(ErrProviderUnavailable, err)
+	}
+	return err
+}
+
+// refreshToken exchanges a refresh token for a new access token, recording
+// the request's latency and outcome.
+func (p *Provider) refreshToken(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	start := time.Now()
+	t := oauth2.Token{RefreshToken: refreshToken}
+	token, err := p.oauth.TokenSource(p.clientContext(ctx), &t).Token()
+	status := http.StatusOK
+	if err != nil {
+		status = 0
+		var re *oauth2.RetrieveError
+		if errors.As(err, &re) && re.Response != nil {
+			status = re.Response.StatusCode
+		}
+	}
+	metrics.RecordIdentityAPIRequest(ctx, p.ProviderName, opTokenRefresh, status, time.Since(start), err)
+	var re *oauth2.RetrieveError
+	if errors.As(err, &re) && oauthErrorCode(re.Body) == "invalid_grant" {
+		// rfc6749 5.2: an invalid, expired, or revoked refresh token is
+		// reported as an invalid_grant error
+		return nil, newProviderError(ErrTokenExpired, err)
+	}
+	return token, classifyError(status, err)
+}
+
+// oauthErrorCode returns the error code of an OAuth error response, which
+// some providers encode as a form rather than as JSON.
+func oauthErrorCode(body []byte) string {
+	var response struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &response) == nil {
+		return response.Error
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return ""
+	}
+	return values.Get("error")
+}
+
+// clientContext returns a context carrying the provider's HTTP client, which
+// the oauth2 and oidc packages use for the requests they make.
+func (p *Provider) clientContext(ctx context.Context) context.Context {
+	if p.HTTPClient == nil {
+		return ctx
+	}
+	return oidc.ClientContext(ctx, p.HTTPClient)
+}
+
+// newHTTPClient returns the HTTP client requests to the identity provider
+// are made with, including those made by the oauth2 and oidc packages. It
+// trusts the provider's certificate authority in addition to the system's
+// roots, enforces its TLS settings, and connects through its proxy unless
+// the host is excluded by NoProxy. Connecting, the TLS handshake, and
+// waiting for a response's headers are each bounded by the provider's
+// timeouts, and connections are pooled per host, as httputil's are. Requests
+// are tagged with the id of the request which caused them.
+func newHTTPClient(p *Provider) (*http.Client, error) {
+	transport := httputil.NewPooledTransport()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   durationOrDefault(p.DialTimeout, DefaultDialTimeout),
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = durationOrDefault(p.TLSHandshakeTimeout, DefaultTLSHandshakeTimeout)
+	transport.ResponseHeaderTimeout = durationOrDefault(p.ResponseHeaderTimeout, DefaultResponseHeaderTimeout)
+	tlsConfig, err := newTLSConfig(p)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	if p.ProxyURL != "" {
+		proxy, err := newProxyFunc(p.ProxyURL, p.NoProxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = proxy
+	}
+	return &http.Client{
+		Timeout:   httputil.DefaultClient.Timeout,
+		Transport: &httputil.RequestIDTransport{Base: &ochttp.Transport{Base: transport}},
+	}, nil
+}
+
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// newCertPool returns the system's roots, with the given base64 encoded
+// certificate authority, or the one in caFile, appended.
+func newCertPool(ca, caFile string) (*x509.CertPool, error) {
+	var pem []byte
+	var err error
+	if ca != "" {
+		pem, err = base64.StdEncoding.DecodeString(ca)
+		if err != nil {
+			return nil, fmt.Errorf("internal/identity: failed to decode certificate authority: %w", err)
+		}
+	} else {
+		pem, err = ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("internal/identity: certificate authority file %v not readable: %w", caFile, err)
+		}
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if ok := rootCAs.AppendCertsFromPEM(pem); !ok {
+		return nil, errors.New("internal/identity: failed to append certificate authority to pool")
+	}
+	return rootCAs, nil
+}
+
+// newProxyFunc returns a transport proxy function which sends requests
+// through proxyURL, except for hosts matching noProxy. As with the proxy
+// environment variables, requests to localhost are never proxied.
+//
+// Credentials in the proxy url's userinfo are sent to the proxy as basic
+// authentication.
+func newProxyFunc(proxyURL, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		// the url, and any credentials in it, are left out of the error
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return nil, fmt.Errorf("internal/identity: invalid proxy url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("internal/identity: proxy url scheme %q must be http, https, or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("internal/identity: proxy url has no host")
+	}
+	proxy := (&httpproxy.Config{
+		HTTPProxy:  proxyURL,
+		HTTPSProxy: proxyURL,
+		NoProxy:    noProxy,
+	}).ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxy(r.URL)
+	}, nil
+}
@@ -0,0 +1,152 @@
+package identity
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+)
+
+// MachineClient is an OAuth 2.0 client which authenticates with the client
+// credentials grant. Machine clients have no user at the identity provider,
+// so the email and groups their sessions are given, and which policies are
+// matched against, are configured instead.
+type MachineClient struct {
+	ClientID string
+	Email    string
+	Groups   []string
+	// Scopes, if set, are requested along with the client's token.
+	Scopes []string
+}
+
+// ClientCredentialsTokenSource returns a token source which obtains tokens
+// for the given client from the provider's token endpoint with the client
+// credentials grant. Tokens are reused until they expire.
+//
+// https://tools.ietf.org/html/rfc6749#section-4.4
+func (p *Provider) ClientCredentialsTokenSource(ctx context.Context, clientID, clientSecret string, scopes []string) oauth2.TokenSource {
+	cfg := &clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     p.oauth.Endpoint.TokenURL,
+		Scopes:       scopes,
+		AuthStyle:    p.oauth.Endpoint.AuthStyle,
+	}
+	return cfg.TokenSource(p.clientContext(ctx))
+}
+
+// AuthenticateClientCredentials creates a session for a machine client by
+// exchanging its credentials for a token with the client credentials grant.
+// JWT access tokens must be signed by the provider and issued to the
+// client; opaque tokens can't be checked, but were only issued because the
+// provider accepted the client's credentials.
+//
+// Client credentials sessions have no refresh token, so the client must
+// authenticate again once its session expires.
+func (p *Provider) AuthenticateClientCredentials(ctx context.Context, clientID, clientSecret string) (*sessions.State, error) {
+	if len(p.MachineClients) == 0 {
+		return nil, ErrClientCredentialsDisabled
+	}
+	if clientID == "" || clientSecret == "" {
+		return nil, ErrMissingSession
+	}
+	client, ok := p.machineClient(clientID)
+	if !ok {
+		return nil, ErrUnknownMachineClient
+	}
+	token, err := p.clientCredentialsToken(ctx, client, clientSecret)
+	if err != nil {
+		return nil, fmt.Errorf("internal/identity: client credentials grant failed: %w", err)
+	}
+	if err := p.verifyClientAccessToken(ctx, clientID, token.AccessToken); err != nil {
+		return nil, newProviderError(ErrTokenExpired, fmt.Errorf("internal/identity: invalid client access token: %w", err))
+	}
+
+	expiry := token.Expiry
+	if expiry.IsZero() {
+		expiry = time.Now().Add(refreshDeadline)
+	}
+	// the refresh token, if any, isn't kept; the grant is repeated instead
+	token = &oauth2.Token{AccessToken: token.AccessToken, TokenType: token.TokenType, Expiry: expiry}
+	return &sessions.State{
+		Subject:     client.ClientID,
+		Email:       client.Email,
+		Groups:      append([]string(nil), client.Groups...),
+		Expiry:      jwt.NewNumericDate(expiry),
+		AccessToken: token,
+		// the session id ends up in urls, so it mustn't be the token itself
+		AccessTokenID: fmt.Sprintf("%x", sha256.Sum256([]byte(token.AccessToken))),
+	}, nil
+}
+
+func (p *Provider) machineClient(clientID string) (MachineClient, bool) {
+	for _, c := range p.MachineClients {
+		if c.ClientID == clientID {
+			return c, true
+		}
+	}
+	return MachineClient{}, false
+}
+
+// clientCredentialsToken obtains a token for the client, recording the
+// request's latency and outcome.
+func (p *Provider) clientCredentialsToken(ctx context.Context, client MachineClient, clientSecret string) (*oauth2.Token, error) {
+	start := time.Now()
+	token, err := p.ClientCredentialsTokenSource(ctx, client.ClientID, clientSecret, client.Scopes).Token()
+	status := http.StatusOK
+	if err != nil {
+		status = 0
+		var re *oauth2.RetrieveError
+		if errors.As(err, &re) && re.Response != nil {
+			status = re.Response.StatusCode
+		}
+	}
+	metrics.RecordIdentityAPIRequest(ctx, p.ProviderName, opClientToken, status, time.Since(start), err)
+	var re *oauth2.RetrieveError
+	if errors.As(err, &re) && oauthErrorCode(re.Body) == "invalid_client" {
+		// rfc6749 5.2: bad client credentials are reported as an
+		// invalid_client error with a 400 or 401 status
+		return nil, newProviderError(ErrTokenExpired, err)
+	}
+	return token, classifyError(status, err)
+}
+
+// verifyClientAccessToken checks that a JWT access token was issued by the
+// provider to the client, as named by its client_id, azp, cid (Okta), or
+// sub claim. Opaque access tokens are accepted as is.
+func (p *Provider) verifyClientAccessToken(ctx context.Context, clientID, accessToken string) error {
+	if p.accessTokenVerifier == nil || strings.Count(accessToken, ".") != 2 {
+		return nil
+	}
+	idToken, err := p.accessTokenVerifier.Verify(ctx, accessToken)
+	if err != nil {
+		return err
+	}
+	if err := p.checkIssuer(idToken.Issuer); err != nil {
+		return err
+	}
+	var claims struct {
+		ClientID string `json:"client_id"`
+		AZP      string `json:"azp"`
+		CID      string `json:"cid"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return err
+	}
+	for _, id := range []string{claims.ClientID, claims.AZP, claims.CID, idToken.Subject} {
+		if id == clientID {
+			return nil
+		}
+	}
+	return fmt.Errorf("token was not issued to %s", clientID)
+}
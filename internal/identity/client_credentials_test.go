@@ -0,0 +1,113 @@
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+)
+
+func testAccessToken(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	claims["iss"] = "https://idp.example.com"
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`))
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString([]byte("sig"))
+}
+
+func TestProviderAuthenticateClientCredentials(t *testing.T) {
+	t.Parallel()
+	tokens := map[string]string{
+		"opaque":       "opaque-token",
+		"jwt":          testAccessToken(t, map[string]interface{}{"sub": "other", "client_id": "jwt"}),
+		"okta":         testAccessToken(t, map[string]interface{}{"sub": "okta", "cid": "okta"}),
+		"someone-else": testAccessToken(t, map[string]interface{}{"sub": "other", "azp": "other"}),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.FormValue("grant_type"); got != "client_credentials" {
+			t.Errorf("grant_type = %q, want client_credentials", got)
+		}
+		id, secret, _ := r.BasicAuth()
+		switch {
+		case secret == "unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case secret != "secret":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":%q,"token_type":"Bearer","expires_in":300,"scope":%q}`, tokens[id], r.FormValue("scope"))
+	}))
+	defer srv.Close()
+
+	clients := []MachineClient{
+		{ClientID: "opaque", Email: "ci@example.com", Groups: []string{"ci"}, Scopes: []string{"api"}},
+		{ClientID: "jwt", Email: "jwt@example.com"},
+		{ClientID: "okta", Email: "okta@example.com"},
+		{ClientID: "someone-else", Email: "else@example.com"},
+	}
+	tests := []struct {
+		name       string
+		clients    []MachineClient
+		clientID   string
+		secret     string
+		wantEmail  string
+		wantGroups []string
+		wantErr    error
+	}{
+		{"opaque token", clients, "opaque", "secret", "ci@example.com", []string{"ci"}, nil},
+		{"jwt issued to client", clients, "jwt", "secret", "jwt@example.com", nil, nil},
+		{"okta client id claim", clients, "okta", "secret", "okta@example.com", nil, nil},
+		{"jwt issued to another client", clients, "someone-else", "secret", "", nil, ErrTokenExpired},
+		{"bad secret", clients, "opaque", "wrong", "", nil, ErrTokenExpired},
+		{"provider unavailable", clients, "opaque", "unavailable", "", nil, ErrProviderUnavailable},
+		{"unknown client", clients, "unknown", "secret", "", nil, ErrUnknownMachineClient},
+		{"missing secret", clients, "opaque", "", "", nil, ErrMissingSession},
+		{"disabled", nil, "opaque", "secret", "", nil, ErrClientCredentialsDisabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provider{
+				ProviderName:        OIDCProviderName,
+				MachineClients:      tt.clients,
+				oauth:               &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: srv.URL, AuthStyle: oauth2.AuthStyleInHeader}},
+				accessTokenVerifier: oidc.NewVerifier("https://idp.example.com", insecureKeySet{}, &oidc.Config{SkipClientIDCheck: true}),
+			}
+			s, err := p.AuthenticateClientCredentials(context.Background(), tt.clientID, tt.secret)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("AuthenticateClientCredentials() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if s.Subject != tt.clientID || s.Email != tt.wantEmail {
+				t.Errorf("session = %s <%s>, want %s <%s>", s.Subject, s.Email, tt.clientID, tt.wantEmail)
+			}
+			if diff := cmp.Diff(tt.wantGroups, s.Groups); diff != "" {
+				t.Errorf("session groups = %s", diff)
+			}
+			if s.AccessToken.AccessToken != tokens[tt.clientID] || s.AccessTokenID == "" || s.AccessTokenID == s.AccessToken.AccessToken {
+				t.Errorf("session token = %+v, id %q", s.AccessToken, s.AccessTokenID)
+			}
+			if s.Expiry == nil || s.Expiry.Time().After(time.Now().Add(5*time.Minute)) {
+				t.Errorf("session expiry = %v, want the token's", s.Expiry)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// cognitoGroupsClaim is the ID token claim Cognito conveys a user's user
+	// pool groups in.
+	cognitoGroupsClaim = "cognito:groups"
+
+	cognitoLogoutPath = "/logout"
+	cognitoRevokePath = "/oauth2/revoke"
+)
+
+// cognitoIssuer matches the issuer url of a Cognito user pool, which is of
+// the form https://cognito-idp.{region}.amazonaws.com/{user-pool-id}.
+var cognitoIssuer = regexp.MustCompile(`^https://cognito-idp\.[a-z0-9-]+\.amazonaws\.com/[a-z0-9-]+_[A-Za-z0-9]+$`)
+
+// CognitoProvider is an implementation of the OpenID Connect provider for
+// AWS Cognito user pools.
+//
+// https://docs.aws.amazon.com/cognito/latest/developerguide/cognito-userpools-server-contract-reference.html
+type CognitoProvider struct {
+	*Provider
+
+	// Cognito's logout and revocation endpoints are served from the user
+	// pool's domain, and are not advertised in its discovery document.
+	RevokeURL string
+	LogoutURL string
+}
+
+// NewCognitoProvider returns a new CognitoProvider. The provider url is the
+// user pool's issuer url.
+// https://www.pomerium.io/docs/identity-providers/cognito.html
+func NewCognitoProvider(p *Provider) (*CognitoProvider, error) {
+	ctx := p.clientContext(context.Background())
+	if p.ProviderURL == "" {
+		return nil, ErrMissingProviderURL
+	}
+	if !cognitoIssuer.MatchString(p.ProviderURL) {
+		return nil, fmt.Errorf("%w: %q is not a cognito user pool url, expected https://cognito-idp.{region}.amazonaws.com/{user-pool-id}", ErrInvalidProviderURL, p.ProviderURL)
+	}
+	if p.GroupsClaim == "" {
+		p.GroupsClaim = cognitoGroupsClaim
+	}
+
+	var err error
+	p.provider, err = p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// cognito issues refresh tokens without the offline_access scope, which
+	// it does not support
+	p.Scopes = requireScopes(p.Scopes,
+		[]string{oidc.ScopeOpenID, "profile", "email"},
+		[]string{oidc.ScopeOpenID})
+
+	p.verifier, err = p.newVerifier()
+	if err != nil {
+		return nil, err
+	}
+	p.oauth = &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint:     p.provider.Endpoint(),
+		RedirectURL:  p.RedirectURL.String(),
+		Scopes:       p.Scopes,
+	}
+
+	// the user pool's domain is the host of its authorization endpoint
+	domain, err := url.Parse(p.oauth.Endpoint.AuthURL)
+	if err != nil {
+		return nil, fmt.Errorf("identity/cognito: invalid authorization endpoint: %w", err)
+	}
+	domain.RawQuery = ""
+	domain.Path = cognitoRevokePath
+	revokeURL := domain.String()
+	domain.Path = cognitoLogoutPath
+	logoutURL := domain.String()
+
+	return &CognitoProvider{
+		Provider:  p,
+		RevokeURL: revokeURL,
+		LogoutURL: logoutURL,
+	}, nil
+}
+
+// Revoke revokes the user's refresh token, and with it the access tokens
+// issued from it. Cognito cannot revoke an access token on its own.
+//
+// https://docs.aws.amazon.com/cognito/latest/developerguide/revocation-endpoint.html
+func (p *CognitoProvider) Revoke(ctx context.Context, token *oauth2.Token) error {
+	if token == nil || (token.AccessToken == "" && token.RefreshToken == "") {
+		return ErrMissingToken
+	}
+	if token.RefreshToken == "" {
+		logFrom(p.logContext(ctx, opRevoke, nil)).Debug().Msg("identity/cognito: no refresh token, skipping token revocation")
+		return nil
+	}
+	headers := map[string]string{
+		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(p.ClientID+":"+p.ClientSecret)),
+	}
+	params := url.Values{}
+	params.Add("client_id", p.ClientID)
+	params.Add("token", token.RefreshToken)
+	return p.revoke(ctx, p.RevokeURL, headers, params)
+}
+
+// GetSignOutURL returns the url of Cognito's logout endpoint, which signs the
+// user out of the user pool's hosted UI before redirecting them to
+// redirectURL. The redirect url must be one of the app client's sign out urls.
+//
+// https://docs.aws.amazon.com/cognito/latest/developerguide/logout-endpoint.html
+func (p *CognitoProvider) GetSignOutURL(redirectURL string) string {
+	u, _ := url.Parse(p.LogoutURL)
+	q := u.Query()
+	q.Set("client_id", p.ClientID)
+	q.Set("logout_uri", redirectURL)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,93 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+)
+
+func TestNewCognitoProviderURL(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		providerURL string
+		wantErr     error
+	}{
+		{"missing", "", ErrMissingProviderURL},
+		{"hosted ui domain", "https://corp.auth.us-east-1.amazoncognito.com", ErrInvalidProviderURL},
+		{"trailing slash", "https://cognito-idp.us-east-1.amazonaws.com/us-east-1_AbCdEf123/", ErrInvalidProviderURL},
+		{"missing pool id", "https://cognito-idp.us-east-1.amazonaws.com", ErrInvalidProviderURL},
+		{"not https", "http://cognito-idp.us-east-1.amazonaws.com/us-east-1_AbCdEf123", ErrInvalidProviderURL},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := NewCognitoProvider(&Provider{ProviderName: CognitoProviderName, ProviderURL: tt.providerURL})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("NewCognitoProvider() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if !cognitoIssuer.MatchString("https://cognito-idp.us-east-1.amazonaws.com/us-east-1_AbCdEf123") {
+		t.Error("cognitoIssuer should match a user pool issuer url")
+	}
+}
+
+func TestCognitoProviderRevoke(t *testing.T) {
+	t.Parallel()
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if user, pass, ok := r.BasicAuth(); !ok || user != "client" || pass != "secret" {
+			t.Errorf("basic auth = %q:%q, want client:secret", user, pass)
+		}
+		if got := r.FormValue("token"); got != "REFRESH" {
+			t.Errorf("token = %q, want REFRESH", got)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	p := &CognitoProvider{
+		Provider:  &Provider{ProviderName: CognitoProviderName, ClientID: "client", ClientSecret: "secret"},
+		RevokeURL: srv.URL + cognitoRevokePath,
+	}
+	if err := p.Revoke(context.Background(), &oauth2.Token{AccessToken: "ACCESS"}); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 {
+		t.Errorf("Revoke() without a refresh token made %d requests, want 0", requests)
+	}
+	if err := p.Revoke(context.Background(), &oauth2.Token{AccessToken: "ACCESS", RefreshToken: "REFRESH"}); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("Revoke() made %d requests, want 1", requests)
+	}
+}
+
+func TestCognitoProviderGetSignOutURL(t *testing.T) {
+	t.Parallel()
+	p := &CognitoProvider{
+		Provider:  &Provider{ClientID: "client"},
+		LogoutURL: "https://corp.auth.us-east-1.amazoncognito.com/logout",
+	}
+	u, err := url.Parse(p.GetSignOutURL("https://httpbin.corp.example/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := url.Values{"client_id": {"client"}, "logout_uri": {"https://httpbin.corp.example/"}}
+	if diff := cmp.Diff(want, u.Query()); diff != "" {
+		t.Errorf("GetSignOutURL() query = %s", diff)
+	}
+	if u.Host != "corp.auth.us-east-1.amazoncognito.com" || u.Path != cognitoLogoutPath {
+		t.Errorf("GetSignOutURL() = %s", u)
+	}
+}
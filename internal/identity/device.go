@@ -0,0 +1,204 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/httputil"
+	"github.com/pomerium/pomerium/internal/sessions"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+)
+
+// deviceCodeGrantType is the grant type devices poll the token endpoint
+// with.
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// maxDeviceTokenResponseSize bounds how much of a token response is read.
+const maxDeviceTokenResponseSize = 1 << 20
+
+// DeviceAuthorization is the identity provider's response to a device
+// authorization request. The user is shown the UserCode, and asked to enter
+// it at the VerificationURI, while the device polls for their tokens with
+// the DeviceCode.
+//
+// https://tools.ietf.org/html/rfc8628#section-3.2
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	// ExpiresIn and Interval are in seconds.
+	ExpiresIn int `json:"expires_in"`
+	Interval  int `json:"interval,omitempty"`
+}
+
+// AuthorizeDevice starts the device authorization grant for a device which
+// can't open a browser, requesting the provider's scopes. The device should
+// then call AuthenticateDevice with the returned device code.
+//
+// https://tools.ietf.org/html/rfc8628
+func (p *Provider) AuthorizeDevice(ctx context.Context) (*DeviceAuthorization, error) {
+	if !p.AllowDeviceAuthorization {
+		return nil, ErrDeviceAuthorizationDisabled
+	}
+	endpoint, err := p.deviceAuthorizationURL()
+	if err != nil {
+		return nil, err
+	}
+	params := p.deviceClientParams()
+	params.Set("scope", strings.Join(p.Scopes, " "))
+	var response struct {
+		DeviceAuthorization
+		// Google names the verification uri differently
+		VerificationURL string `json:"verification_url"`
+	}
+	if _, err := p.apiRequest(ctx, opDeviceAuthorization, http.MethodPost, endpoint, nil, params, &response); err != nil {
+		return nil, fmt.Errorf("internal/identity: device authorization failed: %w", err)
+	}
+	da := response.DeviceAuthorization
+	if da.VerificationURI == "" {
+		da.VerificationURI = response.VerificationURL
+	}
+	if da.DeviceCode == "" || da.UserCode == "" || da.VerificationURI == "" {
+		return nil, errors.New("internal/identity: incomplete device authorization response")
+	}
+	return &da, nil
+}
+
+// AuthenticateDevice polls the provider's token endpoint, once, with a
+// device code from AuthorizeDevice, and returns the user's session if they
+// have approved the device's sign in. Until they have it fails with
+// ErrAuthorizationPending, or ErrSlowDown if the device is polling too
+// often, and the device polls again after its interval. It fails with
+// ErrAccessDenied if the user denies the sign in, or ErrDeviceCodeExpired if
+// they don't approve it in time.
+//
+// https://tools.ietf.org/html/rfc8628#section-3.4
+func (p *Provider) AuthenticateDevice(ctx context.Context, deviceCode string) (*sessions.State, error) {
+	if !p.AllowDeviceAuthorization {
+		return nil, ErrDeviceAuthorizationDisabled
+	}
+	if deviceCode == "" {
+		return nil, ErrMissingSession
+	}
+	token, err := p.deviceToken(ctx, deviceCode)
+	if err != nil {
+		return nil, fmt.Errorf("internal/identity: device token request failed: %w", err)
+	}
+	return p.sessionFromToken(ctx, token)
+}
+
+// deviceAuthorizationURL returns the provider's device authorization
+// endpoint, from its discovery document.
+func (p *Provider) deviceAuthorizationURL() (string, error) {
+	if p.provider == nil {
+		return "", ErrDeviceAuthorizationNotSupported
+	}
+	var claims struct {
+		DeviceAuthorizationURL string `json:"device_authorization_endpoint"`
+	}
+	if err := p.provider.Claims(&claims); err != nil || claims.DeviceAuthorizationURL == "" {
+		return "", ErrDeviceAuthorizationNotSupported
+	}
+	return claims.DeviceAuthorizationURL, nil
+}
+
+// deviceClientParams returns the parameters the device authorization and
+// token requests authenticate Pomerium's client with.
+func (p *Provider) deviceClientParams() url.Values {
+	params := url.Values{"client_id": []string{p.ClientID}}
+	if p.ClientSecret != "" {
+		params.Set("client_secret", p.ClientSecret)
+	}
+	return params
+}
+
+// deviceToken makes a single poll of the token endpoint with a device code,
+// recording the request's latency and outcome. The token endpoint's
+// authorization_pending, slow_down, expired_token and access_denied errors
+// are returned as ErrAuthorizationPending, ErrSlowDown, ErrDeviceCodeExpired
+// and ErrAccessDenied.
+func (p *Provider) deviceToken(ctx context.Context, deviceCode string) (*oauth2.Token, error) {
+	params := p.deviceClientParams()
+	params.Set("grant_type", deviceCodeGrantType)
+	params.Set("device_code", deviceCode)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.oauth.Endpoint.TokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", p.userAgent())
+	client := p.HTTPClient
+	if client == nil {
+		client = httputil.DefaultClient
+	}
+
+	start := time.Now()
+	token, status, err := deviceTokenResponse(client.Do(req))
+	metrics.RecordIdentityAPIRequest(ctx, p.ProviderName, opDeviceToken, status, time.Since(start), err)
+	return token, err
+}
+
+// deviceTokenResponse reads the token endpoint's response to a device token
+// request.
+func deviceTokenResponse(resp *http.Response, err error) (*oauth2.Token, int, error) {
+	if err != nil {
+		return nil, 0, newProviderError(ErrProviderUnavailable, err)
+	}
+	defer httputil.DrainAndClose(resp.Body)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDeviceTokenResponseSize))
+	if err != nil {
+		return nil, resp.StatusCode, newProviderError(ErrProviderUnavailable, err)
+	}
+	var response struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		RefreshToken     string `json:"refresh_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return nil, resp.StatusCode, newProviderError(ErrProviderUnavailable, errors.New(http.StatusText(resp.StatusCode)))
+		}
+		return nil, resp.StatusCode, fmt.Errorf("invalid token response: %w", err)
+	}
+	switch response.Error {
+	case "":
+	case "authorization_pending":
+		return nil, resp.StatusCode, ErrAuthorizationPending
+	case "slow_down":
+		return nil, resp.StatusCode, ErrSlowDown
+	case "expired_token":
+		return nil, resp.StatusCode, ErrDeviceCodeExpired
+	case "access_denied":
+		return nil, resp.StatusCode, ErrAccessDenied
+	default:
+		return nil, resp.StatusCode, classifyError(resp.StatusCode, fmt.Errorf("%s: %s", response.Error, response.ErrorDescription))
+	}
+	if resp.StatusCode != http.StatusOK || response.AccessToken == "" {
+		return nil, resp.StatusCode, classifyError(resp.StatusCode, fmt.Errorf("unexpected token response: %s", http.StatusText(resp.StatusCode)))
+	}
+	token := &oauth2.Token{
+		AccessToken:  response.AccessToken,
+		TokenType:    response.TokenType,
+		RefreshToken: response.RefreshToken,
+	}
+	if response.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	}
+	return token.WithExtra(map[string]interface{}{"id_token": response.IDToken}), resp.StatusCode, nil
+}
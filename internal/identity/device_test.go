@@ -0,0 +1,168 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+)
+
+func TestProviderAuthorizeDevice(t *testing.T) {
+	t.Parallel()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                        srv.URL,
+				"device_authorization_endpoint": srv.URL + "/device",
+			})
+		case "/device":
+			if r.FormValue("client_id") != "client" || r.FormValue("scope") != "openid email" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			// as Google responds
+			fmt.Fprint(w, `{"device_code":"device","user_code":"WDJB-MJHT","verification_url":"https://idp.example.com/device","expires_in":1800,"interval":5}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	provider, err := oidc.NewProvider(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		allow    bool
+		provider *oidc.Provider
+		want     *DeviceAuthorization
+		wantErr  error
+	}{
+		{"good", true, provider, &DeviceAuthorization{DeviceCode: "device", UserCode: "WDJB-MJHT", VerificationURI: "https://idp.example.com/device", ExpiresIn: 1800, Interval: 5}, nil},
+		{"disabled", false, provider, nil, ErrDeviceAuthorizationDisabled},
+		{"not an oidc provider", true, nil, nil, ErrDeviceAuthorizationNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provider{
+				ProviderName:             OIDCProviderName,
+				ClientID:                 "client",
+				Scopes:                   []string{oidc.ScopeOpenID, "email"},
+				AllowDeviceAuthorization: tt.allow,
+				provider:                 tt.provider,
+			}
+			got, err := p.AuthorizeDevice(context.Background())
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("AuthorizeDevice() error = %v, want %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("AuthorizeDevice() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderAuthenticateDevice(t *testing.T) {
+	t.Parallel()
+	idToken := testAccessToken(t, map[string]interface{}{"sub": "user", "aud": "client", "email": "user@example.com", "email_verified": true})
+	var mu sync.Mutex
+	polls := make(map[string]int)
+	// each device code names the token endpoint's response to it
+	responses := map[string]string{
+		"approved": "",
+		"pending":  "authorization_pending",
+		"slow":     "slow_down",
+		"denied":   "access_denied",
+		"expired":  "expired_token",
+		"invalid":  "invalid_grant",
+	}
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{"issuer": srv.URL})
+			return
+		case "/token":
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.FormValue("grant_type"); got != deviceCodeGrantType {
+			t.Errorf("grant_type = %q, want %q", got, deviceCodeGrantType)
+		}
+		code := r.FormValue("device_code")
+		mu.Lock()
+		response := responses[code]
+		polls[code]++
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if response != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":%q}`, response)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"ACCESS","token_type":"Bearer","refresh_token":"REFRESH","expires_in":3600,"id_token":%q}`, idToken)
+	}))
+	defer srv.Close()
+	provider, err := oidc.NewProvider(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		wantErr  bool
+		wantKind error
+	}{
+		{"approved", "approved", false, nil},
+		{"pending", "pending", true, ErrAuthorizationPending},
+		{"slow down", "slow", true, ErrSlowDown},
+		{"denied", "denied", true, ErrAccessDenied},
+		{"expired", "expired", true, ErrDeviceCodeExpired},
+		{"invalid device code", "invalid", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provider{
+				ProviderName:             OIDCProviderName,
+				ClientID:                 "client",
+				RedirectURL:              &url.URL{Scheme: "https", Host: "authenticate.example.com"},
+				AllowDeviceAuthorization: true,
+				provider:                 provider,
+				verifier:                 oidc.NewVerifier("https://idp.example.com", insecureKeySet{}, &oidc.Config{ClientID: "client"}),
+				oauth:                    &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: srv.URL + "/token"}},
+			}
+			s, err := p.AuthenticateDevice(context.Background(), tt.code)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AuthenticateDevice() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantKind != nil && !errors.Is(err, tt.wantKind) {
+				t.Errorf("AuthenticateDevice() error = %v, want %v", err, tt.wantKind)
+			}
+			if !tt.wantErr && (s.Subject != "user" || s.Email != "user@example.com" || s.AccessToken.RefreshToken != "REFRESH") {
+				t.Errorf("AuthenticateDevice() session = %+v", s)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			// the device polls again itself, rather than being held
+			if polls[tt.code] != 1 {
+				t.Errorf("AuthenticateDevice() polled %d times, want 1", polls[tt.code])
+			}
+		})
+	}
+}
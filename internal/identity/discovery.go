@@ -0,0 +1,67 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+)
+
+// DefaultDiscoveryRetries and DefaultDiscoveryTimeout bound how many times,
+// and for how long, an identity provider's OpenID Connect discovery document
+// is retried when it can't be fetched as the provider is created.
+const (
+	DefaultDiscoveryRetries = 4
+	DefaultDiscoveryTimeout = 30 * time.Second
+)
+
+const (
+	discoveryMinBackoff = time.Second
+	discoveryMaxBackoff = 8 * time.Second
+)
+
+// discover fetches the provider's discovery document, retrying with
+// exponential backoff so that an identity provider which is briefly
+// unavailable, e.g. while it restarts, doesn't fail startup. Retries stop
+// after DiscoveryRetries, or once DiscoveryTimeout has passed, and the last
+// error is returned.
+//
+// go-oidc's errors don't tell transient failures from misconfiguration, so
+// all of them are retried. The context isn't given a deadline, as go-oidc
+// keeps it for requests made after discovery.
+func (p *Provider) discover(ctx context.Context) (*oidc.Provider, error) {
+	retries := p.DiscoveryRetries
+	switch {
+	case retries == 0:
+		retries = DefaultDiscoveryRetries
+	case retries < 0:
+		retries = 0
+	}
+	deadline := time.Now().Add(durationOrDefault(p.DiscoveryTimeout, DefaultDiscoveryTimeout))
+	backoff := p.discoveryBackoff
+	if backoff <= 0 {
+		backoff = discoveryMinBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		provider, err := oidc.NewProvider(ctx, p.ProviderURL)
+		if err == nil {
+			return provider, nil
+		}
+		if attempt >= retries || time.Now().Add(backoff).After(deadline) {
+			return nil, fmt.Errorf("internal/identity: discovery failed after %d attempts: %w", attempt+1, err)
+		}
+		logFrom(ctx).Warn().Err(err).Str("provider_url", p.ProviderURL).Int("attempt", attempt+1).Dur("backoff", backoff).
+			Msg("internal/identity: discovery failed, retrying")
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, fmt.Errorf("internal/identity: discovery failed after %d attempts: %w", attempt+1, err)
+		case <-t.C:
+		}
+		if backoff *= 2; backoff > discoveryMaxBackoff {
+			backoff = discoveryMaxBackoff
+		}
+	}
+}
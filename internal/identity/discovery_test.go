@@ -0,0 +1,66 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProviderDiscover(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name         string
+		failures     int32
+		retries      int
+		timeout      time.Duration
+		wantErr      bool
+		wantAttempts int32
+	}{
+		{"first attempt", 0, 0, 0, false, 1},
+		{"recovers", 2, 3, 0, false, 3},
+		{"default retries", 4, 0, 0, false, 5},
+		{"retries exhausted", 3, 2, 0, true, 3},
+		{"retries disabled", 1, -1, 0, true, 1},
+		{"timeout", 2, 3, time.Nanosecond, true, 1},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var attempts int32
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) <= tt.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"issuer":   srv.URL,
+					"jwks_uri": srv.URL + "/keys",
+				})
+			}))
+			defer srv.Close()
+
+			p := &Provider{
+				ProviderURL:      srv.URL,
+				DiscoveryRetries: tt.retries,
+				DiscoveryTimeout: tt.timeout,
+				discoveryBackoff: time.Millisecond,
+			}
+			provider, err := p.discover(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && provider == nil {
+				t.Error("discover() returned no provider")
+			}
+			if got := atomic.LoadInt32(&attempts); got != tt.wantAttempts {
+				t.Errorf("discover() made %d attempts, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
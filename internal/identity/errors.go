@@ -1,7 +1,152 @@
 package identity
 
-import "errors"
+import (
+	"errors"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/httputil"
+)
 
 // ErrRevokeNotImplemented error type when Revoke method is not implemented
 // by an identity provider
 var ErrRevokeNotImplemented = errors.New("internal/identity: revoke not implemented")
+
+// ErrMissingToken is returned when asked to revoke an empty token.
+var ErrMissingToken = errors.New("internal/identity: token to revoke cannot be empty")
+
+// ErrGroupsRequestTimeout is returned when an identity provider does not
+// return a user's groups within the configured timeout.
+var ErrGroupsRequestTimeout = errors.New("internal/identity: groups request timed out")
+
+// ErrMissingSession is returned when the user session, or the tokens within
+// it, required to make a request to the identity provider are missing.
+var ErrMissingSession = errors.New("internal/identity: user session cannot be empty")
+
+// ErrTokenExpired is returned when the identity provider rejects a user's
+// tokens as expired or revoked. The user must re-authenticate.
+var ErrTokenExpired = errors.New("internal/identity: token expired or revoked")
+
+// ErrTokenRevoked is returned, along with ErrTokenExpired, when the identity
+// provider rejects a user's access token as invalid, typically because it
+// was revoked while the user's session was still in use. The session should
+// be cleared.
+var ErrTokenRevoked = errors.New("internal/identity: token revoked at identity provider")
+
+// ErrInsufficientScope is returned when the identity provider refuses a
+// request because the user's access token lacks a scope it requires. The
+// provider's configured scopes must be fixed, and the user re-authenticate.
+var ErrInsufficientScope = errors.New("internal/identity: access token lacks a required scope")
+
+// ErrACRNotSatisfied is returned when a user signs in with an authentication
+// context class other than the ones the provider requires.
+var ErrACRNotSatisfied = errors.New("internal/identity: requested authentication context class not satisfied")
+
+// ErrProviderUnavailable is returned when the identity provider could not be
+// reached, or failed to handle a request. Retrying later may succeed.
+var ErrProviderUnavailable = errors.New("internal/identity: identity provider unavailable")
+
+// ErrRateLimited is returned, along with ErrProviderUnavailable, when the
+// identity provider refuses a request because its rate limit was exceeded.
+// RetryAfter returns how long the provider asked to wait, if it did.
+var ErrRateLimited = errors.New("internal/identity: rate limited by identity provider")
+
+// ErrGroupsCircuitOpen is returned, along with ErrProviderUnavailable, when a
+// user's groups aren't looked up because recent lookups have failed and the
+// circuit breaker around them is open.
+var ErrGroupsCircuitOpen = errors.New("internal/identity: groups lookups suspended after repeated failures")
+
+// ErrIssuerNotFound is returned when an email domain's OpenID Connect
+// issuer can't be discovered, typically because the domain doesn't support
+// WebFinger.
+var ErrIssuerNotFound = errors.New("internal/identity: issuer not found")
+
+// ErrBackChannelLogoutNotSupported is returned when asked to verify a
+// back-channel logout token for a provider which doesn't issue them.
+var ErrBackChannelLogoutNotSupported = errors.New("internal/identity: back-channel logout not supported")
+
+// ErrTokenValidationNotSupported is returned when asked to validate an id
+// token for a provider which doesn't issue them.
+var ErrTokenValidationNotSupported = errors.New("internal/identity: id token validation not supported")
+
+// ErrAudienceNotAllowed is returned when an id token was issued for neither
+// the provider's client id nor one of its allowed audiences.
+var ErrAudienceNotAllowed = errors.New("internal/identity: id token audience not allowed")
+
+// ErrIssuerNotAllowed is returned when a token was issued by an issuer
+// other than the provider's allowed issuers.
+var ErrIssuerNotAllowed = errors.New("internal/identity: token issuer not allowed")
+
+// ErrInvalidRedirectURL is returned when an identity provider is configured
+// with a redirect url the OAuth 2.0 flow can't work with.
+var ErrInvalidRedirectURL = errors.New("internal/identity: invalid redirect url")
+
+// ErrInvalidProviderURL is returned when an identity provider is configured
+// with a provider url which isn't of the form the provider requires.
+var ErrInvalidProviderURL = errors.New("internal/identity: invalid provider url")
+
+// ErrPersonalAccessTokensDisabled is returned when a client authenticates
+// with a personal access token but personal access tokens are not enabled.
+var ErrPersonalAccessTokensDisabled = errors.New("internal/identity: personal access tokens are disabled")
+
+// ErrClientCredentialsDisabled is returned when a client authenticates with
+// the client credentials grant but no machine clients are configured.
+var ErrClientCredentialsDisabled = errors.New("internal/identity: client credentials grant is disabled")
+
+// ErrUnknownMachineClient is returned when a client authenticates with the
+// client credentials grant but isn't a configured machine client.
+var ErrUnknownMachineClient = errors.New("internal/identity: unknown machine client")
+
+// ErrDeviceAuthorizationDisabled is returned when a client starts the
+// device authorization grant but it is not enabled.
+var ErrDeviceAuthorizationDisabled = errors.New("internal/identity: device authorization grant is disabled")
+
+// ErrDeviceAuthorizationNotSupported is returned when a client starts the
+// device authorization grant with a provider which has no device
+// authorization endpoint.
+var ErrDeviceAuthorizationNotSupported = errors.New("internal/identity: device authorization grant not supported")
+
+// ErrAuthorizationPending and ErrSlowDown are returned while a user has yet
+// to approve a device's sign in. After ErrSlowDown, the device must poll
+// less often.
+var (
+	ErrAuthorizationPending = errors.New("internal/identity: device authorization pending")
+	ErrSlowDown             = errors.New("internal/identity: device polling too often")
+)
+
+// ErrDeviceCodeExpired is returned when a device's sign in wasn't approved
+// before its device code expired. The device must start again.
+var ErrDeviceCodeExpired = errors.New("internal/identity: device code expired")
+
+// ErrAccessDenied is returned when a user denies a device's sign in.
+var ErrAccessDenied = errors.New("internal/identity: device authorization denied")
+
+// RetryAfter returns how long a rate limited identity provider asked to wait
+// before further requests, if err is ErrRateLimited and the provider said.
+func RetryAfter(err error) (time.Duration, bool) {
+	var rle *httputil.RateLimitError
+	if !errors.Is(err, ErrRateLimited) || !errors.As(err, &rle) || !rle.Known {
+		return 0, false
+	}
+	return rle.RetryAfter, true
+}
+
+// providerError attaches one of the errors above to an underlying error,
+// so that callers can use errors.Is to decide how to react while the
+// original cause is kept in the error chain.
+type providerError struct {
+	kind error
+	err  error
+}
+
+func newProviderError(kind, err error) error {
+	return &providerError{kind: kind, err: err}
+}
+
+// Error implements the `error` interface.
+func (e *providerError) Error() string { return e.kind.Error() + ": " + e.err.Error() }
+
+// Is reports whether the error is of the given kind.
+func (e *providerError) Is(target error) bool { return target == e.kind }
+
+// Unwrap implements the `error` Unwrap interface.
+func (e *providerError) Unwrap() error { return e.err }
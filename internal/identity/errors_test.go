@@ -0,0 +1,73 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/httputil"
+)
+
+func TestClassifyError(t *testing.T) {
+	t.Parallel()
+	errAPI := errors.New("api error")
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   error
+	}{
+		{"ok", http.StatusOK, nil, nil},
+		{"revoked", http.StatusBadRequest, httputil.ErrTokenRevoked, ErrTokenExpired},
+		{"unauthorized", http.StatusUnauthorized, errAPI, errAPI},
+		{"invalid token", http.StatusUnauthorized, httputil.ErrInvalidToken, ErrTokenRevoked},
+		{"invalid token expired", http.StatusUnauthorized, httputil.ErrInvalidToken, ErrTokenExpired},
+		{"no response", 0, errAPI, ErrProviderUnavailable},
+		{"rate limited", http.StatusTooManyRequests, errAPI, ErrProviderUnavailable},
+		{"server error", http.StatusBadGateway, errAPI, ErrProviderUnavailable},
+		{"forbidden", http.StatusForbidden, errAPI, errAPI},
+		{"insufficient scope", http.StatusForbidden, httputil.ErrInsufficientScope, ErrInsufficientScope},
+		{"rate limit error", http.StatusTooManyRequests, &httputil.RateLimitError{}, ErrRateLimited},
+		{"rate limit error unavailable", http.StatusTooManyRequests, &httputil.RateLimitError{}, ErrProviderUnavailable},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyError(tt.status, tt.err)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("classifyError() = %v, want %v", got, tt.want)
+			}
+			if tt.want == tt.err && got != tt.err {
+				t.Errorf("classifyError() = %v, want it unchanged", got)
+			}
+			if tt.err != nil && !errors.Is(got, tt.err) {
+				t.Errorf("classifyError() = %v, lost original error %v", got, tt.err)
+			}
+			if wrapped := fmt.Errorf("wrapped: %w", got); got != nil && !errors.Is(wrapped, tt.want) {
+				t.Errorf("wrapped error = %v, want %v", wrapped, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		err    error
+		want   time.Duration
+		wantOK bool
+	}{
+		{"known", classifyError(http.StatusTooManyRequests, &httputil.RateLimitError{RetryAfter: time.Minute, Known: true}), time.Minute, true},
+		{"unknown", classifyError(http.StatusTooManyRequests, &httputil.RateLimitError{}), 0, false},
+		{"not rate limited", classifyError(http.StatusServiceUnavailable, errors.New("api error")), 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := RetryAfter(fmt.Errorf("wrapped: %w", tt.err))
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: RetryAfter() = %v, %v, want %v, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
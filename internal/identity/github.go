@@ -6,12 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pomerium/pomerium/internal/httputil"
-	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/sessions"
-	"github.com/pomerium/pomerium/internal/version"
 
 	"golang.org/x/oauth2"
 	"gopkg.in/square/go-jose.v2/jwt"
@@ -22,9 +23,17 @@ const (
 	githubAuthURL            = "/login/oauth/authorize"
 	githubUserURL            = "https://api.github.com/user"
 	githubUserTeamURL        = "https://api.github.com/user/teams"
+	githubUserOrgURL         = "https://api.github.com/user/orgs"
 	githubRevokeURL          = "https://github.com/oauth/revoke"
 	githubUserEmailURL       = "https://api.github.com/user/emails"
 
+	// githubTeamsPerPage is the largest page size the GitHub API allows.
+	githubTeamsPerPage = 100
+	// githubMaxTeamPages bounds the number of team pages that are followed.
+	githubMaxTeamPages = 50
+	// githubTeamsScope is the OAuth scope required to list a user's teams.
+	githubTeamsScope = "read:org"
+
 	// since github doesn't implement oidc, we need this to refresh the user session
 	refreshDeadline = time.Minute * 60
 )
@@ -33,29 +42,43 @@ const (
 type GitHubProvider struct {
 	*Provider
 
-	authURL      string
-	tokenURL     string
-	userEndpoint string
+	authURL       string
+	tokenURL      string
+	userEndpoint  string
+	teamsEndpoint string
+	orgsEndpoint  string
 
 	RevokeURL string `json:"revocation_endpoint"`
 }
 
 // NewGitHubProvider returns a new GitHubProvider.
+//
+// Teams are identified by their ID unless GroupFormat is
+// GroupFormatFullPath.
 func NewGitHubProvider(p *Provider) (*GitHubProvider, error) {
+	switch p.GroupFormat {
+	case "":
+		p.GroupFormat = GroupFormatID
+	case GroupFormatID, GroupFormatFullPath:
+	default:
+		return nil, fmt.Errorf("identity/github: unknown group format %q", p.GroupFormat)
+	}
 	gp := &GitHubProvider{
-		authURL:      defaultGitHubProviderURL + githubAuthURL,
-		tokenURL:     defaultGitHubProviderURL + "/login/oauth/access_token",
-		userEndpoint: githubUserURL,
-		RevokeURL:    githubRevokeURL,
+		authURL:       defaultGitHubProviderURL + githubAuthURL,
+		tokenURL:      defaultGitHubProviderURL + "/login/oauth/access_token",
+		userEndpoint:  githubUserURL,
+		teamsEndpoint: githubUserTeamURL,
+		orgsEndpoint:  githubUserOrgURL,
+		RevokeURL:     githubRevokeURL,
 	}
 
 	if p.ProviderURL == "" {
 		p.ProviderURL = defaultGitHubProviderURL
 	}
 
-	if len(p.Scopes) == 0 {
-		p.Scopes = []string{"user:email", "read:org"}
-	}
+	p.Scopes = requireScopes(p.Scopes,
+		[]string{"user:email", githubTeamsScope},
+		[]string{"user:email", githubTeamsScope})
 
 	p.oauth = &oauth2.Config{
 		ClientID:     p.ClientID,
@@ -68,14 +91,16 @@ func NewGitHubProvider(p *Provider) (*GitHubProvider, error) {
 		Scopes:      p.Scopes,
 	}
 	gp.Provider = p
+	gp.UserGroupFn = gp.UserGroups
+	gp.UserOrgFn = gp.UserOrgs
 
 	return gp, nil
 }
 
 // Authenticate creates an identity session with github from a authorization code, and follows up
 // call to the user and user group endpoint with the
-func (p *GitHubProvider) Authenticate(ctx context.Context, code string) (*sessions.State, error) {
-	resp, err := p.oauth.Exchange(ctx, code)
+func (p *GitHubProvider) Authenticate(ctx context.Context, code, codeVerifier string) (*sessions.State, error) {
+	resp, err := p.oauth.Exchange(p.clientContext(ctx), code, codeVerifierOptions(codeVerifier)...)
 	if err != nil {
 		return nil, fmt.Errorf("identity/github: token exchange failed %v", err)
 	}
@@ -101,7 +126,7 @@ func (p *GitHubProvider) Authenticate(ctx context.Context, code string) (*sessio
 // https://developer.github.com/v3/users/#get-the-authenticated-user
 func (p *GitHubProvider) updateSessionState(ctx context.Context, s *sessions.State) error {
 	if s == nil || s.AccessToken == nil {
-		return errors.New("identity/github: user session cannot be empty")
+		return ErrMissingSession
 	}
 	accessToken := s.AccessToken.AccessToken
 
@@ -115,18 +140,24 @@ func (p *GitHubProvider) updateSessionState(ctx context.Context, s *sessions.Sta
 		return fmt.Errorf("identity/github: could not retrieve user email %w", err)
 	}
 
-	err = p.userTeams(ctx, accessToken, s)
+	// both signing in and refreshing pick up the user's latest teams
+	p.groupsCache.invalidate(ctx, s)
+	groups, err := p.UserGroupFn(ctx, s)
 	if err != nil {
-		return fmt.Errorf("identity/github: could not retrieve groups %w", err)
+		return p.groupsFailed(ctx, s, fmt.Errorf("identity/github: could not retrieve groups %w", err))
 	}
+	p.setGroups(ctx, s, groups)
 
-	return nil
+	if err := p.updateOrgs(ctx, s); err != nil {
+		return err
+	}
+	return p.updateAttributes(ctx, s)
 }
 
 // Refresh renews a user's session by making a new userInfo request.
 func (p *GitHubProvider) Refresh(ctx context.Context, s *sessions.State) (*sessions.State, error) {
 	if s.AccessToken == nil {
-		return nil, errors.New("identity/github: missing oauth2 access token")
+		return nil, newProviderError(ErrMissingSession, errors.New("missing oauth2 access token"))
 	}
 	if err := p.updateSessionState(ctx, s); err != nil {
 		return nil, err
@@ -134,37 +165,134 @@ func (p *GitHubProvider) Refresh(ctx context.Context, s *sessions.State) (*sessi
 	return s, nil
 }
 
-// userTeams returns a slice of teams the user belongs by making a request
-// to github API
+// UserGroups returns the teams the user belongs to, across all of their
+// organizations, identified by their ID or, if GroupFormat is
+// GroupFormatFullPath, as "org/team-slug" strings.
+//
+// Listing teams requires the read:org scope. As GitHub returns an empty list,
+// rather than an error, for tokens without it, the token's scopes are checked
+// so that a missing scope isn't mistaken for a user with no teams.
 //
 // https://developer.github.com/v3/teams/#list-user-teams
 // https://developer.github.com/v3/auth/
-func (p *GitHubProvider) userTeams(ctx context.Context, at string, s *sessions.State) error {
-
-	var response []struct {
-		ID          json.Number `json:"id"`
-		Name        string      `json:"name,omitempty"`
-		URL         string      `json:"url,omitempty"`
-		Slug        string      `json:"slug"`
-		Description string      `json:"description,omitempty"`
-		ReposURL    string      `json:"repos_url,omitempty"`
-		Privacy     string      `json:"privacy,omitempty"`
+func (p *GitHubProvider) UserGroups(ctx context.Context, s *sessions.State) ([]string, error) {
+	if s == nil || s.AccessToken == nil {
+		return nil, ErrMissingSession
 	}
-
-	headers := map[string]string{"Authorization": fmt.Sprintf("token %s", at)}
-	err := httputil.Client(ctx, http.MethodGet, githubUserTeamURL, version.UserAgent(), headers, nil, &response)
-	if err != nil {
-		return err
+	headers := map[string]string{
+		"Authorization": fmt.Sprintf("token %s", s.AccessToken.AccessToken),
+		"Accept":        "application/vnd.github.v3+json",
 	}
+	params := url.Values{"per_page": []string{strconv.Itoa(githubTeamsPerPage)}}
+
+	var groups []string
+	endpoint := p.teamsEndpoint
+	for page := 0; endpoint != ""; page++ {
+		if page >= githubMaxTeamPages {
+			logFrom(ctx).Warn().Int("max-pages", githubMaxTeamPages).Int("teams", len(groups)).
+				Msg("identity/github: team page limit reached, the user's remaining teams are left out")
+			break
+		}
+		var response []struct {
+			ID           json.Number `json:"id"`
+			Name         string      `json:"name,omitempty"`
+			Slug         string      `json:"slug"`
+			Organization struct {
+				Login string `json:"login"`
+			} `json:"organization"`
+		}
+		h, err := p.apiRequest(ctx, opUserGroups, http.MethodGet, endpoint, headers, params, &response)
+		if err != nil {
+			return nil, err
+		}
+		if page == 0 && !githubHasScope(h, githubTeamsScope) {
+			return nil, fmt.Errorf("identity/github: token is missing the %q scope required to list teams", githubTeamsScope)
+		}
+		logFrom(ctx).Debug().Interface("teams", response).Msg("identity/github: user teams")
+		for _, team := range response {
+			if p.GroupFormat == GroupFormatFullPath {
+				groups = append(groups, team.Organization.Login+"/"+team.Slug)
+			} else {
+				groups = append(groups, team.ID.String())
+			}
+		}
+		// next links already include the original query parameters
+		params = nil
+		if endpoint, err = httputil.NextPage(endpoint, h); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
 
-	log.Debug().Interface("teams", response).Msg("identity/github: user teams")
-
-	s.Groups = nil
-	for _, org := range response {
-		s.Groups = append(s.Groups, org.ID.String())
+// UserOrgs returns the logins of the organizations the user is a member of.
+// Without the read:org scope GitHub only lists the user's public memberships,
+// so, as for teams, tokens lacking it are an error rather than a partial list.
+//
+// https://developer.github.com/v3/orgs/#list-your-organizations
+func (p *GitHubProvider) UserOrgs(ctx context.Context, s *sessions.State) ([]string, error) {
+	if s == nil || s.AccessToken == nil {
+		return nil, ErrMissingSession
+	}
+	headers := map[string]string{
+		"Authorization": fmt.Sprintf("token %s", s.AccessToken.AccessToken),
+		"Accept":        "application/vnd.github.v3+json",
 	}
+	params := url.Values{"per_page": []string{strconv.Itoa(githubTeamsPerPage)}}
+
+	var orgs []string
+	endpoint := p.orgsEndpoint
+	for page := 0; endpoint != ""; page++ {
+		if page >= githubMaxTeamPages {
+			logFrom(ctx).Warn().Int("max-pages", githubMaxTeamPages).Int("orgs", len(orgs)).
+				Msg("identity/github: org page limit reached, the user's remaining organizations are left out")
+			break
+		}
+		var response []struct {
+			Login string `json:"login"`
+		}
+		h, err := p.apiRequest(ctx, opUserOrgs, http.MethodGet, endpoint, headers, params, &response)
+		if err != nil {
+			return nil, err
+		}
+		if page == 0 && !githubHasScope(h, githubTeamsScope) {
+			return nil, fmt.Errorf("identity/github: token is missing the %q scope required to list organizations", githubTeamsScope)
+		}
+		for _, org := range response {
+			orgs = append(orgs, org.Login)
+		}
+		params = nil
+		if endpoint, err = httputil.NextPage(endpoint, h); err != nil {
+			return nil, err
+		}
+	}
+	return orgs, nil
+}
 
-	return nil
+// githubHasScope reports whether the scopes GitHub lists in a response's
+// X-OAuth-Scopes header include scope, or a scope which implies it. If the
+// header is absent, e.g. for GitHub App tokens, the scope is assumed granted.
+//
+// https://developer.github.com/apps/building-oauth-apps/understanding-scopes-for-oauth-apps/
+func githubHasScope(h http.Header, scope string) bool {
+	if _, ok := h["X-Oauth-Scopes"]; !ok {
+		return true
+	}
+	implied := map[string][]string{
+		"read:org": {"read:org", "write:org", "admin:org"},
+	}
+	want, ok := implied[scope]
+	if !ok {
+		want = []string{scope}
+	}
+	for _, granted := range strings.Split(h.Get("X-OAuth-Scopes"), ",") {
+		for _, w := range want {
+			if strings.TrimSpace(granted) == w {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // userEmail returns the primary email of the user by making
@@ -182,12 +310,12 @@ func (p *GitHubProvider) userEmail(ctx context.Context, at string, s *sessions.S
 		Visibility string `json:"visibility"`
 	}
 	headers := map[string]string{"Authorization": fmt.Sprintf("token %s", at)}
-	err := httputil.Client(ctx, http.MethodGet, githubUserEmailURL, version.UserAgent(), headers, nil, &response)
+	_, err := p.apiRequest(ctx, opUserEmail, http.MethodGet, githubUserEmailURL, headers, nil, &response)
 	if err != nil {
 		return err
 	}
 
-	log.Debug().Interface("emails", response).Msg("identity/github: user emails")
+	logFrom(ctx).Debug().Interface("emails", response).Msg("identity/github: user emails")
 	for _, email := range response {
 		if email.Primary && email.Verified {
 			s.Email = email.Email
@@ -211,7 +339,7 @@ func (p *GitHubProvider) userInfo(ctx context.Context, at string, s *sessions.St
 		"Authorization": fmt.Sprintf("token %s", at),
 		"Accept":        "application/vnd.github.v3+json",
 	}
-	err := httputil.Client(ctx, http.MethodGet, p.userEndpoint, version.UserAgent(), headers, nil, &response)
+	_, err := p.apiRequest(ctx, opUserInfo, http.MethodGet, p.userEndpoint, headers, nil, &response)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,194 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestGitHubProviderUserGroups(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		format  string
+		scopes  []string
+		want    []string
+		wantErr bool
+	}{
+		{"read:org", GroupFormatFullPath, []string{"user:email, read:org"}, []string{"pomerium/engineering", "pomerium/platform", "other/admins"}, false},
+		{"implied by admin:org", GroupFormatFullPath, []string{"admin:org"}, []string{"pomerium/engineering", "pomerium/platform", "other/admins"}, false},
+		{"no scopes header", GroupFormatFullPath, nil, []string{"pomerium/engineering", "pomerium/platform", "other/admins"}, false},
+		{"missing read:org", GroupFormatFullPath, []string{"user:email"}, nil, true},
+		{"ids", GroupFormatID, nil, []string{"1", "2", "3"}, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "token ACCESS" {
+					t.Errorf("unexpected authorization header %q", got)
+				}
+				for _, s := range tt.scopes {
+					w.Header().Add("X-OAuth-Scopes", s)
+				}
+				switch r.URL.Query().Get("page") {
+				case "":
+					w.Header().Set("Link", fmt.Sprintf(`<%s/user/teams?per_page=100&page=2>; rel="next"`, srv.URL))
+					fmt.Fprint(w, `[{"id":1,"slug":"engineering","organization":{"login":"pomerium"}},{"id":2,"slug":"platform","organization":{"login":"pomerium"}}]`)
+				case "2":
+					fmt.Fprint(w, `[{"id":3,"slug":"admins","organization":{"login":"other"}}]`)
+				}
+			}))
+			defer srv.Close()
+
+			p := &GitHubProvider{Provider: &Provider{ProviderName: GithubProviderName, GroupFormat: tt.format}, teamsEndpoint: srv.URL + "/user/teams"}
+			got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: "ACCESS"}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UserGroups() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestGitHubProviderUserGroupsPagination(t *testing.T) {
+	t.Parallel()
+	// another host, which must not be sent the user's token
+	foreign := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("next page requested from another host, with authorization %q", r.Header.Get("Authorization"))
+		fmt.Fprint(w, `[]`)
+	}))
+	defer foreign.Close()
+	tests := []struct {
+		name  string
+		pages int
+		// linkTo is the host next links are to: "self" for the server itself,
+		// or none for relative links
+		linkTo  string
+		want    int
+		wantErr bool
+	}{
+		{"several pages", 4, "self", 4, false},
+		{"relative next link", 3, "", 3, false},
+		{"page limit", githubMaxTeamPages + 10, "self", githubMaxTeamPages, false},
+		{"next page on another host", 3, foreign.URL, 0, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				page := 1
+				if p := r.URL.Query().Get("page"); p != "" {
+					page, _ = strconv.Atoi(p)
+				} else if got, want := r.URL.Query().Get("per_page"), "100"; got != want {
+					t.Errorf("per_page = %q, want %q", got, want)
+				}
+				if page < tt.pages {
+					linkTo := tt.linkTo
+					if linkTo == "self" {
+						linkTo = srv.URL
+					}
+					w.Header().Set("Link", fmt.Sprintf(`<%s/user/teams?page=%d>; rel="next"`, linkTo, page+1))
+				}
+				fmt.Fprintf(w, `[{"id":%d,"slug":"team-%d","organization":{"login":"pomerium"}}]`, page, page)
+			}))
+			defer srv.Close()
+
+			p := &GitHubProvider{Provider: &Provider{ProviderName: GithubProviderName, GroupFormat: GroupFormatFullPath}, teamsEndpoint: srv.URL + "/user/teams"}
+			got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: "ACCESS"}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UserGroups() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != tt.want {
+				t.Errorf("UserGroups() = %d teams, want %d", len(got), tt.want)
+			}
+			for i, team := range got {
+				if want := fmt.Sprintf("pomerium/team-%d", i+1); team != want {
+					t.Errorf("UserGroups()[%d] = %q, want %q", i, team, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGitHubProviderUserOrgs(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		scopes  []string
+		want    []string
+		wantErr bool
+	}{
+		{"read:org", []string{"user:email, read:org"}, []string{"pomerium", "other"}, false},
+		{"missing read:org", []string{"user:email"}, nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for _, s := range tt.scopes {
+					w.Header().Add("X-OAuth-Scopes", s)
+				}
+				switch r.URL.Query().Get("page") {
+				case "":
+					w.Header().Set("Link", fmt.Sprintf(`<%s/user/orgs?per_page=100&page=2>; rel="next"`, srv.URL))
+					fmt.Fprint(w, `[{"login":"pomerium","id":1}]`)
+				case "2":
+					fmt.Fprint(w, `[{"login":"other","id":2}]`)
+				}
+			}))
+			defer srv.Close()
+
+			p := &GitHubProvider{Provider: &Provider{ProviderName: GithubProviderName}, orgsEndpoint: srv.URL + "/user/orgs"}
+			got, err := p.UserOrgs(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: "ACCESS"}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UserOrgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserOrgs() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestNewGitHubProviderGroupFormat(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{"", GroupFormatID, false},
+		{GroupFormatID, GroupFormatID, false},
+		{GroupFormatFullPath, GroupFormatFullPath, false},
+		{GroupFormatName, "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.format, func(t *testing.T) {
+			t.Parallel()
+			p, err := NewGitHubProvider(&Provider{GroupFormat: tt.format, RedirectURL: &url.URL{}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewGitHubProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && p.GroupFormat != tt.want {
+				t.Errorf("NewGitHubProvider() group format = %q, want %q", p.GroupFormat, tt.want)
+			}
+		})
+	}
+}
@@ -2,53 +2,152 @@ package identity // import "github.com/pomerium/pomerium/internal/identity"
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	oidc "github.com/coreos/go-oidc"
 	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2/jwt"
 
 	"github.com/pomerium/pomerium/internal/httputil"
 	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/sessions"
-	"github.com/pomerium/pomerium/internal/version"
+	"github.com/pomerium/pomerium/internal/urlutil"
 )
 
 const (
 	defaultGitLabProviderURL = "https://gitlab.com"
-	revokeURL                = "https://gitlab.com/oauth/revoke"
-	defaultGitLabGroupURL    = "https://gitlab.com/api/v4/groups"
+
+	// group and revocation endpoints are relative to the provider url so
+	// that self-hosted instances work as well as gitlab.com
+	gitlabGroupPath   = "/api/v4/groups"
+	gitlabProjectPath = "/api/v4/projects"
+	gitlabUserPath    = "/api/v4/user"
+	gitlabRevokePath  = "/oauth/revoke"
+
+	// gitlabProjectPrefix sets the projects a user is a member of apart from
+	// their groups, which may share a path (e.g. `project:dev/backend`).
+	gitlabProjectPrefix = "project:"
+
+	// gitlabPersonalAccessTokenType is the token type of sessions
+	// authenticated with a personal access token. Such sessions have no
+	// refresh token, and are refreshed by validating the token again.
+	gitlabPersonalAccessTokenType = "personal_access_token"
+
+	// gitlabMaxGroupsPerPage is the largest page size the GitLab API allows,
+	// and the default GroupsPageSize.
+	gitlabMaxGroupsPerPage = 100
+	// gitlabMaxGroupPages bounds the number of group pages that are followed
+	// so that a misbehaving instance can't keep us paginating forever.
+	gitlabMaxGroupPages = 50
 )
 
+// Group formats control which attribute of a GitLab group is used to
+// identify it in a user's session, and therefore in policy.
+const (
+	// GroupFormatID identifies groups by their numeric ID (e.g. `4821`).
+	GroupFormatID = "id"
+	// GroupFormatPath identifies groups by their URL path (e.g. `backend`).
+	GroupFormatPath = "path"
+	// GroupFormatFullPath identifies groups by their full, namespaced
+	// path (e.g. `dev-team/backend`).
+	GroupFormatFullPath = "full_path"
+	// GroupFormatName identifies groups by their display name (e.g.
+	// `Backend`). Names aren't unique, so different groups may share one.
+	GroupFormatName = "name"
+	// GroupFormatIDAndName identifies each group by both its numeric ID and
+	// its display name, so that policies can use either.
+	GroupFormatIDAndName = "id_and_name"
+)
+
+// GitLab group scopes control which of the groups GitLab's groups API can
+// list are a user's groups.
+const (
+	// GitLabGroupScopeAllVisible lists every group the user can see,
+	// including public and internal groups they aren't a member of.
+	GitLabGroupScopeAllVisible = "all_visible"
+	// GitLabGroupScopeMemberOnly lists only the groups the user is a member
+	// of, even for administrators, who can otherwise see every group.
+	GitLabGroupScopeMemberOnly = "member_only"
+)
+
+// gitlabGuestAccessLevel is the lowest access level, which every member of
+// a group has.
+const gitlabGuestAccessLevel = 10
+
+// gitlabAccessLevels are the valid values of a GitLab access level, from
+// guest (10) to owner (50).
+//
+// https://docs.gitlab.com/ee/api/members.html#valid-access-levels
+var gitlabAccessLevels = map[int]bool{10: true, 20: true, 30: true, 40: true, 50: true}
+
 // GitLabProvider is an implementation of the OAuth Provider
 type GitLabProvider struct {
 	*Provider
 	RevokeURL string `json:"revocation_endpoint"`
+
+	groupURL   string
+	graphqlURL string
+	projectURL string
+	userURL    string
 }
 
 // NewGitLabProvider returns a new GitLabProvider.
 // https://www.pomerium.io/docs/identity-providers/gitlab.html
 func NewGitLabProvider(p *Provider) (*GitLabProvider, error) {
-	ctx := context.Background()
+	ctx := p.clientContext(context.Background())
 
 	if p.ProviderURL == "" {
 		p.ProviderURL = defaultGitLabProviderURL
 	}
 
+	switch p.GroupFormat {
+	case "":
+		p.GroupFormat = GroupFormatID
+	case GroupFormatID, GroupFormatPath, GroupFormatFullPath, GroupFormatName, GroupFormatIDAndName:
+	default:
+		return nil, fmt.Errorf("identity/gitlab: unknown group format %q", p.GroupFormat)
+	}
+	if p.MinGroupAccessLevel != 0 && !gitlabAccessLevels[p.MinGroupAccessLevel] {
+		return nil, fmt.Errorf("identity/gitlab: invalid minimum group access level %d", p.MinGroupAccessLevel)
+	}
+	switch p.GitLabGroupScope {
+	case "", GitLabGroupScopeMemberOnly:
+	case GitLabGroupScopeAllVisible:
+		if p.GroupsGraphQL {
+			return nil, fmt.Errorf("identity/gitlab: the graphql groups query only lists memberships, not the %q group scope", GitLabGroupScopeAllVisible)
+		}
+	default:
+		return nil, fmt.Errorf("identity/gitlab: unknown group scope %q", p.GitLabGroupScope)
+	}
+	p.GroupsPageSize = gitlabGroupsPageSize(p.GroupsPageSize)
+	if p.IncludeParentGroups && p.GroupFormat != GroupFormatPath && p.GroupFormat != GroupFormatFullPath {
+		return nil, fmt.Errorf("identity/gitlab: parent groups require the %q or %q group format", GroupFormatPath, GroupFormatFullPath)
+	}
+
 	var err error
-	p.provider, err = oidc.NewProvider(ctx, p.ProviderURL)
+	p.provider, err = p.discover(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(p.Scopes) == 0 {
-		p.Scopes = []string{oidc.ScopeOpenID, "api", "read_user", "profile", "email"}
-	}
+	p.Scopes = requireScopes(p.Scopes,
+		[]string{oidc.ScopeOpenID, "api", "read_user", "profile", "email"},
+		[]string{oidc.ScopeOpenID, "api", "read_user"})
 
-	p.verifier = p.provider.Verifier(&oidc.Config{ClientID: p.ClientID})
+	p.verifier, err = p.newVerifier()
+	if err != nil {
+		return nil, err
+	}
 	p.oauth = &oauth2.Config{
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
@@ -56,65 +155,503 @@ func NewGitLabProvider(p *Provider) (*GitLabProvider, error) {
 		RedirectURL:  p.RedirectURL.String(),
 		Scopes:       p.Scopes,
 	}
+	groupURL, err := gitlabURL(p.ProviderURL, gitlabGroupPath)
+	if err != nil {
+		return nil, err
+	}
+	graphqlURL, err := gitlabURL(p.ProviderURL, gitlabGraphQLPath)
+	if err != nil {
+		return nil, err
+	}
+	projectURL, err := gitlabURL(p.ProviderURL, gitlabProjectPath)
+	if err != nil {
+		return nil, err
+	}
+	userURL, err := gitlabURL(p.ProviderURL, gitlabUserPath)
+	if err != nil {
+		return nil, err
+	}
+	revokeURL, err := gitlabURL(p.ProviderURL, gitlabRevokePath)
+	if err != nil {
+		return nil, err
+	}
 	gp := &GitLabProvider{
-		Provider:  p,
-		RevokeURL: revokeURL,
+		Provider:   p,
+		RevokeURL:  revokeURL,
+		groupURL:   groupURL,
+		graphqlURL: graphqlURL,
+		projectURL: projectURL,
+		userURL:    userURL,
 	}
 
 	if err := p.provider.Claims(&gp); err != nil {
 		return nil, err
 	}
-	gp.UserGroupFn = gp.UserGroups
+	sources := []groupSource{{name: "groups", fn: gp.UserGroups}}
+	if p.IncludeProjects {
+		sources = append(sources, groupSource{name: "projects", fn: gp.UserProjects})
+	}
+	gp.UserGroupFn = mergeGroupSources(p.GroupsBestEffort, sources...)
+	gp.UserOrgFn = gp.UserOrgs
 	return gp, nil
 }
 
-// UserGroups returns a slice of groups for the user.
+// gitlabGroupsPageSize returns the page size groups are listed with,
+// defaulting to, and clamped within, the range the GitLab API allows.
+func gitlabGroupsPageSize(size int) int {
+	switch {
+	case size == 0:
+		return gitlabMaxGroupsPerPage
+	case size < 1, size > gitlabMaxGroupsPerPage:
+		clamped := 1
+		if size > gitlabMaxGroupsPerPage {
+			clamped = gitlabMaxGroupsPerPage
+		}
+		log.Warn().Int("page-size", size).Int("clamped", clamped).
+			Msg("identity/gitlab: groups page size out of range, clamping")
+		return clamped
+	default:
+		return size
+	}
+}
+
+// UserGroups returns a sorted slice of groups for the user, without
+// duplicates. Groups are identified by their ID unless the provider's
+// GroupFormat specifies otherwise; groups which share a name are returned
+// once for name based formats. If the
+// provider's MinGroupAccessLevel is set, only groups where the user has at
+// least that access level are returned.
 //
-// By default, this request returns 20 results at a time because the API results are paginated.
+// The groups API is paginated, so each page is requested with the provider's
+// GroupsPageSize and the response's `next` link is followed until exhausted.
+// If a page after the first fails, the lookup fails unless GroupsBestEffort
+// is set, in which case the groups from earlier pages are returned.
+//
+// Which groups are listed is up to GitLab unless the provider's
+// GitLabGroupScope is set: administrators, for one, can see every group.
+// GitLabGroupScopeMemberOnly restricts them to the user's memberships, and
+// GitLabGroupScopeAllVisible extends them to every group the user can see,
+// which over-reports the user's groups for authorization.
+//
+// If the provider's IncludeParentGroups is set, the ancestors of each group,
+// derived from its full path, are returned too, so that membership of
+// `dev/backend` also matches policies written against `dev`.
+//
+// Listing groups requires a token with the `api` or `read_api` scope; if
+// GitLab refuses the request for lack of one, ErrInsufficientScope is
+// returned rather than the user having no groups.
 // https://docs.gitlab.com/ee/api/groups.html#list-groups
+// https://docs.gitlab.com/ee/api/README.html#pagination
 func (p *GitLabProvider) UserGroups(ctx context.Context, s *sessions.State) ([]string, error) {
 	if s == nil || s.AccessToken == nil {
-		return nil, errors.New("identity/gitlab: user session cannot be empty")
-	}
-
-	var response []struct {
-		ID                             json.Number `json:"id"`
-		Name                           string      `json:"name,omitempty"`
-		Path                           string      `json:"path,omitempty"`
-		Description                    string      `json:"description,omitempty"`
-		Visibility                     string      `json:"visibility,omitempty"`
-		ShareWithGroupLock             bool        `json:"share_with_group_lock,omitempty"`
-		RequireTwoFactorAuthentication bool        `json:"require_two_factor_authentication,omitempty"`
-		SubgroupCreationLevel          string      `json:"subgroup_creation_level,omitempty"`
-		FullName                       string      `json:"full_name,omitempty"`
-		FullPath                       string      `json:"full_path,omitempty"`
-	}
-	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", s.AccessToken.AccessToken)}
-	err := httputil.Client(ctx, http.MethodGet, defaultGitLabGroupURL, version.UserAgent(), headers, nil, &response)
+		return nil, ErrMissingSession
+	}
+	return p.TokenGroups(ctx, s.AccessToken)
+}
+
+// TokenGroups returns the groups of the user an access token belongs to, as
+// UserGroups does, for tokens which aren't part of a session yet.
+func (p *GitLabProvider) TokenGroups(ctx context.Context, token *oauth2.Token) ([]string, error) {
+	response, err := p.listGroups(ctx, token, opUserGroups)
 	if err != nil {
 		return nil, err
 	}
 
 	var groups []string
-	log.Debug().Interface("response", response).Msg("identity/gitlab: groups")
+	seen := make(map[string]bool)
+	// groups by name, to warn about names shared by more than one group
+	names := make(map[string][]string)
+	for _, group := range response {
+		ids := group.identifiers(p.GroupFormat)
+		if p.IncludeParentGroups {
+			ids = append(ids, group.parents(p.GroupFormat)...)
+		}
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				groups = append(groups, id)
+			}
+		}
+		names[group.Name] = append(names[group.Name], group.ID.String())
+	}
 
+	if p.GroupFormat == GroupFormatName || p.GroupFormat == GroupFormatIDAndName {
+		for name, ids := range names {
+			if len(ids) > 1 {
+				logFrom(ctx).Warn().
+					Str("name", name).
+					Strs("ids", ids).
+					Msg("identity/gitlab: groups share a name, policies using it match all of them")
+			}
+		}
+	}
+
+	// a user can be listed in a group more than once, e.g. when it is shared
+	// with another of their groups, and pages aren't ordered, so groups are
+	// sorted to keep sessions, caches and logs stable
+	sort.Strings(groups)
+
+	// record what was retrieved, so that policies written against the wrong
+	// group format can be told apart from users without groups
+	logFrom(ctx).Debug().
+		Int("count", len(groups)).
+		Strs("groups", firstGroups(groups)).
+		Str("format", p.GroupFormat).
+		Msg("identity/gitlab: retrieved groups")
+	return groups, nil
+}
+
+// UserOrgs returns a sorted slice of the user's organizations: the paths of
+// the top-level groups of the groups they are a member of, so that a member
+// of only `dev/backend` belongs to the `dev` organization. The groups are
+// listed as they are for UserGroups, including MinGroupAccessLevel.
+func (p *GitLabProvider) UserOrgs(ctx context.Context, s *sessions.State) ([]string, error) {
+	if s == nil || s.AccessToken == nil {
+		return nil, ErrMissingSession
+	}
+	response, err := p.listGroups(ctx, s.AccessToken, opUserOrgs)
+	if err != nil {
+		return nil, err
+	}
+	var orgs []string
+	seen := make(map[string]bool)
 	for _, group := range response {
-		groups = append(groups, group.ID.String())
+		org := strings.SplitN(group.FullPath, "/", 2)[0]
+		if org != "" && !seen[org] {
+			seen[org] = true
+			orgs = append(orgs, org)
+		}
+	}
+	sort.Strings(orgs)
+	return orgs, nil
+}
+
+// listGroups returns the groups the token's user is a member of, each
+// listed once, following the groups API's pagination. If the provider's
+// GroupsGraphQL is set, the GraphQL API is queried instead, falling back to
+// the groups API if the query fails.
+func (p *GitLabProvider) listGroups(ctx context.Context, token *oauth2.Token, op string) ([]gitlabGroup, error) {
+	if token == nil || token.AccessToken == "" {
+		return nil, ErrMissingToken
+	}
+	if p.GroupsGraphQL {
+		groups, err := p.listGroupsGraphQL(ctx, token, op)
+		if err == nil {
+			return groups, nil
+		}
+		// the groups api would refuse the token too
+		if errors.Is(err, ErrTokenExpired) {
+			return nil, err
+		}
+		logFrom(ctx).Warn().Err(err).Msg("identity/gitlab: graphql groups query failed, falling back to the groups api")
 	}
 
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", token.AccessToken)}
+	params := url.Values{"per_page": []string{strconv.Itoa(p.GroupsPageSize)}}
+	if p.MinGroupAccessLevel != 0 {
+		params.Set("min_access_level", strconv.Itoa(p.MinGroupAccessLevel))
+	}
+	switch p.GitLabGroupScope {
+	case GitLabGroupScopeAllVisible:
+		params.Set("all_available", "true")
+	case GitLabGroupScopeMemberOnly:
+		// groups are only listed with an access level if the user is a
+		// member of them
+		params.Set("all_available", "false")
+		if p.MinGroupAccessLevel == 0 {
+			params.Set("min_access_level", strconv.Itoa(gitlabGuestAccessLevel))
+		}
+	}
+
+	var groups []gitlabGroup
+	listed := make(map[string]bool)
+	endpoint := p.groupURL
+	for page := 0; endpoint != ""; page++ {
+		if page >= gitlabMaxGroupPages {
+			logFrom(ctx).Debug().Int("max-pages", gitlabMaxGroupPages).Msg("identity/gitlab: group page limit reached")
+			break
+		}
+		var response []gitlabGroup
+		h, err := p.apiRequest(ctx, op, http.MethodGet, endpoint, headers, params, &response)
+		if err != nil && page > 0 && p.GroupsBestEffort {
+			logFrom(ctx).Warn().Err(err).Int("page", page+1).Int("groups", len(groups)).
+				Msg("identity/gitlab: groups page failed, returning the groups retrieved so far")
+			break
+		}
+		if errors.Is(err, ErrInsufficientScope) {
+			return nil, fmt.Errorf("identity/gitlab: listing groups requires the `api` or `read_api` scope, check the provider's scopes: %w", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		logFrom(ctx).Debug().Interface("response", response).Msg("identity/gitlab: groups")
+		for _, group := range response {
+			if listed[group.ID.String()] {
+				continue
+			}
+			listed[group.ID.String()] = true
+			groups = append(groups, group)
+		}
+		// next links already include the original query parameters
+		params = nil
+		if endpoint, err = httputil.NextPage(endpoint, h); err != nil {
+			return nil, err
+		}
+	}
 	return groups, nil
 }
 
-// Revoke attempts to revoke session access via revocation endpoint
+// UserProjects returns a sorted slice of the projects the user is a member
+// of, identified by their full path prefixed with `project:` (e.g.
+// `project:dev/backend`) so that they can't be mistaken for groups. If the
+// provider's MinGroupAccessLevel is set, only projects where the user has at
+// least that access level are returned.
+//
+// Projects are paginated like groups, and page failures are handled the same
+// way.
+// https://docs.gitlab.com/ee/api/projects.html#list-all-projects
+func (p *GitLabProvider) UserProjects(ctx context.Context, s *sessions.State) ([]string, error) {
+	if s == nil || s.AccessToken == nil {
+		return nil, ErrMissingSession
+	}
+	return p.TokenProjects(ctx, s.AccessToken)
+}
+
+// TokenProjects returns the projects of the user an access token belongs
+// to, as UserProjects does, for tokens which aren't part of a session yet.
+func (p *GitLabProvider) TokenProjects(ctx context.Context, token *oauth2.Token) ([]string, error) {
+	if token == nil || token.AccessToken == "" {
+		return nil, ErrMissingToken
+	}
+
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", token.AccessToken)}
+	params := url.Values{
+		"membership": []string{"true"},
+		"simple":     []string{"true"},
+		"per_page":   []string{strconv.Itoa(p.GroupsPageSize)},
+	}
+	if p.MinGroupAccessLevel != 0 {
+		params.Set("min_access_level", strconv.Itoa(p.MinGroupAccessLevel))
+	}
+
+	var projects []string
+	seen := make(map[string]bool)
+	endpoint := p.projectURL
+	for page := 0; endpoint != ""; page++ {
+		if page >= gitlabMaxGroupPages {
+			logFrom(ctx).Debug().Int("max-pages", gitlabMaxGroupPages).Msg("identity/gitlab: project page limit reached")
+			break
+		}
+		var response []struct {
+			ID                json.Number `json:"id"`
+			PathWithNamespace string      `json:"path_with_namespace"`
+		}
+		h, err := p.apiRequest(ctx, opUserGroups, http.MethodGet, endpoint, headers, params, &response)
+		if err != nil && page > 0 && p.GroupsBestEffort {
+			logFrom(ctx).Warn().Err(err).Int("page", page+1).Int("projects", len(projects)).
+				Msg("identity/gitlab: projects page failed, returning the projects retrieved so far")
+			break
+		}
+		if errors.Is(err, ErrInsufficientScope) {
+			return nil, fmt.Errorf("identity/gitlab: listing projects requires the `api` or `read_api` scope, check the provider's scopes: %w", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, project := range response {
+			id := gitlabProjectPrefix + project.PathWithNamespace
+			if project.PathWithNamespace != "" && !seen[id] {
+				seen[id] = true
+				projects = append(projects, id)
+			}
+		}
+		params = nil
+		if endpoint, err = httputil.NextPage(endpoint, h); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(projects)
+	logFrom(ctx).Debug().
+		Int("count", len(projects)).
+		Strs("projects", firstGroups(projects)).
+		Msg("identity/gitlab: retrieved projects")
+	return projects, nil
+}
+
+// gitlabURL returns an API endpoint relative to a GitLab instance's base url.
+func gitlabURL(providerURL, endpoint string) (string, error) {
+	u, err := urlutil.ParseAndValidateURL(providerURL)
+	if err != nil {
+		return "", fmt.Errorf("identity/gitlab: invalid provider url: %w", err)
+	}
+	u.Path = path.Join(u.Path, endpoint)
+	return u.String(), nil
+}
+
+// gitlabGroup represents a group as returned by the GitLab groups API.
+// https://docs.gitlab.com/ee/api/groups.html#list-groups
+type gitlabGroup struct {
+	ID                             json.Number `json:"id"`
+	Name                           string      `json:"name,omitempty"`
+	Path                           string      `json:"path,omitempty"`
+	Description                    string      `json:"description,omitempty"`
+	Visibility                     string      `json:"visibility,omitempty"`
+	ShareWithGroupLock             bool        `json:"share_with_group_lock,omitempty"`
+	RequireTwoFactorAuthentication bool        `json:"require_two_factor_authentication,omitempty"`
+	SubgroupCreationLevel          string      `json:"subgroup_creation_level,omitempty"`
+	FullName                       string      `json:"full_name,omitempty"`
+	FullPath                       string      `json:"full_path,omitempty"`
+}
+
+// identifiers returns the attributes used to identify the group for a given
+// group format, falling back to the group's ID.
+func (g gitlabGroup) identifiers(format string) []string {
+	switch format {
+	case GroupFormatPath:
+		return []string{g.Path}
+	case GroupFormatFullPath:
+		return []string{g.FullPath}
+	case GroupFormatName:
+		return []string{g.Name}
+	case GroupFormatIDAndName:
+		return []string{g.ID.String(), g.Name}
+	default:
+		return []string{g.ID.String()}
+	}
+}
+
+// parents returns the identifiers of the group's ancestors, derived from its
+// full path, for the path and full path group formats.
+func (g gitlabGroup) parents(format string) []string {
+	segments := strings.Split(g.FullPath, "/")
+	var parents []string
+	for i := 1; i < len(segments); i++ {
+		if format == GroupFormatPath {
+			parents = append(parents, segments[i-1])
+		} else {
+			parents = append(parents, strings.Join(segments[:i], "/"))
+		}
+	}
+	return parents
+}
+
+// AuthenticatePersonalAccessToken creates an identity session from a GitLab
+// personal access token, which must have the `api` or `read_api` scope. The
+// token is validated against the user endpoint, and the user's groups are
+// retrieved with it as they would be for an interactive session.
+//
+// https://docs.gitlab.com/ee/user/profile/personal_access_tokens.html
+func (p *GitLabProvider) AuthenticatePersonalAccessToken(ctx context.Context, token string) (*sessions.State, error) {
+	if !p.AllowPersonalAccessTokens {
+		return nil, ErrPersonalAccessTokensDisabled
+	}
+	if token == "" {
+		return nil, ErrMissingSession
+	}
+	s := &sessions.State{
+		AccessToken: &oauth2.Token{
+			AccessToken: token,
+			TokenType:   gitlabPersonalAccessTokenType,
+		},
+		// the session id ends up in urls, so it mustn't be the token itself
+		AccessTokenID: fmt.Sprintf("%x", sha256.Sum256([]byte(token))),
+	}
+	if err := p.updatePersonalAccessTokenSession(ctx, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Refresh renews a user's session. Sessions authenticated with a personal
+// access token are refreshed by validating the token again, so that revoked
+// tokens and blocked users lose access.
+func (p *GitLabProvider) Refresh(ctx context.Context, s *sessions.State) (*sessions.State, error) {
+	if s.AccessToken == nil || s.AccessToken.TokenType != gitlabPersonalAccessTokenType {
+		return p.Provider.Refresh(ctx, s)
+	}
+	if !p.AllowPersonalAccessTokens {
+		return nil, ErrPersonalAccessTokensDisabled
+	}
+	if err := p.updatePersonalAccessTokenSession(ctx, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// updatePersonalAccessTokenSession sets the session's user and groups from
+// GitLab, using the personal access token it holds.
+func (p *GitLabProvider) updatePersonalAccessTokenSession(ctx context.Context, s *sessions.State) error {
+	user, err := p.user(ctx, s.AccessToken.AccessToken)
+	if err != nil {
+		return fmt.Errorf("identity/gitlab: could not validate personal access token: %w", err)
+	}
+	if user.State != "active" {
+		return newProviderError(ErrTokenExpired, fmt.Errorf("identity/gitlab: user %s is %s", user.Username, user.State))
+	}
+	s.Subject = user.ID.String()
+	s.User = user.Username
+	s.Name = user.Name
+	s.Email = user.Email
+	// a user's primary email is verified once they've confirmed their account
+	s.EmailVerified = user.ConfirmedAt != ""
+	s.Picture = user.AvatarURL
+
+	// personal access tokens can be revoked at any time, so sessions are
+	// kept short and the token is validated again when they expire
+	expiry := time.Now().Add(refreshDeadline)
+	s.AccessToken.Expiry = expiry
+	s.Expiry = jwt.NewNumericDate(expiry)
+
+	// validating the token, whether to sign in or refresh, picks up the
+	// user's latest groups
+	p.groupsCache.invalidate(ctx, s)
+	groups, err := p.UserGroupFn(ctx, s)
+	if err != nil {
+		return p.groupsFailed(ctx, s, fmt.Errorf("identity/gitlab: could not retrieve groups: %w", err))
+	}
+	p.setGroups(ctx, s, groups)
+	if err := p.updateOrgs(ctx, s); err != nil {
+		return err
+	}
+	return p.updateAttributes(ctx, s)
+}
+
+// gitlabUser represents the authenticated user as returned by the GitLab
+// user API.
+// https://docs.gitlab.com/ee/api/users.html#for-normal-users-1
+type gitlabUser struct {
+	ID          json.Number `json:"id"`
+	Username    string      `json:"username"`
+	Name        string      `json:"name"`
+	Email       string      `json:"email"`
+	State       string      `json:"state"`
+	AvatarURL   string      `json:"avatar_url"`
+	ConfirmedAt string      `json:"confirmed_at"`
+}
+
+// user returns the user the access token belongs to.
+func (p *GitLabProvider) user(ctx context.Context, accessToken string) (*gitlabUser, error) {
+	var user gitlabUser
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", accessToken)}
+	if _, err := p.apiRequest(ctx, opUserInfo, http.MethodGet, p.userURL, headers, nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Revoke attempts to revoke session access via revocation endpoint. Personal
+// access tokens are not revoked, as they are managed by the user in GitLab.
 // https://docs.gitlab.com/ee/user/profile/personal_access_tokens.html#revoking-a-personal-access-token
 func (p *GitLabProvider) Revoke(ctx context.Context, token *oauth2.Token) error {
+	if token == nil || token.AccessToken == "" {
+		return ErrMissingToken
+	}
+	if token.TokenType == gitlabPersonalAccessTokenType {
+		logFrom(p.logContext(ctx, opRevoke, nil)).Debug().Msg("identity/gitlab: skipping revocation of personal access token")
+		return nil
+	}
 	params := url.Values{}
 	params.Add("access_token", token.AccessToken)
 
-	err := httputil.Client(ctx, http.MethodPost, p.RevokeURL, version.UserAgent(), nil, params, nil)
-	if err != nil && err != httputil.ErrTokenRevoked {
-		return err
-	}
-
-	return nil
+	return p.revoke(ctx, p.RevokeURL, nil, params)
 }
@@ -0,0 +1,130 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	gitlabGraphQLPath = "/api/graphql"
+
+	// gitlabGroupIDPrefix prefixes the global ids the GraphQL API gives
+	// groups, which are otherwise the numeric ids the REST API uses.
+	gitlabGroupIDPrefix = "gid://gitlab/Group/"
+)
+
+// gitlabGroupMembershipsQuery lists the groups the current user is a member
+// of, a page at a time, with their access level in each.
+const gitlabGroupMembershipsQuery = `query($first: Int!, $after: String) {
+  currentUser {
+    groupMemberships(first: $first, after: $after) {
+      nodes {
+        accessLevel { integerValue }
+        group { id name path fullName fullPath }
+      }
+      pageInfo { hasNextPage endCursor }
+    }
+  }
+}`
+
+// gitlabGroupMembershipsResponse is the GraphQL API's response to
+// gitlabGroupMembershipsQuery.
+type gitlabGroupMembershipsResponse struct {
+	Data struct {
+		CurrentUser *struct {
+			GroupMemberships struct {
+				Nodes []struct {
+					AccessLevel struct {
+						IntegerValue int `json:"integerValue"`
+					} `json:"accessLevel"`
+					Group *struct {
+						ID       string `json:"id"`
+						Name     string `json:"name"`
+						Path     string `json:"path"`
+						FullName string `json:"fullName"`
+						FullPath string `json:"fullPath"`
+					} `json:"group"`
+				} `json:"nodes"`
+				PageInfo struct {
+					HasNextPage bool   `json:"hasNextPage"`
+					EndCursor   string `json:"endCursor"`
+				} `json:"pageInfo"`
+			} `json:"groupMemberships"`
+		} `json:"currentUser"`
+	} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// listGroupsGraphQL returns the groups the token's user is a member of, as
+// listGroups does, with GitLab's GraphQL API. A user's memberships are
+// usually returned by a single query; further pages are only requested for
+// users with more than GroupsPageSize of them. Groups where the user has
+// less than MinGroupAccessLevel are left out.
+//
+// https://docs.gitlab.com/ee/api/graphql/reference/#usergroupmemberships
+func (p *GitLabProvider) listGroupsGraphQL(ctx context.Context, token *oauth2.Token, op string) ([]gitlabGroup, error) {
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", token.AccessToken)}
+
+	var groups []gitlabGroup
+	listed := make(map[string]bool)
+	var cursor *string
+	for page := 0; ; page++ {
+		if page >= gitlabMaxGroupPages {
+			logFrom(ctx).Debug().Int("max-pages", gitlabMaxGroupPages).Msg("identity/gitlab: group page limit reached")
+			break
+		}
+		variables, err := json.Marshal(map[string]interface{}{"first": p.GroupsPageSize, "after": cursor})
+		if err != nil {
+			return nil, err
+		}
+		params := url.Values{"query": []string{gitlabGroupMembershipsQuery}, "variables": []string{string(variables)}}
+		var response gitlabGroupMembershipsResponse
+		if _, err := p.apiRequest(ctx, op, http.MethodPost, p.graphqlURL, headers, params, &response); err != nil {
+			return nil, err
+		}
+		if len(response.Errors) > 0 {
+			messages := make([]string, 0, len(response.Errors))
+			for _, e := range response.Errors {
+				messages = append(messages, e.Message)
+			}
+			return nil, fmt.Errorf("identity/gitlab: graphql error: %s", strings.Join(messages, "; "))
+		}
+		if response.Data.CurrentUser == nil {
+			return nil, errors.New("identity/gitlab: graphql response has no current user")
+		}
+		memberships := response.Data.CurrentUser.GroupMemberships
+		for _, m := range memberships.Nodes {
+			// groups the user can no longer see are null
+			if m.Group == nil || m.AccessLevel.IntegerValue < p.MinGroupAccessLevel {
+				continue
+			}
+			id := strings.TrimPrefix(m.Group.ID, gitlabGroupIDPrefix)
+			if listed[id] {
+				continue
+			}
+			listed[id] = true
+			groups = append(groups, gitlabGroup{
+				ID:       json.Number(id),
+				Name:     m.Group.Name,
+				Path:     m.Group.Path,
+				FullName: m.Group.FullName,
+				FullPath: m.Group.FullPath,
+			})
+		}
+		if !memberships.PageInfo.HasNextPage || memberships.PageInfo.EndCursor == "" {
+			break
+		}
+		endCursor := memberships.PageInfo.EndCursor
+		cursor = &endCursor
+	}
+	return groups, nil
+}
@@ -0,0 +1,111 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestGitLabProviderUserGroupsGraphQL(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name           string
+		format         string
+		minAccessLevel int
+		graphql        string
+		token          string
+		want           []string
+		wantErr        error
+		wantREST       bool
+	}{
+		{"ids", GroupFormatID, 0, "", "ACCESS", []string{"1", "10", "2"}, nil, false},
+		{"full paths", GroupFormatFullPath, 0, "", "ACCESS", []string{"dev/backend", "dev/frontend", "ops"}, nil, false},
+		{"developer", GroupFormatID, 30, "", "ACCESS", []string{"10", "2"}, nil, false},
+		{"graphql errors fall back", GroupFormatID, 0, `{"errors":[{"message":"Field 'groupMemberships' doesn't exist on type 'UserCore'"}]}`, "ACCESS", []string{"4821"}, nil, true},
+		{"graphql unavailable falls back", GroupFormatID, 0, "unavailable", "ACCESS", []string{"4821"}, nil, true},
+		{"no current user falls back", GroupFormatID, 0, `{"data":{"currentUser":null}}`, "ACCESS", []string{"4821"}, nil, true},
+		{"unauthorized", GroupFormatID, 0, "", "REVOKED", nil, ErrTokenExpired, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var rest bool
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer ACCESS" {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				if r.URL.Path == gitlabGroupPath {
+					rest = true
+					fmt.Fprint(w, `[{"id":4821,"name":"Backend","path":"backend","full_path":"backend"}]`)
+					return
+				}
+				if r.Method != http.MethodPost || r.FormValue("query") != gitlabGroupMembershipsQuery {
+					t.Errorf("graphql request = %s %q", r.Method, r.FormValue("query"))
+				}
+				switch tt.graphql {
+				case "unavailable":
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				case "":
+				default:
+					fmt.Fprint(w, tt.graphql)
+					return
+				}
+				var variables struct {
+					First int     `json:"first"`
+					After *string `json:"after"`
+				}
+				if err := json.Unmarshal([]byte(r.FormValue("variables")), &variables); err != nil {
+					t.Error(err)
+				}
+				if variables.First != gitlabMaxGroupsPerPage {
+					t.Errorf("first = %d, want %d", variables.First, gitlabMaxGroupsPerPage)
+				}
+				if variables.After == nil {
+					fmt.Fprint(w, `{"data":{"currentUser":{"groupMemberships":{"nodes":[
+						{"accessLevel":{"integerValue":40},"group":{"id":"gid://gitlab/Group/10","name":"Ops","path":"ops","fullPath":"ops"}},
+						{"accessLevel":{"integerValue":10},"group":{"id":"gid://gitlab/Group/1","name":"Backend","path":"backend","fullPath":"dev/backend"}},
+						{"accessLevel":{"integerValue":30},"group":null}
+					],"pageInfo":{"hasNextPage":true,"endCursor":"page-2"}}}}}`)
+					return
+				}
+				if *variables.After != "page-2" {
+					t.Errorf("after = %q, want page-2", *variables.After)
+				}
+				fmt.Fprint(w, `{"data":{"currentUser":{"groupMemberships":{"nodes":[
+					{"accessLevel":{"integerValue":30},"group":{"id":"gid://gitlab/Group/2","name":"Frontend","path":"frontend","fullPath":"dev/frontend"}},
+					{"accessLevel":{"integerValue":40},"group":{"id":"gid://gitlab/Group/10","name":"Ops","path":"ops","fullPath":"ops"}}
+				],"pageInfo":{"hasNextPage":false,"endCursor":"page-3"}}}}}`)
+			}))
+			defer srv.Close()
+
+			p := &GitLabProvider{
+				Provider:   &Provider{ProviderName: GitlabProviderName, GroupFormat: tt.format, MinGroupAccessLevel: tt.minAccessLevel, GroupsPageSize: gitlabMaxGroupsPerPage, GroupsGraphQL: true},
+				groupURL:   srv.URL + gitlabGroupPath,
+				graphqlURL: srv.URL + gitlabGraphQLPath,
+			}
+			got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: tt.token}})
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("UserGroups() error = %v, want %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroups() = %s", diff)
+			}
+			if rest != tt.wantREST {
+				t.Errorf("UserGroups() used the groups api = %v, want %v", rest, tt.wantREST)
+			}
+		})
+	}
+}
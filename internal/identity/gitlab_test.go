@@ -0,0 +1,485 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestGitLabProviderUserGroups(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name           string
+		format         string
+		minAccessLevel int
+		pageSize       int
+		parents        bool
+		want           []string
+		wantLevel      string
+		wantPerPage    string
+	}{
+		{"ids", GroupFormatID, 0, 0, false, []string{"1", "10", "2", "3"}, "", "100"},
+		{"full paths", GroupFormatFullPath, 0, 0, false, []string{"dev/backend", "dev/frontend", "ops", "ops/backend"}, "", "100"},
+		{"full paths with parents", GroupFormatFullPath, 0, 0, true, []string{"dev", "dev/backend", "dev/frontend", "ops", "ops/backend"}, "", "100"},
+		{"developer", GroupFormatPath, 30, 0, false, []string{"backend", "frontend", "ops"}, "30", "100"},
+		{"paths with parents", GroupFormatPath, 0, 0, true, []string{"backend", "dev", "frontend", "ops"}, "", "100"},
+		{"page size", GroupFormatID, 0, 20, false, []string{"1", "10", "2", "3"}, "", "20"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.URL.Query().Get("min_access_level"); got != tt.wantLevel {
+					t.Errorf("min_access_level = %q, want %q", got, tt.wantLevel)
+				}
+				if got := r.URL.Query().Get("per_page"); got != tt.wantPerPage {
+					t.Errorf("per_page = %q, want %q", got, tt.wantPerPage)
+				}
+				switch r.URL.Query().Get("page") {
+				case "":
+					q := r.URL.Query()
+					q.Set("page", "2")
+					w.Header().Set("Link", fmt.Sprintf(`<%s%s?%s>; rel="next"`, srv.URL, r.URL.Path, q.Encode()))
+					fmt.Fprint(w, `[{"id":10,"path":"ops","full_path":"ops"},{"id":2,"path":"frontend","full_path":"dev/frontend"}]`)
+				case "2":
+					// groups may be listed again on a later page
+					fmt.Fprint(w, `[{"id":2,"path":"frontend","full_path":"dev/frontend"},{"id":1,"path":"backend","full_path":"dev/backend"},{"id":3,"path":"backend","full_path":"ops/backend"}]`)
+				}
+			}))
+			defer srv.Close()
+
+			p := &GitLabProvider{
+				Provider: &Provider{ProviderName: GitlabProviderName, GroupFormat: tt.format, MinGroupAccessLevel: tt.minAccessLevel, GroupsPageSize: gitlabGroupsPageSize(tt.pageSize), IncludeParentGroups: tt.parents},
+				groupURL: srv.URL + gitlabGroupPath,
+			}
+			got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: "ACCESS"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestGitLabProviderUserGroupsNames(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		format string
+		want   []string
+	}{
+		// groups which share a name can't be told apart by it
+		{"names", GroupFormatName, []string{"Backend", "Frontend", "Ops"}},
+		{"ids and names", GroupFormatIDAndName, []string{"1", "10", "2", "3", "Backend", "Frontend", "Ops"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `[{"id":10,"name":"Ops","path":"ops","full_path":"ops"},{"id":2,"name":"Frontend","path":"frontend","full_path":"dev/frontend"},{"id":1,"name":"Backend","path":"backend","full_path":"dev/backend"},{"id":3,"name":"Backend","path":"backend","full_path":"ops/backend"}]`)
+			}))
+			defer srv.Close()
+
+			p := &GitLabProvider{
+				Provider: &Provider{ProviderName: GitlabProviderName, GroupFormat: tt.format, GroupsPageSize: gitlabMaxGroupsPerPage},
+				groupURL: srv.URL + gitlabGroupPath,
+			}
+			got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: "ACCESS"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestGitLabProviderUserGroupsScope(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name             string
+		scope            string
+		minAccessLevel   int
+		wantAllAvailable string
+		wantLevel        string
+	}{
+		{"default", "", 0, "", ""},
+		{"all visible", GitLabGroupScopeAllVisible, 0, "true", ""},
+		{"member only", GitLabGroupScopeMemberOnly, 0, "false", "10"},
+		{"member only with access level", GitLabGroupScopeMemberOnly, 30, "false", "30"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.URL.Query().Get("all_available"); got != tt.wantAllAvailable {
+					t.Errorf("all_available = %q, want %q", got, tt.wantAllAvailable)
+				}
+				if got := r.URL.Query().Get("min_access_level"); got != tt.wantLevel {
+					t.Errorf("min_access_level = %q, want %q", got, tt.wantLevel)
+				}
+				fmt.Fprint(w, `[{"id":1,"path":"backend","full_path":"dev/backend"}]`)
+			}))
+			defer srv.Close()
+
+			p := &GitLabProvider{
+				Provider: &Provider{ProviderName: GitlabProviderName, GroupFormat: GroupFormatID, GitLabGroupScope: tt.scope, MinGroupAccessLevel: tt.minAccessLevel},
+				groupURL: srv.URL + gitlabGroupPath,
+			}
+			if _, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: "ACCESS"}}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestGitLabProviderUserOrgs(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id":1,"path":"backend","full_path":"dev/backend"},{"id":2,"path":"frontend","full_path":"dev/frontend"},{"id":10,"path":"ops","full_path":"ops"},{"id":4,"path":"web","full_path":"infra/sites/web"}]`)
+	}))
+	defer srv.Close()
+
+	p := &GitLabProvider{
+		Provider: &Provider{ProviderName: GitlabProviderName, GroupFormat: GroupFormatID},
+		groupURL: srv.URL + gitlabGroupPath,
+	}
+	got, err := p.UserOrgs(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: "ACCESS"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"dev", "infra", "ops"}, got); diff != "" {
+		t.Errorf("UserOrgs() = %s", diff)
+	}
+}
+
+func TestGitLabProviderTokenGroups(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ACCESS" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `[{"id":1,"path":"backend","full_path":"dev/backend"},{"id":10,"path":"ops","full_path":"ops"}]`)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		token   *oauth2.Token
+		want    []string
+		wantErr error
+	}{
+		{"token", &oauth2.Token{AccessToken: "ACCESS"}, []string{"1", "10"}, nil},
+		{"no token", nil, nil, ErrMissingToken},
+		{"empty token", &oauth2.Token{}, nil, ErrMissingToken},
+		{"revoked token", &oauth2.Token{AccessToken: "REVOKED"}, nil, ErrTokenExpired},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &GitLabProvider{
+				Provider: &Provider{ProviderName: GitlabProviderName, GroupFormat: GroupFormatID},
+				groupURL: srv.URL + gitlabGroupPath,
+			}
+			got, err := p.TokenGroups(context.Background(), tt.token)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("TokenGroups() error = %v, want %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("TokenGroups() = %s", diff)
+			}
+		})
+	}
+	p := &GitLabProvider{Provider: &Provider{ProviderName: GitlabProviderName}, groupURL: srv.URL + gitlabGroupPath}
+	if _, err := p.UserGroups(context.Background(), &sessions.State{}); !errors.Is(err, ErrMissingSession) {
+		t.Errorf("UserGroups() error = %v, want %v", err, ErrMissingSession)
+	}
+}
+
+func TestGitLabProviderUserGroupsPageFailure(t *testing.T) {
+	t.Parallel()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		if page == "3" {
+			http.Error(w, "upstream connect error", http.StatusBadGateway)
+			return
+		}
+		next := "2"
+		if page == "2" {
+			next = "3"
+		}
+		q := r.URL.Query()
+		q.Set("page", next)
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s?%s>; rel="next"`, srv.URL, r.URL.Path, q.Encode()))
+		fmt.Fprintf(w, `[{"id":%s0,"name":"group","path":"group","full_path":"group"}]`, next)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		bestEffort bool
+		want       []string
+		wantErr    bool
+	}{
+		{"strict", false, nil, true},
+		{"best effort", true, []string{"20", "30"}, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &GitLabProvider{
+				Provider: &Provider{ProviderName: GitlabProviderName, GroupFormat: GroupFormatID, GroupsBestEffort: tt.bestEffort},
+				groupURL: srv.URL + gitlabGroupPath,
+			}
+			got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: "ACCESS"}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UserGroups() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestGitLabProviderUserGroupsInsufficientScope(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error":"insufficient_scope","error_description":"The request requires higher privileges than provided by the access token.","scope":"api"}`)
+	}))
+	defer srv.Close()
+
+	p := &GitLabProvider{
+		Provider: &Provider{ProviderName: GitlabProviderName, GroupFormat: GroupFormatID},
+		groupURL: srv.URL + gitlabGroupPath,
+	}
+	got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: "ACCESS"}})
+	if !errors.Is(err, ErrInsufficientScope) {
+		t.Fatalf("UserGroups() error = %v, want %v", err, ErrInsufficientScope)
+	}
+	if got != nil {
+		t.Errorf("UserGroups() = %v, want no groups", got)
+	}
+}
+
+func TestGitLabProviderUserGroupsTokenRevoked(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		want   error
+	}{
+		{"invalid token body", "", `{"error":"invalid_token","error_description":"Token was revoked. You have to re-authorize from the user."}`, ErrTokenRevoked},
+		{"invalid token header", `Bearer realm="", error="invalid_token", error_description="Token was revoked. You have to re-authorize from the user."`, `{"message":"401 Unauthorized"}`, ErrTokenRevoked},
+		// without an OAuth error, a 401 isn't known to be an expired token
+		{"unauthorized", "", `{"message":"401 Unauthorized"}`, nil},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.header != "" {
+					w.Header().Set("WWW-Authenticate", tt.header)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+
+			p := &GitLabProvider{
+				Provider: &Provider{ProviderName: GitlabProviderName, GroupFormat: GroupFormatID},
+				groupURL: srv.URL + gitlabGroupPath,
+			}
+			_, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: "ACCESS"}})
+			if tt.want == nil {
+				if err == nil || errors.Is(err, ErrTokenExpired) {
+					t.Errorf("UserGroups() error = %v, want it not to be %v", err, ErrTokenExpired)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) || !errors.Is(err, ErrTokenExpired) {
+				t.Fatalf("UserGroups() error = %v, want %v", err, tt.want)
+			}
+			if tt.want != ErrTokenRevoked && errors.Is(err, ErrTokenRevoked) {
+				t.Errorf("UserGroups() error = %v, want it not to be %v", err, ErrTokenRevoked)
+			}
+		})
+	}
+}
+
+func TestGitLabProviderUserProjects(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name           string
+		minAccessLevel int
+		want           []string
+		wantLevel      string
+	}{
+		{"all projects", 0, []string{"project:dev/backend", "project:dev/frontend", "project:ops/infra"}, ""},
+		{"developer", 30, []string{"project:dev/backend", "project:dev/frontend"}, "30"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.URL.Query().Get("membership"); got != "true" {
+					t.Errorf("membership = %q, want %q", got, "true")
+				}
+				if got := r.URL.Query().Get("min_access_level"); got != tt.wantLevel {
+					t.Errorf("min_access_level = %q, want %q", got, tt.wantLevel)
+				}
+				// as GitLab does, projects where the user has less than the
+				// minimum access level aren't listed; they're only a
+				// Reporter (20) of ops/infra
+				minLevel, _ := strconv.Atoi(r.URL.Query().Get("min_access_level"))
+				switch r.URL.Query().Get("page") {
+				case "":
+					q := r.URL.Query()
+					q.Set("page", "2")
+					w.Header().Set("Link", fmt.Sprintf(`<%s%s?%s>; rel="next"`, srv.URL, r.URL.Path, q.Encode()))
+					if minLevel > 20 {
+						fmt.Fprint(w, `[{"id":1,"path_with_namespace":"dev/frontend"}]`)
+						return
+					}
+					fmt.Fprint(w, `[{"id":3,"path_with_namespace":"ops/infra"},{"id":1,"path_with_namespace":"dev/frontend"}]`)
+				case "2":
+					fmt.Fprint(w, `[{"id":1,"path_with_namespace":"dev/frontend"},{"id":2,"path_with_namespace":"dev/backend"}]`)
+				}
+			}))
+			defer srv.Close()
+
+			p := &GitLabProvider{
+				Provider:   &Provider{ProviderName: GitlabProviderName, MinGroupAccessLevel: tt.minAccessLevel},
+				projectURL: srv.URL + gitlabProjectPath,
+			}
+			got, err := p.UserProjects(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: "ACCESS"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserProjects() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestGitLabGroupsPageSize(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		size int
+		want int
+	}{
+		{0, 100},
+		{1, 1},
+		{50, 50},
+		{100, 100},
+		{500, 100},
+		{-1, 1},
+	}
+	for _, tt := range tests {
+		if got := gitlabGroupsPageSize(tt.size); got != tt.want {
+			t.Errorf("gitlabGroupsPageSize(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestGitLabProviderAuthenticatePersonalAccessToken(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		allow      bool
+		userStatus int
+		userState  string
+		want       *sessions.State
+		wantErr    error
+	}{
+		{"good", true, http.StatusOK, "active", &sessions.State{Subject: "42", User: "ci-bot", Name: "CI Bot", Email: "ci@example.com", EmailVerified: true, Picture: "https://gitlab.example.com/avatar.png", Groups: []string{"1", "2"}}, nil},
+		{"disabled", false, http.StatusOK, "active", nil, ErrPersonalAccessTokensDisabled},
+		{"revoked token", true, http.StatusUnauthorized, "", nil, ErrTokenExpired},
+		{"blocked user", true, http.StatusOK, "blocked", nil, ErrTokenExpired},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "Bearer PAT" {
+					t.Errorf("Authorization = %q, want %q", got, "Bearer PAT")
+				}
+				switch r.URL.Path {
+				case gitlabUserPath:
+					if tt.userStatus == http.StatusUnauthorized {
+						w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					}
+					w.WriteHeader(tt.userStatus)
+					fmt.Fprintf(w, `{"id":42,"username":"ci-bot","name":"CI Bot","email":"ci@example.com","state":%q,"avatar_url":"https://gitlab.example.com/avatar.png","confirmed_at":"2020-03-01T12:00:00Z"}`, tt.userState)
+				case gitlabGroupPath:
+					fmt.Fprint(w, `[{"id":1},{"id":2}]`)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+
+			p := &GitLabProvider{
+				Provider: &Provider{ProviderName: GitlabProviderName, AllowPersonalAccessTokens: tt.allow},
+				groupURL: srv.URL + gitlabGroupPath,
+				userURL:  srv.URL + gitlabUserPath,
+			}
+			p.UserGroupFn = p.UserGroups
+			got, err := p.AuthenticatePersonalAccessToken(context.Background(), "PAT")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AuthenticatePersonalAccessToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.AccessToken.TokenType != gitlabPersonalAccessTokenType || got.AccessToken.AccessToken != "PAT" {
+				t.Errorf("AuthenticatePersonalAccessToken() access token = %+v", got.AccessToken)
+			}
+			if got.AccessTokenID == "" || got.AccessTokenID == "PAT" {
+				t.Errorf("AuthenticatePersonalAccessToken() access token id = %q", got.AccessTokenID)
+			}
+			if err := got.Verify(""); err != nil {
+				t.Errorf("AuthenticatePersonalAccessToken() session not valid: %v", err)
+			}
+			opts := cmpopts.IgnoreFields(sessions.State{}, "AccessToken", "AccessTokenID", "Expiry", "GroupsRefreshedAt")
+			if diff := cmp.Diff(tt.want, got, opts, cmpopts.IgnoreUnexported(sessions.State{})); diff != "" {
+				t.Errorf("AuthenticatePersonalAccessToken() = %s", diff)
+			}
+
+			// refreshing validates the token again, rather than using a
+			// refresh token
+			if _, err := p.Refresh(context.Background(), got); err != nil {
+				t.Errorf("Refresh() error = %v", err)
+			}
+			// the token belongs to the user, so signing out leaves it be
+			if err := p.Revoke(context.Background(), got.AccessToken); err != nil {
+				t.Errorf("Revoke() error = %v", err)
+			}
+		})
+	}
+}
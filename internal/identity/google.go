@@ -4,23 +4,35 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	oidc "github.com/coreos/go-oidc"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
 
-	"github.com/pomerium/pomerium/internal/httputil"
 	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/sessions"
-	"github.com/pomerium/pomerium/internal/version"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
 )
 
 const defaultGoogleProviderURL = "https://accounts.google.com"
 
+const (
+	// googleGroupsPageSize is the most groups the Directory API lists at
+	// a time.
+	googleGroupsPageSize = 200
+	// googleMaxGroupPages bounds how many pages of a user's groups are
+	// listed.
+	googleMaxGroupPages = 50
+)
+
 // GoogleProvider is an implementation of the Provider interface.
 type GoogleProvider struct {
 	*Provider
@@ -32,21 +44,24 @@ type GoogleProvider struct {
 
 // NewGoogleProvider instantiates an OpenID Connect (OIDC) session with Google.
 func NewGoogleProvider(p *Provider) (*GoogleProvider, error) {
-	ctx := context.Background()
+	ctx := p.clientContext(context.Background())
 	if p.ProviderURL == "" {
 		p.ProviderURL = defaultGoogleProviderURL
 	}
 	var err error
-	p.provider, err = oidc.NewProvider(ctx, p.ProviderURL)
+	p.provider, err = p.discover(ctx)
 	if err != nil {
 		return nil, err
 	}
 	// Google rejects the offline scope favoring "access_type=offline"
 	// as part of the authorization request instead.
-	if len(p.Scopes) == 0 {
-		p.Scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	p.Scopes = requireScopes(p.Scopes,
+		[]string{oidc.ScopeOpenID, "profile", "email"},
+		[]string{oidc.ScopeOpenID})
+	p.verifier, err = p.newVerifier()
+	if err != nil {
+		return nil, err
 	}
-	p.verifier = p.provider.Verifier(&oidc.Config{ClientID: p.ClientID})
 	p.oauth = &oauth2.Config{
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
@@ -65,9 +80,9 @@ func NewGoogleProvider(p *Provider) (*GoogleProvider, error) {
 	}
 	// if service account set, configure admin sdk calls
 	if p.ServiceAccount != "" {
-		apiCreds, err := base64.StdEncoding.DecodeString(p.ServiceAccount)
+		apiCreds, err := googleServiceAccountJSON(p.ServiceAccount)
 		if err != nil {
-			return nil, fmt.Errorf("identity/google: could not decode service account json %w", err)
+			return nil, err
 		}
 		// Required scopes for groups api
 		// https://developers.google.com/admin-sdk/directory/v1/reference/groups/list
@@ -81,8 +96,15 @@ func NewGoogleProvider(p *Provider) (*GoogleProvider, error) {
 		if err := json.Unmarshal(apiCreds, &credentialsFile); err != nil {
 			return nil, err
 		}
+		// domain-wide delegation only lets the service account act on
+		// behalf of a Workspace user, typically an administrator
+		if credentialsFile.ImpersonateUser == "" {
+			log.Warn().Msg("identity/google: service account has no impersonate_user, directory api requests will likely be refused")
+		}
 		conf.Subject = credentialsFile.ImpersonateUser
-		client := conf.Client(context.TODO())
+		// admin sdk calls go through the provider's client too, so that
+		// they share its certificate authority and proxy
+		client := conf.Client(p.clientContext(context.Background()))
 		gp.apiClient, err = admin.New(client)
 		if err != nil {
 			return nil, fmt.Errorf("identity/google: failed creating admin service %w", err)
@@ -99,13 +121,12 @@ func NewGoogleProvider(p *Provider) (*GoogleProvider, error) {
 //
 // https://developers.google.com/identity/protocols/OAuth2WebServer#tokenrevoke
 func (p *GoogleProvider) Revoke(ctx context.Context, token *oauth2.Token) error {
+	if token == nil || token.AccessToken == "" {
+		return ErrMissingToken
+	}
 	params := url.Values{}
 	params.Add("token", token.AccessToken)
-	err := httputil.Client(ctx, http.MethodPost, p.RevokeURL, version.UserAgent(), nil, params, nil)
-	if err != nil && err != httputil.ErrTokenRevoked {
-		return err
-	}
-	return nil
+	return p.revoke(ctx, p.RevokeURL, nil, params)
 }
 
 // GetSignInURL returns a URL to OAuth 2.0 provider's consent page that asks for permissions for
@@ -118,26 +139,99 @@ func (p *GoogleProvider) Revoke(ctx context.Context, token *oauth2.Token) error
 // Google only provide refresh_token on the first authorization from the user. If user clears
 // cookies, re-authorization will not bring back refresh_token. A work around to this is to add
 // prompt=consent to the OAuth redirect URL and will always return a refresh_token.
+// When additional scopes are requested, Google is asked to include the ones
+// the user has already granted, so that the new grant supersedes the old.
 // https://openid.net/specs/openid-connect-core-1_0.html#OfflineAccess
-func (p *GoogleProvider) GetSignInURL(state string) string {
-	return p.oauth.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "select_account consent"))
+// https://developers.google.com/identity/protocols/oauth2/web-server#incrementalAuth
+func (p *GoogleProvider) GetSignInURL(state string, opts SignInOptions) string {
+	params := []oauth2.AuthCodeOption{
+		oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("prompt", "select_account consent"),
+	}
+	if len(opts.Scopes) != 0 {
+		params = append(params, oauth2.SetAuthURLParam("include_granted_scopes", "true"))
+	}
+	return p.oauth.AuthCodeURL(state, append(params, opts.authCodeOptions(p.Provider)...)...)
 }
 
-// UserGroups returns a slice of group names a given user is in
+// googleServiceAccountJSON returns the service account's JSON key file,
+// which is configured either base64 encoded or as is.
+func googleServiceAccountJSON(serviceAccount string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(serviceAccount), "{") {
+		return []byte(serviceAccount), nil
+	}
+	apiCreds, err := base64.StdEncoding.DecodeString(serviceAccount)
+	if err != nil {
+		return nil, fmt.Errorf("identity/google: could not decode service account json %w", err)
+	}
+	return apiCreds, nil
+}
+
+// UserGroups returns the email addresses of the Google Workspace groups a
+// user is a direct member of, from the Directory API, acting as the service
+// account's impersonated user with domain-wide delegation. Users who aren't
+// in the directory (e.g. consumer accounts) have no groups.
+//
 // NOTE: groups via Directory API is limited to 1 QPS!
 // https://developers.google.com/admin-sdk/directory/v1/reference/groups/list
 // https://developers.google.com/admin-sdk/directory/v1/limits
 func (p *GoogleProvider) UserGroups(ctx context.Context, s *sessions.State) ([]string, error) {
+	if s == nil || s.Subject == "" {
+		return nil, ErrMissingSession
+	}
+	if p.apiClient == nil {
+		return nil, nil
+	}
 	var groups []string
-	if p.apiClient != nil {
-		req := p.apiClient.Groups.List().UserKey(s.Subject).MaxResults(100)
+	var pageToken string
+	for page := 0; page < googleMaxGroupPages; page++ {
+		req := p.apiClient.Groups.List().UserKey(s.Subject).MaxResults(googleGroupsPageSize).Context(ctx)
+		if pageToken != "" {
+			req = req.PageToken(pageToken)
+		}
+		start := time.Now()
 		resp, err := req.Do()
+		status := http.StatusOK
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) {
+			status = gerr.Code
+		} else if err != nil {
+			status = 0
+		}
+		metrics.RecordIdentityAPIRequest(ctx, p.ProviderName, opUserGroups, status, time.Since(start), err)
+		if status == http.StatusNotFound {
+			logFrom(ctx).Debug().Msg("identity/google: user not found in directory")
+			return nil, nil
+		}
 		if err != nil {
-			return nil, fmt.Errorf("identity/google: group api request failed %w", err)
+			return nil, fmt.Errorf("identity/google: group api request failed %w", googleGroupsError(status, gerr, err))
 		}
 		for _, group := range resp.Groups {
 			groups = append(groups, group.Email)
 		}
+		if resp.NextPageToken == "" {
+			return groups, nil
+		}
+		pageToken = resp.NextPageToken
 	}
+	logFrom(ctx).Debug().Int("max-pages", googleMaxGroupPages).Msg("identity/google: group page limit reached")
 	return groups, nil
 }
+
+// googleGroupsError attaches ErrProviderUnavailable to Directory API errors
+// which may succeed if retried, including rate limits, which Google reports
+// with a 403 as well as a 429. Other errors are the service account's, not
+// the user's, so they aren't classified as the user's token having expired.
+func googleGroupsError(status int, gerr *googleapi.Error, err error) error {
+	if gerr != nil && status == http.StatusForbidden {
+		for _, e := range gerr.Errors {
+			if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+				return newProviderError(ErrProviderUnavailable, newProviderError(ErrRateLimited, err))
+			}
+		}
+	}
+	if status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError {
+		return newProviderError(ErrProviderUnavailable, err)
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/option"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestGoogleProviderUserGroups(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/directory/v1/groups" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch user := r.URL.Query().Get("userKey"); user {
+		case "paged":
+			if r.URL.Query().Get("pageToken") == "" {
+				fmt.Fprint(w, `{"groups":[{"email":"admins@example.com"},{"email":"eng@example.com"}],"nextPageToken":"next"}`)
+				return
+			}
+			fmt.Fprint(w, `{"groups":[{"email":"ops@example.com"}]}`)
+		case "none":
+			fmt.Fprint(w, `{}`)
+		case "unknown":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":404,"message":"Resource Not Found: userKey","errors":[{"reason":"notFound"}]}}`)
+		case "rate-limited":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":{"code":403,"message":"Quota exceeded","errors":[{"reason":"userRateLimitExceeded"}]}}`)
+		case "forbidden":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":{"code":403,"message":"Not Authorized to access this resource/api","errors":[{"reason":"forbidden"}]}}`)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	apiClient, err := admin.NewService(context.Background(), option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL+"/admin/directory/v1/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		subject string
+		want    []string
+		wantErr error
+	}{
+		{"paginated", "paged", []string{"admins@example.com", "eng@example.com", "ops@example.com"}, nil},
+		{"no groups", "none", nil, nil},
+		{"not in directory", "unknown", nil, nil},
+		{"rate limited", "rate-limited", nil, ErrRateLimited},
+		{"unavailable", "unavailable", nil, ErrProviderUnavailable},
+		{"missing subject", "", nil, ErrMissingSession},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &GoogleProvider{Provider: &Provider{ProviderName: GoogleProviderName}, apiClient: apiClient}
+			got, err := p.UserGroups(context.Background(), &sessions.State{Subject: tt.subject})
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("UserGroups() error = %v, want %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroups() = %s", diff)
+			}
+		})
+	}
+
+	t.Run("service account refused", func(t *testing.T) {
+		p := &GoogleProvider{Provider: &Provider{ProviderName: GoogleProviderName}, apiClient: apiClient}
+		_, err := p.UserGroups(context.Background(), &sessions.State{Subject: "forbidden"})
+		if err == nil || errors.Is(err, ErrTokenExpired) || errors.Is(err, ErrProviderUnavailable) {
+			t.Errorf("UserGroups() error = %v, want a configuration error", err)
+		}
+	})
+}
+
+func TestGoogleServiceAccountJSON(t *testing.T) {
+	t.Parallel()
+	raw := `{"type":"service_account","client_email":"pomerium@example.iam.gserviceaccount.com","impersonate_user":"admin@example.com"}`
+	tests := []struct {
+		name           string
+		serviceAccount string
+		wantErr        bool
+	}{
+		{"base64", base64.StdEncoding.EncodeToString([]byte(raw)), false},
+		{"json", raw, false},
+		{"json with whitespace", "\n  " + raw, false},
+		{"invalid", "not base64!", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := googleServiceAccountJSON(tt.serviceAccount)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("googleServiceAccountJSON() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var key map[string]string
+			if err := json.Unmarshal(got, &key); err != nil {
+				t.Fatal(err)
+			}
+			if key["impersonate_user"] != "admin@example.com" {
+				t.Errorf("googleServiceAccountJSON() = %s", got)
+			}
+		})
+	}
+}
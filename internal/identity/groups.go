@@ -0,0 +1,411 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/pomerium/pomerium/internal/audit"
+	"github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/internal/sessions"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+)
+
+// DefaultGroupsClaim is the ID token claim a user's groups are read from.
+const DefaultGroupsClaim = "groups"
+
+// DefaultGroupsRequestTimeout is the default upper bound on how long a user's
+// groups may take to be retrieved from an identity provider.
+const DefaultGroupsRequestTimeout = 10 * time.Second
+
+// emailDomainGroupPrefix prefixes the pseudo-group naming the domain of a
+// user's verified email.
+const emailDomainGroupPrefix = "domain:"
+
+// maxLoggedGroups bounds the number of a user's groups which are logged.
+const maxLoggedGroups = 5
+
+// firstGroups returns up to maxLoggedGroups of groups, for logging.
+func firstGroups(groups []string) []string {
+	if len(groups) > maxLoggedGroups {
+		return groups[:maxLoggedGroups]
+	}
+	return groups
+}
+
+// userGroupFunc is the signature of a provider's UserGroupFn.
+type userGroupFunc func(context.Context, *sessions.State) ([]string, error)
+
+// withGroupsTimeout bounds each call to fn by timeout, so that a slow or
+// unresponsive identity provider can't stall the request indefinitely.
+// Timeouts are reported as ErrGroupsRequestTimeout so they can be told apart
+// from errors returned by the identity provider's API.
+func withGroupsTimeout(timeout time.Duration, fn userGroupFunc) userGroupFunc {
+	if timeout <= 0 {
+		timeout = DefaultGroupsRequestTimeout
+	}
+	return func(ctx context.Context, s *sessions.State) ([]string, error) {
+		tctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		groups, err := fn(tctx, s)
+		if err != nil && ctx.Err() == nil && errors.Is(tctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w after %s: %v", ErrGroupsRequestTimeout, timeout, err)
+		}
+		return groups, err
+	}
+}
+
+// withEmailDomainGroup adds the session's email domain group, if any, to the
+// groups fn returns.
+func withEmailDomainGroup(fn userGroupFunc) userGroupFunc {
+	return func(ctx context.Context, s *sessions.State) ([]string, error) {
+		groups, err := fn(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		return addEmailDomainGroup(s, groups), nil
+	}
+}
+
+// withGroupsMetric records the number of groups each successful call to fn
+// returns for the provider.
+func withGroupsMetric(providerName string, fn userGroupFunc) userGroupFunc {
+	return func(ctx context.Context, s *sessions.State) ([]string, error) {
+		groups, err := fn(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		metrics.RecordUserGroups(ctx, providerName, len(groups))
+		return groups, nil
+	}
+}
+
+// withGroupAliases translates the groups fn returns through aliases.
+func withGroupAliases(aliases map[string]string, fn userGroupFunc) userGroupFunc {
+	return func(ctx context.Context, s *sessions.State) ([]string, error) {
+		groups, err := fn(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		return aliasGroups(aliases, groups), nil
+	}
+}
+
+// withLowercaseGroups lowercases the groups fn returns.
+func withLowercaseGroups(fn userGroupFunc) userGroupFunc {
+	return func(ctx context.Context, s *sessions.State) ([]string, error) {
+		groups, err := fn(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		return lowercaseGroups(groups), nil
+	}
+}
+
+// normalizeGroups applies GroupsNamePrefix, GroupAliases, and
+// GroupsCaseInsensitive, to groups read from somewhere other than
+// UserGroupFn, which does so itself.
+func (p *Provider) normalizeGroups(groups []string) []string {
+	groups = prefixedGroups(p.GroupsNamePrefix, groups)
+	groups = aliasGroups(p.GroupAliases, groups)
+	if p.GroupsCaseInsensitive {
+		groups = lowercaseGroups(groups)
+	}
+	return groups
+}
+
+// prefixedGroups returns those of groups which start with prefix.
+func prefixedGroups(prefix string, groups []string) []string {
+	if prefix == "" || len(groups) == 0 {
+		return groups
+	}
+	var prefixed []string
+	for _, group := range groups {
+		if strings.HasPrefix(group, prefix) {
+			prefixed = append(prefixed, group)
+		}
+	}
+	return prefixed
+}
+
+// lowercaseGroups lowercases each of groups. Groups which end up the same
+// are only kept once.
+func lowercaseGroups(groups []string) []string {
+	if len(groups) == 0 {
+		return groups
+	}
+	lowered := make([]string, 0, len(groups))
+	seen := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		group = strings.ToLower(group)
+		if !seen[group] {
+			seen[group] = true
+			lowered = append(lowered, group)
+		}
+	}
+	return lowered
+}
+
+// aliasGroups replaces each of groups which has an alias with it, leaving
+// the others as they are. Groups which end up the same are only kept once.
+func aliasGroups(aliases map[string]string, groups []string) []string {
+	if len(aliases) == 0 || len(groups) == 0 {
+		return groups
+	}
+	aliased := make([]string, 0, len(groups))
+	seen := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		if alias, ok := aliases[group]; ok {
+			group = alias
+		}
+		if !seen[group] {
+			seen[group] = true
+			aliased = append(aliased, group)
+		}
+	}
+	return aliased
+}
+
+// addEmailDomainGroup adds a pseudo-group such as `domain:example.com`,
+// naming the domain of the session's email, to groups. It is only added if
+// the email is verified, and isn't added twice. groups is copied rather than
+// appended to, as it may be shared, such as by the groups cache.
+func addEmailDomainGroup(s *sessions.State, groups []string) []string {
+	if s == nil || !s.EmailVerified {
+		return groups
+	}
+	i := strings.LastIndex(s.Email, "@")
+	if i < 0 || i == len(s.Email)-1 {
+		return groups
+	}
+	group := emailDomainGroupPrefix + strings.ToLower(s.Email[i+1:])
+	for _, g := range groups {
+		if g == group {
+			return groups
+		}
+	}
+	out := make([]string, len(groups), len(groups)+1)
+	copy(out, groups)
+	return append(out, group)
+}
+
+// maxGroupSourceConcurrency bounds how many of a provider's group sources
+// are queried at once for a user.
+const maxGroupSourceConcurrency = 4
+
+// groupSource retrieves some of a user's groups, typically from one of the
+// identity provider's API endpoints (e.g. GitLab groups, or projects).
+type groupSource struct {
+	name string
+	fn   userGroupFunc
+}
+
+// mergeGroupSources returns a UserGroupFn which queries each of the sources
+// concurrently, merging their groups in the order the sources are given and
+// removing duplicates.
+//
+// Unless bestEffort is set, any failing source fails the lookup and cancels
+// the sources still in flight. With bestEffort, failing sources are logged
+// and skipped; the lookup only fails if every source does, so that a user
+// isn't silently left without groups.
+func mergeGroupSources(bestEffort bool, sources ...groupSource) userGroupFunc {
+	return func(ctx context.Context, s *sessions.State) ([]string, error) {
+		results := make([][]string, len(sources))
+		errs := make([]error, len(sources))
+		sem := make(chan struct{}, maxGroupSourceConcurrency)
+		g, gctx := errgroup.WithContext(ctx)
+		for i, source := range sources {
+			i, source := i, source
+			g.Go(func() error {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-gctx.Done():
+					return gctx.Err()
+				}
+				groups, err := source.fn(gctx, s)
+				if err != nil {
+					err = fmt.Errorf("internal/identity: %s group source failed: %w", source.name, err)
+					if !bestEffort {
+						return err
+					}
+					errs[i] = err
+					return nil
+				}
+				results[i] = groups
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+
+		var failed []error
+		for i, err := range errs {
+			if err != nil {
+				logFrom(ctx).Warn().Err(err).Str("source", sources[i].name).Msg("internal/identity: skipping failed group source")
+				failed = append(failed, err)
+			}
+		}
+		if len(sources) > 0 && len(failed) == len(sources) {
+			// the first error is kept in the chain so callers can still tell
+			// an expired token from an unavailable provider
+			return nil, fmt.Errorf("internal/identity: all %d group sources failed: %w", len(failed), failed[0])
+		}
+
+		var groups []string
+		seen := make(map[string]bool)
+		for _, result := range results {
+			for _, group := range result {
+				if !seen[group] {
+					seen[group] = true
+					groups = append(groups, group)
+				}
+			}
+		}
+		return groups, nil
+	}
+}
+
+// updateGroups sets the session's groups. Groups are read from the ID
+// token's GroupsClaim, saving an API call, if the provider has no other way
+// of retrieving them or if GroupsClaim was explicitly configured. Otherwise,
+// they are retrieved using UserGroupFn.
+func (p *Provider) updateGroups(ctx context.Context, s *sessions.State, idToken *oidc.IDToken) error {
+	claim := p.GroupsClaim
+	if claim == "" {
+		claim = DefaultGroupsClaim
+	}
+	if p.GroupsClaim != "" || p.UserGroupFn == nil {
+		groups, ok, err := groupsFromIDToken(idToken, claim)
+		if err != nil {
+			return err
+		}
+		if ok {
+			p.setGroups(ctx, s, p.emailDomainGroup(s, p.normalizeGroups(groups)))
+			return nil
+		}
+	}
+	if p.UserGroupFn == nil {
+		p.setGroups(ctx, s, p.emailDomainGroup(s, p.normalizeGroups(s.Groups)))
+		return nil
+	}
+	groups, err := p.UserGroupFn(ctx, s)
+	if err != nil {
+		return p.groupsFailed(ctx, s, fmt.Errorf("internal/identity: could not retrieve groups %w", err))
+	}
+	p.setGroups(ctx, s, groups)
+	return nil
+}
+
+// InvalidateGroups drops the cached groups of the user sub, including those
+// kept to serve while the identity provider is unavailable, so that their
+// groups are next retrieved from the identity provider.
+func (p *Provider) InvalidateGroups(ctx context.Context, sub string) {
+	p.groupsCache.purge(ctx, &sessions.State{Subject: sub})
+}
+
+// maxSessionGroups is the number of groups above which a session's groups
+// are likely to make it too large, since they're carried in every session.
+const maxSessionGroups = 200
+
+// setGroups sets the groups fetched for the session, warning if there are
+// so many that they'd bloat it.
+func (p *Provider) setGroups(ctx context.Context, s *sessions.State, groups []string) {
+	if len(groups) > maxSessionGroups {
+		logFrom(p.logContext(ctx, opUserGroups, s)).Warn().Int("count", len(groups)).Int("max", maxSessionGroups).
+			Msg("internal/identity: user has many groups, which makes their session large; consider filtering them")
+	}
+	s.SetGroups(groups)
+	p.Audit.Emit(ctx, p.groupResolutionEvent(audit.Success, s))
+}
+
+// groupsFailed records that the session's groups couldn't be retrieved,
+// returning err.
+func (p *Provider) groupsFailed(ctx context.Context, s *sessions.State, err error) error {
+	p.Audit.Emit(ctx, p.groupResolutionEvent(audit.Failure, s).WithReason(err))
+	return err
+}
+
+func (p *Provider) groupResolutionEvent(outcome audit.Outcome, s *sessions.State) audit.Event {
+	e := audit.NewEvent(audit.GroupResolution, outcome, s)
+	// the session isn't yet named by the provider it signs in with
+	e.Provider = p.Name
+	return e
+}
+
+// updateOrgs sets the session's orgs using UserOrgFn, if the provider
+// distinguishes them from groups.
+func (p *Provider) updateOrgs(ctx context.Context, s *sessions.State) error {
+	if p.UserOrgFn == nil {
+		return nil
+	}
+	orgs, err := p.UserOrgFn(ctx, s)
+	if err != nil {
+		return fmt.Errorf("internal/identity: could not retrieve orgs %w", err)
+	}
+	s.Orgs = orgs
+	return nil
+}
+
+// emailDomainGroup adds the session's email domain group to groups, if
+// EmailDomainGroup is set. Groups retrieved with UserGroupFn already have it.
+func (p *Provider) emailDomainGroup(s *sessions.State, groups []string) []string {
+	if !p.EmailDomainGroup {
+		return groups
+	}
+	return addEmailDomainGroup(s, groups)
+}
+
+// groupsFromIDToken returns the groups listed in the ID token's claim, and
+// whether the claim was present. The claim may either be an array of strings
+// or a single, space delimited, string.
+func groupsFromIDToken(idToken *oidc.IDToken, claim string) ([]string, bool, error) {
+	if idToken == nil {
+		return nil, false, nil
+	}
+	var claims map[string]json.RawMessage
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, false, fmt.Errorf("internal/identity: couldn't unmarshal claims: %w", err)
+	}
+	if groupsClaimOverage(claims, claim) {
+		log.Debug().Str("claim", claim).Msg("internal/identity: groups left out of id token, retrieving them from the identity provider")
+		return nil, false, nil
+	}
+	raw, ok := claims[claim]
+	if !ok {
+		return nil, false, nil
+	}
+	groups, err := sessions.ParseGroups(raw)
+	if err != nil {
+		return nil, false, fmt.Errorf("internal/identity: invalid %q claim: %w", claim, err)
+	}
+	return groups, true, nil
+}
+
+// groupsClaimOverage reports whether the ID token says the user's groups
+// were left out of it, typically because there were too many of them. Azure
+// AD does so for users in more than ~150 groups, either with a distributed
+// claim (OpenID Connect Core 5.6.2) listed in `_claim_names` or, in implicit
+// flows, with a `hasgroups` claim.
+//
+// https://docs.microsoft.com/en-us/azure/active-directory/develop/id-tokens#groups-overage-claim
+func groupsClaimOverage(claims map[string]json.RawMessage, claim string) bool {
+	var names map[string]string
+	if raw, ok := claims["_claim_names"]; ok && json.Unmarshal(raw, &names) == nil {
+		if _, ok := names[claim]; ok {
+			return true
+		}
+	}
+	var hasGroups bool
+	if raw, ok := claims["hasgroups"]; ok && json.Unmarshal(raw, &hasGroups) == nil {
+		return hasGroups
+	}
+	return false
+}
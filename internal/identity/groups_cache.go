@@ -0,0 +1,216 @@
+package identity
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+)
+
+// DefaultGroupsCacheTTL is the default duration a user's groups are cached
+// before the identity provider is asked for them again.
+const DefaultGroupsCacheTTL = 5 * time.Minute
+
+// GroupsCache stores users' groups so that the identity provider's API isn't
+// called on every request. Implementations must be safe for concurrent use.
+type GroupsCache interface {
+	// Get returns the groups stored under key, and whether they were found.
+	Get(ctx context.Context, key string) ([]string, bool)
+	// Set stores groups under key for the duration of ttl.
+	Set(ctx context.Context, key string, groups []string, ttl time.Duration)
+	// Delete removes any groups stored under key.
+	Delete(ctx context.Context, key string)
+}
+
+// groupsCache wraps a provider's UserGroupFn with a GroupsCache, namespacing
+// keys by provider and client so that a cache can be shared between
+// providers.
+type groupsCache struct {
+	provider  string
+	namespace string
+	ttl       time.Duration
+	cache     GroupsCache
+	// staleTTL, if set, is how long each user's groups are also stored for
+	// so they can be served by stale, which bounds how old they can be.
+	staleTTL time.Duration
+	// serveStale, if set, answers lookups which fail because the identity
+	// provider is unavailable with the groups served by stale.
+	serveStale bool
+}
+
+func newGroupsCache(provider, clientID string, ttl time.Duration, cache GroupsCache) *groupsCache {
+	if ttl <= 0 {
+		ttl = DefaultGroupsCacheTTL
+	}
+	if cache == nil {
+		cache = NewMemoryGroupsCache()
+	}
+	return &groupsCache{
+		provider:  provider,
+		namespace: provider + "/" + clientID + "/",
+		ttl:       ttl,
+		cache:     cache,
+	}
+}
+
+// wrap returns a UserGroupFn which serves a user's groups from the cache,
+// calling fn on a cache miss. If serveStale is set, and fn fails because the
+// identity provider is unavailable, the user's last known groups are served
+// instead, if there are any.
+func (c *groupsCache) wrap(fn userGroupFunc) userGroupFunc {
+	return func(ctx context.Context, s *sessions.State) ([]string, error) {
+		key := c.key(s)
+		if key == "" {
+			return fn(ctx, s)
+		}
+		if groups, ok := c.cache.Get(ctx, key); ok {
+			metrics.RecordGroupsCacheRequest(ctx, c.provider, true)
+			return groups, nil
+		}
+		metrics.RecordGroupsCacheRequest(ctx, c.provider, false)
+		groups, err := fn(ctx, s)
+		if err != nil {
+			if c.serveStale && isUnavailable(err) {
+				if groups, ok := c.stale(ctx, s); ok {
+					logFrom(ctx).Warn().Err(err).Dur("max_stale", c.staleTTL).
+						Msg("internal/identity: identity provider unavailable, serving the user's last known groups")
+					return groups, nil
+				}
+			}
+			return nil, err
+		}
+		c.cache.Set(ctx, key, groups, c.ttl)
+		if c.staleTTL > 0 {
+			c.cache.Set(ctx, c.staleKey(key), groups, c.staleTTL)
+		}
+		return groups, nil
+	}
+}
+
+// stale returns the groups last retrieved for a user, even if they have
+// expired from the cache, and whether there were any.
+func (c *groupsCache) stale(ctx context.Context, s *sessions.State) ([]string, bool) {
+	key := c.key(s)
+	if key == "" || c.staleTTL <= 0 {
+		return nil, false
+	}
+	return c.cache.Get(ctx, c.staleKey(key))
+}
+
+// invalidate removes a user's cached groups, if any, so that the next lookup
+// is made against the identity provider. It is safe to call on a nil cache.
+func (c *groupsCache) invalidate(ctx context.Context, s *sessions.State) {
+	if c == nil {
+		return
+	}
+	if key := c.key(s); key != "" {
+		c.cache.Delete(ctx, key)
+	}
+}
+
+// purge removes a user's cached groups, and their last known groups, so
+// that neither is served again. It is safe to call on a nil cache.
+func (c *groupsCache) purge(ctx context.Context, s *sessions.State) {
+	if c == nil {
+		return
+	}
+	if key := c.key(s); key != "" {
+		c.cache.Delete(ctx, key)
+		c.cache.Delete(ctx, c.staleKey(key))
+	}
+}
+
+// staleKey returns the key a user's last known groups are stored under.
+func (c *groupsCache) staleKey(key string) string {
+	return "stale/" + key
+}
+
+// key returns the key a session's groups are cached under, or an empty
+// string if the session can't be identified.
+func (c *groupsCache) key(s *sessions.State) string {
+	id := groupsCacheKey(s)
+	if id == "" {
+		return ""
+	}
+	return c.namespace + id
+}
+
+// groupsCacheKey returns the user identifier a session's groups are cached
+// under, or an empty string if the session can't be identified.
+func groupsCacheKey(s *sessions.State) string {
+	if s == nil {
+		return ""
+	}
+	switch {
+	case s.Subject != "":
+		return s.Subject
+	case s.Email != "":
+		return s.Email
+	default:
+		return s.User
+	}
+}
+
+// memoryGroupsCache is an in-memory, TTL based GroupsCache. It is the default
+// cache, and is local to each instance. Groups are copied in and out, so
+// that callers can't change each other's, or the cache's, groups.
+type memoryGroupsCache struct {
+	mu        sync.Mutex
+	entries   map[string]memoryGroupsCacheEntry
+	lastSweep time.Time
+}
+
+type memoryGroupsCacheEntry struct {
+	groups []string
+	expiry time.Time
+}
+
+// NewMemoryGroupsCache returns a new in-memory GroupsCache.
+func NewMemoryGroupsCache() GroupsCache {
+	return &memoryGroupsCache{
+		entries:   make(map[string]memoryGroupsCacheEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Get implements GroupsCache.
+func (c *memoryGroupsCache) Get(ctx context.Context, key string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expiry) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return append([]string(nil), e.groups...), true
+}
+
+// Set implements GroupsCache.
+func (c *memoryGroupsCache) Set(ctx context.Context, key string, groups []string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	// periodically sweep expired entries so users who never come back
+	// don't accumulate in memory
+	if now.Sub(c.lastSweep) > ttl {
+		for k, e := range c.entries {
+			if now.After(e.expiry) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[key] = memoryGroupsCacheEntry{groups: append([]string(nil), groups...), expiry: now.Add(ttl)}
+}
+
+// Delete implements GroupsCache.
+func (c *memoryGroupsCache) Delete(ctx context.Context, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
@@ -0,0 +1,165 @@
+package identity
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/pomerium/pomerium/internal/cryptutil"
+	"github.com/pomerium/pomerium/internal/log"
+)
+
+// redisGroupsCacheVersion is the version of the encoding used to store
+// groups in redis. It is part of each key, and of each entry, so that
+// entries written by an incompatible version are treated as a cache miss
+// rather than misread. Version 2 entries are encrypted.
+const redisGroupsCacheVersion = 2
+
+var redisGroupsCachePrefix = fmt.Sprintf("pomerium/identity/groups/v%d/", redisGroupsCacheVersion)
+
+// redisGroupsCache is a GroupsCache backed by redis, which lets replicas of
+// the authenticate service share users' groups. Entries are encrypted, and
+// keys are named by their HMAC, so that the groups, and the users they
+// belong to, aren't readable at rest.
+type redisGroupsCache struct {
+	db   *redis.Client
+	keys groupsCacheCiphers
+}
+
+type redisGroupsCacheEntry struct {
+	Version int      `json:"v"`
+	Groups  []string `json:"groups"`
+}
+
+// NewRedisGroupsCache returns a GroupsCache backed by the redis server at
+// rawURL (e.g. `redis://:password@localhost:6379/0`, or `rediss://` for TLS).
+//
+// Entries are encrypted with the first of the base64 encoded sharedKeys.
+// The others are previous keys, which entries are still read with, so that
+// the shared secret can be rotated without dropping the cache.
+func NewRedisGroupsCache(rawURL string, sharedKeys ...string) (GroupsCache, error) {
+	keys, err := newGroupsCacheCiphers(sharedKeys)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("internal/identity: invalid groups cache redis url: %w", err)
+	}
+	db := redis.NewClient(opts)
+	if _, err := db.Ping().Result(); err != nil {
+		return nil, fmt.Errorf("internal/identity: error connecting to groups cache redis: %w", err)
+	}
+	return &redisGroupsCache{db: db, keys: keys}, nil
+}
+
+// Get implements GroupsCache. Redis errors are logged and treated as a miss
+// so that an unavailable cache falls back to the identity provider. Entries
+// written with a previous key are looked up if there's none for the current
+// key.
+func (c *redisGroupsCache) Get(ctx context.Context, key string) ([]string, bool) {
+	for _, k := range c.keys {
+		v, err := c.db.WithContext(ctx).Get(redisGroupsCachePrefix + k.name(key)).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		} else if err != nil {
+			log.Warn().Err(err).Msg("internal/identity: groups cache get failed")
+			return nil, false
+		}
+		return k.decode(key, v)
+	}
+	return nil, false
+}
+
+// Set implements GroupsCache.
+func (c *redisGroupsCache) Set(ctx context.Context, key string, groups []string, ttl time.Duration) {
+	k := c.keys[0]
+	v, err := k.encode(key, groups)
+	if err != nil {
+		log.Warn().Err(err).Msg("internal/identity: groups cache encode failed")
+		return
+	}
+	if err := c.db.WithContext(ctx).Set(redisGroupsCachePrefix+k.name(key), v, ttl).Err(); err != nil {
+		log.Warn().Err(err).Msg("internal/identity: groups cache set failed")
+	}
+}
+
+// Delete implements GroupsCache, removing the entries written with any key.
+func (c *redisGroupsCache) Delete(ctx context.Context, key string) {
+	names := make([]string, 0, len(c.keys))
+	for _, k := range c.keys {
+		names = append(names, redisGroupsCachePrefix+k.name(key))
+	}
+	if err := c.db.WithContext(ctx).Del(names...).Err(); err != nil {
+		log.Warn().Err(err).Msg("internal/identity: groups cache delete failed")
+	}
+}
+
+// groupsCacheCiphers are the ciphers groups cache entries are encrypted with,
+// the current one first.
+type groupsCacheCiphers []groupsCacheCipher
+
+type groupsCacheCipher struct {
+	secret string
+	aead   cipher.AEAD
+}
+
+func newGroupsCacheCiphers(sharedKeys []string) (groupsCacheCiphers, error) {
+	if len(sharedKeys) == 0 {
+		return nil, errors.New("internal/identity: groups cache requires a shared key")
+	}
+	keys := make(groupsCacheCiphers, 0, len(sharedKeys))
+	for _, secret := range sharedKeys {
+		aead, err := cryptutil.NewAEADCipherFromBase64(secret)
+		if err != nil {
+			return nil, fmt.Errorf("internal/identity: invalid groups cache key: %w", err)
+		}
+		keys = append(keys, groupsCacheCipher{secret: secret, aead: aead})
+	}
+	return keys, nil
+}
+
+// name returns the name an entry for key is stored under with k.
+func (k groupsCacheCipher) name(key string) string {
+	return base64.RawURLEncoding.EncodeToString(cryptutil.GenerateHMAC([]byte(key), k.secret))
+}
+
+// encode encrypts groups, binding them to key so that an entry can't be
+// moved to another user's.
+func (k groupsCacheCipher) encode(key string, groups []string) ([]byte, error) {
+	v, err := encodeRedisGroups(groups)
+	if err != nil {
+		return nil, err
+	}
+	return cryptutil.Encrypt(k.aead, v, []byte(key)), nil
+}
+
+// decode decrypts an entry for key, reporting entries which can't be
+// decrypted or decoded as a miss.
+func (k groupsCacheCipher) decode(key string, v []byte) ([]string, bool) {
+	plaintext, err := cryptutil.Decrypt(k.aead, v, []byte(key))
+	if err != nil {
+		return nil, false
+	}
+	return decodeRedisGroups(plaintext)
+}
+
+func encodeRedisGroups(groups []string) ([]byte, error) {
+	return json.Marshal(redisGroupsCacheEntry{Version: redisGroupsCacheVersion, Groups: groups})
+}
+
+// decodeRedisGroups decodes a cache entry, reporting entries which can't be
+// decoded, or were written with another version, as a miss.
+func decodeRedisGroups(v []byte) ([]string, bool) {
+	var e redisGroupsCacheEntry
+	if err := json.Unmarshal(v, &e); err != nil || e.Version != redisGroupsCacheVersion {
+		return nil, false
+	}
+	return e.Groups, true
+}
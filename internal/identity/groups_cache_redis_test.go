@@ -0,0 +1,114 @@
+package identity
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pomerium/pomerium/internal/cryptutil"
+)
+
+func TestRedisGroupsEncoding(t *testing.T) {
+	t.Parallel()
+	v, err := encodeRedisGroups([]string{"admins", "devs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		v      []byte
+		want   []string
+		wantOK bool
+	}{
+		{"round trip", v, []string{"admins", "devs"}, true},
+		{"no groups", []byte(`{"v":2,"groups":null}`), nil, true},
+		{"other version", []byte(`{"v":1,"groups":["admins"]}`), nil, false},
+		{"unversioned", []byte(`["admins"]`), nil, false},
+		{"garbage", []byte(`not json`), nil, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := decodeRedisGroups(tt.v)
+			if ok != tt.wantOK {
+				t.Errorf("decodeRedisGroups() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("decodeRedisGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestGroupsCacheCiphers(t *testing.T) {
+	t.Parallel()
+	oldKey, newKey := cryptutil.NewBase64Key(), cryptutil.NewBase64Key()
+	before, err := newGroupsCacheCiphers([]string{oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := newGroupsCacheCiphers([]string{newKey, oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := before[0].encode("user", []string{"admins"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(v, []byte("admins")) {
+		t.Errorf("encode() = %q, want groups encrypted", v)
+	}
+	if name := before[0].name("user"); name == "user" || name == before[0].name("other") {
+		t.Errorf("name() = %q, want a distinct hmac of the key", name)
+	}
+	if after[0].name("user") == after[1].name("user") {
+		t.Error("name() is the same for different keys")
+	}
+	tests := []struct {
+		name   string
+		cipher groupsCacheCipher
+		key    string
+		want   []string
+		wantOK bool
+	}{
+		{"round trip", before[0], "user", []string{"admins"}, true},
+		{"previous key", after[1], "user", []string{"admins"}, true},
+		{"other user", before[0], "other", nil, false},
+		{"rotated key", after[0], "user", nil, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := tt.cipher.decode(tt.key, v)
+			if ok != tt.wantOK {
+				t.Errorf("decode() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("decode() = %s", diff)
+			}
+		})
+	}
+	if before[0].name("user") != after[1].name("user") {
+		t.Error("name() changed for the previous key")
+	}
+}
+
+func TestNewRedisGroupsCache(t *testing.T) {
+	t.Parallel()
+	key := cryptutil.NewBase64Key()
+	if _, err := NewRedisGroupsCache("redis://localhost:6379"); err == nil {
+		t.Error("NewRedisGroupsCache() expected error for a missing key")
+	}
+	if _, err := NewRedisGroupsCache("redis://localhost:6379", key, "not a key"); err == nil {
+		t.Error("NewRedisGroupsCache() expected error for an invalid previous key")
+	}
+	if _, err := NewRedisGroupsCache("http://localhost:6379", key); err == nil {
+		t.Error("NewRedisGroupsCache() expected error for a non redis url")
+	}
+	if _, err := NewRedisGroupsCache("redis://localhost:0", key); err == nil {
+		t.Error("NewRedisGroupsCache() expected error for an unreachable server")
+	}
+}
@@ -0,0 +1,244 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestGroupsCache(t *testing.T) {
+	var calls int
+	fn := func(ctx context.Context, s *sessions.State) ([]string, error) {
+		calls++
+		if s.Subject == "error" {
+			return nil, errors.New("error")
+		}
+		return []string{"group1", "group2"}, nil
+	}
+	c := newGroupsCache("test", "client", DefaultGroupsCacheTTL, nil)
+	cached := c.wrap(fn)
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		s          *sessions.State
+		invalidate bool
+		want       []string
+		wantErr    bool
+		wantCalls  int
+	}{
+		{"miss", &sessions.State{Subject: "user"}, false, []string{"group1", "group2"}, false, 1},
+		{"hit", &sessions.State{Subject: "user"}, false, []string{"group1", "group2"}, false, 1},
+		{"invalidated", &sessions.State{Subject: "user"}, true, []string{"group1", "group2"}, false, 2},
+		{"keyed by email", &sessions.State{Email: "user@example.com"}, false, []string{"group1", "group2"}, false, 3},
+		{"no identifier", &sessions.State{}, false, []string{"group1", "group2"}, false, 4},
+		{"no identifier not cached", &sessions.State{}, false, []string{"group1", "group2"}, false, 5},
+		{"error not cached", &sessions.State{Subject: "error"}, false, nil, true, 6},
+		{"error retried", &sessions.State{Subject: "error"}, false, nil, true, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.invalidate {
+				c.invalidate(ctx, tt.s)
+			}
+			got, err := cached(ctx, tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UserGroupFn() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroupFn() = %s", diff)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("UserGroupFn() calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestMemoryGroupsCacheCopies(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	c := NewMemoryGroupsCache()
+	groups := []string{"admins", "devs"}
+	c.Set(ctx, "user", groups, time.Hour)
+	groups[0] = "changed"
+	got, _ := c.Get(ctx, "user")
+	got[1] = "changed"
+	got, _ = c.Get(ctx, "user")
+	if diff := cmp.Diff([]string{"admins", "devs"}, got); diff != "" {
+		t.Errorf("Get() = %s", diff)
+	}
+}
+
+type recordingGroupsCache struct {
+	GroupsCache
+	keys []string
+}
+
+func (c *recordingGroupsCache) Set(ctx context.Context, key string, groups []string, ttl time.Duration) {
+	c.keys = append(c.keys, key)
+	c.GroupsCache.Set(ctx, key, groups, ttl)
+}
+
+func TestGroupsCacheNamespace(t *testing.T) {
+	fn := func(ctx context.Context, s *sessions.State) ([]string, error) {
+		return []string{"group1"}, nil
+	}
+	shared := &recordingGroupsCache{GroupsCache: NewMemoryGroupsCache()}
+	ctx := context.Background()
+	s := &sessions.State{Subject: "user"}
+	for _, c := range []*groupsCache{
+		newGroupsCache("okta", "employees", time.Minute, shared),
+		newGroupsCache("okta", "contractors", time.Minute, shared),
+	} {
+		if _, err := c.wrap(fn)(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"okta/employees/user", "okta/contractors/user"}
+	if diff := cmp.Diff(want, shared.keys); diff != "" {
+		t.Errorf("cache keys = %s", diff)
+	}
+}
+
+func TestGroupsCacheServeStale(t *testing.T) {
+	var err error
+	fn := func(ctx context.Context, s *sessions.State) ([]string, error) {
+		if err != nil {
+			return nil, err
+		}
+		return []string{"group1"}, nil
+	}
+	memory := NewMemoryGroupsCache()
+	c := newGroupsCache("test", "client", time.Nanosecond, memory)
+	c.staleTTL = time.Hour
+	c.serveStale = true
+	lookup := c.wrap(fn)
+	ctx := context.Background()
+	known := &sessions.State{Subject: "known"}
+	if _, err := lookup(ctx, known); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cache entry has expired, but the last known groups are served
+	err = newProviderError(ErrProviderUnavailable, errors.New("502 Bad Gateway"))
+	got, lookupErr := lookup(ctx, known)
+	if lookupErr != nil {
+		t.Fatalf("UserGroupFn() error = %v", lookupErr)
+	}
+	if diff := cmp.Diff([]string{"group1"}, got); diff != "" {
+		t.Errorf("UserGroupFn() = %s", diff)
+	}
+	if _, lookupErr := lookup(ctx, &sessions.State{Subject: "unknown"}); !errors.Is(lookupErr, ErrProviderUnavailable) {
+		t.Errorf("UserGroupFn() error = %v, want %v", lookupErr, ErrProviderUnavailable)
+	}
+
+	// errors specific to the user aren't masked
+	err = ErrTokenRevoked
+	if _, lookupErr := lookup(ctx, known); !errors.Is(lookupErr, ErrTokenRevoked) {
+		t.Errorf("UserGroupFn() error = %v, want %v", lookupErr, ErrTokenRevoked)
+	}
+
+	// nor are groups older than the maximum staleness served
+	err = ErrGroupsRequestTimeout
+	memory.Set(ctx, c.staleKey(c.key(known)), []string{"group1"}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, lookupErr := lookup(ctx, known); !errors.Is(lookupErr, ErrGroupsRequestTimeout) {
+		t.Errorf("UserGroupFn() error = %v, want %v", lookupErr, ErrGroupsRequestTimeout)
+	}
+}
+
+func TestProviderInvalidateGroups(t *testing.T) {
+	var calls int
+	fn := func(ctx context.Context, s *sessions.State) ([]string, error) {
+		calls++
+		return []string{"group1"}, nil
+	}
+	c := newGroupsCache("test", "client", time.Hour, nil)
+	c.staleTTL = time.Hour
+	p := &Provider{groupsCache: c, UserGroupFn: c.wrap(fn)}
+	ctx := context.Background()
+	s := &sessions.State{Subject: "user", Email: "user@example.com"}
+	for i := 0; i < 2; i++ {
+		if _, err := p.UserGroupFn(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("UserGroupFn() calls = %d, want 1", calls)
+	}
+	p.InvalidateGroups(ctx, "user")
+	if _, ok := c.stale(ctx, s); ok {
+		t.Error("stale() found the groups of an invalidated user")
+	}
+	if _, err := p.UserGroupFn(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("UserGroupFn() calls after InvalidateGroups() = %d, want 2", calls)
+	}
+	// providers without a groups cache have nothing to invalidate
+	(&Provider{}).InvalidateGroups(ctx, "user")
+}
+
+func TestProviderAuthenticateGroupsCache(t *testing.T) {
+	t.Parallel()
+	idToken := testAccessToken(t, map[string]interface{}{"sub": "user", "aud": "client", "email": "user@example.com"})
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{"issuer": srv.URL})
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"ACCESS","token_type":"Bearer","expires_in":3600,"id_token":%q}`, idToken)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	provider, err := oidc.NewProvider(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	c := newGroupsCache("test", "client", time.Hour, nil)
+	// groups cached before the user's membership changed
+	c.cache.Set(ctx, c.key(&sessions.State{Subject: "user"}), []string{"old"}, time.Hour)
+	fn := func(ctx context.Context, s *sessions.State) ([]string, error) { return []string{"new"}, nil }
+	p := &Provider{
+		ProviderName: OIDCProviderName,
+		ClientID:     "client",
+		RedirectURL:  &url.URL{Scheme: "https", Host: "authenticate.example.com"},
+		provider:     provider,
+		verifier:     oidc.NewVerifier("https://idp.example.com", insecureKeySet{}, &oidc.Config{ClientID: "client"}),
+		oauth:        &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: srv.URL + "/token"}},
+		groupsCache:  c,
+		UserGroupFn:  c.wrap(fn),
+	}
+	s, err := p.Authenticate(ctx, "code", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// signing in isn't answered from the cache
+	if diff := cmp.Diff([]string{"new"}, s.Groups); diff != "" {
+		t.Errorf("Authenticate() groups = %s", diff)
+	}
+	// but later lookups are
+	if groups, ok := c.cache.Get(ctx, c.key(s)); !ok || len(groups) != 1 || groups[0] != "new" {
+		t.Errorf("cached groups = %v, %v, want the signed in user's", groups, ok)
+	}
+}
@@ -0,0 +1,427 @@
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pomerium/pomerium/internal/audit"
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestWithGroupsTimeout(t *testing.T) {
+	t.Parallel()
+	errAPI := errors.New("api error")
+	slow := func(ctx context.Context, s *sessions.State) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	tests := []struct {
+		name        string
+		fn          userGroupFunc
+		cancel      bool
+		want        error
+		wantTimeout bool
+	}{
+		{"ok", func(context.Context, *sessions.State) ([]string, error) { return []string{"a"}, nil }, false, nil, false},
+		{"api error", func(context.Context, *sessions.State) ([]string, error) { return nil, errAPI }, false, errAPI, false},
+		{"timeout", slow, false, context.DeadlineExceeded, true},
+		{"parent cancelled", slow, true, context.Canceled, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+			_, err := withGroupsTimeout(10*time.Millisecond, tt.fn)(ctx, &sessions.State{})
+			if tt.want == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) && !errors.Is(err, ErrGroupsRequestTimeout) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			if got := errors.Is(err, ErrGroupsRequestTimeout); got != tt.wantTimeout {
+				t.Errorf("timeout = %v, want %v (%v)", got, tt.wantTimeout, err)
+			}
+		})
+	}
+}
+
+// insecureKeySet accepts any signature, so that tests can verify hand
+// crafted ID tokens.
+type insecureKeySet struct{}
+
+func (insecureKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed jwt")
+	}
+	return base64.RawURLEncoding.DecodeString(parts[1])
+}
+
+func newTestIDToken(t *testing.T, claims map[string]interface{}) *oidc.IDToken {
+	t.Helper()
+	claims["iss"] = "https://idp.example.com"
+	claims["aud"] = "client"
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`))
+	raw := header + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString([]byte("sig"))
+	verifier := oidc.NewVerifier("https://idp.example.com", insecureKeySet{}, &oidc.Config{ClientID: "client"})
+	idToken, err := verifier.Verify(context.Background(), raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idToken
+}
+
+func TestMergeGroupSources(t *testing.T) {
+	t.Parallel()
+	errAPI := errors.New("api error")
+	groups := func(groups ...string) userGroupFunc {
+		return func(context.Context, *sessions.State) ([]string, error) { return groups, nil }
+	}
+	failing := func(err error) userGroupFunc {
+		return func(context.Context, *sessions.State) ([]string, error) { return nil, err }
+	}
+	tests := []struct {
+		name       string
+		bestEffort bool
+		sources    []groupSource
+		want       []string
+		wantErr    error
+	}{
+		{"merged in order", false, []groupSource{{"a", groups("1", "2")}, {"b", groups("3")}}, []string{"1", "2", "3"}, nil},
+		{"duplicates removed", false, []groupSource{{"a", groups("1", "2")}, {"b", groups("2", "3", "1")}}, []string{"1", "2", "3"}, nil},
+		{"no sources", false, nil, nil, nil},
+		{"fatal failure", false, []groupSource{{"a", groups("1")}, {"b", failing(errAPI)}}, nil, errAPI},
+		{"fatal token expired", false, []groupSource{{"a", failing(newProviderError(ErrTokenExpired, errAPI))}, {"b", groups("1")}}, nil, ErrTokenExpired},
+		{"best effort failure skipped", true, []groupSource{{"a", groups("1")}, {"b", failing(errAPI)}, {"c", groups("2")}}, []string{"1", "2"}, nil},
+		{"best effort all failed", true, []groupSource{{"a", failing(errAPI)}, {"b", failing(errAPI)}}, nil, errAPI},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			fn := mergeGroupSources(tt.bestEffort, tt.sources...)
+			got, err := fn(context.Background(), &sessions.State{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("mergeGroupSources() error = %v, want %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("mergeGroupSources() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestMergeGroupSourcesConcurrency(t *testing.T) {
+	t.Parallel()
+	var inFlight, maxInFlight int32
+	release := make(chan struct{})
+	source := func(ctx context.Context, s *sessions.State) ([]string, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		<-release
+		return []string{"group"}, nil
+	}
+	var sources []groupSource
+	for i := 0; i < 3*maxGroupSourceConcurrency; i++ {
+		sources = append(sources, groupSource{name: "source", fn: source})
+	}
+	done := make(chan error)
+	go func() {
+		_, err := mergeGroupSources(false, sources...)(context.Background(), &sessions.State{})
+		done <- err
+	}()
+	// let the first batch of sources start before releasing them all
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&maxInFlight); got > maxGroupSourceConcurrency {
+		t.Errorf("max concurrent sources = %d, want at most %d", got, maxGroupSourceConcurrency)
+	}
+}
+
+func TestMergeGroupSourcesCancel(t *testing.T) {
+	t.Parallel()
+	errAPI := errors.New("api error")
+	slow := func(ctx context.Context, s *sessions.State) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	fn := mergeGroupSources(false,
+		groupSource{"slow", slow},
+		groupSource{"failing", func(context.Context, *sessions.State) ([]string, error) { return nil, errAPI }},
+	)
+	// a fatal failure cancels the sources still in flight, so this returns
+	// rather than waiting on the slow source forever
+	if _, err := fn(context.Background(), &sessions.State{}); !errors.Is(err, errAPI) {
+		t.Errorf("mergeGroupSources() error = %v, want %v", err, errAPI)
+	}
+}
+
+func TestProviderUpdateGroups(t *testing.T) {
+	t.Parallel()
+	apiGroups := func(context.Context, *sessions.State) ([]string, error) { return []string{"from-api"}, nil }
+	tests := []struct {
+		name        string
+		groupsClaim string
+		userGroupFn userGroupFunc
+		claims      map[string]interface{}
+		want        []string
+		wantErr     bool
+	}{
+		{"array claim", "", nil, map[string]interface{}{"groups": []string{"admins", "devs"}}, []string{"admins", "devs"}, false},
+		{"space delimited claim", "", nil, map[string]interface{}{"groups": "admins devs"}, []string{"admins", "devs"}, false},
+		{"custom claim", "roles", nil, map[string]interface{}{"roles": []string{"admins"}}, []string{"admins"}, false},
+		{"invalid claim", "", nil, map[string]interface{}{"groups": 42}, nil, true},
+		{"no claim or api", "", nil, map[string]interface{}{}, nil, false},
+		{"api preferred by default", "", apiGroups, map[string]interface{}{"groups": []string{"admins"}}, []string{"from-api"}, false},
+		{"explicit claim preferred over api", "groups", apiGroups, map[string]interface{}{"groups": []string{"admins"}}, []string{"admins"}, false},
+		{"explicit claim missing falls back to api", "roles", apiGroups, map[string]interface{}{}, []string{"from-api"}, false},
+		{"overage falls back to api", "groups", apiGroups, map[string]interface{}{
+			"_claim_names":   map[string]string{"groups": "src1"},
+			"_claim_sources": map[string]interface{}{"src1": map[string]string{"endpoint": "https://graph.windows.net/tenant/users/oid/getMemberObjects"}},
+		}, []string{"from-api"}, false},
+		{"hasgroups falls back to api", "groups", apiGroups, map[string]interface{}{"hasgroups": true}, []string{"from-api"}, false},
+		{"other distributed claim", "groups", apiGroups, map[string]interface{}{
+			"_claim_names":   map[string]string{"roles": "src1"},
+			"_claim_sources": map[string]interface{}{"src1": map[string]string{"endpoint": "https://idp.example.com/roles"}},
+			"groups":         []string{"admins"},
+		}, []string{"admins"}, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provider{GroupsClaim: tt.groupsClaim, UserGroupFn: tt.userGroupFn}
+			s := &sessions.State{}
+			err := p.updateGroups(context.Background(), s, newTestIDToken(t, tt.claims))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("updateGroups() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, s.Groups); diff != "" {
+				t.Errorf("updateGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestGroupAliases(t *testing.T) {
+	t.Parallel()
+	aliases := map[string]string{"4821": "backend", "5102": "platform", "6000": "backend"}
+	apiGroups := func(context.Context, *sessions.State) ([]string, error) { return []string{"4821", "7000"}, nil }
+	tests := []struct {
+		name        string
+		userGroupFn userGroupFunc
+		claims      map[string]interface{}
+		want        []string
+	}{
+		{"api groups", withGroupAliases(aliases, apiGroups), map[string]interface{}{}, []string{"backend", "7000"}},
+		{"claim groups", nil, map[string]interface{}{"groups": []string{"5102", "admins"}}, []string{"platform", "admins"}},
+		{"aliased once", nil, map[string]interface{}{"groups": []string{"4821", "6000", "backend"}}, []string{"backend"}},
+		{"no groups", nil, map[string]interface{}{}, nil},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provider{GroupAliases: aliases, UserGroupFn: tt.userGroupFn}
+			s := &sessions.State{}
+			if err := p.updateGroups(context.Background(), s, newTestIDToken(t, tt.claims)); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, s.Groups); diff != "" {
+				t.Errorf("updateGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestGroupsNamePrefix(t *testing.T) {
+	t.Parallel()
+	// groups retrieved from the api are filtered by the provider, by name
+	apiGroups := func(context.Context, *sessions.State) ([]string, error) { return []string{"00g1"}, nil }
+	tests := []struct {
+		name        string
+		groupsClaim string
+		userGroupFn userGroupFunc
+		claims      map[string]interface{}
+		groups      []string
+		want        []string
+	}{
+		{"claim groups", "", nil, map[string]interface{}{"groups": []string{"Everyone", "pomerium-admins", "pomerium-users"}}, nil, []string{"pomerium-admins", "pomerium-users"}},
+		{"explicit claim preferred over api", "groups", apiGroups, map[string]interface{}{"groups": []string{"Everyone", "pomerium-admins"}}, nil, []string{"pomerium-admins"}},
+		{"none prefixed", "", nil, map[string]interface{}{"groups": []string{"Everyone"}}, nil, nil},
+		{"session groups", "", nil, map[string]interface{}{}, []string{"Everyone", "pomerium-users"}, []string{"pomerium-users"}},
+		{"api groups", "", apiGroups, map[string]interface{}{"groups": []string{"Everyone"}}, nil, []string{"00g1"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provider{GroupsNamePrefix: "pomerium-", GroupsClaim: tt.groupsClaim, UserGroupFn: tt.userGroupFn}
+			s := &sessions.State{Groups: tt.groups}
+			if err := p.updateGroups(context.Background(), s, newTestIDToken(t, tt.claims)); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, s.Groups); diff != "" {
+				t.Errorf("updateGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestGroupsCaseInsensitive(t *testing.T) {
+	t.Parallel()
+	aliases := map[string]string{"4821": "Backend"}
+	apiGroups := func(context.Context, *sessions.State) ([]string, error) {
+		return []string{"Backend", "4821", "Ops"}, nil
+	}
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		userGroupFn     userGroupFunc
+		claims          map[string]interface{}
+		want            []string
+	}{
+		{"api groups", true, withLowercaseGroups(withGroupAliases(aliases, apiGroups)), map[string]interface{}{}, []string{"backend", "ops"}},
+		{"claim groups", true, nil, map[string]interface{}{"groups": []string{"Backend", "backend", "ADMINS", "4821"}}, []string{"backend", "admins"}},
+		{"unicode", true, nil, map[string]interface{}{"groups": []string{"ÉQUIPE"}}, []string{"équipe"}},
+		{"disabled", false, nil, map[string]interface{}{"groups": []string{"Backend", "backend"}}, []string{"Backend", "backend"}},
+		{"no groups", true, nil, map[string]interface{}{}, nil},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provider{GroupAliases: aliases, GroupsCaseInsensitive: tt.caseInsensitive, UserGroupFn: tt.userGroupFn}
+			s := &sessions.State{}
+			if err := p.updateGroups(context.Background(), s, newTestIDToken(t, tt.claims)); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, s.Groups); diff != "" {
+				t.Errorf("updateGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestEmailDomainGroup(t *testing.T) {
+	t.Parallel()
+	apiGroups := func(context.Context, *sessions.State) ([]string, error) { return []string{"from-api"}, nil }
+	tests := []struct {
+		name          string
+		userGroupFn   userGroupFunc
+		claims        map[string]interface{}
+		email         string
+		emailVerified bool
+		groups        []string
+		want          []string
+	}{
+		{"api groups", apiGroups, map[string]interface{}{}, "user@Example.com", true, nil, []string{"from-api", "domain:example.com"}},
+		{"claim groups", nil, map[string]interface{}{"groups": []string{"admins"}}, "user@example.com", true, nil, []string{"admins", "domain:example.com"}},
+		{"no groups", nil, map[string]interface{}{}, "user@example.com", true, nil, []string{"domain:example.com"}},
+		{"not added twice", nil, map[string]interface{}{}, "user@example.com", true, []string{"domain:example.com"}, []string{"domain:example.com"}},
+		{"unverified email", apiGroups, map[string]interface{}{}, "user@example.com", false, nil, []string{"from-api"}},
+		{"no email", apiGroups, map[string]interface{}{}, "", true, nil, []string{"from-api"}},
+		{"no domain", apiGroups, map[string]interface{}{}, "user@", true, nil, []string{"from-api"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provider{EmailDomainGroup: true}
+			if tt.userGroupFn != nil {
+				p.UserGroupFn = withEmailDomainGroup(tt.userGroupFn)
+			}
+			s := &sessions.State{Email: tt.email, EmailVerified: tt.emailVerified, Groups: tt.groups}
+			if err := p.updateGroups(context.Background(), s, newTestIDToken(t, tt.claims)); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, s.Groups); diff != "" {
+				t.Errorf("updateGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestEmailDomainGroupCached(t *testing.T) {
+	t.Parallel()
+	// groups with spare capacity, which appending to would share
+	fn := func(context.Context, *sessions.State) ([]string, error) {
+		return append(make([]string, 0, 4), "admins"), nil
+	}
+	cached := newGroupsCache("test", "client", DefaultGroupsCacheTTL, nil).wrap(fn)
+	if _, err := cached(context.Background(), &sessions.State{Subject: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for _, domain := range []string{"a.example.com", "b.example.com"} {
+		domain := domain
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				s := &sessions.State{Subject: "user", Email: "user@" + domain, EmailVerified: true}
+				groups, err := cached(context.Background(), s)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if diff := cmp.Diff([]string{"admins", "domain:" + domain}, addEmailDomainGroup(s, groups)); diff != "" {
+					t.Errorf("addEmailDomainGroup() = %s", diff)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestUpdateGroupsAudit(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		fn   userGroupFunc
+		want audit.Event
+	}{
+		{"resolved", func(context.Context, *sessions.State) ([]string, error) { return []string{"admins"}, nil },
+			audit.Event{Type: audit.GroupResolution, Outcome: audit.Success, Subject: "user", Provider: "corp", Groups: []string{"admins"}}},
+		{"failed", func(context.Context, *sessions.State) ([]string, error) { return nil, errors.New("api error") },
+			audit.Event{Type: audit.GroupResolution, Outcome: audit.Failure, Subject: "user", Provider: "corp", Reason: "internal/identity: could not retrieve groups api error"}},
+	}
+	for _, tt := range tests {
+		sink := &audit.MockSink{}
+		p := &Provider{Name: "corp", UserGroupFn: tt.fn, Audit: audit.New(sink)}
+		p.updateGroups(context.Background(), &sessions.State{Subject: "user"}, newTestIDToken(t, map[string]interface{}{}))
+		events := sink.Events()
+		if len(events) != 1 {
+			t.Fatalf("%s: updateGroups() audit events = %v, want 1", tt.name, events)
+		}
+		got := events[0]
+		got.Time = time.Time{}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s: updateGroups() audit event = %s", tt.name, diff)
+		}
+	}
+}
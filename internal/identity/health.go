@@ -0,0 +1,88 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/httputil"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+)
+
+// healthCheckTTL is how long the result of a health check is reused, so
+// that frequent health polls don't each make a request to the provider.
+const healthCheckTTL = 10 * time.Second
+
+// HealthChecker is implemented by identity providers which can report
+// whether they are reachable.
+type HealthChecker interface {
+	Healthy(context.Context) error
+}
+
+// healthCheck caches the result of a provider's health check. Concurrent
+// callers wait for a single check rather than each making their own.
+type healthCheck struct {
+	check func(context.Context) error
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+func newHealthCheck(check func(context.Context) error) *healthCheck {
+	return &healthCheck{check: check, ttl: healthCheckTTL, now: time.Now}
+}
+
+func (h *healthCheck) result(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.checkedAt.IsZero() && h.now().Sub(h.checkedAt) < h.ttl {
+		return h.err
+	}
+	err := h.check(ctx)
+	if ctx.Err() != nil {
+		// the caller gave up, which says nothing about the provider
+		return err
+	}
+	h.checkedAt, h.err = h.now(), err
+	return err
+}
+
+// Healthy reports whether the identity provider is reachable, by fetching
+// the signing keys advertised in its discovery document. Results are reused
+// for a few seconds. Providers which don't use OpenID Connect discovery are
+// not probed, and are always reported healthy.
+func (p *Provider) Healthy(ctx context.Context) error {
+	if p.health == nil {
+		return p.checkHealth(ctx)
+	}
+	return p.health.result(ctx)
+}
+
+func (p *Provider) checkHealth(ctx context.Context) error {
+	if p.provider == nil {
+		return nil
+	}
+	var claims struct {
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := p.provider.Claims(&claims); err != nil {
+		return fmt.Errorf("internal/identity: invalid discovery document: %w", err)
+	}
+	var status int
+	opts := &httputil.ClientOptions{
+		HTTPClient: p.HTTPClient,
+		Observe: func(code int, d time.Duration, err error) {
+			status = code
+			metrics.RecordIdentityAPIRequest(ctx, p.ProviderName, opHealthCheck, code, d, err)
+		},
+	}
+	if _, err := httputil.ClientWithOptions(ctx, opts, http.MethodGet, claims.JWKSURL, p.userAgent(), nil, nil, nil); err != nil {
+		return classifyError(status, fmt.Errorf("internal/identity: could not fetch %s: %w", claims.JWKSURL, err))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+)
+
+func TestProviderHealthy(t *testing.T) {
+	var status, fetches int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":   srv.URL,
+				"jwks_uri": srv.URL + "/keys",
+			})
+		case "/keys":
+			atomic.AddInt32(&fetches, 1)
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+			w.Write([]byte(`{"keys":[]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Provider{ProviderName: OIDCProviderName, provider: provider}
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	p.health = newHealthCheck(p.checkHealth)
+	p.health.now = func() time.Time { return now }
+
+	tests := []struct {
+		name            string
+		advance         time.Duration
+		status          int32
+		wantUnavailable bool
+		wantErr         bool
+		wantFetches     int32
+	}{
+		{"healthy", 0, http.StatusOK, false, false, 1},
+		{"cached", time.Second, http.StatusServiceUnavailable, false, false, 1},
+		{"unavailable", healthCheckTTL, http.StatusServiceUnavailable, true, true, 2},
+		{"unavailable cached", time.Second, http.StatusOK, true, true, 2},
+		{"not found", healthCheckTTL, http.StatusNotFound, false, true, 3},
+		{"recovered", healthCheckTTL, http.StatusOK, false, false, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			atomic.StoreInt32(&status, tt.status)
+			err := p.Healthy(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Healthy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := errors.Is(err, ErrProviderUnavailable); got != tt.wantUnavailable {
+				t.Errorf("Healthy() error = %v, want ErrProviderUnavailable %v", err, tt.wantUnavailable)
+			}
+			if got := atomic.LoadInt32(&fetches); got != tt.wantFetches {
+				t.Errorf("fetches = %d, want %d", got, tt.wantFetches)
+			}
+		})
+	}
+
+	// providers without discovery aren't probed
+	if err := (&Provider{ProviderName: GithubProviderName}).Healthy(ctx); err != nil {
+		t.Errorf("Healthy() error = %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Claims are the claims of an id token verified by ValidateToken.
+type Claims struct {
+	Issuer   string
+	Subject  string
+	Audience []string
+	Expiry   time.Time
+	IssuedAt time.Time
+
+	Email string
+	// Groups are read from the provider's groups claim, if the token has
+	// it.
+	Groups []string
+
+	// Raw holds all of the token's claims, by name.
+	Raw map[string]interface{}
+}
+
+// ValidateToken verifies an id token issued by the provider, to its client,
+// without a sign in: that it was signed with one of the provider's signing
+// keys, by its issuer, for its client id, and hasn't expired. This lets
+// clients which already hold an id token present it directly.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+func (p *Provider) ValidateToken(ctx context.Context, rawIDToken string) (*Claims, error) {
+	if p.idTokenVerifier() == nil {
+		return nil, ErrTokenValidationNotSupported
+	}
+	if rawIDToken == "" {
+		return nil, ErrMissingToken
+	}
+	idToken, err := p.verifyIDToken(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("internal/identity: invalid id token: %w", err)
+	}
+	claims := &Claims{
+		Issuer:   idToken.Issuer,
+		Subject:  idToken.Subject,
+		Audience: idToken.Audience,
+		Expiry:   idToken.Expiry,
+		IssuedAt: idToken.IssuedAt,
+	}
+	if err := idToken.Claims(&claims.Raw); err != nil {
+		return nil, fmt.Errorf("internal/identity: couldn't unmarshal claims: %w", err)
+	}
+	claims.Email, _ = claims.Raw["email"].(string)
+	claim := p.GroupsClaim
+	if claim == "" {
+		claim = DefaultGroupsClaim
+	}
+	groups, _, err := groupsFromIDToken(idToken, claim)
+	if err != nil {
+		return nil, err
+	}
+	claims.Groups = p.normalizeGroups(groups)
+	return claims, nil
+}
@@ -0,0 +1,173 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestProviderValidateToken(t *testing.T) {
+	t.Parallel()
+	now := time.Now().Truncate(time.Second)
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    "https://idp.example.com",
+			"aud":    "client",
+			"sub":    "user",
+			"iat":    now.Unix(),
+			"exp":    now.Add(time.Hour).Unix(),
+			"email":  "user@example.com",
+			"groups": []string{"4821", "admins"},
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	tests := []struct {
+		name    string
+		token   string
+		want    *Claims
+		wantErr bool
+	}{
+		{"valid", testJWT(t, claims(nil)), &Claims{
+			Issuer:   "https://idp.example.com",
+			Subject:  "user",
+			Audience: []string{"client"},
+			Expiry:   now.Add(time.Hour),
+			IssuedAt: now,
+			Email:    "user@example.com",
+			Groups:   []string{"backend", "admins"},
+		}, false},
+		{"expired", testJWT(t, claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), nil, true},
+		{"wrong audience", testJWT(t, claims(map[string]interface{}{"aud": "other"})), nil, true},
+		{"wrong issuer", testJWT(t, claims(map[string]interface{}{"iss": "https://other.example.com"})), nil, true},
+		{"invalid groups", testJWT(t, claims(map[string]interface{}{"groups": 42})), nil, true},
+		{"not a jwt", "token", nil, true},
+	}
+	p := &Provider{
+		GroupAliases: map[string]string{"4821": "backend"},
+		verifier:     oidc.NewVerifier("https://idp.example.com", insecureKeySet{}, &oidc.Config{ClientID: "client"}),
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := p.ValidateToken(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got, cmpopts.IgnoreFields(Claims{}, "Raw")); diff != "" {
+				t.Errorf("ValidateToken() = %s", diff)
+			}
+			if got != nil && got.Raw["sub"] != "user" {
+				t.Errorf("ValidateToken() raw claims = %v", got.Raw)
+			}
+		})
+	}
+
+	if _, err := p.ValidateToken(context.Background(), ""); err != ErrMissingToken {
+		t.Errorf("ValidateToken() error = %v, want %v", err, ErrMissingToken)
+	}
+	if _, err := (&Provider{}).ValidateToken(context.Background(), "token"); err != ErrTokenValidationNotSupported {
+		t.Errorf("ValidateToken() error = %v, want %v", err, ErrTokenValidationNotSupported)
+	}
+}
+
+func TestProviderVerifyIDTokenAudiences(t *testing.T) {
+	t.Parallel()
+	token := func(aud interface{}) string {
+		return testJWT(t, map[string]interface{}{
+			"iss": "https://idp.example.com",
+			"aud": aud,
+			"sub": "user",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+	}
+	tests := []struct {
+		name     string
+		audience []string
+		token    string
+		wantErr  bool
+	}{
+		{"client id", []string{"spa"}, token("client"), false},
+		{"allowed audience", []string{"spa", "backend"}, token("backend"), false},
+		{"one of several audiences", []string{"spa"}, token([]string{"other", "spa"}), false},
+		{"audience not allowed", []string{"spa"}, token("other"), true},
+		{"no allowed audiences", nil, token("spa"), true},
+		{"no allowed audiences, client id", nil, token("client"), false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			p := &Provider{
+				ClientID:         "client",
+				AllowedAudiences: tt.audience,
+				verifier: oidc.NewVerifier("https://idp.example.com", insecureKeySet{}, &oidc.Config{
+					ClientID:          "client",
+					SkipClientIDCheck: len(tt.audience) != 0,
+				}),
+			}
+			_, err := p.verifyIDToken(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && len(tt.audience) != 0 && !errors.Is(err, ErrAudienceNotAllowed) {
+				t.Errorf("verifyIDToken() error = %v, want %v", err, ErrAudienceNotAllowed)
+			}
+		})
+	}
+}
+
+func TestProviderVerifyIDTokenIssuers(t *testing.T) {
+	t.Parallel()
+	token := func(iss string) string {
+		return testJWT(t, map[string]interface{}{
+			"iss": iss,
+			"aud": "client",
+			"sub": "user",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+	}
+	tests := []struct {
+		name     string
+		issuers  []string
+		token    string
+		wantErr  bool
+		wantKind error
+	}{
+		{"discovery issuer", nil, token("https://idp.example.com"), false, nil},
+		{"other issuer", nil, token("https://other.example.com"), true, nil},
+		{"pinned issuer", []string{"https://idp.example.com"}, token("https://idp.example.com"), false, nil},
+		{"one of several pinned issuers", []string{"https://idp.example.com", "https://tenant.idp.example.com"}, token("https://tenant.idp.example.com"), false, nil},
+		{"issuer not pinned", []string{"https://tenant.idp.example.com"}, token("https://idp.example.com"), true, ErrIssuerNotAllowed},
+		{"secondary idp", []string{"https://idp.example.com"}, token("https://idp.example.com/"), true, ErrIssuerNotAllowed},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			p := &Provider{
+				ClientID:       "client",
+				AllowedIssuers: tt.issuers,
+				verifier: oidc.NewVerifier("https://idp.example.com", insecureKeySet{}, &oidc.Config{
+					ClientID:        "client",
+					SkipIssuerCheck: len(tt.issuers) != 0,
+				}),
+			}
+			_, err := p.verifyIDToken(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantKind != nil && !errors.Is(err, tt.wantKind) {
+				t.Errorf("verifyIDToken() error = %v, want %v", err, tt.wantKind)
+			}
+		})
+	}
+}
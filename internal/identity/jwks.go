@@ -0,0 +1,344 @@
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/pomerium/pomerium/internal/httputil"
+	"github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/internal/version"
+)
+
+// DefaultJWKSRefreshInterval is the default interval at which an identity
+// provider's signing keys are re-fetched from its jwks_uri.
+const DefaultJWKSRefreshInterval = time.Hour
+
+// minJWKSRefreshInterval is the shortest interval signing keys are refetched
+// at, whether following cache headers, retrying a failed fetch, or looking
+// for a key which isn't in the current key set.
+const minJWKSRefreshInterval = time.Minute
+
+// refreshingKeySet is an oidc.KeySet whose keys are periodically refetched
+// from an identity provider's jwks_uri, so that rotated signing keys are
+// picked up without a restart.
+//
+// The key set is replaced as a whole once a fetch has completed, so
+// verification never sees a partially updated set of keys.
+type refreshingKeySet struct {
+	jwksURL   string
+	client    *http.Client
+	interval  time.Duration
+	userAgent string
+
+	keys atomic.Value // *jose.JSONWebKeySet
+
+	// mu serializes fetches, and guards lastFetch.
+	mu        sync.Mutex
+	lastFetch time.Time
+}
+
+// newRefreshingKeySet returns a key set for the keys at jwksURL, refreshed
+// every interval or sooner if the response's cache headers expire first. If
+// the interval is negative, keys are only refetched when a token is signed
+// with an unknown key.
+func newRefreshingKeySet(jwksURL string, client *http.Client, interval time.Duration) *refreshingKeySet {
+	if client == nil {
+		client = httputil.DefaultClient
+	}
+	if interval == 0 {
+		interval = DefaultJWKSRefreshInterval
+	}
+	ks := &refreshingKeySet{
+		jwksURL:   jwksURL,
+		client:    client,
+		interval:  interval,
+		userAgent: version.UserAgent(),
+	}
+	ks.keys.Store(&jose.JSONWebKeySet{})
+	return ks
+}
+
+// VerifySignature implements oidc.KeySet. If no current key verifies the
+// token, the keys are refetched once in case the provider has rotated them.
+func (ks *refreshingKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("internal/identity: malformed jwt: %w", err)
+	}
+	if payload, ok := ks.verify(jws); ok {
+		return payload, nil
+	}
+	if err := ks.refreshIfStale(ctx); err != nil {
+		return nil, fmt.Errorf("internal/identity: failed to fetch signing keys: %w", err)
+	}
+	if payload, ok := ks.verify(jws); ok {
+		return payload, nil
+	}
+	return nil, errors.New("internal/identity: failed to verify id token signature")
+}
+
+// verify verifies jws against the current key set, returning its payload.
+func (ks *refreshingKeySet) verify(jws *jose.JSONWebSignature) ([]byte, bool) {
+	// tokens with multiple signatures aren't supported, as with go-oidc
+	var keyID string
+	for _, sig := range jws.Signatures {
+		keyID = sig.Header.KeyID
+		break
+	}
+	keys := ks.keys.Load().(*jose.JSONWebKeySet)
+	for _, key := range keys.Keys {
+		if keyID != "" && key.KeyID != keyID {
+			continue
+		}
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, true
+		}
+	}
+	return nil, false
+}
+
+// run refreshes the key set until ctx is done.
+func (ks *refreshingKeySet) run(ctx context.Context) {
+	if ks.interval < 0 {
+		return
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		next, err := ks.refresh(ctx)
+		if err != nil {
+			log.Warn().Err(err).Str("jwks_uri", ks.jwksURL).Msg("internal/identity: failed to refresh signing keys")
+			next = minJWKSRefreshInterval
+		}
+		timer.Reset(next)
+	}
+}
+
+// refreshIfStale refetches the key set unless it was fetched recently, so
+// that tokens signed with unknown keys can't be used to hammer the provider.
+func (ks *refreshingKeySet) refreshIfStale(ctx context.Context) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if time.Since(ks.lastFetch) < minJWKSRefreshInterval {
+		return nil
+	}
+	_, err := ks.refreshLocked(ctx)
+	return err
+}
+
+// refresh fetches the key set and swaps it in, returning how long until it
+// should next be refreshed.
+func (ks *refreshingKeySet) refresh(ctx context.Context) (time.Duration, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.refreshLocked(ctx)
+}
+
+func (ks *refreshingKeySet) refreshLocked(ctx context.Context) (time.Duration, error) {
+	keys, maxAge, err := ks.fetch(ctx)
+	if err != nil {
+		return 0, err
+	}
+	ks.keys.Store(keys)
+	ks.lastFetch = time.Now()
+
+	next := ks.interval
+	if next < 0 || (maxAge > 0 && maxAge < next) {
+		next = maxAge
+	}
+	if next < minJWKSRefreshInterval {
+		next = minJWKSRefreshInterval
+	}
+	return next, nil
+}
+
+// fetch retrieves the key set, and how long the response may be cached
+// for, if the response says.
+func (ks *refreshingKeySet) fetch(ctx context.Context) (*jose.JSONWebKeySet, time.Duration, error) {
+	// the key set is read no further than any other provider response
+	var keys jose.JSONWebKeySet
+	h, err := httputil.ClientWithOptions(ctx, &httputil.ClientOptions{HTTPClient: ks.client},
+		http.MethodGet, ks.jwksURL, ks.userAgent, nil, nil, &keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &keys, cacheMaxAge(h, time.Now()), nil
+}
+
+// cacheMaxAge returns how long a response may be cached for according to its
+// Cache-Control max-age directive or, failing that, its Expires header. Zero
+// is returned if neither is set.
+func cacheMaxAge(h http.Header, now time.Time) time.Duration {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		if secs, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	if expires, err := http.ParseTime(h.Get("Expires")); err == nil && expires.After(now) {
+		return expires.Sub(now)
+	}
+	return 0
+}
+
+// newVerifier returns an ID token verifier for the provider whose signing
+// keys are refreshed in the background every JWKSRefreshInterval.
+func (p *Provider) newVerifier() (*oidc.IDTokenVerifier, error) {
+	var claims struct {
+		Issuer     string   `json:"issuer"`
+		JWKSURL    string   `json:"jwks_uri"`
+		Algorithms []string `json:"id_token_signing_alg_values_supported"`
+		EndSession string   `json:"end_session_endpoint"`
+	}
+	if err := p.provider.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("internal/identity: invalid discovery document: %w", err)
+	}
+	if p.InsecureSkipVerify {
+		return p.newInsecureVerifier(claims.Issuer, claims.EndSession), nil
+	}
+	if claims.JWKSURL == "" {
+		return nil, errors.New("internal/identity: discovery document has no jwks_uri")
+	}
+	ks := newRefreshingKeySet(claims.JWKSURL, p.HTTPClient, p.JWKSRefreshInterval)
+	ks.userAgent = p.userAgent()
+	// the key set is refreshed until the provider is closed
+	var ctx context.Context
+	ctx, p.stopKeyRefresh = context.WithCancel(context.Background())
+	go ks.run(ctx)
+	// access tokens issued to machine clients are for an audience of their
+	// own, so only their issuer and signature are checked
+	// go-oidc only accepts a single issuer, so if issuers are pinned
+	// tokens' issuers are checked by checkIssuer instead
+	skipIssuerCheck := len(p.AllowedIssuers) != 0
+	p.accessTokenVerifier = oidc.NewVerifier(claims.Issuer, ks, &oidc.Config{
+		SkipClientIDCheck:    true,
+		SkipIssuerCheck:      skipIssuerCheck,
+		SupportedSigningAlgs: signingAlgorithms(claims.Algorithms),
+	})
+	p.logoutTokenVerifier = oidc.NewVerifier(claims.Issuer, ks, &oidc.Config{
+		ClientID:             p.ClientID,
+		SkipExpiryCheck:      true,
+		SkipIssuerCheck:      skipIssuerCheck,
+		SupportedSigningAlgs: signingAlgorithms(claims.Algorithms),
+	})
+	p.endSessionURL = claims.EndSession
+	// likewise, if other audiences are allowed id tokens' audiences are
+	// checked by verifyIDToken
+	return oidc.NewVerifier(claims.Issuer, ks, &oidc.Config{
+		ClientID:             p.ClientID,
+		SkipClientIDCheck:    len(p.AllowedAudiences) != 0,
+		SkipIssuerCheck:      skipIssuerCheck,
+		SupportedSigningAlgs: signingAlgorithms(claims.Algorithms),
+	}), nil
+}
+
+// Close stops the background refresh of the provider's signing keys.
+func (p *Provider) Close() error {
+	if p.stopKeyRefresh != nil {
+		p.stopKeyRefresh()
+	}
+	return nil
+}
+
+// idTokenVerifier returns the provider's current ID token verifier, or nil
+// if it has none.
+func (p *Provider) idTokenVerifier() *oidc.IDTokenVerifier {
+	p.verifierMu.RLock()
+	defer p.verifierMu.RUnlock()
+	return p.verifier
+}
+
+// insecureSigningAlgorithms are the algorithms accepted when signatures
+// aren't verified, including those mock identity providers use for
+// unsigned, or symmetrically signed, tokens.
+var insecureSigningAlgorithms = []string{
+	"none", "HS256", "HS384", "HS512",
+	oidc.RS256, oidc.RS384, oidc.RS512,
+	oidc.ES256, oidc.ES384, oidc.ES512,
+	oidc.PS256, oidc.PS384, oidc.PS512,
+}
+
+// newInsecureVerifier returns verifiers, for InsecureSkipVerify, which
+// check tokens' audience and expiry as usual, but not their signature or
+// issuer, so that a mock identity provider can be developed against.
+func (p *Provider) newInsecureVerifier(issuer, endSessionURL string) *oidc.IDTokenVerifier {
+	log.Warn().Str("provider", p.ProviderName).Str("issuer", issuer).
+		Msg("internal/identity: INSECURE: id token signatures and issuers are not verified; anyone can forge tokens, never use this in production")
+	ks := unverifiedKeySet{}
+	p.accessTokenVerifier = oidc.NewVerifier(issuer, ks, &oidc.Config{
+		SkipClientIDCheck:    true,
+		SkipIssuerCheck:      true,
+		SupportedSigningAlgs: insecureSigningAlgorithms,
+	})
+	p.logoutTokenVerifier = oidc.NewVerifier(issuer, ks, &oidc.Config{
+		ClientID:             p.ClientID,
+		SkipExpiryCheck:      true,
+		SkipIssuerCheck:      true,
+		SupportedSigningAlgs: insecureSigningAlgorithms,
+	})
+	p.endSessionURL = endSessionURL
+	return oidc.NewVerifier(issuer, ks, &oidc.Config{
+		ClientID:             p.ClientID,
+		SkipClientIDCheck:    len(p.AllowedAudiences) != 0,
+		SkipIssuerCheck:      true,
+		SupportedSigningAlgs: insecureSigningAlgorithms,
+	})
+}
+
+// unverifiedKeySet accepts every token's signature, returning its payload
+// as though it had been verified.
+type unverifiedKeySet struct{}
+
+func (unverifiedKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("internal/identity: malformed jwt")
+	}
+	return base64.RawURLEncoding.DecodeString(parts[1])
+}
+
+// supportedSigningAlgorithms are the id token signing algorithms go-oidc
+// can verify.
+var supportedSigningAlgorithms = map[string]bool{
+	oidc.RS256: true,
+	oidc.RS384: true,
+	oidc.RS512: true,
+	oidc.ES256: true,
+	oidc.ES384: true,
+	oidc.ES512: true,
+	oidc.PS256: true,
+	oidc.PS384: true,
+	oidc.PS512: true,
+}
+
+// signingAlgorithms returns the algorithms advertised in a provider's
+// discovery document which can be verified, as oidc.Provider.Verifier does.
+// If none are, nil is returned and go-oidc's default of RS256 applies.
+func signingAlgorithms(advertised []string) []string {
+	var algs []string
+	for _, alg := range advertised {
+		if supportedSigningAlgorithms[alg] {
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
@@ -0,0 +1,405 @@
+package identity
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/pomerium/pomerium/internal/httputil"
+)
+
+func newTestSigningKey(t *testing.T, kid string) (jose.Signer, jose.JSONWebKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, jwk.Public()
+}
+
+func signTestToken(t *testing.T, signer jose.Signer, payload string) string {
+	t.Helper()
+	jws, err := signer.Sign([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// setVerifier swaps the provider's ID token verifier, for one with another
+// key set, as verifications are in progress.
+func (p *Provider) setVerifier(v *oidc.IDTokenVerifier) {
+	p.verifierMu.Lock()
+	defer p.verifierMu.Unlock()
+	p.verifier = v
+}
+
+func TestRefreshingKeySet(t *testing.T) {
+	t.Parallel()
+	oldSigner, oldKey := newTestSigningKey(t, "old")
+	newSigner, newKey := newTestSigningKey(t, "new")
+
+	var mu sync.Mutex
+	keys := []jose.JSONWebKey{oldKey}
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		w.Header().Set("Cache-Control", "public, max-age=120")
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: keys})
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	ks := newRefreshingKeySet(srv.URL, nil, time.Hour)
+
+	// the first verification fetches the key set
+	if _, err := ks.VerifySignature(ctx, signTestToken(t, oldSigner, "old")); err != nil {
+		t.Fatalf("VerifySignature() error = %v", err)
+	}
+
+	// the provider rotates its keys; the key set was fetched too recently to
+	// be refetched on demand
+	mu.Lock()
+	keys = []jose.JSONWebKey{newKey}
+	mu.Unlock()
+	if _, err := ks.VerifySignature(ctx, signTestToken(t, newSigner, "new")); err == nil {
+		t.Fatal("VerifySignature() expected error for unknown key")
+	}
+
+	// a scheduled refresh swaps in the new keys, following cache headers
+	next, err := ks.refresh(ctx)
+	if err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	if next != 2*time.Minute {
+		t.Errorf("refresh() next = %s, want %s", next, 2*time.Minute)
+	}
+	payload, err := ks.VerifySignature(ctx, signTestToken(t, newSigner, "new"))
+	if err != nil {
+		t.Fatalf("VerifySignature() error = %v", err)
+	}
+	if string(payload) != "new" {
+		t.Errorf("VerifySignature() = %q, want %q", payload, "new")
+	}
+	if _, err := ks.VerifySignature(ctx, signTestToken(t, oldSigner, "old")); err == nil {
+		t.Error("VerifySignature() expected error for rotated out key")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 2 {
+		t.Errorf("fetches = %d, want 2", fetches)
+	}
+}
+
+func TestRefreshingKeySetFailedRefresh(t *testing.T) {
+	t.Parallel()
+	signer, key := newTestSigningKey(t, "kid")
+	fail := false
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key}})
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	ks := newRefreshingKeySet(srv.URL, nil, time.Hour)
+	if _, err := ks.refresh(ctx); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	if _, err := ks.refresh(ctx); err == nil {
+		t.Fatal("refresh() expected error")
+	}
+	// a failed refresh keeps the previous keys
+	if _, err := ks.VerifySignature(ctx, signTestToken(t, signer, "payload")); err != nil {
+		t.Errorf("VerifySignature() error = %v", err)
+	}
+}
+
+func TestRefreshingKeySetTooLarge(t *testing.T) {
+	t.Parallel()
+	_, key := newTestSigningKey(t, "kid")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a valid key set, padded past the response size limit
+		keys, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key}})
+		w.Write(keys[:len(keys)-1])
+		w.Write([]byte(`,"padding":"`))
+		w.Write(bytes.Repeat([]byte("a"), httputil.DefaultMaxResponseBodySize))
+		w.Write([]byte(`"}`))
+	}))
+	defer srv.Close()
+
+	ks := newRefreshingKeySet(srv.URL, nil, time.Hour)
+	if _, err := ks.refresh(context.Background()); !errors.Is(err, httputil.ErrResponseTooLarge) {
+		t.Errorf("refresh() error = %v, want %v", err, httputil.ErrResponseTooLarge)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"none", http.Header{}, 0},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=3600"}}, time.Hour},
+		{"invalid max-age", http.Header{"Cache-Control": {"max-age=soon"}}, 0},
+		{"expires", http.Header{"Expires": {now.Add(30 * time.Minute).Format(http.TimeFormat)}}, 30 * time.Minute},
+		{"expired", http.Header{"Expires": {now.Add(-time.Minute).Format(http.TimeFormat)}}, 0},
+		{"max-age over expires", http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Expires":       {now.Add(time.Hour).Format(http.TimeFormat)},
+		}, time.Minute},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := cacheMaxAge(tt.header, now); got != tt.want {
+				t.Errorf("cacheMaxAge() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProviderNewVerifier(t *testing.T) {
+	t.Parallel()
+	signer, key := newTestSigningKey(t, "kid")
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                                srv.URL,
+				"authorization_endpoint":                srv.URL + "/auth",
+				"token_endpoint":                        srv.URL + "/token",
+				"jwks_uri":                              srv.URL + "/keys",
+				"id_token_signing_alg_values_supported": []string{"ES256", "HS256"},
+			})
+		case "/keys":
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Provider{ClientID: "client", provider: provider, JWKSRefreshInterval: -1}
+	verifier, err := p.newVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the id token is signed with an algorithm advertised by the provider,
+	// rather than go-oidc's default of RS256
+	rawIDToken := signTestToken(t, signer, fmt.Sprintf(`{"iss":%q,"aud":"client","sub":"user","exp":%d}`,
+		srv.URL, time.Now().Add(time.Hour).Unix()))
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if idToken.Subject != "user" {
+		t.Errorf("Verify() subject = %q, want %q", idToken.Subject, "user")
+	}
+}
+
+func TestProviderClose(t *testing.T) {
+	t.Parallel()
+	fetching := make(chan struct{})
+	stopped := make(chan struct{})
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                 srv.URL,
+				"authorization_endpoint": srv.URL + "/auth",
+				"token_endpoint":         srv.URL + "/token",
+				"jwks_uri":               srv.URL + "/keys",
+			})
+		case "/keys":
+			// the background refresh hangs until it's stopped
+			close(fetching)
+			<-r.Context().Done()
+			close(stopped)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	provider, err := oidc.NewProvider(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Provider{ClientID: "client", provider: provider}
+	if _, err := p.newVerifier(); err != nil {
+		t.Fatal(err)
+	}
+	<-fetching
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() didn't stop the signing keys being refreshed")
+	}
+}
+
+func TestProviderNewVerifierInsecureSkipVerify(t *testing.T) {
+	t.Parallel()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a mock identity provider, which has no signing keys
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/auth",
+			"token_endpoint":         srv.URL + "/token",
+		})
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Provider{ClientID: "client", provider: provider}).newVerifier(); err == nil {
+		t.Fatal("newVerifier() without jwks_uri error = nil, want an error")
+	}
+
+	unsigned := func(alg string, claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": alg})
+		payload, _ := json.Marshal(claims)
+		return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString([]byte("sig"))
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"unsigned", unsigned("none", map[string]interface{}{"iss": "http://mock", "aud": "client", "sub": "user", "exp": exp}), false},
+		{"hmac signed", unsigned("HS256", map[string]interface{}{"iss": srv.URL, "aud": "client", "sub": "user", "exp": exp}), false},
+		{"other audience", unsigned("none", map[string]interface{}{"iss": srv.URL, "aud": "other", "sub": "user", "exp": exp}), true},
+		{"expired", unsigned("none", map[string]interface{}{"iss": srv.URL, "aud": "client", "sub": "user", "exp": time.Now().Add(-time.Hour).Unix()}), true},
+		{"malformed", "not-a-jwt", true},
+	}
+	p := &Provider{ClientID: "client", provider: provider, InsecureSkipVerify: true}
+	verifier, err := p.newVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idToken, err := verifier.Verify(ctx, tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && idToken.Subject != "user" {
+				t.Errorf("Verify() subject = %q, want %q", idToken.Subject, "user")
+			}
+		})
+	}
+}
+
+func TestProviderVerifierSwap(t *testing.T) {
+	t.Parallel()
+	oldSigner, oldKey := newTestSigningKey(t, "old")
+	_, newKey := newTestSigningKey(t, "new")
+	newKeySet := func(keys ...jose.JSONWebKey) *refreshingKeySet {
+		ks := newRefreshingKeySet("", nil, -1)
+		ks.keys.Store(&jose.JSONWebKeySet{Keys: keys})
+		// keep the key set from being fetched, should verification fail
+		ks.lastFetch = time.Now()
+		return ks
+	}
+	newVerifier := func(ks oidc.KeySet) *oidc.IDTokenVerifier {
+		return oidc.NewVerifier("https://idp.example.com", ks, &oidc.Config{ClientID: "client", SupportedSigningAlgs: []string{oidc.ES256}})
+	}
+	ks := newKeySet(oldKey)
+	p := &Provider{ClientID: "client", verifier: newVerifier(ks)}
+	rawIDToken := signTestToken(t, oldSigner, fmt.Sprintf(`{"iss":"https://idp.example.com","aud":"client","sub":"user","exp":%d}`,
+		time.Now().Add(time.Hour).Unix()))
+
+	// run with -race: verifications race the keys being rotated in, and the
+	// verifier being swapped for one with another key set which still has
+	// the old key
+	ctx, cancel := context.WithCancel(context.Background())
+	var swaps sync.WaitGroup
+	swaps.Add(1)
+	go func() {
+		defer swaps.Done()
+		for i := 0; ctx.Err() == nil; i++ {
+			if i%2 == 0 {
+				ks.keys.Store(&jose.JSONWebKeySet{Keys: []jose.JSONWebKey{oldKey, newKey}})
+				p.setVerifier(newVerifier(newKeySet(newKey, oldKey)))
+			} else {
+				ks.keys.Store(&jose.JSONWebKeySet{Keys: []jose.JSONWebKey{oldKey}})
+				p.setVerifier(newVerifier(ks))
+			}
+		}
+	}()
+
+	var verifications sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		verifications.Add(1)
+		go func() {
+			defer verifications.Done()
+			for j := 0; j < 200; j++ {
+				if _, err := p.verifyIDToken(context.Background(), rawIDToken); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	verifications.Wait()
+	cancel()
+	swaps.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("verifyIDToken() error = %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+// Role sources control which of a Keycloak user's roles are returned as
+// their groups.
+const (
+	// RoleSourceRealm returns only a user's realm roles (e.g. `admin`).
+	RoleSourceRealm = "realm"
+	// RoleSourceClient returns only a user's client roles, prefixed with
+	// the client they belong to (e.g. `account:manage-account`).
+	RoleSourceClient = "client"
+	// RoleSourceAll returns both realm and client roles.
+	RoleSourceAll = "all"
+)
+
+// KeycloakProvider is an implementation of the OpenID Connect provider for
+// Keycloak which maps a user's realm and client roles to groups.
+//
+// https://www.keycloak.org/docs/latest/server_admin/#_oidc
+type KeycloakProvider struct {
+	*Provider
+	RevokeURL string `json:"revocation_endpoint"`
+}
+
+// NewKeycloakProvider returns a new KeycloakProvider. The provider url is the
+// realm's issuer url (e.g. `https://keycloak.example.com/auth/realms/corp`).
+// https://www.pomerium.io/docs/identity-providers/keycloak.html
+func NewKeycloakProvider(p *Provider) (*KeycloakProvider, error) {
+	ctx := p.clientContext(context.Background())
+	if p.ProviderURL == "" {
+		return nil, ErrMissingProviderURL
+	}
+
+	switch p.RoleSource {
+	case "":
+		p.RoleSource = RoleSourceAll
+	case RoleSourceRealm, RoleSourceClient, RoleSourceAll:
+	default:
+		return nil, fmt.Errorf("identity/keycloak: unknown role source %q", p.RoleSource)
+	}
+
+	var err error
+	p.provider, err = p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Scopes = requireScopes(p.Scopes,
+		[]string{oidc.ScopeOpenID, "profile", "email", "offline_access"},
+		p.refreshScopes(oidc.ScopeOpenID))
+
+	p.verifier, err = p.newVerifier()
+	if err != nil {
+		return nil, err
+	}
+	p.oauth = &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint:     p.provider.Endpoint(),
+		RedirectURL:  p.RedirectURL.String(),
+		Scopes:       p.Scopes,
+	}
+
+	kp := &KeycloakProvider{Provider: p}
+	if err := p.provider.Claims(&kp); err != nil {
+		return nil, err
+	}
+	kp.UserGroupFn = kp.UserGroups
+	return kp, nil
+}
+
+// keycloakRoleClaims are the claims Keycloak uses to convey a user's realm
+// and client roles.
+type keycloakRoleClaims struct {
+	RealmAccess struct {
+		Roles []string `json:"roles"`
+	} `json:"realm_access"`
+	ResourceAccess map[string]struct {
+		Roles []string `json:"roles"`
+	} `json:"resource_access"`
+}
+
+// UserGroups returns the user's roles, as selected by the provider's
+// RoleSource. Realm roles are returned as is, while client roles are
+// prefixed with their client id to avoid collisions between clients.
+//
+// By default Keycloak only maps roles into the access token, which is read
+// here. The token was received directly from Keycloak's token endpoint, so
+// its signature is not verified again.
+//
+// https://www.keycloak.org/docs/latest/server_admin/#_role_mappers
+func (p *KeycloakProvider) UserGroups(ctx context.Context, s *sessions.State) ([]string, error) {
+	if s == nil || s.AccessToken == nil {
+		return nil, ErrMissingSession
+	}
+	tok, err := jwt.ParseSigned(s.AccessToken.AccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("identity/keycloak: could not parse access token: %w", err)
+	}
+	var claims keycloakRoleClaims
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, fmt.Errorf("identity/keycloak: could not read access token claims: %w", err)
+	}
+	groups := claims.roles(p.RoleSource)
+	logFrom(ctx).Debug().Strs("groups", groups).Msg("identity/keycloak: roles")
+	return groups, nil
+}
+
+// roles flattens the role claims into a list of groups for a role source.
+func (c keycloakRoleClaims) roles(source string) []string {
+	var groups []string
+	if source == RoleSourceRealm || source == RoleSourceAll {
+		groups = append(groups, c.RealmAccess.Roles...)
+	}
+	if source == RoleSourceClient || source == RoleSourceAll {
+		// sort clients so a user's groups are stable between sessions
+		clients := make([]string, 0, len(c.ResourceAccess))
+		for client := range c.ResourceAccess {
+			clients = append(clients, client)
+		}
+		sort.Strings(clients)
+		for _, client := range clients {
+			for _, role := range c.ResourceAccess[client].Roles {
+				groups = append(groups, client+":"+role)
+			}
+		}
+	}
+	return groups
+}
+
+// Revoke attempts to revoke session access via revocation endpoint. The
+// refresh token is preferred, as revoking it also ends the user's session.
+// https://www.keycloak.org/docs/latest/securing_apps/#_token_revocation_endpoint
+func (p *KeycloakProvider) Revoke(ctx context.Context, token *oauth2.Token) error {
+	if token == nil || (token.AccessToken == "" && token.RefreshToken == "") {
+		return ErrMissingToken
+	}
+	params := url.Values{}
+	params.Add("client_id", p.ClientID)
+	params.Add("client_secret", p.ClientSecret)
+	if token.RefreshToken != "" {
+		params.Add("token", token.RefreshToken)
+		params.Add("token_type_hint", "refresh_token")
+	} else {
+		params.Add("token", token.AccessToken)
+		params.Add("token_type_hint", "access_token")
+	}
+	return p.revoke(ctx, p.RevokeURL, nil, params)
+}
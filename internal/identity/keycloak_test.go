@@ -0,0 +1,58 @@
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestKeycloakProviderUserGroups(t *testing.T) {
+	t.Parallel()
+	claims := map[string]interface{}{
+		"realm_access": map[string]interface{}{"roles": []string{"admin", "offline_access"}},
+		"resource_access": map[string]interface{}{
+			"grafana": map[string]interface{}{"roles": []string{"editor"}},
+			"account": map[string]interface{}{"roles": []string{"manage-account", "view-profile"}},
+		},
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte("sig"))
+
+	tests := []struct {
+		name        string
+		source      string
+		accessToken string
+		want        []string
+		wantErr     bool
+	}{
+		{"realm", RoleSourceRealm, accessToken, []string{"admin", "offline_access"}, false},
+		{"client", RoleSourceClient, accessToken, []string{"account:manage-account", "account:view-profile", "grafana:editor"}, false},
+		{"all", RoleSourceAll, accessToken, []string{"admin", "offline_access", "account:manage-account", "account:view-profile", "grafana:editor"}, false},
+		{"opaque access token", RoleSourceAll, "ACCESS", nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			p := &KeycloakProvider{Provider: &Provider{ProviderName: KeycloakProviderName, RoleSource: tt.source}}
+			got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: tt.accessToken}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UserGroups() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroups() = %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package identity
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+
+	"github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+// logContext returns ctx with a logger which tags events with the provider,
+// the operation being performed for the user, and the user's subject, if
+// known. Provider methods log through logFrom(ctx), so that logs from
+// different providers, and for different users, can be told apart.
+func (p *Provider) logContext(ctx context.Context, op string, s *sessions.State) context.Context {
+	l := logFrom(ctx).With().Str("provider", p.ProviderName).Str("operation", op)
+	if s != nil && s.Subject != "" {
+		l = l.Str("user", s.Subject)
+	}
+	logger := l.Logger()
+	return logger.WithContext(ctx)
+}
+
+// withLogContext tags the logs of each call to fn as logContext does.
+func (p *Provider) withLogContext(op string, fn userGroupFunc) userGroupFunc {
+	return func(ctx context.Context, s *sessions.State) ([]string, error) {
+		return fn(p.logContext(ctx, op, s), s)
+	}
+}
+
+// logFrom returns the logger of ctx, such as a request's logger or one set
+// by logContext, falling back to the global logger.
+func logFrom(ctx context.Context) *zerolog.Logger {
+	if l := log.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+	return &log.Logger
+}
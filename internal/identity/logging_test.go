@@ -0,0 +1,43 @@
+package identity
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rs/zerolog"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestProviderLogContext(t *testing.T) {
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf)
+	ctx := logger.WithContext(context.Background())
+	p := &Provider{ProviderName: GitlabProviderName}
+
+	fn := p.withLogContext(opUserGroups, func(ctx context.Context, s *sessions.State) ([]string, error) {
+		logFrom(ctx).Info().Msg("looking up groups")
+		return nil, nil
+	})
+	if _, err := fn(ctx, &sessions.State{Subject: "user"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"level":     "info",
+		"provider":  GitlabProviderName,
+		"operation": opUserGroups,
+		"user":      "user",
+		"message":   "looking up groups",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("log event = %s", diff)
+	}
+}
@@ -0,0 +1,101 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+// backChannelLogoutEvent is the member of a logout token's events claim
+// which marks it as a back-channel logout token.
+const backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// maxLogoutTokenAge is how long ago a logout token without an expiry may
+// have been issued.
+const maxLogoutTokenAge = 5 * time.Minute
+
+// LogoutToken is a verified OpenID Connect back-channel logout token. It
+// names the user's session with the provider, or if it doesn't, the user,
+// all of whose sessions have ended.
+type LogoutToken struct {
+	Subject   string
+	SessionID string
+}
+
+// VerifyLogoutToken verifies a back-channel logout token: that it's signed
+// by the provider, for the client, and recently issued, and that it's a
+// logout token rather than an id token, which the events claim and the lack
+// of a nonce tell apart.
+//
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#Validation
+func (p *Provider) VerifyLogoutToken(ctx context.Context, rawToken string) (*LogoutToken, error) {
+	if p.logoutTokenVerifier == nil {
+		return nil, ErrBackChannelLogoutNotSupported
+	}
+	if rawToken == "" {
+		return nil, ErrMissingToken
+	}
+	token, err := p.logoutTokenVerifier.Verify(ctx, rawToken)
+	if err == nil {
+		err = p.checkIssuer(token.Issuer)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("internal/identity: invalid logout token: %w", err)
+	}
+	var claims struct {
+		SessionID string                     `json:"sid"`
+		Events    map[string]json.RawMessage `json:"events"`
+		Nonce     *string                    `json:"nonce"`
+		Expiry    *int64                     `json:"exp"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("internal/identity: invalid logout token claims: %w", err)
+	}
+	if _, ok := claims.Events[backChannelLogoutEvent]; !ok {
+		return nil, errors.New("internal/identity: logout token has no back-channel logout event")
+	}
+	if claims.Nonce != nil {
+		return nil, errors.New("internal/identity: logout token must not have a nonce")
+	}
+	if token.Subject == "" && claims.SessionID == "" {
+		return nil, errors.New("internal/identity: logout token has neither a sub nor a sid")
+	}
+	now := time.Now()
+	if claims.Expiry != nil {
+		if now.After(time.Unix(*claims.Expiry, 0)) {
+			return nil, sessions.ErrExpired
+		}
+	} else if now.Sub(token.IssuedAt) > maxLogoutTokenAge {
+		return nil, fmt.Errorf("internal/identity: logout token issued %s ago: %w", now.Sub(token.IssuedAt).Round(time.Second), sessions.ErrExpired)
+	}
+	return &LogoutToken{Subject: token.Subject, SessionID: claims.SessionID}, nil
+}
+
+// GetEndSessionURL returns the url of the provider's end session endpoint,
+// with the id token hint and post logout redirect url set, or an empty
+// string if the provider has none. The redirect url must be registered as
+// one of the client's post logout redirect urls.
+//
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+func (p *Provider) GetEndSessionURL(idTokenHint, redirectURL string) string {
+	if p.endSessionURL == "" {
+		return ""
+	}
+	u, err := url.Parse(p.endSessionURL)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	if idTokenHint != "" {
+		q.Set("id_token_hint", idTokenHint)
+	}
+	q.Set("client_id", p.ClientID)
+	q.Set("post_logout_redirect_uri", redirectURL)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
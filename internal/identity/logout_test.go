@@ -0,0 +1,105 @@
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/google/go-cmp/cmp"
+)
+
+func testJWT(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`))
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString([]byte("sig"))
+}
+
+func TestProviderVerifyLogoutToken(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	events := map[string]interface{}{backChannelLogoutEvent: map[string]interface{}{}}
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    "https://idp.example.com",
+			"aud":    "client",
+			"iat":    now.Unix(),
+			"jti":    "logout",
+			"events": events,
+		}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+	tests := []struct {
+		name    string
+		token   string
+		want    *LogoutToken
+		wantErr bool
+	}{
+		{"session", testJWT(t, claims(map[string]interface{}{"sid": "session"})), &LogoutToken{SessionID: "session"}, false},
+		{"subject and session", testJWT(t, claims(map[string]interface{}{"sub": "user", "sid": "session"})), &LogoutToken{Subject: "user", SessionID: "session"}, false},
+		{"subject", testJWT(t, claims(map[string]interface{}{"sub": "user"})), &LogoutToken{Subject: "user"}, false},
+		{"unexpired", testJWT(t, claims(map[string]interface{}{"sub": "user", "iat": now.Add(-time.Hour).Unix(), "exp": now.Add(time.Hour).Unix()})), &LogoutToken{Subject: "user"}, false},
+		{"expired", testJWT(t, claims(map[string]interface{}{"sub": "user", "exp": now.Add(-time.Minute).Unix()})), nil, true},
+		{"issued long ago", testJWT(t, claims(map[string]interface{}{"sub": "user", "iat": now.Add(-time.Hour).Unix()})), nil, true},
+		{"neither subject nor session", testJWT(t, claims(nil)), nil, true},
+		{"no logout event", testJWT(t, claims(map[string]interface{}{"sub": "user", "events": map[string]interface{}{"other": map[string]interface{}{}}})), nil, true},
+		{"no events", testJWT(t, claims(map[string]interface{}{"sub": "user", "events": nil})), nil, true},
+		{"id token", testJWT(t, claims(map[string]interface{}{"sub": "user", "nonce": "nonce"})), nil, true},
+		{"other audience", testJWT(t, claims(map[string]interface{}{"sub": "user", "aud": "other"})), nil, true},
+		{"other issuer", testJWT(t, claims(map[string]interface{}{"sub": "user", "iss": "https://other.example.com"})), nil, true},
+		{"missing", "", nil, true},
+	}
+	p := &Provider{
+		logoutTokenVerifier: oidc.NewVerifier("https://idp.example.com", insecureKeySet{}, &oidc.Config{ClientID: "client", SkipExpiryCheck: true}),
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := p.VerifyLogoutToken(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyLogoutToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("VerifyLogoutToken() = %s", diff)
+			}
+		})
+	}
+
+	if _, err := (&Provider{}).VerifyLogoutToken(context.Background(), "token"); err != ErrBackChannelLogoutNotSupported {
+		t.Errorf("VerifyLogoutToken() error = %v, want %v", err, ErrBackChannelLogoutNotSupported)
+	}
+}
+
+func TestProviderGetEndSessionURL(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		endSessionURL string
+		idTokenHint   string
+		want          string
+	}{
+		{"id token hint", "https://idp.example.com/logout", "ID_TOKEN", "https://idp.example.com/logout?client_id=client&id_token_hint=ID_TOKEN&post_logout_redirect_uri=https%3A%2F%2Fcorp.example.com%2F"},
+		{"no id token", "https://idp.example.com/logout?tenant=corp", "", "https://idp.example.com/logout?client_id=client&post_logout_redirect_uri=https%3A%2F%2Fcorp.example.com%2F&tenant=corp"},
+		{"no end session endpoint", "", "ID_TOKEN", ""},
+	}
+	for _, tt := range tests {
+		p := &Provider{ClientID: "client", endSessionURL: tt.endSessionURL}
+		if got := p.GetEndSessionURL(tt.idTokenHint, "https://corp.example.com/"); got != tt.want {
+			t.Errorf("%s: GetEndSessionURL() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package identity
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -11,10 +10,7 @@ import (
 	oidc "github.com/coreos/go-oidc"
 	"golang.org/x/oauth2"
 
-	"github.com/pomerium/pomerium/internal/httputil"
-	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/sessions"
-	"github.com/pomerium/pomerium/internal/version"
 )
 
 // defaultAzureProviderURL Users with both a personal Microsoft
@@ -23,29 +19,43 @@ import (
 const defaultAzureProviderURL = "https://login.microsoftonline.com/common"
 const defaultAzureGroupURL = "https://graph.microsoft.com/v1.0/me/memberOf"
 
+// azureMaxGroupPages bounds the number of group pages that are followed.
+const azureMaxGroupPages = 50
+
 // AzureProvider is an implementation of the Provider interface
 type AzureProvider struct {
 	*Provider
 	// non-standard oidc fields
 	RevokeURL string `json:"end_session_endpoint"`
+
+	groupURL string
 }
 
 // NewAzureProvider returns a new AzureProvider and sets the provider url endpoints.
 // https://www.pomerium.io/docs/identity-providers.html#azure-active-directory
 func NewAzureProvider(p *Provider) (*AzureProvider, error) {
-	ctx := context.Background()
+	ctx := p.clientContext(context.Background())
 	if p.ProviderURL == "" {
 		p.ProviderURL = defaultAzureProviderURL
 	}
+	// prefer the groups in the id token, if the app registration's group
+	// membership claims are enabled, and only call the graph api for users
+	// with too many groups for the token
+	if p.GroupsClaim == "" {
+		p.GroupsClaim = DefaultGroupsClaim
+	}
 	var err error
-	p.provider, err = oidc.NewProvider(ctx, p.ProviderURL)
+	p.provider, err = p.discover(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if len(p.Scopes) == 0 {
-		p.Scopes = []string{oidc.ScopeOpenID, "profile", "email", "offline_access", "Group.Read.All"}
+	p.Scopes = requireScopes(p.Scopes,
+		[]string{oidc.ScopeOpenID, "profile", "email", "offline_access", "Group.Read.All"},
+		p.refreshScopes(oidc.ScopeOpenID, "Group.Read.All"))
+	p.verifier, err = p.newVerifier()
+	if err != nil {
+		return nil, err
 	}
-	p.verifier = p.provider.Verifier(&oidc.Config{ClientID: p.ClientID})
 	p.oauth = &oauth2.Config{
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
@@ -54,7 +64,7 @@ func NewAzureProvider(p *Provider) (*AzureProvider, error) {
 		Scopes:       p.Scopes,
 	}
 
-	azureProvider := &AzureProvider{Provider: p}
+	azureProvider := &AzureProvider{Provider: p, groupURL: defaultAzureGroupURL}
 	if err := p.provider.Claims(&azureProvider); err != nil {
 		return nil, err
 	}
@@ -67,46 +77,64 @@ func NewAzureProvider(p *Provider) (*AzureProvider, error) {
 // Revoke revokes the access token a given session state.
 // https://docs.microsoft.com/en-us/azure/active-directory/develop/v2-protocols-oidc#send-a-sign-out-request
 func (p *AzureProvider) Revoke(ctx context.Context, token *oauth2.Token) error {
+	if token == nil || token.AccessToken == "" {
+		return ErrMissingToken
+	}
 	params := url.Values{}
 	params.Add("token", token.AccessToken)
-	err := httputil.Client(ctx, http.MethodPost, p.RevokeURL, version.UserAgent(), nil, params, nil)
-	if err != nil && err != httputil.ErrTokenRevoked {
-		return err
-	}
-	return nil
+	return p.revoke(ctx, p.RevokeURL, nil, params)
 }
 
 // GetSignInURL returns the sign in url with typical oauth parameters
-func (p *AzureProvider) GetSignInURL(state string) string {
-	return p.oauth.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "select_account"))
+func (p *AzureProvider) GetSignInURL(state string, opts SignInOptions) string {
+	return p.oauth.AuthCodeURL(state, append([]oauth2.AuthCodeOption{
+		oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("prompt", "select_account"),
+	}, opts.authCodeOptions(p.Provider)...)...)
 }
 
-// UserGroups returns a slice of group names a given user is in.
-// `Directory.Read.All` is required.
+// UserGroups returns the object IDs of the groups a given user is a member
+// of, as the ID token's groups claim would. It is only called when the groups
+// are not in the ID token, such as when the token carries a groups overage
+// claim instead. `Group.Read.All` is required.
+//
+// The results are paginated, so the response's `@odata.nextLink` is followed
+// until exhausted.
 // https://docs.microsoft.com/en-us/graph/api/resources/directoryobject?view=graph-rest-1.0
 // https://docs.microsoft.com/en-us/graph/api/user-list-memberof?view=graph-rest-1.0
+// https://docs.microsoft.com/en-us/graph/paging
 func (p *AzureProvider) UserGroups(ctx context.Context, s *sessions.State) ([]string, error) {
 	if s == nil || s.AccessToken == nil {
-		return nil, errors.New("identity/azure: session cannot be nil")
-	}
-	var response struct {
-		Groups []struct {
-			ID              string    `json:"id"`
-			Description     string    `json:"description,omitempty"`
-			DisplayName     string    `json:"displayName"`
-			CreatedDateTime time.Time `json:"createdDateTime,omitempty"`
-			GroupTypes      []string  `json:"groupTypes,omitempty"`
-		} `json:"value"`
+		return nil, ErrMissingSession
 	}
 	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", s.AccessToken.AccessToken)}
-	err := httputil.Client(ctx, http.MethodGet, defaultAzureGroupURL, version.UserAgent(), headers, nil, &response)
-	if err != nil {
-		return nil, err
-	}
+
 	var groups []string
-	for _, group := range response.Groups {
-		log.Debug().Str("DisplayName", group.DisplayName).Str("ID", group.ID).Msg("identity/microsoft: group")
-		groups = append(groups, group.ID)
+	endpoint := p.groupURL
+	for page := 0; endpoint != ""; page++ {
+		if page >= azureMaxGroupPages {
+			logFrom(ctx).Debug().Int("max-pages", azureMaxGroupPages).Msg("identity/microsoft: group page limit reached")
+			break
+		}
+		var response struct {
+			Groups []struct {
+				ID              string    `json:"id"`
+				Description     string    `json:"description,omitempty"`
+				DisplayName     string    `json:"displayName"`
+				CreatedDateTime time.Time `json:"createdDateTime,omitempty"`
+				GroupTypes      []string  `json:"groupTypes,omitempty"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink,omitempty"`
+		}
+		_, err := p.apiRequest(ctx, opUserGroups, http.MethodGet, endpoint, headers, nil, &response)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range response.Groups {
+			logFrom(ctx).Debug().Str("DisplayName", group.DisplayName).Str("ID", group.ID).Msg("identity/microsoft: group")
+			groups = append(groups, group.ID)
+		}
+		endpoint = response.NextLink
 	}
 	return groups, nil
 }
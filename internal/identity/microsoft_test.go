@@ -0,0 +1,47 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestAzureProviderUserGroups(t *testing.T) {
+	t.Parallel()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer ACCESS" {
+			t.Errorf("Authorization = %q, want %q", got, "Bearer ACCESS")
+		}
+		switch r.URL.Query().Get("$skiptoken") {
+		case "":
+			fmt.Fprintf(w, `{"value":[{"@odata.type":"#microsoft.graph.group","id":"0b1c"},{"@odata.type":"#microsoft.graph.group","id":"2d3e"}],"@odata.nextLink":"%s/me/memberOf?$skiptoken=page2"}`, srv.URL)
+		case "page2":
+			fmt.Fprint(w, `{"value":[{"@odata.type":"#microsoft.graph.group","id":"4f5a"}]}`)
+		}
+	}))
+	defer srv.Close()
+
+	p := &AzureProvider{
+		Provider: &Provider{ProviderName: AzureProviderName},
+		groupURL: srv.URL + "/me/memberOf",
+	}
+	got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: "ACCESS"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"0b1c", "2d3e", "4f5a"}, got); diff != "" {
+		t.Errorf("UserGroups() = %s", diff)
+	}
+
+	if _, err := p.UserGroups(context.Background(), &sessions.State{}); err != ErrMissingSession {
+		t.Errorf("UserGroups() error = %v, want %v", err, ErrMissingSession)
+	}
+}
@@ -16,10 +16,15 @@ type MockProvider struct {
 	RefreshError         error
 	RevokeError          error
 	GetSignInURLResponse string
+	HealthyError         error
+
+	GetEndSessionURLResponse  string
+	VerifyLogoutTokenResponse LogoutToken
+	VerifyLogoutTokenError    error
 }
 
 // Authenticate is a mocked providers function.
-func (mp MockProvider) Authenticate(ctx context.Context, code string) (*sessions.State, error) {
+func (mp MockProvider) Authenticate(ctx context.Context, code, codeVerifier string) (*sessions.State, error) {
 	return &mp.AuthenticateResponse, mp.AuthenticateError
 }
 
@@ -34,4 +39,21 @@ func (mp MockProvider) Revoke(ctx context.Context, s *oauth2.Token) error {
 }
 
 // GetSignInURL is a mocked providers function.
-func (mp MockProvider) GetSignInURL(s string) string { return mp.GetSignInURLResponse }
+func (mp MockProvider) GetSignInURL(s string, opts SignInOptions) string {
+	return mp.GetSignInURLResponse
+}
+
+// Healthy is a mocked providers function.
+func (mp MockProvider) Healthy(ctx context.Context) error {
+	return mp.HealthyError
+}
+
+// GetEndSessionURL is a mocked providers function.
+func (mp MockProvider) GetEndSessionURL(idTokenHint, redirectURL string) string {
+	return mp.GetEndSessionURLResponse
+}
+
+// VerifyLogoutToken is a mocked providers function.
+func (mp MockProvider) VerifyLogoutToken(ctx context.Context, rawToken string) (*LogoutToken, error) {
+	return &mp.VerifyLogoutTokenResponse, mp.VerifyLogoutTokenError
+}
@@ -2,11 +2,25 @@ package identity
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
 
 	oidc "github.com/coreos/go-oidc"
 	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
 )
 
+// DefaultGroupsIDField is the field of a group object, from a groups API,
+// its identifier is read from if GroupsIDField isn't set.
+const DefaultGroupsIDField = "id"
+
+// groupListFields are the fields groups APIs commonly wrap their list of
+// groups in, when they don't respond with the list itself.
+var groupListFields = []string{"groups", "value", "data", "items", "Resources"}
+
 // OIDCProvider provides a standard, OpenID Connect implementation
 // of an authorization identity provider.
 // https://openid.net/specs/openid-connect-core-1_0.html
@@ -15,20 +29,26 @@ type OIDCProvider struct {
 }
 
 // NewOIDCProvider creates a new instance of a generic OpenID Connect provider.
+//
+// If GroupsURL is set, a user's groups are retrieved from it, rather than
+// from the ID token's groups claim, unless GroupsClaim is also set.
 func NewOIDCProvider(p *Provider) (*OIDCProvider, error) {
-	ctx := context.Background()
+	ctx := p.clientContext(context.Background())
 	if p.ProviderURL == "" {
 		return nil, ErrMissingProviderURL
 	}
 	var err error
-	p.provider, err = oidc.NewProvider(ctx, p.ProviderURL)
+	p.provider, err = p.discover(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if len(p.Scopes) == 0 {
-		p.Scopes = []string{oidc.ScopeOpenID, "profile", "email", "offline_access"}
+	p.Scopes = requireScopes(p.Scopes,
+		[]string{oidc.ScopeOpenID, "profile", "email", "offline_access"},
+		p.refreshScopes(oidc.ScopeOpenID))
+	p.verifier, err = p.newVerifier()
+	if err != nil {
+		return nil, err
 	}
-	p.verifier = p.provider.Verifier(&oidc.Config{ClientID: p.ClientID})
 	p.oauth = &oauth2.Config{
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
@@ -36,5 +56,83 @@ func NewOIDCProvider(p *Provider) (*OIDCProvider, error) {
 		RedirectURL:  p.RedirectURL.String(),
 		Scopes:       p.Scopes,
 	}
-	return &OIDCProvider{Provider: p}, nil
+	op := &OIDCProvider{Provider: p}
+	if p.GroupsURL != "" {
+		p.UserGroupFn = op.UserGroups
+	}
+	return op, nil
+}
+
+// UserGroups returns a user's groups from GroupsURL, which is called with
+// the user's access token and must respond with a list of group objects,
+// either as is or in one of the fields groups APIs commonly wrap it in
+// (e.g. `value` or `data`). Each group is identified by its GroupsIDField,
+// defaulting to `id`, which may be a string or a number. Groups without the
+// field are skipped.
+func (p *OIDCProvider) UserGroups(ctx context.Context, s *sessions.State) ([]string, error) {
+	if s == nil || s.AccessToken == nil {
+		return nil, ErrMissingSession
+	}
+	var response json.RawMessage
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", s.AccessToken.AccessToken)}
+	if _, err := p.apiRequest(ctx, opUserGroups, http.MethodGet, p.GroupsURL, headers, nil, &response); err != nil {
+		return nil, err
+	}
+	list, err := groupList(response)
+	if err != nil {
+		return nil, fmt.Errorf("internal/identity: invalid groups response: %w", err)
+	}
+	field := p.GroupsIDField
+	if field == "" {
+		field = DefaultGroupsIDField
+	}
+	groups := make([]string, 0, len(list))
+	for _, group := range list {
+		raw, ok := group[field]
+		if !ok {
+			logFrom(ctx).Debug().Str("field", field).Msg("internal/identity: skipping group without an identifier")
+			continue
+		}
+		id, err := groupIdentifier(raw)
+		if err != nil {
+			return nil, fmt.Errorf("internal/identity: invalid group %q field: %w", field, err)
+		}
+		groups = append(groups, id)
+	}
+	return groups, nil
+}
+
+// groupList decodes a groups API's list of group objects, which may be
+// wrapped in an object under one of groupListFields.
+func groupList(raw json.RawMessage) ([]map[string]json.RawMessage, error) {
+	var list []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list, nil
+	}
+	var wrapper map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &wrapper); err != nil {
+		return nil, fmt.Errorf("want a list of groups: %w", err)
+	}
+	for _, name := range groupListFields {
+		if v, ok := wrapper[name]; ok {
+			if err := json.Unmarshal(v, &list); err != nil {
+				return nil, fmt.Errorf("%q is not a list of groups: %w", name, err)
+			}
+			return list, nil
+		}
+	}
+	return nil, fmt.Errorf("no list of groups in any of %s", strings.Join(groupListFields, ", "))
+}
+
+// groupIdentifier returns a group's identifier from a string or number.
+func groupIdentifier(raw json.RawMessage) (string, error) {
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id, nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return "", fmt.Errorf("want a string or number, got %s", raw)
+	}
+	return n.String(), nil
 }
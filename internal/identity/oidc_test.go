@@ -0,0 +1,68 @@
+package identity
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestOIDCProviderUserGroups(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ACCESS" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/list":
+			w.Write([]byte(`[{"id":4821,"slug":"backend","displayName":"Backend"},{"id":"g-7","slug":"ops"},{"slug":"unnamed"}]`))
+		case "/value":
+			w.Write([]byte(`{"value":[{"id":"a1","displayName":"Admins"}],"@odata.nextLink":""}`))
+		case "/data":
+			w.Write([]byte(`{"data":[{"name":"engineering"}]}`))
+		case "/unwrapped":
+			w.Write([]byte(`{"memberships":[{"id":"a1"}]}`))
+		case "/invalid":
+			w.Write([]byte(`[{"id":{"not":"an identifier"}}]`))
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		field   string
+		token   string
+		want    []string
+		wantErr bool
+	}{
+		{"default field", "/list", "", "ACCESS", []string{"4821", "g-7"}, false},
+		{"slug", "/list", "slug", "ACCESS", []string{"backend", "ops", "unnamed"}, false},
+		{"display name", "/list", "displayName", "ACCESS", []string{"Backend"}, false},
+		{"wrapped in value", "/value", "displayName", "ACCESS", []string{"Admins"}, false},
+		{"wrapped in data", "/data", "name", "ACCESS", []string{"engineering"}, false},
+		{"unknown wrapper", "/unwrapped", "", "ACCESS", nil, true},
+		{"invalid identifier", "/invalid", "", "ACCESS", nil, true},
+		{"unauthorized", "/list", "", "REVOKED", nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &OIDCProvider{Provider: &Provider{ProviderName: OIDCProviderName, GroupsURL: srv.URL + tt.path, GroupsIDField: tt.field}}
+			got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: tt.token}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UserGroups() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroups() = %s", diff)
+			}
+		})
+	}
+}
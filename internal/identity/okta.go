@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	oidc "github.com/coreos/go-oidc"
 	"golang.org/x/oauth2"
@@ -13,9 +14,12 @@ import (
 	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/sessions"
 	"github.com/pomerium/pomerium/internal/urlutil"
-	"github.com/pomerium/pomerium/internal/version"
 )
 
+// oktaMaxGroupPages bounds the number of pages of a user's groups requested
+// from Okta's API.
+const oktaMaxGroupPages = 50
+
 // OktaProvider represents the Okta Identity Provider
 //
 // https://www.pomerium.io/docs/identity-providers.html#okta
@@ -27,20 +31,41 @@ type OktaProvider struct {
 }
 
 // NewOktaProvider creates a new instance of Okta as an identity provider.
+//
+// Groups are identified by their ID unless GroupFormat is
+// GroupFormatName. As Okta's groups claim lists group names, it is then
+// read from the ID token when present, and the groups API, which requires
+// an API token as the ServiceAccount, is only called for users whose
+// groups were left out of it. With GroupFormatID, a GroupsClaim is only
+// read if configured, for claims which list group IDs.
 func NewOktaProvider(p *Provider) (*OktaProvider, error) {
-	ctx := context.Background()
+	ctx := p.clientContext(context.Background())
 	if p.ProviderURL == "" {
 		return nil, ErrMissingProviderURL
 	}
+	switch p.GroupFormat {
+	case "":
+		p.GroupFormat = GroupFormatID
+	case GroupFormatID:
+	case GroupFormatName:
+		if p.GroupsClaim == "" {
+			p.GroupsClaim = DefaultGroupsClaim
+		}
+	default:
+		return nil, fmt.Errorf("identity/okta: unknown group format %q", p.GroupFormat)
+	}
 	var err error
-	p.provider, err = oidc.NewProvider(ctx, p.ProviderURL)
+	p.provider, err = p.discover(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if len(p.Scopes) == 0 {
-		p.Scopes = []string{oidc.ScopeOpenID, "profile", "email", "groups", "offline_access"}
+	p.Scopes = requireScopes(p.Scopes,
+		[]string{oidc.ScopeOpenID, "profile", "email", "groups", "offline_access"},
+		p.refreshScopes(oidc.ScopeOpenID))
+	p.verifier, err = p.newVerifier()
+	if err != nil {
+		return nil, err
 	}
-	p.verifier = p.provider.Verifier(&oidc.Config{ClientID: p.ClientID})
 	p.oauth = &oauth2.Config{
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
@@ -61,7 +86,7 @@ func NewOktaProvider(p *Provider) (*OktaProvider, error) {
 		if err != nil {
 			return nil, err
 		}
-		userAPI.Path = "/api/v1/users/"
+		userAPI.Path = "/api/v1/users"
 		oktaProvider.userAPI = userAPI
 	} else {
 		log.Warn().Msg("identity/okta: api token not set, cannot retrieve groups")
@@ -73,38 +98,63 @@ func NewOktaProvider(p *Provider) (*OktaProvider, error) {
 // Revoke revokes the access token a given session state.
 // https://developer.okta.com/docs/api/resources/oidc#revoke
 func (p *OktaProvider) Revoke(ctx context.Context, token *oauth2.Token) error {
+	if token == nil || token.AccessToken == "" {
+		return ErrMissingToken
+	}
 	params := url.Values{}
 	params.Add("client_id", p.ClientID)
 	params.Add("client_secret", p.ClientSecret)
 	params.Add("token", token.AccessToken)
 	params.Add("token_type_hint", "refresh_token")
-	err := httputil.Client(ctx, http.MethodPost, p.RevokeURL, version.UserAgent(), nil, params, nil)
-	if err != nil && err != httputil.ErrTokenRevoked {
-		return err
-	}
-	return nil
+	return p.revoke(ctx, p.RevokeURL, nil, params)
 }
 
-// UserGroups fetches the groups of which the user is a member
+// UserGroups fetches the groups of which the user is a member, identified by
+// their ID or name as GroupFormat selects. If GroupsNamePrefix is set, only
+// groups whose name starts with it are returned.
+//
+// The results are paginated, so the response's `next` link is followed
+// until exhausted.
 // https://developer.okta.com/docs/reference/api/users/#get-user-s-groups
+// https://developer.okta.com/docs/reference/api-overview/#pagination
 func (p *OktaProvider) UserGroups(ctx context.Context, s *sessions.State) ([]string, error) {
-	var response []struct {
-		ID      string `json:"id"`
-		Profile struct {
-			Name        string `json:"name"`
-			Description string `json:"description"`
-		} `json:"profile"`
+	if s == nil || s.Subject == "" {
+		return nil, ErrMissingSession
 	}
-
 	headers := map[string]string{"Authorization": fmt.Sprintf("SSWS %s", p.ServiceAccount)}
-	err := httputil.Client(ctx, http.MethodGet, fmt.Sprintf("%s/%s/groups", p.userAPI.String(), s.Subject), version.UserAgent(), headers, nil, &response)
-	if err != nil {
-		return nil, err
-	}
+
 	var groups []string
-	for _, group := range response {
-		log.Debug().Interface("group", group).Msg("identity/okta: group")
-		groups = append(groups, group.ID)
+	endpoint := fmt.Sprintf("%s/%s/groups", p.userAPI.String(), url.PathEscape(s.Subject))
+	for page := 0; endpoint != ""; page++ {
+		if page >= oktaMaxGroupPages {
+			logFrom(ctx).Debug().Int("max-pages", oktaMaxGroupPages).Msg("identity/okta: group page limit reached")
+			break
+		}
+		var response []struct {
+			ID      string `json:"id"`
+			Profile struct {
+				Name        string `json:"name"`
+				Description string `json:"description"`
+			} `json:"profile"`
+		}
+		h, err := p.apiRequest(ctx, opUserGroups, http.MethodGet, endpoint, headers, nil, &response)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range response {
+			logFrom(ctx).Debug().Interface("group", group).Msg("identity/okta: group")
+			if !strings.HasPrefix(group.Profile.Name, p.GroupsNamePrefix) {
+				continue
+			}
+			if p.GroupFormat == GroupFormatName {
+				groups = append(groups, group.Profile.Name)
+			} else {
+				groups = append(groups, group.ID)
+			}
+		}
+		if endpoint, err = httputil.NextPage(endpoint, h); err != nil {
+			return nil, err
+		}
 	}
 	return groups, nil
 }
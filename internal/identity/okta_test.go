@@ -0,0 +1,71 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestOktaProviderUserGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		prefix string
+		want   []string
+	}{
+		{"ids", GroupFormatID, "", []string{"00g1", "00g2", "00g3"}},
+		{"names", GroupFormatName, "", []string{"Everyone", "pomerium-admins", "pomerium-users"}},
+		{"name prefix", GroupFormatName, "pomerium-", []string{"pomerium-admins", "pomerium-users"}},
+		{"ids with name prefix", GroupFormatID, "pomerium-", []string{"00g2", "00g3"}},
+	}
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Authorization"), "SSWS TOKEN"; got != want {
+			t.Errorf("Authorization = %q, want %q", got, want)
+		}
+		if got, want := r.URL.Path, "/api/v1/users/00u1/groups"; got != want {
+			t.Errorf("path = %q, want %q", got, want)
+		}
+		switch r.URL.Query().Get("after") {
+		case "":
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?after=00g2>; rel="next"`, srv.URL, r.URL.Path))
+			fmt.Fprint(w, `[{"id":"00g1","profile":{"name":"Everyone"}},{"id":"00g2","profile":{"name":"pomerium-admins"}}]`)
+		case "00g2":
+			fmt.Fprint(w, `[{"id":"00g3","profile":{"name":"pomerium-users"}}]`)
+		}
+	}))
+	defer srv.Close()
+	userAPI, _ := url.Parse(srv.URL + "/api/v1/users")
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &OktaProvider{
+				Provider: &Provider{ProviderName: OktaProviderName, ServiceAccount: "TOKEN", GroupFormat: tt.format, GroupsNamePrefix: tt.prefix},
+				userAPI:  userAPI,
+			}
+			got, err := p.UserGroups(context.Background(), &sessions.State{Subject: "00u1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestNewOktaProviderGroupFormat(t *testing.T) {
+	t.Parallel()
+	_, err := NewOktaProvider(&Provider{ProviderURL: "https://okta.example.com", GroupFormat: GroupFormatFullPath})
+	if err == nil {
+		t.Fatal("NewOktaProvider() expected an error for an unsupported group format")
+	}
+}
@@ -2,47 +2,65 @@ package identity
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
-	"time"
+	"strings"
 
 	oidc "github.com/coreos/go-oidc"
 	"golang.org/x/oauth2"
 
-	"github.com/pomerium/pomerium/internal/httputil"
 	"github.com/pomerium/pomerium/internal/sessions"
-	"github.com/pomerium/pomerium/internal/version"
 )
 
-const defaultOneLoginProviderURL = "https://openid-connect.onelogin.com/oidc"
-const defaultOneloginGroupURL = "https://openid-connect.onelogin.com/oidc/me"
+const (
+	defaultOneLoginProviderURL = "https://openid-connect.onelogin.com/oidc"
+	defaultOneloginGroupURL    = "https://openid-connect.onelogin.com/oidc/me"
+
+	// oneloginGroupsClaim is the claim OneLogin conveys a user's roles in by
+	// default, as configured by the app's "Groups" parameter.
+	oneloginGroupsClaim = "groups"
+)
 
 // OneLoginProvider provides a standard, OpenID Connect implementation
 // of an authorization identity provider.
+//
+// https://developers.onelogin.com/openid-connect
 type OneLoginProvider struct {
 	*Provider
 
 	// non-standard oidc fields
-	RevokeURL string `json:"revocation_endpoint"`
+	RevokeURL     string `json:"revocation_endpoint"`
+	UserInfoURL   string `json:"userinfo_endpoint"`
+	EndSessionURL string `json:"end_session_endpoint"`
 }
 
 // NewOneLoginProvider creates a new instance of an OpenID Connect provider.
+//
+// A user's roles are read, as their groups, from the userinfo claim set by
+// GroupsClaim, defaulting to OneLogin's `groups`. Custom parameters, which
+// OneLogin nests under `params`, are selected with a dotted path such as
+// `params.roles`.
+//
+// https://www.pomerium.io/docs/identity-providers/one-login.html
 func NewOneLoginProvider(p *Provider) (*OneLoginProvider, error) {
-	ctx := context.Background()
+	ctx := p.clientContext(context.Background())
 	if p.ProviderURL == "" {
 		p.ProviderURL = defaultOneLoginProviderURL
 	}
 	var err error
-	p.provider, err = oidc.NewProvider(ctx, p.ProviderURL)
+	p.provider, err = p.discover(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if len(p.Scopes) == 0 {
-		p.Scopes = []string{oidc.ScopeOpenID, "profile", "email", "groups", "offline_access"}
+	p.Scopes = requireScopes(p.Scopes,
+		[]string{oidc.ScopeOpenID, "profile", "email", "groups", "offline_access"},
+		p.refreshScopes(oidc.ScopeOpenID, "groups"))
+	p.verifier, err = p.newVerifier()
+	if err != nil {
+		return nil, err
 	}
-	p.verifier = p.provider.Verifier(&oidc.Config{ClientID: p.ClientID})
 	p.oauth = &oauth2.Config{
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
@@ -56,6 +74,9 @@ func NewOneLoginProvider(p *Provider) (*OneLoginProvider, error) {
 	if err := p.provider.Claims(&olProvider); err != nil {
 		return nil, err
 	}
+	if olProvider.UserInfoURL == "" {
+		olProvider.UserInfoURL = defaultOneloginGroupURL
+	}
 
 	p.UserGroupFn = olProvider.UserGroups
 
@@ -65,38 +86,91 @@ func NewOneLoginProvider(p *Provider) (*OneLoginProvider, error) {
 // Revoke revokes the access token a given session state.
 // https://developers.onelogin.com/openid-connect/api/revoke-session
 func (p *OneLoginProvider) Revoke(ctx context.Context, token *oauth2.Token) error {
+	if token == nil || token.AccessToken == "" {
+		return ErrMissingToken
+	}
 	params := url.Values{}
 	params.Add("client_id", p.ClientID)
 	params.Add("client_secret", p.ClientSecret)
 	params.Add("token", token.AccessToken)
 	params.Add("token_type_hint", "access_token")
-	err := httputil.Client(ctx, http.MethodPost, p.RevokeURL, version.UserAgent(), nil, params, nil)
-	if err != nil && err != httputil.ErrTokenRevoked {
+	if err := p.revoke(ctx, p.RevokeURL, nil, params); err != nil {
 		return fmt.Errorf("identity/onelogin: revocation error %w", err)
 	}
 	return nil
 }
 
-// UserGroups returns a slice of group names a given user is in.
+// GetSignOutURL returns the url of OneLogin's end session endpoint, which
+// ends the user's OneLogin session before redirecting them to redirectURL.
+// The redirect url must be one of the app's post logout redirect urls. If
+// the provider doesn't advertise an end session endpoint, the user is
+// redirected to redirectURL directly.
+//
+// https://developers.onelogin.com/openid-connect/api/logout
+func (p *OneLoginProvider) GetSignOutURL(redirectURL string) string {
+	if p.EndSessionURL == "" {
+		return redirectURL
+	}
+	u, err := url.Parse(p.EndSessionURL)
+	if err != nil {
+		return redirectURL
+	}
+	q := u.Query()
+	q.Set("client_id", p.ClientID)
+	q.Set("post_logout_redirect_uri", redirectURL)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// UserGroups returns a slice of the roles a given user has, read from the
+// provider's groups claim of the userinfo endpoint's response.
 // https://developers.onelogin.com/openid-connect/api/user-info
 func (p *OneLoginProvider) UserGroups(ctx context.Context, s *sessions.State) ([]string, error) {
 	if s == nil || s.AccessToken == nil {
-		return nil, errors.New("identity/onelogin: session cannot be nil")
-	}
-	var response struct {
-		User              string    `json:"sub"`
-		Email             string    `json:"email"`
-		PreferredUsername string    `json:"preferred_username"`
-		Name              string    `json:"name"`
-		UpdatedAt         time.Time `json:"updated_at"`
-		GivenName         string    `json:"given_name"`
-		FamilyName        string    `json:"family_name"`
-		Groups            []string  `json:"groups"`
+		return nil, ErrMissingSession
 	}
+	var response map[string]json.RawMessage
 	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", s.AccessToken.AccessToken)}
-	err := httputil.Client(ctx, http.MethodGet, defaultOneloginGroupURL, version.UserAgent(), headers, nil, &response)
+	_, err := p.apiRequest(ctx, opUserGroups, http.MethodGet, p.UserInfoURL, headers, nil, &response)
+	if err != nil {
+		return nil, err
+	}
+	claim := p.GroupsClaim
+	if claim == "" {
+		claim = oneloginGroupsClaim
+	}
+	raw, ok, err := oneloginClaim(response, claim)
 	if err != nil {
 		return nil, err
 	}
-	return response.Groups, nil
+	if !ok {
+		logFrom(ctx).Debug().Str("claim", claim).Msg("identity/onelogin: groups claim not found in user info")
+		return nil, nil
+	}
+	groups, err := sessions.ParseGroups(raw)
+	if err != nil {
+		return nil, fmt.Errorf("identity/onelogin: invalid %q claim: %w", claim, err)
+	}
+	return groups, nil
+}
+
+// oneloginClaim returns the claim at the dotted path, and whether it was
+// found. A claim named with a dot takes precedence over a nested one.
+func oneloginClaim(claims map[string]json.RawMessage, path string) (json.RawMessage, bool, error) {
+	if raw, ok := claims[path]; ok {
+		return raw, true, nil
+	}
+	i := strings.Index(path, ".")
+	if i < 0 {
+		return nil, false, nil
+	}
+	raw, ok := claims[path[:i]]
+	if !ok {
+		return nil, false, nil
+	}
+	var nested map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &nested); err != nil {
+		return nil, false, fmt.Errorf("identity/onelogin: %q is not an object: %w", path[:i], err)
+	}
+	return oneloginClaim(nested, path[i+1:])
 }
@@ -0,0 +1,81 @@
+package identity
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestOneLoginProviderUserGroups(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ACCESS" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"sub":"user","groups":["Admin","Engineering"],"params":{"roles":"Support Sales"},"roles":{"not":"a list"}}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		claim   string
+		token   string
+		want    []string
+		wantErr bool
+	}{
+		{"default claim", "", "ACCESS", []string{"Admin", "Engineering"}, false},
+		{"custom parameter", "params.roles", "ACCESS", []string{"Support", "Sales"}, false},
+		{"missing claim", "params.departments", "ACCESS", nil, false},
+		{"invalid claim", "roles", "ACCESS", nil, true},
+		{"unauthorized", "", "REVOKED", nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &OneLoginProvider{
+				Provider:    &Provider{ProviderName: OneLoginProviderName, GroupsClaim: tt.claim},
+				UserInfoURL: srv.URL + "/oidc/2/me",
+			}
+			got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: tt.token}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UserGroups() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestOneLoginProviderGetSignOutURL(t *testing.T) {
+	t.Parallel()
+	redirectURL := "https://authenticate.example.com/.pomerium/signed_out"
+	tests := []struct {
+		name          string
+		endSessionURL string
+		want          string
+	}{
+		{"end session", "https://corp.onelogin.com/oidc/2/logout",
+			"https://corp.onelogin.com/oidc/2/logout?client_id=client&post_logout_redirect_uri=" + url.QueryEscape(redirectURL)},
+		{"not advertised", "", redirectURL},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			p := &OneLoginProvider{Provider: &Provider{ClientID: "client"}, EndSessionURL: tt.endSessionURL}
+			if got := p.GetSignOutURL(redirectURL); got != tt.want {
+				t.Errorf("GetSignOutURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
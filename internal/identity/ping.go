@@ -0,0 +1,173 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+const (
+	// pingGroupsClaim is the claim PingOne and PingFederate conventionally
+	// map a user's group membership, or roles, to.
+	pingGroupsClaim = "memberOf"
+
+	// pingOneIssuerPath is the path of a PingOne environment's issuer,
+	// relative to the environment's id.
+	pingOneIssuerPath = "/as"
+)
+
+// pingOneHosts are the regional hosts PingOne environments are served from.
+var pingOneHosts = map[string]bool{
+	"auth.pingone.com":  true,
+	"auth.pingone.eu":   true,
+	"auth.pingone.asia": true,
+	"auth.pingone.ca":   true,
+}
+
+// pingOneEnvironmentID matches the id of a PingOne environment.
+var pingOneEnvironmentID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// PingProvider is an implementation of the OpenID Connect provider for Ping
+// Identity's PingOne and PingFederate.
+//
+// https://apidocs.pingidentity.com/pingone/platform/v1/api/
+type PingProvider struct {
+	*Provider
+	RevokeURL   string `json:"revocation_endpoint"`
+	UserInfoURL string `json:"userinfo_endpoint"`
+}
+
+// NewPingProvider returns a new PingProvider. The provider url is the
+// issuer url of a PingFederate server (e.g. `https://sso.example.com`), or
+// of a PingOne environment (e.g.
+// `https://auth.pingone.com/{environment id}/as`).
+//
+// https://www.pomerium.io/docs/identity-providers/ping.html
+func NewPingProvider(p *Provider) (*PingProvider, error) {
+	ctx := p.clientContext(context.Background())
+	if p.ProviderURL == "" {
+		return nil, ErrMissingProviderURL
+	}
+	providerURL, err := pingIssuerURL(p.ProviderURL)
+	if err != nil {
+		return nil, err
+	}
+	p.ProviderURL = providerURL
+
+	p.provider, err = p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Scopes = requireScopes(p.Scopes,
+		[]string{oidc.ScopeOpenID, "profile", "email", "offline_access"},
+		p.refreshScopes(oidc.ScopeOpenID))
+
+	p.verifier, err = p.newVerifier()
+	if err != nil {
+		return nil, err
+	}
+	p.oauth = &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint:     p.provider.Endpoint(),
+		RedirectURL:  p.RedirectURL.String(),
+		Scopes:       p.Scopes,
+	}
+
+	pp := &PingProvider{Provider: p}
+	if err := p.provider.Claims(&pp); err != nil {
+		return nil, err
+	}
+	pp.UserGroupFn = pp.UserGroups
+	return pp, nil
+}
+
+// pingIssuerURL checks that a PingOne provider url names an environment,
+// adding the issuer path if it was left off. Other urls are assumed to be
+// PingFederate servers, which are returned as is.
+func pingIssuerURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("identity/ping: invalid provider url: %w", err)
+	}
+	if !pingOneHosts[strings.ToLower(u.Hostname())] {
+		return rawURL, nil
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if !pingOneEnvironmentID.MatchString(segments[0]) {
+		return "", fmt.Errorf("identity/ping: PingOne provider url %q must start with an environment id", rawURL)
+	}
+	switch {
+	case len(segments) == 1:
+		u.Path = "/" + segments[0] + pingOneIssuerPath
+	case len(segments) == 2 && "/"+segments[1] == pingOneIssuerPath:
+		u.Path = "/" + segments[0] + pingOneIssuerPath
+	default:
+		return "", fmt.Errorf("identity/ping: PingOne provider url %q is not an environment's issuer", rawURL)
+	}
+	return u.String(), nil
+}
+
+// UserGroups returns a user's groups, read from the provider's groups claim
+// of the userinfo endpoint's response, defaulting to `memberOf`. The claim
+// is set by the application's attribute mappings, in PingOne, or its OpenID
+// Connect policy, in PingFederate.
+func (p *PingProvider) UserGroups(ctx context.Context, s *sessions.State) ([]string, error) {
+	if s == nil || s.AccessToken == nil {
+		return nil, ErrMissingSession
+	}
+	var response map[string]json.RawMessage
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", s.AccessToken.AccessToken)}
+	if _, err := p.apiRequest(ctx, opUserGroups, http.MethodGet, p.UserInfoURL, headers, nil, &response); err != nil {
+		return nil, err
+	}
+	claim := p.GroupsClaim
+	if claim == "" {
+		claim = pingGroupsClaim
+	}
+	raw, ok := response[claim]
+	if !ok {
+		logFrom(ctx).Debug().Str("claim", claim).Msg("identity/ping: groups claim not found in user info")
+		return nil, nil
+	}
+	groups, err := sessions.ParseGroups(raw)
+	if err != nil {
+		return nil, fmt.Errorf("identity/ping: invalid %q claim: %w", claim, err)
+	}
+	return groups, nil
+}
+
+// Revoke revokes a token via the provider's revocation endpoint. The
+// refresh token is preferred, as revoking it also revokes the access tokens
+// issued with it.
+//
+// https://tools.ietf.org/html/rfc7009
+func (p *PingProvider) Revoke(ctx context.Context, token *oauth2.Token) error {
+	if token == nil || (token.AccessToken == "" && token.RefreshToken == "") {
+		return ErrMissingToken
+	}
+	params := url.Values{}
+	params.Add("client_id", p.ClientID)
+	params.Add("client_secret", p.ClientSecret)
+	if token.RefreshToken != "" {
+		params.Add("token", token.RefreshToken)
+		params.Add("token_type_hint", "refresh_token")
+	} else {
+		params.Add("token", token.AccessToken)
+		params.Add("token_type_hint", "access_token")
+	}
+	if err := p.revoke(ctx, p.RevokeURL, nil, params); err != nil {
+		return fmt.Errorf("identity/ping: revocation error %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package identity
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestPingIssuerURL(t *testing.T) {
+	t.Parallel()
+	const env = "0f2d6def-5c5c-4b1c-8f0e-5d7b8d2e3a41"
+	tests := []struct {
+		name    string
+		rawURL  string
+		want    string
+		wantErr bool
+	}{
+		{"pingfederate", "https://sso.example.com", "https://sso.example.com", false},
+		{"pingfederate with path", "https://sso.example.com/pf", "https://sso.example.com/pf", false},
+		{"pingone issuer", "https://auth.pingone.com/" + env + "/as", "https://auth.pingone.com/" + env + "/as", false},
+		{"pingone environment", "https://auth.pingone.eu/" + env, "https://auth.pingone.eu/" + env + "/as", false},
+		{"pingone trailing slash", "https://auth.pingone.asia/" + env + "/as/", "https://auth.pingone.asia/" + env + "/as", false},
+		{"pingone missing environment", "https://auth.pingone.com/as", "", true},
+		{"pingone bad environment", "https://auth.pingone.com/corp/as", "", true},
+		{"pingone endpoint", "https://auth.pingone.com/" + env + "/as/authorize", "", true},
+		{"invalid", "https://sso.example.com/%zz", "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := pingIssuerURL(tt.rawURL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pingIssuerURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("pingIssuerURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPingProviderUserGroups(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ACCESS" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"sub":"user","memberOf":["Admins","Engineering"],"roles":"admin support","department":{"not":"a list"}}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		claim   string
+		token   string
+		want    []string
+		wantErr bool
+	}{
+		{"default claim", "", "ACCESS", []string{"Admins", "Engineering"}, false},
+		{"custom claim", "roles", "ACCESS", []string{"admin", "support"}, false},
+		{"missing claim", "groups", "ACCESS", nil, false},
+		{"invalid claim", "department", "ACCESS", nil, true},
+		{"unauthorized", "", "REVOKED", nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PingProvider{
+				Provider:    &Provider{ProviderName: PingProviderName, GroupsClaim: tt.claim},
+				UserInfoURL: srv.URL + "/as/userinfo",
+			}
+			got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: tt.token}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UserGroups() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroups() = %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package identity
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/cryptutil"
+)
+
+// NewCodeVerifier returns a new, random PKCE code verifier to be passed to
+// an Authenticator's GetSignInURL, as SignInOptions.CodeVerifier, and, once
+// the user is redirected back, Authenticate.
+//
+// https://tools.ietf.org/html/rfc7636#section-4.1
+func NewCodeVerifier() string {
+	return base64.RawURLEncoding.EncodeToString(cryptutil.NewKey())
+}
+
+// codeChallengeOptions returns the authorization request parameters for the
+// S256 code challenge of verifier, or none if verifier is empty.
+//
+// https://tools.ietf.org/html/rfc7636#section-4.2
+func codeChallengeOptions(verifier string) []oauth2.AuthCodeOption {
+	if verifier == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+}
+
+// codeVerifierOptions returns the token request parameters which send
+// verifier, or none if verifier is empty.
+//
+// https://tools.ietf.org/html/rfc7636#section-4.5
+func codeVerifierOptions(verifier string) []oauth2.AuthCodeOption {
+	if verifier == "" {
+		return nil
+	}
+	return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("code_verifier", verifier)}
+}
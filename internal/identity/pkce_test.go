@@ -0,0 +1,58 @@
+package identity
+
+import (
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestProviderGetSignInURLCodeChallenge(t *testing.T) {
+	t.Parallel()
+	p := &Provider{oauth: &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"},
+	}}
+	tests := []struct {
+		name          string
+		verifier      string
+		wantChallenge string
+		wantMethod    string
+	}{
+		{"no verifier", "", "", ""},
+		// base64url(sha256(verifier)), without padding
+		{"verifier", "dBjftJeZ4CVP-mJ92K9ckfS0BVVP2xskvw2Yl5_VeH0", "P59qvV7DpXJh7TagTN-h49j8f2_PLlwVNZI9iGv6gE4", "S256"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			u, err := url.Parse(p.GetSignInURL("state", SignInOptions{CodeVerifier: tt.verifier}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := u.Query()
+			if got := q.Get("code_challenge"); got != tt.wantChallenge {
+				t.Errorf("code_challenge = %q, want %q", got, tt.wantChallenge)
+			}
+			if got := q.Get("code_challenge_method"); got != tt.wantMethod {
+				t.Errorf("code_challenge_method = %q, want %q", got, tt.wantMethod)
+			}
+			if q.Get("code_verifier") != "" {
+				t.Error("sign in url must not include the code verifier")
+			}
+		})
+	}
+}
+
+func TestNewCodeVerifier(t *testing.T) {
+	t.Parallel()
+	v := NewCodeVerifier()
+	// rfc7636 section 4.1 requires 43 to 128 unreserved characters
+	if len(v) < 43 || len(v) > 128 {
+		t.Errorf("NewCodeVerifier() length = %d", len(v))
+	}
+	if v == NewCodeVerifier() {
+		t.Error("NewCodeVerifier() returned the same verifier twice")
+	}
+}
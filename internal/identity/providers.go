@@ -6,8 +6,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
+	"github.com/pomerium/pomerium/internal/audit"
 	"github.com/pomerium/pomerium/internal/sessions"
 
 	oidc "github.com/coreos/go-oidc"
@@ -17,56 +21,200 @@ import (
 const (
 	// AzureProviderName identifies the Azure identity provider
 	AzureProviderName = "azure"
+	// BitbucketProviderName identifies the Bitbucket identity provider
+	BitbucketProviderName = "bitbucket"
+	// CognitoProviderName identifies the AWS Cognito identity provider
+	CognitoProviderName = "cognito"
 	// GitlabProviderName identifies the GitLab identity provider
 	GitlabProviderName = "gitlab"
 	// GithubProviderName identifies the GitHub identity provider
 	GithubProviderName = "github"
 	// GoogleProviderName identifies the Google identity provider
 	GoogleProviderName = "google"
+	// KeycloakProviderName identifies the Keycloak identity provider
+	KeycloakProviderName = "keycloak"
 	// OIDCProviderName identifies a generic OpenID connect provider
 	OIDCProviderName = "oidc"
 	// OktaProviderName identifies the Okta identity provider
 	OktaProviderName = "okta"
 	// OneLoginProviderName identifies the OneLogin identity provider
 	OneLoginProviderName = "onelogin"
+	// PingProviderName identifies the Ping Identity (PingOne and
+	// PingFederate) identity provider
+	PingProviderName = "ping"
+	// SlackProviderName identifies the Slack identity provider
+	SlackProviderName = "slack"
 )
 
 // ErrMissingProviderURL is returned when an identity provider requires a provider url
 // does not receive one.
 var ErrMissingProviderURL = errors.New("internal/identity: missing provider url")
 
+// offlineAccessScope is the OpenID Connect scope which requests a refresh
+// token.
+const offlineAccessScope = "offline_access"
+
 // Authenticator is an interface representing the ability to authenticate with an identity provider.
 type Authenticator interface {
-	Authenticate(context.Context, string) (*sessions.State, error)
+	// Authenticate redeems an authorization code. If the sign in url was
+	// requested with a PKCE code verifier, it must be passed again here.
+	Authenticate(ctx context.Context, code, codeVerifier string) (*sessions.State, error)
 	Refresh(context.Context, *sessions.State) (*sessions.State, error)
 	Revoke(context.Context, *oauth2.Token) error
-	GetSignInURL(state string) string
+	// GetSignInURL returns the identity provider's sign in url, with the
+	// authorization request parameters set by opts.
+	GetSignInURL(state string, opts SignInOptions) string
+}
+
+// SignOutURLer is implemented by identity providers which keep a session of
+// their own that the user's browser must be sent to the provider to end.
+type SignOutURLer interface {
+	GetSignOutURL(redirectURL string) string
+}
+
+// EndSessionURLer is implemented by identity providers which support OpenID
+// Connect RP-initiated logout. The url returned ends the user's session with
+// the provider, identified by the id token hint, before redirecting them to
+// redirectURL. It is empty if the provider has no end session endpoint.
+type EndSessionURLer interface {
+	GetEndSessionURL(idTokenHint, redirectURL string) string
+}
+
+// BackChannelLogouter is implemented by identity providers which support
+// OpenID Connect back-channel logout, in which the provider tells relying
+// parties that a user's session with it has ended.
+type BackChannelLogouter interface {
+	VerifyLogoutToken(ctx context.Context, rawToken string) (*LogoutToken, error)
+}
+
+// TokenValidator is implemented by identity providers which can verify id
+// tokens they issued to clients which present them directly.
+type TokenValidator interface {
+	ValidateToken(ctx context.Context, rawIDToken string) (*Claims, error)
+}
+
+// PersonalAccessTokenAuthenticator is implemented by identity providers which
+// can authenticate non-interactive clients (e.g. CI jobs) with a personal
+// access token, rather than an OAuth 2.0 authorization code.
+type PersonalAccessTokenAuthenticator interface {
+	AuthenticatePersonalAccessToken(ctx context.Context, token string) (*sessions.State, error)
+}
+
+// ClientCredentialsAuthenticator is implemented by identity providers which
+// can authenticate machine clients with the OAuth 2.0 client credentials
+// grant, rather than an interactive sign in.
+type ClientCredentialsAuthenticator interface {
+	AuthenticateClientCredentials(ctx context.Context, clientID, clientSecret string) (*sessions.State, error)
+}
+
+// DeviceAuthenticator is implemented by identity providers which can
+// authenticate users of devices which can't open a browser, such as command
+// line tools, with the OAuth 2.0 device authorization grant.
+type DeviceAuthenticator interface {
+	AuthorizeDevice(ctx context.Context) (*DeviceAuthorization, error)
+	AuthenticateDevice(ctx context.Context, deviceCode string) (*sessions.State, error)
+}
+
+// OrgLister is implemented by identity providers which distinguish a user's
+// organizations, or tenants, from their groups, or teams. Providers which
+// don't leave it unimplemented, and their sessions have no orgs.
+type OrgLister interface {
+	UserOrgs(ctx context.Context, s *sessions.State) ([]string, error)
+}
+
+// GroupsInvalidator is implemented by identity providers which cache users'
+// groups, so that a user's cached groups can be dropped when an admin
+// changes their membership rather than served until they expire.
+type GroupsInvalidator interface {
+	InvalidateGroups(ctx context.Context, sub string)
 }
 
 // New returns a new identity provider based on its name.
 // Returns an error if selected provided not found or if the identity provider is not known.
 func New(providerName string, p *Provider) (a Authenticator, err error) {
+	if err := validateRedirectURL(p.RedirectURL, p.AllowInsecureRedirectURL); err != nil {
+		return nil, err
+	}
+	if p.HTTPClient == nil {
+		if p.HTTPClient, err = newHTTPClient(p); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateGroupsCircuitBreakerFallback(p.GroupsCircuitBreakerFallback); err != nil {
+		return nil, err
+	}
 	switch providerName {
 	case AzureProviderName:
 		a, err = NewAzureProvider(p)
+	case BitbucketProviderName:
+		a, err = NewBitbucketProvider(p)
+	case CognitoProviderName:
+		a, err = NewCognitoProvider(p)
 	case GitlabProviderName:
 		a, err = NewGitLabProvider(p)
 	case GithubProviderName:
 		a, err = NewGitHubProvider(p)
 	case GoogleProviderName:
 		a, err = NewGoogleProvider(p)
+	case KeycloakProviderName:
+		a, err = NewKeycloakProvider(p)
 	case OIDCProviderName:
 		a, err = NewOIDCProvider(p)
 	case OktaProviderName:
 		a, err = NewOktaProvider(p)
 	case OneLoginProviderName:
 		a, err = NewOneLoginProvider(p)
+	case PingProviderName:
+		a, err = NewPingProvider(p)
+	case SlackProviderName:
+		a, err = NewSlackProvider(p)
 	default:
 		return nil, fmt.Errorf("internal/identity: %s provider not known", providerName)
 	}
 	if err != nil {
 		return nil, err
 	}
+	p.tokenRefresher = newTokenRefresher(p.refreshToken)
+	p.health = newHealthCheck(p.checkHealth)
+	if p.UserGroupFn != nil {
+		p.groupsCache = newGroupsCache(providerName, p.ClientID, p.GroupsCacheTTL, p.GroupsCache)
+		fn := withGroupsTimeout(p.GroupsRequestTimeout, p.tokenRefresher.wrap(p.UserGroupFn))
+		if p.GroupsCircuitBreakerThreshold >= 0 {
+			breaker := newGroupsCircuitBreaker(providerName, p.GroupsCircuitBreakerThreshold, p.GroupsCircuitBreakerCooldown)
+			if p.GroupsCircuitBreakerFallback == GroupsCircuitBreakerCache {
+				p.groupsCache.staleTTL = groupsStaleTTL
+				breaker.fallback = p.groupsCache.stale
+			}
+			fn = breaker.wrap(fn)
+		}
+		if p.MaxStaleGroups > 0 {
+			// the groups the breaker falls back to are kept no longer than
+			// either allows
+			if p.groupsCache.staleTTL == 0 || p.MaxStaleGroups < p.groupsCache.staleTTL {
+				p.groupsCache.staleTTL = p.MaxStaleGroups
+			}
+			p.groupsCache.serveStale = true
+		}
+		p.UserGroupFn = p.withLogContext(opUserGroups, p.groupsCache.wrap(fn))
+		if len(p.GroupAliases) != 0 {
+			p.UserGroupFn = withGroupAliases(p.GroupAliases, p.UserGroupFn)
+		}
+		if p.GroupsCaseInsensitive {
+			p.UserGroupFn = withLowercaseGroups(p.UserGroupFn)
+		}
+		if p.EmailDomainGroup {
+			p.UserGroupFn = withEmailDomainGroup(p.UserGroupFn)
+		}
+		// observed last, so that the metric counts the groups sessions get
+		// from every provider alike
+		p.UserGroupFn = withGroupsMetric(providerName, p.UserGroupFn)
+	}
+	if p.UserAttributeFn == nil && p.AttributesURL != "" {
+		p.UserAttributeFn = p.attributesFromURL
+	}
+	if p.UserOrgFn != nil {
+		p.UserOrgFn = p.withLogContext(opUserOrgs, withGroupsTimeout(p.GroupsRequestTimeout, p.tokenRefresher.wrap(p.UserOrgFn)))
+	}
 	return a, nil
 }
 
@@ -75,25 +223,308 @@ func New(providerName string, p *Provider) (a Authenticator, err error) {
 // https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
 type Provider struct {
 	ProviderName string
+	// Name is the name the provider is configured with, which is empty for
+	// the default identity provider, as sessions name it.
+	Name string
+
+	// Audit, if set, records the groups resolved for users.
+	Audit *audit.Logger
 
 	RedirectURL *url.URL
 
+	// AllowInsecureRedirectURL permits a plain http RedirectURL, which
+	// should only be used for development.
+	AllowInsecureRedirectURL bool
+
 	ClientID     string
 	ClientSecret string
 	ProviderURL  string
 	Scopes       []string
 
+	// EnableRefresh requires the offline_access scope, for providers which
+	// only issue refresh tokens when it is requested, even if Scopes leaves
+	// it out. Sessions without a refresh token can't be refreshed, so users
+	// must sign in again when they expire.
+	EnableRefresh bool
+
+	// AllowedAudiences are the audiences, besides ClientID, which id tokens
+	// are accepted for, for clients which share tokens with others (e.g. a
+	// single page app and its backend).
+	AllowedAudiences []string
+
+	// AllowedIssuers, if set, pins the issuers whose tokens are accepted, in
+	// place of the issuer of the provider's discovery document, which is
+	// then only accepted if it's one of them.
+	AllowedIssuers []string
+
 	UserGroupFn func(context.Context, *sessions.State) ([]string, error)
+	// UserOrgFn, if set, retrieves the user's organizations, for providers
+	// which implement OrgLister.
+	UserOrgFn func(context.Context, *sessions.State) ([]string, error)
+	// UserAttributeFn, if set, retrieves attributes of the user from
+	// outside the identity provider (e.g. their department, from an HR
+	// system) once they're authenticated, and whenever their session is
+	// refreshed. Those named by ForwardedClaims are merged into the
+	// session's forwarded claims, so that they can be set as headers as
+	// claims are. If unset, and AttributesURL is, they are retrieved from
+	// AttributesURL.
+	UserAttributeFn func(context.Context, *sessions.State) (map[string]interface{}, error)
+
+	// AttributesURL is an HTTP API a user's attributes are retrieved from,
+	// sent with AttributesHeaders (e.g. an API key).
+	AttributesURL     string
+	AttributesHeaders map[string]string
+	// AttributesFailOpen signs users in without their attributes, rather
+	// than failing, if they can't be retrieved.
+	AttributesFailOpen bool
 
 	UserInfoEndpoint bool
 
+	// ACRValues, if set, are the authentication context classes, in order
+	// of preference, requested at sign in (e.g. one which requires MFA). If
+	// RequireACR is set, users who sign in with another are refused.
+	ACRValues  []string
+	RequireACR bool
+
+	// AuthURLParams are additional parameters added to the authorization
+	// request (e.g. a tenant or audience), beneath those set per sign in.
+	AuthURLParams map[string]string
+
 	// ServiceAccount can be set for those providers that require additional
 	// credentials or tokens to do follow up API calls (e.g. Google)
 	ServiceAccount string
 
+	// GroupFormat selects which group attribute is returned as the group's
+	// identifier for providers that support more than one (e.g. GitLab and
+	// Okta).
+	GroupFormat string
+
+	// GroupsClaim is the ID token claim a user's groups are read from.
+	// Defaults to DefaultGroupsClaim. If set, the claim takes precedence over
+	// UserGroupFn when present in the ID token.
+	GroupsClaim string
+
+	// GroupsURL, if set, is a groups API the generic OpenID Connect
+	// provider retrieves a user's groups from, with their access token.
+	// GroupsIDField is the field of each group object the group's
+	// identifier is read from. Defaults to DefaultGroupsIDField.
+	GroupsURL     string
+	GroupsIDField string
+
+	// MinGroupAccessLevel, if set, limits a user's groups to those where
+	// they have at least the given access level, for providers which support
+	// it (e.g. GitLab, where Developer is 30).
+	MinGroupAccessLevel int
+
+	// GroupsPageSize is the number of groups requested per page, for
+	// providers whose groups API is paginated (e.g. GitLab, where it
+	// defaults to, and may be at most, 100).
+	GroupsPageSize int
+
+	// IncludeParentGroups adds the ancestors of each of a user's groups to
+	// their groups, for providers with nested groups (e.g. GitLab, where it
+	// requires the path or full path GroupFormat).
+	IncludeParentGroups bool
+
+	// GitLabGroupScope selects which groups GitLab lists as a user's: only
+	// their memberships (GitLabGroupScopeMemberOnly), or every group they
+	// can see (GitLabGroupScopeAllVisible). Defaults to GitLab's own choice.
+	GitLabGroupScope string
+
+	// GroupsGraphQL retrieves a user's groups with a single GraphQL query,
+	// rather than by paginating a REST API, for providers which support it
+	// (e.g. GitLab). The REST API is used if the query fails.
+	GroupsGraphQL bool
+
+	// IncludeProjects adds the projects a user is a member of to their
+	// groups, for providers with projects (e.g. GitLab, where they are
+	// prefixed with `project:`). It takes an extra API request per lookup.
+	IncludeProjects bool
+
+	// EmailDomainGroup adds a pseudo-group, `domain:` followed by the
+	// domain of the user's email (e.g. `domain:example.com`), to their
+	// groups, if their email is verified.
+	EmailDomainGroup bool
+
+	// GroupsNamePrefix, if set, limits a user's groups to those whose name
+	// starts with it. Groups read from the ID token are filtered by their
+	// value; those retrieved with UserGroupFn by providers which support it
+	// (e.g. Okta) by their name, whichever GroupFormat identifies them.
+	GroupsNamePrefix string
+
+	// ForwardedClaims are the names of the id token and user info claims
+	// kept in a user's session, to be set as headers on the requests proxied
+	// for them, for OpenID Connect based providers.
+	ForwardedClaims []string
+
+	// GroupAliases maps the identifiers the identity provider returns for
+	// groups (e.g. numeric ids) to the names policies refer to them by.
+	// Groups without an alias are kept as they are.
+	GroupAliases map[string]string
+
+	// GroupsCaseInsensitive lowercases a user's groups, after GroupAliases
+	// is applied, for identity providers which aren't consistent about the
+	// case of group names. Groups which only differ by case become one.
+	GroupsCaseInsensitive bool
+
+	// RoleSource selects which roles are returned as a user's groups, for
+	// providers which support it (e.g. Keycloak's realm and client roles).
+	RoleSource string
+
+	// GroupsCacheTTL is the duration a user's groups are cached before
+	// UserGroupFn is called again. Defaults to DefaultGroupsCacheTTL.
+	GroupsCacheTTL time.Duration
+
+	// GroupsCache stores users' groups. Defaults to an in-memory cache local
+	// to this instance.
+	GroupsCache GroupsCache
+
+	// GroupsBestEffort, for providers which combine groups from several
+	// sources (e.g. GitLab), skips sources which fail rather than failing
+	// the user's group lookup, so long as one source succeeds. For paginated
+	// sources, it also keeps the pages retrieved before one failed.
+	GroupsBestEffort bool
+
+	// GroupsRequestTimeout bounds how long a call to UserGroupFn, or to
+	// UserAttributeFn, may take.
+	// Defaults to DefaultGroupsRequestTimeout.
+	GroupsRequestTimeout time.Duration
+
+	// GroupsCircuitBreakerThreshold is the number of consecutive group
+	// lookups which may fail because the identity provider is unavailable
+	// before lookups are suspended for GroupsCircuitBreakerCooldown. Defaults
+	// to DefaultGroupsCircuitBreakerThreshold; if negative, lookups are never
+	// suspended.
+	GroupsCircuitBreakerThreshold int
+	// GroupsCircuitBreakerCooldown defaults to
+	// DefaultGroupsCircuitBreakerCooldown.
+	GroupsCircuitBreakerCooldown time.Duration
+	// GroupsCircuitBreakerFallback is how group lookups are answered while
+	// suspended, either GroupsCircuitBreakerDeny (the default) or
+	// GroupsCircuitBreakerCache.
+	GroupsCircuitBreakerFallback string
+
+	// MaxStaleGroups, if positive, answers group lookups which fail because
+	// the identity provider is unavailable with the groups last retrieved
+	// for the user, so long as they were retrieved within MaxStaleGroups.
+	// Users with no groups that recent are denied. It also bounds the groups
+	// served by GroupsCircuitBreakerCache, if it's shorter than the 24 hours
+	// they're otherwise kept for.
+	MaxStaleGroups time.Duration
+
+	// JWKSRefreshInterval is how often the identity provider's signing keys
+	// are refetched, for OpenID Connect based providers. Defaults to
+	// DefaultJWKSRefreshInterval; if negative, keys are only refetched when a
+	// token is signed with an unknown key.
+	JWKSRefreshInterval time.Duration
+
+	// InsecureSkipVerify skips checking the signature and issuer of id
+	// tokens, and other tokens the provider issues, for development against
+	// a mock identity provider which doesn't sign them. Anyone can forge
+	// tokens for any user with it set, so it must never be used otherwise.
+	InsecureSkipVerify bool
+
+	// AllowPersonalAccessTokens enables authenticating with a personal
+	// access token, for providers which support it (e.g. GitLab). Anyone
+	// holding a user's token can then act as that user, so it is disabled
+	// by default.
+	AllowPersonalAccessTokens bool
+
+	// AllowDeviceAuthorization enables the device authorization grant, for
+	// providers with a device authorization endpoint, so that users can
+	// sign in to devices without a browser, such as command line tools.
+	AllowDeviceAuthorization bool
+
+	// MachineClients are the OAuth 2.0 clients which may authenticate with
+	// the client credentials grant, for service to service requests. If
+	// empty, the grant is disabled.
+	MachineClients []MachineClient
+
+	// CA is a base64 encoded PEM certificate authority bundle which, in
+	// addition to the system's roots, is trusted when connecting to the
+	// identity provider. CAFile is its file based alternative.
+	CA     string
+	CAFile string
+
+	// TLSMinVersion is the minimum TLS version, `1.0` to `1.3`, connections
+	// to the identity provider are made with. Defaults to `1.2`.
+	// TLSCipherSuites, if set, restricts the cipher suites used to those
+	// named, e.g. `TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384`.
+	TLSMinVersion   string
+	TLSCipherSuites []string
+
+	// ClientCert and ClientKey are a base64 encoded PEM certificate and key
+	// presented to identity providers which require mutual TLS.
+	// ClientCertFile and ClientKeyFile are their file based alternative;
+	// the files are reloaded when they change.
+	ClientCert     string
+	ClientKey      string
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// ProxyURL is an HTTP proxy which requests to the identity provider are
+	// made through, instead of any set by the HTTP_PROXY and HTTPS_PROXY
+	// environment variables. Credentials may be set in the url's userinfo.
+	// NoProxy is a comma separated list of hosts which are connected to
+	// directly, in the same format as the NO_PROXY environment variable.
+	ProxyURL string
+	NoProxy  string
+
+	// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout bound how
+	// long connecting to the identity provider, the TLS handshake, and
+	// waiting for a response's headers may each take, separately from a
+	// request's overall timeout. They default to DefaultDialTimeout,
+	// DefaultTLSHandshakeTimeout, and DefaultResponseHeaderTimeout.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// DiscoveryRetries is how many times fetching the provider's discovery
+	// document is retried, within DiscoveryTimeout, before the provider
+	// can't be created. They default to DefaultDiscoveryRetries and
+	// DefaultDiscoveryTimeout; negative retries disable retrying.
+	DiscoveryRetries int
+	DiscoveryTimeout time.Duration
+	discoveryBackoff time.Duration
+
+	// UserAgent overrides the User-Agent header sent with requests made to
+	// the identity provider's API and to fetch its signing keys, for
+	// providers which filter requests by user agent. Defaults to
+	// version.UserAgent().
+	UserAgent string
+
+	// HTTPClient, if set, is used for all requests to the identity provider,
+	// including those made by the oauth2 and oidc packages, in place of the
+	// one New builds from the settings above. Tests may set it to serve the
+	// provider's API without network access. If nil, and the provider isn't
+	// created with New, httputil.DefaultClient is used.
+	HTTPClient *http.Client
+
+	groupsCache *groupsCache
+	// tokenRefresher shares refreshed tokens between concurrent refreshes of
+	// the same session, which providers that rotate refresh tokens require.
+	tokenRefresher *tokenRefresher
+	health         *healthCheck
+
 	provider *oidc.Provider
-	verifier *oidc.IDTokenVerifier
 	oauth    *oauth2.Config
+
+	// verifierMu guards verifier, which may be swapped while tokens are
+	// being verified. It's set directly by constructors, before the
+	// provider is shared.
+	verifierMu sync.RWMutex
+	verifier   *oidc.IDTokenVerifier
+	// stopKeyRefresh stops the verifier's signing keys being refreshed.
+	stopKeyRefresh context.CancelFunc
+
+	// accessTokenVerifier checks the issuer and signature of JWT access
+	// tokens issued to machine clients.
+	accessTokenVerifier *oidc.IDTokenVerifier
+	// logoutTokenVerifier checks the issuer, audience and signature of
+	// back-channel logout tokens, which needn't expire.
+	logoutTokenVerifier *oidc.IDTokenVerifier
+	// endSessionURL is the provider's end session endpoint, if it has one.
+	endSessionURL string
 }
 
 // GetSignInURL returns a URL to OAuth 2.0 provider's consent page
@@ -103,17 +534,25 @@ type Provider struct {
 // always provide a non-empty string and validate that it matches the
 // the state query parameter on your redirect callback.
 // See http://tools.ietf.org/html/rfc6749#section-10.12 for more info.
-func (p *Provider) GetSignInURL(state string) string {
-	return p.oauth.AuthCodeURL(state, oauth2.AccessTypeOffline)
+func (p *Provider) GetSignInURL(state string, opts SignInOptions) string {
+	return p.oauth.AuthCodeURL(state, append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, opts.authCodeOptions(p)...)...)
 }
 
 // Authenticate creates an identity session with google from a authorization code, and follows up
 // call to the admin/group api to check what groups the user is in.
-func (p *Provider) Authenticate(ctx context.Context, code string) (*sessions.State, error) {
-	oauth2Token, err := p.oauth.Exchange(ctx, code)
+func (p *Provider) Authenticate(ctx context.Context, code, codeVerifier string) (*sessions.State, error) {
+	oauth2Token, err := p.oauth.Exchange(p.clientContext(ctx), code, codeVerifierOptions(codeVerifier)...)
 	if err != nil {
 		return nil, fmt.Errorf("internal/identity: token exchange failed: %w", err)
 	}
+	return p.sessionFromToken(ctx, oauth2Token)
+}
+
+// sessionFromToken creates a user's session from the tokens they were just
+// issued, however they signed in, with their claims, user info, groups and
+// orgs.
+func (p *Provider) sessionFromToken(ctx context.Context, oauth2Token *oauth2.Token) (*sessions.State, error) {
+	p.checkRefreshToken(ctx, oauth2Token)
 	idToken, err := p.IdentityFromToken(ctx, oauth2Token)
 	if err != nil {
 		return nil, err
@@ -123,6 +562,9 @@ func (p *Provider) Authenticate(ctx context.Context, code string) (*sessions.Sta
 	if err != nil {
 		return nil, err
 	}
+	if err := p.checkACR(ctx, s); err != nil {
+		return nil, err
+	}
 
 	// check if provider has info endpoint, try to hit that and gather more info
 	// especially useful if initial request did not an contain email, or subject
@@ -131,35 +573,71 @@ func (p *Provider) Authenticate(ctx context.Context, code string) (*sessions.Sta
 		UserInfoURL string `json:"userinfo_endpoint"`
 	}
 
+	sources := []claimsSource{idToken}
 	if err := p.provider.Claims(&claims); err == nil && claims.UserInfoURL != "" {
-		userInfo, err := p.provider.UserInfo(ctx, oauth2.StaticTokenSource(oauth2Token))
+		userInfo, err := p.provider.UserInfo(p.clientContext(ctx), oauth2.StaticTokenSource(oauth2Token))
 		if err != nil {
 			return nil, fmt.Errorf("internal/identity: could not retrieve user info %w", err)
 		}
 		if err := userInfo.Claims(&s); err != nil {
 			return nil, err
 		}
+		sources = append(sources, userInfo)
+	}
+	if err := p.updateClaims(s, sources...); err != nil {
+		return nil, err
 	}
 
-	if p.UserGroupFn != nil {
-		s.Groups, err = p.UserGroupFn(ctx, s)
-		if err != nil {
-			return nil, fmt.Errorf("internal/identity: could not retrieve groups %w", err)
-		}
+	// signing in should pick up the user's latest group membership, as a
+	// refresh does
+	p.groupsCache.invalidate(ctx, s)
+	if err := p.updateGroups(ctx, s, idToken); err != nil {
+		return nil, err
+	}
+	if err := p.updateOrgs(ctx, s); err != nil {
+		return nil, err
+	}
+	if err := p.updateAttributes(ctx, s); err != nil {
+		return nil, err
 	}
 	return s, nil
 }
 
+// checkACR checks that the user signed in with one of the authentication
+// context classes the provider requested. Identity providers may satisfy a
+// request with a different class, or ignore it, so a mismatch is only an
+// error if RequireACR is set.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#acrSemantics
+func (p *Provider) checkACR(ctx context.Context, s *sessions.State) error {
+	if len(p.ACRValues) == 0 {
+		return nil
+	}
+	for _, v := range p.ACRValues {
+		if s.ACR == v {
+			return nil
+		}
+	}
+	if !p.RequireACR {
+		logFrom(ctx).Warn().Str("acr", s.ACR).Strs("acr_values", p.ACRValues).
+			Msg("internal/identity: user signed in with an authentication context class which wasn't requested")
+		return nil
+	}
+	return newProviderError(ErrACRNotSatisfied, fmt.Errorf("acr %q is not one of %q", s.ACR, p.ACRValues))
+}
+
 // Refresh renews a user's session using an oidc refresh token withoutreprompting the user.
 // Group membership is also refreshed.
+//
+// The session keeps the whole refreshed token, including the new refresh
+// token if the provider rotated it, so that it can be refreshed again.
 // https://openid.net/specs/openid-connect-core-1_0.html#RefreshTokens
 func (p *Provider) Refresh(ctx context.Context, s *sessions.State) (*sessions.State, error) {
 	if s.AccessToken == nil || s.AccessToken.RefreshToken == "" {
-		return nil, errors.New("internal/identity: missing refresh token")
+		return nil, newProviderError(ErrMissingSession, errors.New("missing refresh token"))
 	}
 
-	t := oauth2.Token{RefreshToken: s.AccessToken.RefreshToken}
-	oauthToken, err := p.oauth.TokenSource(ctx, &t).Token()
+	oauthToken, err := p.renewToken(ctx, s.AccessToken.RefreshToken)
 	if err != nil {
 		return nil, fmt.Errorf("internal/identity: refresh failed %w", err)
 	}
@@ -170,28 +648,185 @@ func (p *Provider) Refresh(ctx context.Context, s *sessions.State) (*sessions.St
 	if err := s.UpdateState(idToken, oauthToken); err != nil {
 		return nil, fmt.Errorf("internal/identity: state update failed %w", err)
 	}
-	if p.UserGroupFn != nil {
-		s.Groups, err = p.UserGroupFn(ctx, s)
-		if err != nil {
-			return nil, fmt.Errorf("internal/identity: could not retrieve groups %w", err)
-		}
+	if err := p.updateClaims(s, idToken); err != nil {
+		return nil, err
+	}
+	// a refresh should always pick up the user's latest group membership
+	p.groupsCache.invalidate(ctx, s)
+	if err := p.updateGroups(ctx, s, idToken); err != nil {
+		return nil, err
 	}
+	if err := p.updateOrgs(ctx, s); err != nil {
+		return nil, err
+	}
+	if err := p.updateAttributes(ctx, s); err != nil {
+		return nil, err
+	}
+	logFrom(p.logContext(ctx, opTokenRefresh, s)).Debug().Time("expiry", oauthToken.Expiry).Msg("internal/identity: session refreshed")
 	return s, nil
 }
 
 // IdentityFromToken takes an identity provider issued JWT as input ('id_token')
 // and returns a session state. The provided token's audience ('aud') must
-// match Pomerium's client_id.
+// match Pomerium's client_id, or one of the provider's AllowedAudiences.
 func (p *Provider) IdentityFromToken(ctx context.Context, t *oauth2.Token) (*oidc.IDToken, error) {
 	rawIDToken, ok := t.Extra("id_token").(string)
 	if !ok {
 		return nil, fmt.Errorf("internal/identity: id_token not found")
 	}
-	return p.verifier.Verify(ctx, rawIDToken)
+	return p.verifyIDToken(ctx, rawIDToken)
 }
 
-// Revoke enables a user to revoke her token. If the identity provider supports revocation
-// the endpoint is available, otherwise an error is thrown.
+// verifyIDToken verifies an id token with the provider's verifier. If the
+// provider has AllowedAudiences or AllowedIssuers, the verifier doesn't
+// check the token's audience or issuer, so they are checked here instead.
+func (p *Provider) verifyIDToken(ctx context.Context, rawIDToken string) (*oidc.IDToken, error) {
+	verifier := p.idTokenVerifier()
+	if verifier == nil {
+		return nil, ErrTokenValidationNotSupported
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkIssuer(idToken.Issuer); err != nil {
+		return nil, err
+	}
+	if len(p.AllowedAudiences) == 0 {
+		return idToken, nil
+	}
+	for _, aud := range idToken.Audience {
+		if aud == p.ClientID {
+			return idToken, nil
+		}
+		for _, allowed := range p.AllowedAudiences {
+			if aud == allowed {
+				return idToken, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %q is not %q or one of %q", ErrAudienceNotAllowed, idToken.Audience, p.ClientID, p.AllowedAudiences)
+}
+
+// checkIssuer checks that a verified token's issuer is one of the
+// provider's AllowedIssuers, if it has any.
+func (p *Provider) checkIssuer(issuer string) error {
+	if len(p.AllowedIssuers) == 0 {
+		return nil
+	}
+	for _, allowed := range p.AllowedIssuers {
+		if issuer == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q is not one of %q", ErrIssuerNotAllowed, issuer, p.AllowedIssuers)
+}
+
+// Revoke enables a user to revoke her token. If the identity provider
+// advertises a revocation endpoint in its discovery document the token is
+// revoked, otherwise revocation is skipped.
+//
+// https://tools.ietf.org/html/rfc7009
 func (p *Provider) Revoke(ctx context.Context, token *oauth2.Token) error {
-	return ErrRevokeNotImplemented
+	if token == nil || token.AccessToken == "" {
+		return ErrMissingToken
+	}
+	var claims struct {
+		RevokeURL string `json:"revocation_endpoint"`
+	}
+	if p.provider != nil {
+		if err := p.provider.Claims(&claims); err != nil {
+			return fmt.Errorf("internal/identity: couldn't read discovery document: %w", err)
+		}
+	}
+	params := url.Values{}
+	params.Add("client_id", p.ClientID)
+	params.Add("client_secret", p.ClientSecret)
+	params.Add("token", token.AccessToken)
+	params.Add("token_type_hint", "access_token")
+	return p.revoke(ctx, claims.RevokeURL, nil, params)
+}
+
+// validateRedirectURL checks that u can be registered with, and redirected
+// to by, an identity provider so that misconfiguration is reported at
+// startup rather than as an opaque error from the identity provider when a
+// user signs in.
+//
+// https://tools.ietf.org/html/rfc6749#section-3.1.2
+func validateRedirectURL(u *url.URL, allowInsecure bool) error {
+	switch {
+	case u == nil:
+		return fmt.Errorf("%w: redirect url is required", ErrInvalidRedirectURL)
+	case u.Scheme == "http" && !allowInsecure:
+		return fmt.Errorf("%w: %q must use https, http is only allowed in insecure mode", ErrInvalidRedirectURL, u)
+	case u.Scheme != "https" && u.Scheme != "http":
+		return fmt.Errorf("%w: %q must use https", ErrInvalidRedirectURL, u)
+	case u.Hostname() == "":
+		return fmt.Errorf("%w: %q has no host", ErrInvalidRedirectURL, u)
+	case u.Path == "" || u.Path == "/":
+		return fmt.Errorf("%w: %q has no callback path (e.g. /oauth2/callback)", ErrInvalidRedirectURL, u)
+	case u.Fragment != "":
+		return fmt.Errorf("%w: %q must not include a fragment", ErrInvalidRedirectURL, u)
+	}
+	return nil
+}
+
+// requireScopes returns the configured scopes, or defaults if none are
+// configured, adding any of the required scopes which are missing so that
+// custom scopes don't break the provider's API calls.
+func requireScopes(scopes, defaults, required []string) []string {
+	if len(scopes) == 0 {
+		scopes = defaults
+	}
+	merged := make([]string, 0, len(scopes)+len(required))
+	seen := make(map[string]bool, len(scopes)+len(required))
+	for _, scope := range append(append([]string{}, scopes...), required...) {
+		if !seen[scope] {
+			seen[scope] = true
+			merged = append(merged, scope)
+		}
+	}
+	return merged
+}
+
+// refreshScopes returns the required scopes of a provider which issues
+// refresh tokens for the offline_access scope, adding it if EnableRefresh
+// is set.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#OfflineAccess
+func (p *Provider) refreshScopes(required ...string) []string {
+	if p.EnableRefresh {
+		required = append(required, offlineAccessScope)
+	}
+	return required
+}
+
+// checkRefreshToken warns if EnableRefresh is set but the provider didn't
+// issue a refresh token, which it may do if the client isn't allowed the
+// offline_access scope, or ignores it.
+func (p *Provider) checkRefreshToken(ctx context.Context, token *oauth2.Token) {
+	if !p.EnableRefresh || token.RefreshToken != "" {
+		return
+	}
+	logFrom(p.logContext(ctx, opCodeExchange, nil)).Warn().
+		Msg("internal/identity: refresh is enabled, but no refresh token was issued; check that the client is allowed the offline_access scope, or sessions can't be refreshed")
+}
+
+// revoke posts params to the identity provider's revocation endpoint. If the
+// provider has none, revocation is skipped rather than failing the sign out.
+// Tokens which have already expired or been revoked are not an error, so
+// revoking a token twice succeeds, but are logged so that repeated sign outs
+// and reused tokens can be spotted.
+func (p *Provider) revoke(ctx context.Context, endpoint string, headers map[string]string, params url.Values) error {
+	ctx = p.logContext(ctx, opRevoke, nil)
+	if endpoint == "" {
+		logFrom(ctx).Debug().Msg("internal/identity: no revocation endpoint, skipping token revocation")
+		return nil
+	}
+	_, err := p.apiRequest(ctx, opRevoke, http.MethodPost, endpoint, headers, params, nil)
+	if errors.Is(err, ErrTokenExpired) {
+		logFrom(ctx).Info().Err(err).Msg("internal/identity: token already expired or revoked")
+		return nil
+	}
+	return err
 }
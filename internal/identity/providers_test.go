@@ -0,0 +1,400 @@
+package identity
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rs/zerolog"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestProviderRevoke(t *testing.T) {
+	t.Parallel()
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		switch r.FormValue("access_token") {
+		case "revoked":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_token","error_description":"Token expired or revoked"}`))
+		case "bad":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		endpoint  string
+		token     string
+		wantErr   bool
+		wantCalls int32
+	}{
+		{"no endpoint", "", "token", false, 0},
+		{"revoked", srv.URL, "token", false, 1},
+		{"already revoked", srv.URL, "revoked", false, 1},
+		{"error", srv.URL, "bad", true, 1},
+		{"empty token", srv.URL, "", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			p := &GitLabProvider{Provider: &Provider{ProviderName: GitlabProviderName}, RevokeURL: tt.endpoint}
+			err := p.Revoke(context.Background(), &oauth2.Token{AccessToken: tt.token})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Revoke() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRevokeMissingToken(t *testing.T) {
+	t.Parallel()
+	providers := []Authenticator{
+		&Provider{},
+		&GoogleProvider{Provider: &Provider{}},
+		&AzureProvider{Provider: &Provider{}},
+		&GitLabProvider{Provider: &Provider{}},
+		&OktaProvider{Provider: &Provider{}},
+		&OneLoginProvider{Provider: &Provider{}},
+		&KeycloakProvider{Provider: &Provider{}},
+		&CognitoProvider{Provider: &Provider{}},
+		&PingProvider{Provider: &Provider{}},
+		&SlackProvider{Provider: &Provider{}},
+	}
+	for _, p := range providers {
+		for _, token := range []*oauth2.Token{nil, {}} {
+			if err := p.Revoke(context.Background(), token); !errors.Is(err, ErrMissingToken) {
+				t.Errorf("%T.Revoke(%v) error = %v, want %v", p, token, err, ErrMissingToken)
+			}
+		}
+	}
+}
+
+func TestProviderCheckACR(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		acrValues []string
+		require   bool
+		acr       string
+		wantErr   error
+	}{
+		{"not requested", nil, false, "", nil},
+		{"satisfied", []string{"gold", "silver"}, true, "silver", nil},
+		{"not satisfied", []string{"gold"}, true, "bronze", ErrACRNotSatisfied},
+		{"not returned", []string{"gold"}, true, "", ErrACRNotSatisfied},
+		{"not satisfied but not required", []string{"gold"}, false, "bronze", nil},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			p := &Provider{ACRValues: tt.acrValues, RequireACR: tt.require}
+			err := p.checkACR(context.Background(), &sessions.State{ACR: tt.acr})
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("checkACR() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	t.Parallel()
+	defaults := []string{"openid", "profile", "email"}
+	required := []string{"openid", "groups"}
+	tests := []struct {
+		name   string
+		scopes []string
+		want   []string
+	}{
+		{"defaults", nil, []string{"openid", "profile", "email", "groups"}},
+		{"custom missing required", []string{"email"}, []string{"email", "openid", "groups"}},
+		{"custom with required", []string{"groups", "openid"}, []string{"groups", "openid"}},
+		{"duplicates", []string{"email", "email", "openid"}, []string{"email", "openid", "groups"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got := requireScopes(tt.scopes, defaults, required)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("requireScopes() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderRefreshScopes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		enableRefresh bool
+		scopes        []string
+		want          []string
+	}{
+		{"disabled", false, []string{"openid", "email"}, []string{"openid", "email"}},
+		{"enabled", true, []string{"openid", "email"}, []string{"openid", "email", "offline_access"}},
+		{"enabled with defaults", true, nil, []string{"openid", "offline_access", "profile"}},
+		{"already requested", true, []string{"offline_access", "openid"}, []string{"offline_access", "openid"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			p := &Provider{EnableRefresh: tt.enableRefresh}
+			got := requireScopes(tt.scopes, []string{"openid", "offline_access", "profile"}, p.refreshScopes("openid"))
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("requireScopes() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestProviderCheckRefreshToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		enableRefresh bool
+		refreshToken  string
+		wantWarning   bool
+	}{
+		{"disabled", false, "", false},
+		{"issued", true, "refresh", false},
+		{"not issued", true, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := zerolog.New(&buf)
+			ctx := logger.WithContext(context.Background())
+			p := &Provider{ProviderName: OktaProviderName, EnableRefresh: tt.enableRefresh}
+			p.checkRefreshToken(ctx, &oauth2.Token{AccessToken: "access", RefreshToken: tt.refreshToken})
+			if got := strings.Contains(buf.String(), `"level":"warn"`); got != tt.wantWarning {
+				t.Errorf("checkRefreshToken() logged %q, want warning %v", buf.String(), tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestValidateRedirectURL(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		rawURL        string
+		allowInsecure bool
+		wantErr       bool
+	}{
+		{"good", "https://authenticate.example.com/oauth2/callback", false, false},
+		{"missing", "", false, true},
+		{"http", "http://authenticate.example.com/oauth2/callback", false, true},
+		{"http allowed in insecure mode", "http://localhost:8443/oauth2/callback", true, false},
+		{"other scheme", "ftp://authenticate.example.com/oauth2/callback", true, true},
+		{"no scheme", "authenticate.example.com/oauth2/callback", false, true},
+		{"no host", "https:///oauth2/callback", false, true},
+		{"port only", "https://:8443/oauth2/callback", false, true},
+		{"no path", "https://authenticate.example.com", false, true},
+		{"root path", "https://authenticate.example.com/", false, true},
+		{"fragment", "https://authenticate.example.com/oauth2/callback#x", false, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var u *url.URL
+			if tt.rawURL != "" {
+				var err error
+				if u, err = url.Parse(tt.rawURL); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := validateRedirectURL(u, tt.allowInsecure)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateRedirectURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidRedirectURL) {
+				t.Errorf("validateRedirectURL() error = %v, want %v", err, ErrInvalidRedirectURL)
+			}
+		})
+	}
+}
+
+func TestNewInvalidRedirectURL(t *testing.T) {
+	t.Parallel()
+	// the redirect url is checked before the identity provider is contacted
+	u, _ := url.Parse("http://authenticate.example.com/oauth2/callback")
+	_, err := New(GitlabProviderName, &Provider{RedirectURL: u, ProviderURL: "https://gitlab.invalid"})
+	if !errors.Is(err, ErrInvalidRedirectURL) {
+		t.Errorf("New() error = %v, want %v", err, ErrInvalidRedirectURL)
+	}
+}
+
+func TestProviderRefreshRotation(t *testing.T) {
+	t.Parallel()
+	signer, key := newTestSigningKey(t, "kid")
+
+	// the identity provider rotates refresh tokens on use, rejecting any
+	// refresh token which has already been used
+	var mu sync.Mutex
+	current, issued := "refresh-0", 0
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                                srv.URL,
+				"authorization_endpoint":                srv.URL + "/auth",
+				"token_endpoint":                        srv.URL + "/token",
+				"jwks_uri":                              srv.URL + "/keys",
+				"id_token_signing_alg_values_supported": []string{"ES256"},
+			})
+		case "/keys":
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key}})
+		case "/token":
+			mu.Lock()
+			defer mu.Unlock()
+			if r.FormValue("refresh_token") != current {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			// long enough for concurrent refreshes to share the request
+			time.Sleep(10 * time.Millisecond)
+			issued++
+			current = fmt.Sprintf("refresh-%d", issued)
+			idToken := signTestToken(t, signer, fmt.Sprintf(`{"iss":%q,"aud":"client","sub":"user","email":"user@example.com","exp":%d}`,
+				srv.URL, time.Now().Add(time.Hour).Unix()))
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  fmt.Sprintf("access-%d", issued),
+				"refresh_token": current,
+				"id_token":      idToken,
+				"token_type":    "Bearer",
+				"expires_in":    3600,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	redirectURL, _ := url.Parse("https://authenticate.example.com/oauth2/callback")
+	p := &Provider{
+		ProviderName:        OIDCProviderName,
+		ProviderURL:         srv.URL,
+		ClientID:            "client",
+		ClientSecret:        "secret",
+		RedirectURL:         redirectURL,
+		JWKSRefreshInterval: -1,
+	}
+	a, err := New(OIDCProviderName, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	s := &sessions.State{AccessToken: &oauth2.Token{
+		AccessToken:  "access-0",
+		RefreshToken: "refresh-0",
+		Expiry:       time.Now().Add(-time.Minute),
+	}}
+	// a copy of the session, as held by a concurrent request
+	other := &sessions.State{AccessToken: &oauth2.Token{AccessToken: "access-0", RefreshToken: "refresh-0"}}
+
+	// concurrent refreshes share the one rotation, each with its own token
+	var wg sync.WaitGroup
+	var otherErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		other, otherErr = a.Refresh(ctx, other)
+	}()
+	s, err = a.Refresh(ctx, s)
+	wg.Wait()
+	if err != nil || otherErr != nil {
+		t.Fatalf("Refresh() error = %v, concurrent refresh error = %v", err, otherErr)
+	}
+	for _, got := range []*sessions.State{s, other} {
+		if got.AccessToken.RefreshToken != "refresh-1" || got.AccessToken.AccessToken != "access-1" {
+			t.Errorf("Refresh() token = %q, %q, want %q, %q", got.AccessToken.AccessToken, got.AccessToken.RefreshToken, "access-1", "refresh-1")
+		}
+		if got.Email != "user@example.com" {
+			t.Errorf("Refresh() email = %q", got.Email)
+		}
+	}
+	if s.AccessToken == other.AccessToken {
+		t.Error("Refresh() shared one token between sessions")
+	}
+
+	s, err = a.Refresh(ctx, s)
+	if err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if s.AccessToken.RefreshToken != "refresh-2" {
+		t.Errorf("Refresh() refresh token = %q, want %q", s.AccessToken.RefreshToken, "refresh-2")
+	}
+
+	// once rotated, a refresh token isn't handed the token it was rotated
+	// to; the identity provider rejects it
+	if _, err := a.Refresh(ctx, other); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Refresh() with a rotated refresh token error = %v, want %v", err, ErrTokenExpired)
+	}
+}
+
+func TestNewMaxStaleGroups(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name           string
+		threshold      int
+		fallback       string
+		maxStale       time.Duration
+		wantStaleTTL   time.Duration
+		wantServeStale bool
+	}{
+		{"none", 0, GroupsCircuitBreakerDeny, 0, 0, false},
+		{"cache fallback", 0, GroupsCircuitBreakerCache, 0, groupsStaleTTL, false},
+		{"max stale", 0, GroupsCircuitBreakerDeny, time.Hour, time.Hour, true},
+		{"max stale shorter than the cache fallback", 0, GroupsCircuitBreakerCache, time.Hour, time.Hour, true},
+		{"max stale longer than the cache fallback", 0, GroupsCircuitBreakerCache, 3 * groupsStaleTTL, groupsStaleTTL, true},
+		{"max stale without a circuit breaker", -1, GroupsCircuitBreakerCache, 3 * groupsStaleTTL, 3 * groupsStaleTTL, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			a, err := New(GithubProviderName, &Provider{
+				RedirectURL:                   &url.URL{Scheme: "https", Host: "authenticate.example.com", Path: "/oauth2/callback"},
+				GroupsCircuitBreakerThreshold: tt.threshold,
+				GroupsCircuitBreakerFallback:  tt.fallback,
+				MaxStaleGroups:                tt.maxStale,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := a.(*GitHubProvider).groupsCache
+			if c.staleTTL != tt.wantStaleTTL || c.serveStale != tt.wantServeStale {
+				t.Errorf("New() stale groups = %v, %v, want %v, %v", c.staleTTL, c.serveStale, tt.wantStaleTTL, tt.wantServeStale)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// SignInOptions are the per sign in parameters of an authorization request.
+type SignInOptions struct {
+	// CodeVerifier, if set, adds its PKCE code challenge to the request. It
+	// must be passed to Authenticate once the user is redirected back.
+	CodeVerifier string
+	// Prompt, if set, overrides whether the identity provider prompts the
+	// user; for example, `login` forces them to re-authenticate.
+	Prompt string
+	// LoginHint, if set, pre-fills the username the user signs in with.
+	LoginHint string
+	// Scopes, if set, are requested in addition to the provider's own, for
+	// routes which require a broader grant than signing in does.
+	Scopes []string
+	// MaxAge, if set, is how long ago the user may have last authenticated
+	// with the identity provider, for routes which require a recent
+	// authentication; if longer, they must authenticate again.
+	MaxAge time.Duration
+}
+
+// authCodeOptions returns the authorization request parameters for o. They
+// are meant to be appended to a provider's own, which they override. o's
+// scopes are added to the provider's configured scopes, and the provider's
+// ACRValues and AuthURLParams are requested; AuthURLParams come first, so
+// the others override them.
+func (o SignInOptions) authCodeOptions(p *Provider) []oauth2.AuthCodeOption {
+	opts := authURLParamOptions(p.AuthURLParams)
+	opts = append(opts, codeChallengeOptions(o.CodeVerifier)...)
+	if len(o.Scopes) != 0 {
+		opts = append(opts, oauth2.SetAuthURLParam("scope", strings.Join(requireScopes(p.oauth.Scopes, nil, o.Scopes), " ")))
+	}
+	if len(p.ACRValues) != 0 {
+		opts = append(opts, oauth2.SetAuthURLParam("acr_values", strings.Join(p.ACRValues, " ")))
+	}
+	if o.Prompt != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("prompt", o.Prompt))
+	}
+	if o.LoginHint != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("login_hint", o.LoginHint))
+	}
+	if o.MaxAge > 0 {
+		opts = append(opts, oauth2.SetAuthURLParam("max_age", strconv.FormatInt(int64(o.MaxAge/time.Second), 10)))
+	}
+	return opts
+}
+
+// authURLParamOptions returns params as authorization request parameters,
+// in key order so sign in urls are stable.
+func authURLParamOptions(params map[string]string) []oauth2.AuthCodeOption {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	opts := make([]oauth2.AuthCodeOption, 0, len(keys))
+	for _, k := range keys {
+		opts = append(opts, oauth2.SetAuthURLParam(k, params[k]))
+	}
+	return opts
+}
+
+// reservedAuthURLParams are the authorization request parameters set by
+// the OAuth2 flow itself, which AuthURLParams can't replace.
+var reservedAuthURLParams = map[string]bool{
+	"client_id":             true,
+	"code_challenge":        true,
+	"code_challenge_method": true,
+	"redirect_uri":          true,
+	"response_type":         true,
+	"scope":                 true,
+	"state":                 true,
+}
+
+// ValidateAuthURLParams checks that params only adds to the authorization
+// request, rather than naming parameters the OAuth2 flow sets itself.
+func ValidateAuthURLParams(params map[string]string) error {
+	for k := range params {
+		if strings.TrimSpace(k) == "" {
+			return errors.New("internal/identity: auth url parameter name cannot be empty")
+		}
+		if reservedAuthURLParams[strings.ToLower(k)] {
+			return fmt.Errorf("internal/identity: auth url parameter %q is reserved", k)
+		}
+	}
+	return nil
+}
+
+// ValidatePrompt checks that prompt is a space delimited list of OpenID
+// Connect prompt values, or empty. `none` may not be combined with others.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+func ValidatePrompt(prompt string) error {
+	values := strings.Fields(prompt)
+	for _, v := range values {
+		switch v {
+		case "none":
+			if len(values) > 1 {
+				return fmt.Errorf("internal/identity: prompt %q can't be combined with others", v)
+			}
+		case "login", "consent", "select_account":
+		default:
+			return fmt.Errorf("internal/identity: unknown prompt %q", v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package identity
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestGetSignInURLOptions(t *testing.T) {
+	t.Parallel()
+	config := &oauth2.Config{
+		ClientID: "client",
+		Scopes:   []string{"openid", "email"},
+		Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"},
+	}
+	oidcProvider := &Provider{oauth: config}
+	googleProvider := &GoogleProvider{Provider: &Provider{oauth: config}}
+	tests := []struct {
+		name          string
+		provider      Authenticator
+		opts          SignInOptions
+		wantPrompt    string
+		wantLoginHint string
+		wantScope     string
+	}{
+		{"default", oidcProvider, SignInOptions{}, "", "", "openid email"},
+		{"prompt", oidcProvider, SignInOptions{Prompt: "login"}, "login", "", "openid email"},
+		{"login hint", oidcProvider, SignInOptions{LoginHint: "user@example.com"}, "", "user@example.com", "openid email"},
+		{"additional scopes", oidcProvider, SignInOptions{Scopes: []string{"admin", "email"}}, "", "", "openid email admin"},
+		{"provider default prompt", googleProvider, SignInOptions{}, "select_account consent", "", "openid email"},
+		{"provider prompt overridden", googleProvider, SignInOptions{Prompt: "none"}, "none", "", "openid email"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			u, err := url.Parse(tt.provider.GetSignInURL("state", tt.opts))
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := u.Query()
+			if got := q.Get("prompt"); got != tt.wantPrompt {
+				t.Errorf("prompt = %q, want %q", got, tt.wantPrompt)
+			}
+			if got := q.Get("login_hint"); got != tt.wantLoginHint {
+				t.Errorf("login_hint = %q, want %q", got, tt.wantLoginHint)
+			}
+			if got := q.Get("scope"); got != tt.wantScope {
+				t.Errorf("scope = %q, want %q", got, tt.wantScope)
+			}
+		})
+	}
+}
+
+func TestGetSignInURLACRValues(t *testing.T) {
+	t.Parallel()
+	config := &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"}}
+	for _, p := range []Authenticator{
+		&Provider{oauth: config, ACRValues: []string{"mfa", "pwd"}},
+		&GoogleProvider{Provider: &Provider{oauth: config, ACRValues: []string{"mfa", "pwd"}}},
+	} {
+		u, err := url.Parse(p.GetSignInURL("state", SignInOptions{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := u.Query().Get("acr_values"); got != "mfa pwd" {
+			t.Errorf("%T acr_values = %q, want %q", p, got, "mfa pwd")
+		}
+	}
+	u, err := url.Parse((&Provider{oauth: config}).GetSignInURL("state", SignInOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.Query()["acr_values"]; ok {
+		t.Errorf("acr_values = %q, want none", u.Query().Get("acr_values"))
+	}
+}
+
+func TestGetSignInURLMaxAge(t *testing.T) {
+	t.Parallel()
+	config := &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"}}
+	params := map[string]string{"max_age": "3600"}
+	tests := []struct {
+		name       string
+		provider   Authenticator
+		opts       SignInOptions
+		wantMaxAge string
+	}{
+		{"none", &Provider{oauth: config}, SignInOptions{}, ""},
+		{"oidc", &Provider{oauth: config}, SignInOptions{MaxAge: 5 * time.Minute}, "300"},
+		{"google", &GoogleProvider{Provider: &Provider{oauth: config}}, SignInOptions{MaxAge: 5 * time.Minute}, "300"},
+		{"azure", &AzureProvider{Provider: &Provider{oauth: config}}, SignInOptions{MaxAge: 5 * time.Minute}, "300"},
+		{"overrides auth url params", &Provider{oauth: config, AuthURLParams: params}, SignInOptions{MaxAge: 90 * time.Second}, "90"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.provider.GetSignInURL("state", tt.opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := u.Query().Get("max_age"); got != tt.wantMaxAge {
+			t.Errorf("%s: max_age = %q, want %q", tt.name, got, tt.wantMaxAge)
+		}
+	}
+}
+
+func TestGetSignInURLAuthURLParams(t *testing.T) {
+	t.Parallel()
+	config := &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"}}
+	params := map[string]string{"audience": "https://api.example.com", "organization": "org_123", "prompt": "consent"}
+	tests := []struct {
+		name       string
+		provider   Authenticator
+		opts       SignInOptions
+		wantPrompt string
+	}{
+		{"oidc", &Provider{oauth: config, AuthURLParams: params}, SignInOptions{}, "consent"},
+		{"google", &GoogleProvider{Provider: &Provider{oauth: config, AuthURLParams: params}}, SignInOptions{}, "consent"},
+		{"sign in prompt overrides", &Provider{oauth: config, AuthURLParams: params}, SignInOptions{Prompt: "login"}, "login"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.provider.GetSignInURL("state", tt.opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		if got := q.Get("audience"); got != "https://api.example.com" {
+			t.Errorf("%s: audience = %q, want %q", tt.name, got, "https://api.example.com")
+		}
+		if got := q.Get("organization"); got != "org_123" {
+			t.Errorf("%s: organization = %q, want %q", tt.name, got, "org_123")
+		}
+		if got := q.Get("prompt"); got != tt.wantPrompt {
+			t.Errorf("%s: prompt = %q, want %q", tt.name, got, tt.wantPrompt)
+		}
+		if got := q.Get("client_id"); got != "client" {
+			t.Errorf("%s: client_id = %q, want %q", tt.name, got, "client")
+		}
+	}
+}
+
+func TestValidateAuthURLParams(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		params  map[string]string
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"tenant and audience", map[string]string{"tenant": "corp", "audience": "https://api.example.com"}, false},
+		{"client id", map[string]string{"client_id": "other"}, true},
+		{"redirect uri", map[string]string{"redirect_uri": "https://evil.example.com"}, true},
+		{"scope", map[string]string{"scope": "admin"}, true},
+		{"state", map[string]string{"State": "fixed"}, true},
+		{"empty name", map[string]string{"": "value"}, true},
+	}
+	for _, tt := range tests {
+		if err := ValidateAuthURLParams(tt.params); (err != nil) != tt.wantErr {
+			t.Errorf("%s: ValidateAuthURLParams() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidatePrompt(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		prompt  string
+		wantErr bool
+	}{
+		{"", false},
+		{"none", false},
+		{"login", false},
+		{"select_account consent", false},
+		{"none login", true},
+		{"always", true},
+	}
+	for _, tt := range tests {
+		if err := ValidatePrompt(tt.prompt); (err != nil) != tt.wantErr {
+			t.Errorf("ValidatePrompt(%q) error = %v, wantErr %v", tt.prompt, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGoogleGetSignInURLIncrementalAuth(t *testing.T) {
+	t.Parallel()
+	p := &GoogleProvider{Provider: &Provider{oauth: &oauth2.Config{
+		ClientID: "client",
+		Scopes:   []string{"openid", "email"},
+		Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"},
+	}}}
+	tests := []struct {
+		name string
+		opts SignInOptions
+		want string
+	}{
+		{"sign in", SignInOptions{}, ""},
+		{"additional scopes", SignInOptions{Scopes: []string{"https://www.googleapis.com/auth/drive"}}, "true"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(p.GetSignInURL("state", tt.opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := u.Query().Get("include_granted_scopes"); got != tt.want {
+			t.Errorf("%s: include_granted_scopes = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
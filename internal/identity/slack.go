@@ -0,0 +1,179 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+const (
+	defaultSlackProviderURL = "https://slack.com"
+
+	// slackRevokeURL revokes the token a request is authorized with.
+	slackRevokeURL = "https://slack.com/api/auth.revoke"
+)
+
+// SlackProvider is an implementation of the OpenID Connect provider for
+// Sign in with Slack. A user's groups are the workspace (team) they signed
+// in to and, on Enterprise Grid, its organization.
+//
+// https://api.slack.com/authentication/sign-in-with-slack
+type SlackProvider struct {
+	*Provider
+	UserInfoURL string `json:"userinfo_endpoint"`
+	RevokeURL   string
+}
+
+// slackUserInfo is the response of Slack's userinfo endpoint, which, as
+// Slack's other API methods, responds with a 200 and `ok` set to false
+// on failure.
+//
+// https://api.slack.com/methods/openid.connect.userInfo
+type slackUserInfo struct {
+	OK             bool   `json:"ok"`
+	Error          string `json:"error"`
+	TeamID         string `json:"https://slack.com/team_id"`
+	TeamName       string `json:"https://slack.com/team_name"`
+	EnterpriseID   string `json:"https://slack.com/enterprise_id"`
+	EnterpriseName string `json:"https://slack.com/enterprise_name"`
+}
+
+// NewSlackProvider returns a new SlackProvider.
+//
+// Groups are identified by their ID unless GroupFormat is GroupFormatName.
+// Slack only issues refresh tokens to apps with token rotation enabled, so
+// no offline scope is requested.
+//
+// https://www.pomerium.io/docs/identity-providers/slack.html
+func NewSlackProvider(p *Provider) (*SlackProvider, error) {
+	ctx := p.clientContext(context.Background())
+	if p.ProviderURL == "" {
+		p.ProviderURL = defaultSlackProviderURL
+	}
+	switch p.GroupFormat {
+	case "":
+		p.GroupFormat = GroupFormatID
+	case GroupFormatID, GroupFormatName:
+	default:
+		return nil, fmt.Errorf("identity/slack: unknown group format %q", p.GroupFormat)
+	}
+	var err error
+	p.provider, err = p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Scopes = requireScopes(p.Scopes,
+		[]string{oidc.ScopeOpenID, "profile", "email"},
+		[]string{oidc.ScopeOpenID})
+
+	p.verifier, err = p.newVerifier()
+	if err != nil {
+		return nil, err
+	}
+	p.oauth = &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint:     p.provider.Endpoint(),
+		RedirectURL:  p.RedirectURL.String(),
+		Scopes:       p.Scopes,
+	}
+
+	sp := &SlackProvider{Provider: p, RevokeURL: slackRevokeURL}
+	if err := p.provider.Claims(&sp); err != nil {
+		return nil, err
+	}
+	sp.UserGroupFn = sp.UserGroups
+	return sp, nil
+}
+
+// UserGroups returns the workspace the user signed in to and, if it belongs
+// to an Enterprise Grid organization, the organization, as read from the
+// userinfo endpoint. Slack tokens are scoped to a single workspace, so a
+// user who is a member of several is only a member of the one they signed
+// in to here.
+func (p *SlackProvider) UserGroups(ctx context.Context, s *sessions.State) ([]string, error) {
+	if s == nil || s.AccessToken == nil {
+		return nil, ErrMissingSession
+	}
+	var response slackUserInfo
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", s.AccessToken.AccessToken)}
+	if _, err := p.apiRequest(ctx, opUserGroups, http.MethodGet, p.UserInfoURL, headers, nil, &response); err != nil {
+		return nil, err
+	}
+	if !response.OK {
+		return nil, fmt.Errorf("identity/slack: user info failed: %w", slackError(response.Error))
+	}
+	var groups []string
+	if p.GroupFormat == GroupFormatName {
+		groups = appendNonEmpty(groups, response.TeamName, response.EnterpriseName)
+	} else {
+		groups = appendNonEmpty(groups, response.TeamID, response.EnterpriseID)
+	}
+	return groups, nil
+}
+
+// Revoke revokes the access token. Slack's refresh tokens can't be revoked
+// themselves, but are of no use once the access token they were issued with
+// is.
+//
+// https://api.slack.com/methods/auth.revoke
+func (p *SlackProvider) Revoke(ctx context.Context, token *oauth2.Token) error {
+	if token == nil || token.AccessToken == "" {
+		return ErrMissingToken
+	}
+	ctx = p.logContext(ctx, opRevoke, nil)
+	var response struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", token.AccessToken)}
+	_, err := p.apiRequest(ctx, opRevoke, http.MethodPost, p.RevokeURL, headers, nil, &response)
+	if err == nil && !response.OK {
+		err = slackError(response.Error)
+	}
+	if errors.Is(err, ErrTokenExpired) {
+		logFrom(ctx).Info().Err(err).Msg("internal/identity: token already expired or revoked")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("identity/slack: revocation error %w", err)
+	}
+	return nil
+}
+
+// slackError classifies the error code of a failed Slack API call.
+//
+// https://api.slack.com/web#evaluating_responses
+func slackError(code string) error {
+	err := fmt.Errorf("slack api error: %s", code)
+	switch code {
+	case "invalid_auth", "not_authed", "account_inactive", "token_revoked":
+		return newProviderError(ErrTokenExpired, newProviderError(ErrTokenRevoked, err))
+	case "token_expired":
+		return newProviderError(ErrTokenExpired, err)
+	case "missing_scope":
+		return newProviderError(ErrInsufficientScope, err)
+	case "ratelimited":
+		return newProviderError(ErrProviderUnavailable, newProviderError(ErrRateLimited, err))
+	case "internal_error", "fatal_error", "service_unavailable", "request_timeout":
+		return newProviderError(ErrProviderUnavailable, err)
+	}
+	return err
+}
+
+// appendNonEmpty appends the values which aren't empty.
+func appendNonEmpty(s []string, values ...string) []string {
+	for _, v := range values {
+		if v != "" {
+			s = append(s, v)
+		}
+	}
+	return s
+}
@@ -0,0 +1,111 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestSlackProviderUserGroups(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Header.Get("Authorization") {
+		case "Bearer ACCESS":
+			w.Write([]byte(`{"ok":true,"sub":"U0R7JM","https://slack.com/team_id":"T0R7GR","https://slack.com/team_name":"Pomerium"}`))
+		case "Bearer GRID":
+			w.Write([]byte(`{"ok":true,"sub":"W0R7JM","https://slack.com/team_id":"T0R7GR","https://slack.com/team_name":"Pomerium","https://slack.com/enterprise_id":"E0R7EN","https://slack.com/enterprise_name":"Pomerium Inc"}`))
+		case "Bearer REVOKED":
+			w.Write([]byte(`{"ok":false,"error":"token_revoked"}`))
+		default:
+			w.Write([]byte(`{"ok":false,"error":"ratelimited"}`))
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		format   string
+		token    string
+		want     []string
+		wantErr  bool
+		wantKind error
+	}{
+		{"workspace", GroupFormatID, "ACCESS", []string{"T0R7GR"}, false, nil},
+		{"workspace name", GroupFormatName, "ACCESS", []string{"Pomerium"}, false, nil},
+		{"enterprise grid", GroupFormatID, "GRID", []string{"T0R7GR", "E0R7EN"}, false, nil},
+		{"enterprise grid name", GroupFormatName, "GRID", []string{"Pomerium", "Pomerium Inc"}, false, nil},
+		{"revoked", GroupFormatID, "REVOKED", nil, true, ErrTokenRevoked},
+		{"rate limited", GroupFormatID, "LIMITED", nil, true, ErrRateLimited},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &SlackProvider{
+				Provider:    &Provider{ProviderName: SlackProviderName, GroupFormat: tt.format},
+				UserInfoURL: srv.URL + "/api/openid.connect.userInfo",
+			}
+			got, err := p.UserGroups(context.Background(), &sessions.State{AccessToken: &oauth2.Token{AccessToken: tt.token}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UserGroups() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantKind != nil && !errors.Is(err, tt.wantKind) {
+				t.Errorf("UserGroups() error = %v, want %v", err, tt.wantKind)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("UserGroups() = %s", diff)
+			}
+		})
+	}
+}
+
+func TestSlackProviderRevoke(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Header.Get("Authorization") {
+		case "Bearer ACCESS":
+			w.Write([]byte(`{"ok":true,"revoked":true}`))
+		case "Bearer REVOKED":
+			w.Write([]byte(`{"ok":false,"error":"invalid_auth"}`))
+		default:
+			w.Write([]byte(`{"ok":false,"error":"unknown_method"}`))
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"revoked", "ACCESS", false},
+		{"already revoked", "REVOKED", false},
+		{"failed", "OTHER", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			p := &SlackProvider{Provider: &Provider{ProviderName: SlackProviderName}, RevokeURL: srv.URL + "/api/auth.revoke"}
+			err := p.Revoke(context.Background(), &oauth2.Token{AccessToken: tt.token})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Revoke() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewSlackProviderGroupFormat(t *testing.T) {
+	t.Parallel()
+	_, err := NewSlackProvider(&Provider{ProviderURL: "https://slack.example.com", GroupFormat: GroupFormatPath})
+	if err == nil {
+		t.Error("NewSlackProvider() expected an error for an unsupported group format")
+	}
+}
@@ -0,0 +1,152 @@
+package identity
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/cryptutil"
+	"github.com/pomerium/pomerium/internal/log"
+)
+
+// tlsVersions are the TLS versions a provider's minimum may be set to.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCipherSuites are the cipher suites, by their IANA names, which may be
+// allowed for connections to the identity provider. TLS 1.3's suites
+// aren't configurable.
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// newTLSConfig returns the TLS configuration connections to the identity
+// provider are made with. Connections require at least TLS 1.2 unless the
+// provider's TLSMinVersion says otherwise, and, if its TLSCipherSuites are
+// set, use one of them. If the provider has a client certificate, it is
+// presented to the identity provider when asked for.
+func newTLSConfig(p *Provider) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if p.TLSMinVersion != "" {
+		v, ok := tlsVersions[p.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("internal/identity: unknown tls version %q", p.TLSMinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if len(p.TLSCipherSuites) > 0 && cfg.MinVersion == tls.VersionTLS13 {
+		return nil, errors.New("internal/identity: tls 1.3 cipher suites can't be configured")
+	}
+	for _, name := range p.TLSCipherSuites {
+		id, ok := tlsCipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("internal/identity: unknown tls cipher suite %q", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	if p.CA != "" || p.CAFile != "" {
+		rootCAs, err := newCertPool(p.CA, p.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = rootCAs
+	}
+	switch {
+	case p.ClientCert != "" || p.ClientKey != "":
+		cert, err := cryptutil.CertifcateFromBase64(p.ClientCert, p.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("internal/identity: could not load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{*cert}
+	case p.ClientCertFile != "" || p.ClientKeyFile != "":
+		cc, err := newClientCertificate(p.ClientCertFile, p.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = cc.get
+	}
+	return cfg, nil
+}
+
+// clientCertificate is a client certificate loaded from files, which is
+// reloaded when either file changes so that renewed certificates are
+// picked up without a restart.
+type clientCertificate struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newClientCertificate(certFile, keyFile string) (*clientCertificate, error) {
+	cc := &clientCertificate{certFile: certFile, keyFile: keyFile}
+	if err := cc.load(); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// load reads the certificate if its files were modified since it was last
+// read.
+func (cc *clientCertificate) load() error {
+	modTime, err := cc.lastModified()
+	if err != nil {
+		return fmt.Errorf("internal/identity: could not load client certificate: %w", err)
+	}
+	if cc.cert != nil && !modTime.After(cc.modTime) {
+		return nil
+	}
+	cert, err := cryptutil.CertificateFromFile(cc.certFile, cc.keyFile)
+	if err != nil {
+		return fmt.Errorf("internal/identity: could not load client certificate: %w", err)
+	}
+	cc.cert, cc.modTime = cert, modTime
+	return nil
+}
+
+func (cc *clientCertificate) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{cc.certFile, cc.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// get implements tls.Config's GetClientCertificate. If the certificate
+// can't be reloaded, for example while it is being replaced, the one last
+// loaded is used.
+func (cc *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if err := cc.load(); err != nil {
+		log.Warn().Err(err).Msg("internal/identity: using previously loaded client certificate")
+	}
+	return cc.cert, nil
+}
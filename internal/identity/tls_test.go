@@ -0,0 +1,103 @@
+package identity
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name             string
+		minVersion       string
+		cipherSuites     []string
+		wantMinVersion   uint16
+		wantCipherSuites []uint16
+		wantErr          bool
+	}{
+		{"default", "", nil, tls.VersionTLS12, nil, false},
+		{"tls 1.3", "1.3", nil, tls.VersionTLS13, nil, false},
+		{"tls 1.0", "1.0", nil, tls.VersionTLS10, nil, false},
+		{"cipher suites", "", []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}, tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, false},
+		{"unknown version", "1.4", nil, 0, nil, true},
+		{"unknown cipher suite", "", []string{"TLS_RSA_WITH_RC4_128_SHA"}, 0, nil, true},
+		{"tls 1.3 cipher suites", "1.3", []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, 0, nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTLSConfig(&Provider{TLSMinVersion: tt.minVersion, TLSCipherSuites: tt.cipherSuites})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newTLSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.MinVersion != tt.wantMinVersion {
+				t.Errorf("MinVersion = %x, want %x", got.MinVersion, tt.wantMinVersion)
+			}
+			if diff := cmp.Diff(tt.wantCipherSuites, got.CipherSuites); diff != "" {
+				t.Errorf("CipherSuites = %s", diff)
+			}
+		})
+	}
+}
+
+func TestNewHTTPClientClientCertificate(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	ca := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	cert, err := ioutil.ReadFile("testdata/example-cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ioutil.ReadFile("testdata/example-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		p              *Provider
+		wantErr        bool
+		wantRequestErr bool
+	}{
+		{"no client certificate", &Provider{CA: ca}, false, true},
+		{"base64 certificate", &Provider{CA: ca, ClientCert: base64.StdEncoding.EncodeToString(cert), ClientKey: base64.StdEncoding.EncodeToString(key)}, false, false},
+		{"certificate files", &Provider{CA: ca, ClientCertFile: "testdata/example-cert.pem", ClientKeyFile: "testdata/example-key.pem"}, false, false},
+		{"bad base64", &Provider{CA: ca, ClientCert: "%%%", ClientKey: base64.StdEncoding.EncodeToString(key)}, true, false},
+		{"mismatched key", &Provider{CA: ca, ClientCert: base64.StdEncoding.EncodeToString(cert), ClientKey: base64.StdEncoding.EncodeToString(cert)}, true, false},
+		{"missing file", &Provider{CA: ca, ClientCertFile: "testdata/missing.pem", ClientKeyFile: "testdata/example-key.pem"}, true, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := newHTTPClient(tt.p)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newHTTPClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			p := &Provider{ProviderName: "test", HTTPClient: client}
+			_, err = p.apiRequest(context.Background(), opUserInfo, http.MethodGet, srv.URL, nil, nil, nil)
+			if (err != nil) != tt.wantRequestErr {
+				t.Errorf("apiRequest() error = %v, wantRequestErr %v", err, tt.wantRequestErr)
+			}
+		})
+	}
+}
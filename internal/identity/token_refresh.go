@@ -0,0 +1,81 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/groupcache/singleflight"
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+// tokenRefreshTimeout bounds a refresh shared by concurrent requests, which
+// isn't canceled with any one of them.
+const tokenRefreshTimeout = 10 * time.Second
+
+// tokenRefresher renews a session's expired access token before it is used
+// for an API request. Concurrent requests for the same session share a
+// single refresh rather than each making their own; some providers (e.g.
+// GitLab) rotate refresh tokens on use, so all but the first would fail.
+// Once a refresh is done its token isn't handed out again.
+type tokenRefresher struct {
+	refresh func(ctx context.Context, refreshToken string) (*oauth2.Token, error)
+	group   singleflight.Group
+}
+
+func newTokenRefresher(refresh func(context.Context, string) (*oauth2.Token, error)) *tokenRefresher {
+	return &tokenRefresher{refresh: refresh}
+}
+
+// wrap returns a UserGroupFn which, if the session's access token has
+// expired and it holds a refresh token, renews the access token and stores
+// it in the session before calling fn.
+func (r *tokenRefresher) wrap(fn userGroupFunc) userGroupFunc {
+	return func(ctx context.Context, s *sessions.State) ([]string, error) {
+		if s != nil && s.AccessToken != nil && s.AccessToken.RefreshToken != "" && !s.AccessToken.Valid() {
+			token, err := r.token(ctx, s.AccessToken.RefreshToken)
+			if err != nil {
+				return nil, fmt.Errorf("internal/identity: could not refresh expired access token: %w", err)
+			}
+			s.AccessToken = token
+		}
+		return fn(ctx, s)
+	}
+}
+
+// renewToken exchanges a session's refresh token for a new token. Sessions
+// refreshed concurrently share a single request to the identity provider.
+func (p *Provider) renewToken(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	if p.tokenRefresher == nil {
+		return p.refreshToken(ctx, refreshToken)
+	}
+	return p.tokenRefresher.token(ctx, refreshToken)
+}
+
+// token returns a new access token for the given refresh token. Each caller
+// is given its own copy, as sessions update their tokens in place. The
+// refresh is made under the first caller's context values, but not its
+// deadline or cancellation, since other callers wait on it too.
+func (r *tokenRefresher) token(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	v, err := r.group.Do(refreshToken, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, tokenRefreshTimeout)
+		defer cancel()
+		return r.refresh(ctx, refreshToken)
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := *v.(*oauth2.Token)
+	return &t, nil
+}
+
+// detachedContext carries a context's values, such as its trace span and
+// logger, without its deadline or cancellation.
+type detachedContext struct{ parent context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -0,0 +1,132 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestTokenRefresher(t *testing.T) {
+	t.Parallel()
+	expired := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name       string
+		token      *oauth2.Token
+		refreshErr error
+		wantToken  string
+		wantCalls  int32
+		wantErr    bool
+	}{
+		{"valid token", &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}, nil, "old", 0, false},
+		{"no expiry", &oauth2.Token{AccessToken: "old"}, nil, "old", 0, false},
+		{"expired without refresh token", &oauth2.Token{AccessToken: "old", Expiry: expired}, nil, "old", 0, false},
+		{"expired", &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: expired}, nil, "new", 1, false},
+		{"refresh fails", &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: expired}, errors.New("invalid_grant"), "", 1, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			r := newTokenRefresher(func(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+				atomic.AddInt32(&calls, 1)
+				if tt.refreshErr != nil {
+					return nil, tt.refreshErr
+				}
+				return &oauth2.Token{AccessToken: "new", RefreshToken: "rotated", Expiry: time.Now().Add(time.Hour)}, nil
+			})
+			var gotToken string
+			fn := r.wrap(func(ctx context.Context, s *sessions.State) ([]string, error) {
+				gotToken = s.AccessToken.AccessToken
+				return nil, nil
+			})
+			s := &sessions.State{AccessToken: tt.token}
+			_, err := fn(context.Background(), s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotToken != tt.wantToken {
+				t.Errorf("token = %q, want %q", gotToken, tt.wantToken)
+			}
+			if !tt.wantErr && s.AccessToken.AccessToken != tt.wantToken {
+				t.Errorf("session token = %q, want %q", s.AccessToken.AccessToken, tt.wantToken)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("refresh calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestTokenRefresherConcurrent(t *testing.T) {
+	t.Parallel()
+	var calls int32
+	r := newTokenRefresher(func(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return &oauth2.Token{AccessToken: "new", RefreshToken: "rotated", Expiry: time.Now().Add(time.Hour)}, nil
+	})
+	fn := r.wrap(func(ctx context.Context, s *sessions.State) ([]string, error) { return nil, nil })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := &sessions.State{AccessToken: &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}}
+			if _, err := fn(context.Background(), s); err != nil {
+				t.Error(err)
+			}
+			if s.AccessToken.AccessToken != "new" {
+				t.Errorf("token = %q, want new", s.AccessToken.AccessToken)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("refresh calls = %d, want 1", calls)
+	}
+}
+
+func TestTokenRefresherFirstCallerCanceled(t *testing.T) {
+	t.Parallel()
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	type ctxKey struct{}
+	r := newTokenRefresher(func(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+		once.Do(func() { close(started) })
+		<-release
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("refresh has no deadline of its own")
+		}
+		if ctx.Value(ctxKey{}) != "first" {
+			t.Error("refresh lost the first caller's context values")
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return &oauth2.Token{AccessToken: "new", RefreshToken: "rotated", Expiry: time.Now().Add(time.Hour)}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "first"))
+	go r.token(ctx, "refresh")
+	<-started
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.token(context.Background(), "refresh")
+		errc <- err
+	}()
+	// the waiter joins the refresh before the first caller gives up
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	close(release)
+	if err := <-errc; err != nil {
+		t.Errorf("waiter error = %v, want the first caller's cancellation not to fail it", err)
+	}
+}
@@ -0,0 +1,179 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/oauth2/clientcredentials"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+// Check names reported by Validate, in the order they are run.
+const (
+	CheckRedirectURL = "redirect url"
+	CheckProvider    = "provider"
+	CheckDiscovery   = "discovery"
+	CheckScopes      = "scopes"
+	CheckGroups      = "groups"
+)
+
+// CheckResult is the outcome of one of the checks run by Validate.
+type CheckResult struct {
+	Name string
+	// Skipped is set if the check doesn't apply to the provider, or could
+	// not be run because an earlier check failed.
+	Skipped bool
+	// Detail describes what was checked, or why the check was skipped.
+	Detail string
+	Err    error
+}
+
+// Passed reports whether the check ran and succeeded.
+func (c CheckResult) Passed() bool {
+	return !c.Skipped && c.Err == nil
+}
+
+// Validate constructs the identity provider configured by p, as New does,
+// and checks that it is usable so that misconfiguration can be caught before
+// deploying: the redirect url, OpenID Connect discovery and signing keys, and
+// that the configured scopes are ones the provider supports. If probeGroups
+// is set, a token is requested with the client credentials grant and used to
+// call the provider's groups endpoint.
+//
+// Validate does not fail fast; checks which depend on an earlier check that
+// failed are reported as skipped.
+func Validate(ctx context.Context, providerName string, p *Provider, probeGroups bool) []CheckResult {
+	var results []CheckResult
+	skipRest := func(reason string, names ...string) []CheckResult {
+		for _, name := range names {
+			results = append(results, CheckResult{Name: name, Skipped: true, Detail: reason})
+		}
+		return results
+	}
+
+	if err := validateRedirectURL(p.RedirectURL, p.AllowInsecureRedirectURL); err != nil {
+		results = append(results, CheckResult{Name: CheckRedirectURL, Err: err})
+		return skipRest("redirect url is invalid", CheckProvider, CheckDiscovery, CheckScopes, CheckGroups)
+	}
+	results = append(results, CheckResult{Name: CheckRedirectURL, Detail: p.RedirectURL.String()})
+
+	if _, err := New(providerName, p); err != nil {
+		results = append(results, CheckResult{Name: CheckProvider, Err: err})
+		return skipRest("provider could not be constructed", CheckDiscovery, CheckScopes, CheckGroups)
+	}
+	defer p.Close()
+	results = append(results, CheckResult{Name: CheckProvider, Detail: fmt.Sprintf("%s provider constructed", providerName)})
+
+	results = append(results, p.checkDiscovery(ctx), p.checkScopes())
+	if !probeGroups {
+		results = append(results, CheckResult{Name: CheckGroups, Skipped: true, Detail: "groups probe not requested"})
+	} else {
+		results = append(results, p.checkGroups(ctx))
+	}
+	return results
+}
+
+// checkDiscovery checks that the provider's discovery document was fetched,
+// which New has already done, and that its signing keys can be fetched.
+func (p *Provider) checkDiscovery(ctx context.Context) CheckResult {
+	result := CheckResult{Name: CheckDiscovery}
+	if p.provider == nil {
+		result.Skipped = true
+		result.Detail = "provider does not use OpenID Connect discovery"
+		return result
+	}
+	var claims struct {
+		Issuer  string `json:"issuer"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := p.provider.Claims(&claims); err != nil {
+		result.Err = fmt.Errorf("internal/identity: invalid discovery document: %w", err)
+		return result
+	}
+	ks := newRefreshingKeySet(claims.JWKSURL, p.HTTPClient, p.JWKSRefreshInterval)
+	ks.userAgent = p.userAgent()
+	keys, _, err := ks.fetch(ctx)
+	if err != nil {
+		result.Err = fmt.Errorf("internal/identity: could not fetch signing keys from %s: %w", claims.JWKSURL, err)
+		return result
+	}
+	if len(keys.Keys) == 0 {
+		result.Err = fmt.Errorf("internal/identity: %s has no signing keys", claims.JWKSURL)
+		return result
+	}
+	result.Detail = fmt.Sprintf("issuer %s, %d signing key(s)", claims.Issuer, len(keys.Keys))
+	return result
+}
+
+// checkScopes checks the scopes which will be requested against those the
+// provider advertises in its discovery document. Providers aren't required
+// to advertise their scopes, in which case the check is skipped.
+func (p *Provider) checkScopes() CheckResult {
+	result := CheckResult{Name: CheckScopes}
+	if p.provider == nil {
+		result.Skipped = true
+		result.Detail = "provider does not use OpenID Connect discovery"
+		return result
+	}
+	var claims struct {
+		ScopesSupported []string `json:"scopes_supported"`
+	}
+	if err := p.provider.Claims(&claims); err != nil || len(claims.ScopesSupported) == 0 {
+		result.Skipped = true
+		result.Detail = "provider does not advertise its supported scopes"
+		return result
+	}
+	supported := make(map[string]bool, len(claims.ScopesSupported))
+	for _, scope := range claims.ScopesSupported {
+		supported[scope] = true
+	}
+	var unsupported []string
+	for _, scope := range p.Scopes {
+		if !supported[scope] {
+			unsupported = append(unsupported, scope)
+		}
+	}
+	if len(unsupported) > 0 {
+		result.Err = fmt.Errorf("internal/identity: scopes not supported by the provider: %s", strings.Join(unsupported, ", "))
+		return result
+	}
+	result.Detail = strings.Join(p.Scopes, ", ")
+	return result
+}
+
+// checkGroups requests a token with the client credentials grant, and looks
+// up groups with it. Not every provider grants client credentials, or lets
+// such a token list groups; an error here means group lookups need checking
+// with a real user's sign in.
+func (p *Provider) checkGroups(ctx context.Context) CheckResult {
+	result := CheckResult{Name: CheckGroups}
+	if p.UserGroupFn == nil {
+		result.Skipped = true
+		result.Detail = "provider does not look up groups"
+		return result
+	}
+	if p.oauth == nil || p.oauth.Endpoint.TokenURL == "" {
+		result.Skipped = true
+		result.Detail = "provider has no token endpoint"
+		return result
+	}
+	cc := &clientcredentials.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		TokenURL:     p.oauth.Endpoint.TokenURL,
+	}
+	token, err := cc.Token(p.clientContext(ctx))
+	if err != nil {
+		result.Err = fmt.Errorf("internal/identity: client credentials grant failed: %w", err)
+		return result
+	}
+	groups, err := p.UserGroupFn(ctx, &sessions.State{AccessToken: token})
+	if err != nil {
+		result.Err = fmt.Errorf("internal/identity: groups lookup failed: %w", err)
+		return result
+	}
+	result.Detail = fmt.Sprintf("%d group(s) returned", len(groups))
+	return result
+}
@@ -0,0 +1,140 @@
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// newTestDiscoveryServer serves a discovery document advertising scopes, a
+// key set, and a token endpoint which grants client credentials.
+func newTestDiscoveryServer(t *testing.T, scopes []string, keys []jose.JSONWebKey) *httptest.Server {
+	t.Helper()
+	// keycloak reads roles from the access token without verifying it
+	accessToken := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"realm_access":{"roles":["admin","ops"]}}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte("sig"))
+
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/auth",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/keys",
+			"scopes_supported":       scopes,
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "client_credentials" {
+			http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": accessToken,
+			"token_type":   "Bearer",
+			"expires_in":   300,
+		})
+	})
+	srv = httptest.NewServer(mux)
+	return srv
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	_, key := newTestSigningKey(t, "kid")
+	keys := []jose.JSONWebKey{key}
+	allScopes := []string{"openid", "profile", "email", "offline_access"}
+	redirectURL, _ := url.Parse("https://authenticate.example.com/oauth2/callback")
+
+	// status is a compact representation of a check's result
+	type status struct {
+		Name   string
+		Result string
+	}
+	pass := func(name string) status { return status{name, "pass"} }
+	fail := func(name string) status { return status{name, "fail"} }
+	skip := func(name string) status { return status{name, "skip"} }
+
+	tests := []struct {
+		name        string
+		provider    string
+		scopes      []string
+		supported   []string
+		keys        []jose.JSONWebKey
+		redirectURL *url.URL
+		badURL      bool
+		probeGroups bool
+		want        []status
+	}{
+		{"valid", OIDCProviderName, nil, allScopes, keys, redirectURL, false, false,
+			[]status{pass(CheckRedirectURL), pass(CheckProvider), pass(CheckDiscovery), pass(CheckScopes), skip(CheckGroups)}},
+		{"unsupported scope", OIDCProviderName, []string{"openid", "groups"}, allScopes, keys, redirectURL, false, false,
+			[]status{pass(CheckRedirectURL), pass(CheckProvider), pass(CheckDiscovery), fail(CheckScopes), skip(CheckGroups)}},
+		{"scopes not advertised", OIDCProviderName, nil, nil, keys, redirectURL, false, false,
+			[]status{pass(CheckRedirectURL), pass(CheckProvider), pass(CheckDiscovery), skip(CheckScopes), skip(CheckGroups)}},
+		{"no signing keys", OIDCProviderName, nil, allScopes, nil, redirectURL, false, false,
+			[]status{pass(CheckRedirectURL), pass(CheckProvider), fail(CheckDiscovery), pass(CheckScopes), skip(CheckGroups)}},
+		{"invalid redirect url", OIDCProviderName, nil, allScopes, keys, nil, false, false,
+			[]status{fail(CheckRedirectURL), skip(CheckProvider), skip(CheckDiscovery), skip(CheckScopes), skip(CheckGroups)}},
+		{"discovery fails", OIDCProviderName, nil, allScopes, keys, redirectURL, true, false,
+			[]status{pass(CheckRedirectURL), fail(CheckProvider), skip(CheckDiscovery), skip(CheckScopes), skip(CheckGroups)}},
+		{"no groups lookup", OIDCProviderName, nil, allScopes, keys, redirectURL, false, true,
+			[]status{pass(CheckRedirectURL), pass(CheckProvider), pass(CheckDiscovery), pass(CheckScopes), skip(CheckGroups)}},
+		{"groups probe", KeycloakProviderName, nil, allScopes, keys, redirectURL, false, true,
+			[]status{pass(CheckRedirectURL), pass(CheckProvider), pass(CheckDiscovery), pass(CheckScopes), pass(CheckGroups)}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := newTestDiscoveryServer(t, tt.supported, tt.keys)
+			defer srv.Close()
+			providerURL := srv.URL
+			if tt.badURL {
+				providerURL += "/missing"
+			}
+			p := &Provider{
+				ProviderName: tt.provider,
+				ProviderURL:  providerURL,
+				ClientID:     "client",
+				ClientSecret: "secret",
+				Scopes:       tt.scopes,
+				RedirectURL:  tt.redirectURL,
+				// the key set is only fetched by the check itself
+				JWKSRefreshInterval: -1,
+				DiscoveryRetries:    -1,
+			}
+			results := Validate(context.Background(), tt.provider, p, tt.probeGroups)
+			var got []status
+			for _, r := range results {
+				s := pass(r.Name)
+				switch {
+				case r.Err != nil:
+					s = fail(r.Name)
+				case r.Skipped:
+					s = skip(r.Name)
+				}
+				got = append(got, s)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Validate() = %s", diff)
+			}
+			if last := results[len(results)-1]; last.Passed() && last.Detail != "2 group(s) returned" {
+				t.Errorf("Validate() groups detail = %q", last.Detail)
+			}
+		})
+	}
+}
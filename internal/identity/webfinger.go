@@ -0,0 +1,146 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+
+	"github.com/pomerium/pomerium/internal/httputil"
+	"github.com/pomerium/pomerium/internal/version"
+)
+
+// webFingerIssuerRel is the link relation of a WebFinger response which
+// names a user's OpenID Connect issuer.
+//
+// https://openid.net/specs/openid-connect-discovery-1_0.html#IssuerDiscovery
+const webFingerIssuerRel = "http://openid.net/specs/connect/1.0/issuer"
+
+// DefaultIssuerDiscoveryTTL is how long the issuer discovered for an email
+// domain, or the lack of one, is remembered.
+const DefaultIssuerDiscoveryTTL = time.Hour
+
+// issuerDiscoveryTimeout bounds a WebFinger lookup, which may be made while
+// a user waits to sign in.
+const issuerDiscoveryTimeout = 5 * time.Second
+
+// maxDiscoveredIssuers is how many domains' results are cached, the least
+// recently used being evicted first.
+const maxDiscoveredIssuers = 1000
+
+// IssuerDiscovery finds the OpenID Connect issuer of an email domain using
+// WebFinger, caching the results.
+type IssuerDiscovery struct {
+	client *http.Client
+	ttl    time.Duration
+	now    func() time.Time
+	// endpoint returns the WebFinger endpoint of a domain
+	endpoint func(domain string) string
+
+	mu    sync.Mutex
+	cache *lru.Cache
+}
+
+type discoveredIssuer struct {
+	issuer    string
+	err       error
+	expiresAt time.Time
+}
+
+// NewIssuerDiscovery returns an IssuerDiscovery which caches results for
+// ttl, or DefaultIssuerDiscoveryTTL if ttl isn't positive.
+func NewIssuerDiscovery(ttl time.Duration) *IssuerDiscovery {
+	if ttl <= 0 {
+		ttl = DefaultIssuerDiscoveryTTL
+	}
+	return &IssuerDiscovery{
+		client: httputil.DefaultClient,
+		ttl:    ttl,
+		now:    time.Now,
+		endpoint: func(domain string) string {
+			return (&url.URL{Scheme: "https", Host: domain, Path: "/.well-known/webfinger"}).String()
+		},
+		cache: lru.New(maxDiscoveredIssuers),
+	}
+}
+
+// Issuer returns the issuer of an email domain, given either the domain or
+// the email address of one of its users. Issuers are assumed to be the
+// same for all of a domain's users, so results are cached by domain.
+//
+// Domains which don't support WebFinger, or don't name an issuer, return
+// an error wrapping ErrIssuerNotFound; those results are cached like any
+// other. Errors reaching the domain are not cached. Lookups time out after
+// a few seconds, and only the most recently used domains are cached.
+func (d *IssuerDiscovery) Issuer(ctx context.Context, emailOrDomain string) (string, error) {
+	domain, resource := emailOrDomain, "https://"+emailOrDomain
+	if i := strings.LastIndex(emailOrDomain, "@"); i >= 0 {
+		domain, resource = emailOrDomain[i+1:], "acct:"+emailOrDomain
+	}
+	domain = strings.ToLower(domain)
+	if domain == "" || strings.ContainsAny(domain, "/?#") {
+		return "", fmt.Errorf("internal/identity: invalid email domain %q", emailOrDomain)
+	}
+
+	d.mu.Lock()
+	v, ok := d.cache.Get(domain)
+	d.mu.Unlock()
+	if cached, _ := v.(discoveredIssuer); ok && d.now().Before(cached.expiresAt) {
+		return cached.issuer, cached.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, issuerDiscoveryTimeout)
+	defer cancel()
+	issuer, err := d.discover(ctx, domain, resource)
+	if errors.Is(err, ErrProviderUnavailable) {
+		return "", err
+	}
+	d.mu.Lock()
+	d.cache.Add(domain, discoveredIssuer{issuer: issuer, err: err, expiresAt: d.now().Add(d.ttl)})
+	d.mu.Unlock()
+	return issuer, err
+}
+
+// discover looks up the issuer of the resource at the domain.
+//
+// https://tools.ietf.org/html/rfc7033
+func (d *IssuerDiscovery) discover(ctx context.Context, domain, resource string) (string, error) {
+	var response struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	params := url.Values{
+		"resource": []string{resource},
+		"rel":      []string{webFingerIssuerRel},
+	}
+	var status int
+	opts := &httputil.ClientOptions{
+		HTTPClient: d.client,
+		Observe:    func(code int, _ time.Duration, _ error) { status = code },
+	}
+	_, err := httputil.ClientWithOptions(ctx, opts, http.MethodGet, d.endpoint(domain), version.UserAgent(), nil, params, &response)
+	if err = classifyError(status, err); errors.Is(err, ErrProviderUnavailable) {
+		return "", fmt.Errorf("internal/identity: webfinger lookup for %s failed: %w", domain, err)
+	} else if err != nil {
+		return "", newProviderError(ErrIssuerNotFound, fmt.Errorf("webfinger lookup for %s failed: %w", domain, err))
+	}
+	for _, link := range response.Links {
+		if link.Rel != webFingerIssuerRel {
+			continue
+		}
+		u, err := url.Parse(link.Href)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return "", newProviderError(ErrIssuerNotFound, fmt.Errorf("%s advertises an invalid issuer %q", domain, link.Href))
+		}
+		return link.Href, nil
+	}
+	return "", newProviderError(ErrIssuerNotFound, fmt.Errorf("%s doesn't advertise an issuer", domain))
+}
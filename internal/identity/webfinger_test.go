@@ -0,0 +1,127 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+)
+
+func TestIssuerDiscovery(t *testing.T) {
+	t.Parallel()
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if got := r.URL.Query().Get("rel"); got != webFingerIssuerRel {
+			t.Errorf("rel = %q, want %q", got, webFingerIssuerRel)
+		}
+		issuer := "https://idp.example.com"
+		switch r.URL.Query().Get("resource") {
+		case "acct:user@corp.example", "https://corp.example", "acct:user@Mixed.Example":
+		case "acct:user@invalid.example":
+			issuer = "http://idp.example.com"
+		case "acct:user@nolink.example":
+			fmt.Fprint(w, `{"links":[{"rel":"http://webfinger.net/rel/profile-page","href":"https://example.com"}]}`)
+			return
+		case "acct:user@down.example":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"subject":%q,"links":[{"rel":%q,"href":%q}]}`, r.URL.Query().Get("resource"), webFingerIssuerRel, issuer)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		email     string
+		want      string
+		wantErr   error
+		wantCalls int32
+	}{
+		{"user@corp.example", "https://idp.example.com", nil, 1},
+		{"corp.example", "https://idp.example.com", nil, 1},
+		{"user@Mixed.Example", "https://idp.example.com", nil, 1},
+		{"user@unsupported.example", "", ErrIssuerNotFound, 1},
+		{"user@nolink.example", "", ErrIssuerNotFound, 1},
+		{"user@invalid.example", "", ErrIssuerNotFound, 1},
+		{"user@down.example", "", ErrProviderUnavailable, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			d := NewIssuerDiscovery(time.Minute)
+			d.endpoint = func(string) string { return srv.URL }
+			atomic.StoreInt32(&calls, 0)
+			for i := 0; i < 2; i++ {
+				got, err := d.Issuer(context.Background(), tt.email)
+				if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+					t.Fatalf("Issuer() error = %v, want %v", err, tt.wantErr)
+				}
+				if got != tt.want {
+					t.Errorf("Issuer() = %q, want %q", got, tt.want)
+				}
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestIssuerDiscoveryExpiry(t *testing.T) {
+	t.Parallel()
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprintf(w, `{"links":[{"rel":%q,"href":"https://idp.example.com"}]}`, webFingerIssuerRel)
+	}))
+	defer srv.Close()
+
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	d := NewIssuerDiscovery(time.Minute)
+	d.endpoint = func(string) string { return srv.URL }
+	d.now = func() time.Time { return now }
+	ctx := context.Background()
+	for _, advance := range []time.Duration{0, 30 * time.Second, time.Minute} {
+		now = now.Add(advance)
+		if _, err := d.Issuer(ctx, "user@corp.example"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("calls = %d, want 2", got)
+	}
+	if _, err := d.Issuer(ctx, "user@"); err == nil {
+		t.Error("Issuer() expected an error for an email without a domain")
+	}
+}
+
+func TestIssuerDiscoveryCacheBound(t *testing.T) {
+	t.Parallel()
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprintf(w, `{"links":[{"rel":%q,"href":"https://idp.example.com"}]}`, webFingerIssuerRel)
+	}))
+	defer srv.Close()
+
+	d := NewIssuerDiscovery(time.Minute)
+	d.endpoint = func(string) string { return srv.URL }
+	d.cache = lru.New(2)
+	ctx := context.Background()
+	for _, domain := range []string{"a.example", "b.example", "c.example", "a.example"} {
+		if _, err := d.Issuer(ctx, domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 4 {
+		t.Errorf("calls = %d, want 4, as the first domain was evicted", got)
+	}
+}
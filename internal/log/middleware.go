@@ -131,6 +131,18 @@ func IDFromCtx(ctx context.Context) (id string, ok bool) {
 	return
 }
 
+// ContextWithID returns ctx and the unique id associated to it. If ctx has
+// no id, a new one is generated and a copy of ctx associated to it returned,
+// so that, for example, outbound requests made without an inbound request
+// can still be correlated.
+func ContextWithID(ctx context.Context) (context.Context, string) {
+	if id, ok := IDFromCtx(ctx); ok {
+		return ctx, id
+	}
+	id := uuid()
+	return context.WithValue(ctx, idKey{}, id), id
+}
+
 // RequestIDHandler returns a handler setting a unique id to the request which can
 // be gathered using IDFromRequest(req). This generated id is added as a field to the
 // logger using the passed fieldKey as field name. The id is also added as a response
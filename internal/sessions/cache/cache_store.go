@@ -3,6 +3,7 @@
 package cache
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -85,11 +86,31 @@ func (s *Store) SaveSession(w http.ResponseWriter, r *http.Request, x interface{
 	if !ok {
 		return errors.New("sessions/cache: cannot cache non state type")
 	}
+	return s.SaveState(r.Context(), state)
+}
 
+// SaveState saves the session to the cache only, for sessions which are
+// updated outside of a user's request.
+func (s *Store) SaveState(ctx context.Context, state *sessions.State) error {
 	data, err := s.encoder.Marshal(&state)
 	if err != nil {
 		return fmt.Errorf("sessions/cache: marshal %w", err)
 	}
+	return s.cache.Set(ctx, state.AccessTokenID, data)
+}
 
-	return s.cache.Set(r.Context(), state.AccessTokenID, data)
+// LoadState loads the session saved to the cache with the given key.
+func (s *Store) LoadState(ctx context.Context, key string) (*sessions.State, error) {
+	exists, data, err := s.cache.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("sessions/cache: get %w", err)
+	}
+	if !exists {
+		return nil, sessions.ErrNoSessionFound
+	}
+	var state sessions.State
+	if err := s.encoder.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("sessions/cache: unmarshal %w", err)
+	}
+	return &state, nil
 }
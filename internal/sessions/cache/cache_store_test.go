@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/pomerium/pomerium/internal/cryptutil"
 	"github.com/pomerium/pomerium/internal/encoding"
 	"github.com/pomerium/pomerium/internal/encoding/ecjson"
@@ -188,3 +189,47 @@ func TestStore_LoadSession(t *testing.T) {
 		})
 	}
 }
+
+func TestStore_LoadState(t *testing.T) {
+	cipher, err := cryptutil.NewAEADCipherFromBase64(cryptutil.NewBase64Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := ecjson.New(cipher)
+	want := &sessions.State{AccessTokenID: "id", Email: "user@pomerium.io"}
+	data, err := encoder.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		cache   client.Cacher
+		want    *sessions.State
+		wantErr error
+	}{
+		{"good", &mockCache{KeyExists: true, Value: data}, want, nil},
+		{"doesn't exist", &mockCache{}, nil, sessions.ErrNoSessionFound},
+		{"bad data", &mockCache{KeyExists: true, Value: []byte("bad")}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStore(&Options{Cache: tt.cache, Encoder: encoder})
+			got, err := s.LoadState(context.Background(), "id")
+			if tt.want == nil {
+				if err == nil {
+					t.Fatal("Store.LoadState() expected an error")
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("Store.LoadState() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, tt.want, cmpopts.IgnoreUnexported(sessions.State{})); diff != "" {
+				t.Errorf("Store.LoadState() = %s", diff)
+			}
+		})
+	}
+}
@@ -105,14 +105,36 @@ func (cs *Store) makeCookie(value string) *http.Cookie {
 	}
 }
 
-// ClearSession clears the session cookie from a request
+// ClearSession clears the session cookie, and any chunks of it, from a
+// request
 func (cs *Store) ClearSession(w http.ResponseWriter, r *http.Request) {
+	cs.clearCookie(w, cs.Name)
+	cs.clearChunks(w, r, 1)
+}
+
+func (cs *Store) clearCookie(w http.ResponseWriter, name string) {
 	c := cs.makeCookie("")
+	c.Name = name
 	c.MaxAge = -1
 	c.Expires = timeNow().Add(-time.Hour)
 	http.SetCookie(w, c)
 }
 
+// clearChunks clears the chunks of the session cookie the request has,
+// starting with the from'th, so that a session which shrinks isn't followed
+// by the stale chunks of a larger one.
+func (cs *Store) clearChunks(w http.ResponseWriter, r *http.Request, from int) {
+	if r == nil {
+		return
+	}
+	for i := from; i <= MaxNumChunks; i++ {
+		name := chunkName(cs.Name, i)
+		if _, err := r.Cookie(name); err == nil {
+			cs.clearCookie(w, name)
+		}
+	}
+}
+
 func getCookies(r *http.Request, name string) []*http.Cookie {
 	allCookies := r.Cookies()
 	matchedCookies := make([]*http.Cookie, 0, len(allCookies))
@@ -142,8 +164,10 @@ func (cs *Store) LoadSession(r *http.Request) (string, error) {
 	return "", sessions.ErrMalformed
 }
 
-// SaveSession saves a session state to a request's cookie store.
-func (cs *Store) SaveSession(w http.ResponseWriter, _ *http.Request, x interface{}) error {
+// SaveSession saves a session state to a request's cookie store. Sessions
+// too large for one cookie are split across several, up to MaxNumChunks
+// more.
+func (cs *Store) SaveSession(w http.ResponseWriter, r *http.Request, x interface{}) error {
 	var value string
 	switch v := x.(type) {
 	case []byte:
@@ -161,20 +185,30 @@ func (cs *Store) SaveSession(w http.ResponseWriter, _ *http.Request, x interface
 		value = string(data)
 	}
 
-	cs.setSessionCookie(w, value)
-	return nil
+	return cs.setSessionCookie(w, r, value)
 }
 
-func (cs *Store) setSessionCookie(w http.ResponseWriter, val string) {
-	cs.setCookie(w, cs.makeCookie(val))
+func (cs *Store) setSessionCookie(w http.ResponseWriter, r *http.Request, val string) error {
+	chunks, err := cs.setCookie(w, cs.makeCookie(val))
+	if err != nil {
+		return err
+	}
+	cs.clearChunks(w, r, chunks)
+	return nil
 }
 
-func (cs *Store) setCookie(w http.ResponseWriter, cookie *http.Cookie) {
+// setCookie sets the cookie, split into chunks if it's too large, and
+// returns the number of cookies set.
+func (cs *Store) setCookie(w http.ResponseWriter, cookie *http.Cookie) (int, error) {
 	if len(cookie.String()) <= MaxChunkSize {
 		http.SetCookie(w, cookie)
-		return
+		return 1, nil
+	}
+	chunks := chunk(cookie.Value, MaxChunkSize)
+	if len(chunks) > MaxNumChunks+1 {
+		return 0, fmt.Errorf("internal/sessions: session of %d bytes is too large for cookies", len(cookie.Value))
 	}
-	for i, c := range chunk(cookie.Value, MaxChunkSize) {
+	for i, c := range chunks {
 		// start with a copy of our original cookie
 		nc := *cookie
 		if i == 0 {
@@ -182,11 +216,18 @@ func (cs *Store) setCookie(w http.ResponseWriter, cookie *http.Cookie) {
 			nc.Value = fmt.Sprintf("%s%s", string(ChunkedCanaryByte), c)
 		} else {
 			// subsequent parts will be postfixed with their part number
-			nc.Name = fmt.Sprintf("%s_%d", cookie.Name, i)
+			nc.Name = chunkName(cookie.Name, i)
 			nc.Value = c
 		}
 		http.SetCookie(w, &nc)
 	}
+	return len(chunks), nil
+}
+
+// chunkName is the name of the i'th chunk of a chunked cookie; the first
+// chunk keeps the cookie's own name.
+func chunkName(name string, i int) string {
+	return fmt.Sprintf("%s_%d", name, i)
 }
 
 func loadChunkedCookie(r *http.Request, c *http.Cookie) string {
@@ -202,7 +243,7 @@ func loadChunkedCookie(r *http.Request, c *http.Cookie) string {
 	var b strings.Builder
 	fmt.Fprintf(&b, "%s", data[1:])
 	for i := 1; i <= MaxNumChunks; i++ {
-		next, err := r.Cookie(fmt.Sprintf("%s_%d", c.Name, i))
+		next, err := r.Cookie(chunkName(c.Name, i))
 		if err != nil {
 			break // break if we can't find the next cookie
 		}
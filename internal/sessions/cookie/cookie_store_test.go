@@ -98,6 +98,10 @@ func TestStore_SaveSession(t *testing.T) {
 	if _, err := rand.Read(hugeString); err != nil {
 		t.Fatal(err)
 	}
+	tooLargeString := make([]byte, 16384)
+	if _, err := rand.Read(tooLargeString); err != nil {
+		t.Fatal(err)
+	}
 	tests := []struct {
 		name        string
 		State       interface{}
@@ -109,6 +113,7 @@ func TestStore_SaveSession(t *testing.T) {
 		{"good", &sessions.State{Email: "user@domain.com", User: "user"}, ecjson.New(c), ecjson.New(c), false, false},
 		{"bad cipher", &sessions.State{Email: "user@domain.com", User: "user"}, nil, nil, true, true},
 		{"huge cookie", &sessions.State{Subject: fmt.Sprintf("%x", hugeString), Email: "user@domain.com", User: "user"}, ecjson.New(c), ecjson.New(c), false, false},
+		{"too large for cookies", &sessions.State{Subject: fmt.Sprintf("%x", tooLargeString), Email: "user@domain.com", User: "user"}, ecjson.New(c), ecjson.New(c), true, true},
 		{"marshal error", &sessions.State{Email: "user@domain.com", User: "user"}, mock.Encoder{MarshalError: errors.New("error")}, ecjson.New(c), true, true},
 		{"nil encoder cannot save non string type", &sessions.State{Email: "user@domain.com", User: "user"}, nil, ecjson.New(c), true, true},
 		{"good marshal string directly", cryptutil.NewBase64Key(), nil, ecjson.New(c), false, true},
@@ -163,3 +168,75 @@ func TestStore_SaveSession(t *testing.T) {
 		})
 	}
 }
+
+func TestStore_SaveSessionChunks(t *testing.T) {
+	c, err := cryptutil.NewAEADCipher(cryptutil.NewKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Store{
+		Name:    "_pomerium",
+		Expire:  10 * time.Second,
+		encoder: ecjson.New(c),
+		decoder: ecjson.New(c),
+	}
+	hugeString := make([]byte, 4097)
+	if _, err := rand.Read(hugeString); err != nil {
+		t.Fatal(err)
+	}
+	huge := &sessions.State{Subject: fmt.Sprintf("%x", hugeString), Email: "user@domain.com"}
+
+	w := httptest.NewRecorder()
+	if err := s.SaveSession(w, httptest.NewRequest("GET", "/", nil), huge); err != nil {
+		t.Fatal(err)
+	}
+	chunks := w.Result().Cookies()
+	if len(chunks) < 2 {
+		t.Fatalf("SaveSession() set %d cookies, want the session chunked", len(chunks))
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range chunks {
+		r.AddCookie(cookie)
+	}
+	raw, err := s.LoadSession(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state sessions.State
+	if err := ecjson.New(c).Unmarshal([]byte(raw), &state); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(huge, &state, cmpopts.IgnoreUnexported(sessions.State{})); diff != "" {
+		t.Errorf("LoadSession() = %s", diff)
+	}
+
+	expired := func(w *httptest.ResponseRecorder) map[string]bool {
+		got := make(map[string]bool)
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.MaxAge < 0 {
+				got[cookie.Name] = true
+			}
+		}
+		return got
+	}
+	want := make(map[string]bool)
+	for _, cookie := range chunks[1:] {
+		want[cookie.Name] = true
+	}
+
+	// a session which no longer needs chunking clears the stale chunks
+	w = httptest.NewRecorder()
+	if err := s.SaveSession(w, r, &sessions.State{Email: "user@domain.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, expired(w)); diff != "" {
+		t.Errorf("SaveSession() expired = %s", diff)
+	}
+
+	want[s.Name] = true
+	w = httptest.NewRecorder()
+	s.ClearSession(w, r)
+	if diff := cmp.Diff(want, expired(w)); diff != "" {
+		t.Errorf("ClearSession() expired = %s", diff)
+	}
+}
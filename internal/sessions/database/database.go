@@ -0,0 +1,32 @@
+// Package database provides a session store which keeps sessions server
+// side, in a database shared by every replica of the authenticate service,
+// so that a user's cookie only holds an opaque session id rather than their
+// tokens.
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrConflict is returned when a session is saved over a version other than
+// the one stored, as it's been saved since it was loaded.
+var ErrConflict = errors.New("internal/sessions: session saved concurrently")
+
+// SessionStore stores encoded sessions by session id, along with a version
+// which increases every time a session is saved. Implementations must be
+// safe for concurrent use.
+type SessionStore interface {
+	// Save stores data as session id until expiry, returning its new
+	// version. A version of 0 creates the session; otherwise, the session
+	// is only replaced if it's still at version. ErrConflict is returned if
+	// the session exists, or has since been saved, respectively.
+	Save(ctx context.Context, id string, data []byte, expiry time.Time, version int64) (int64, error)
+	// Load returns session id and its version, or sessions.ErrNoSessionFound
+	// if it doesn't exist or has expired.
+	Load(ctx context.Context, id string) ([]byte, int64, error)
+	// Delete deletes session id. Deleting a session which doesn't exist
+	// isn't an error.
+	Delete(ctx context.Context, id string) error
+}
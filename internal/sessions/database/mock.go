@@ -0,0 +1,75 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+var _ SessionStore = &MockSessionStore{}
+
+// MockSessionStore is a mock implementation of SessionStore, which keeps
+// sessions in memory.
+type MockSessionStore struct {
+	Error error
+
+	mu       sync.Mutex
+	sessions map[string]mockSession
+}
+
+type mockSession struct {
+	data    []byte
+	expiry  time.Time
+	version int64
+}
+
+// Save is a mock implementation of SessionStore.
+func (ms *MockSessionStore) Save(_ context.Context, id string, data []byte, expiry time.Time, version int64) (int64, error) {
+	if ms.Error != nil {
+		return 0, ms.Error
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.sessions == nil {
+		ms.sessions = make(map[string]mockSession)
+	}
+	if s, ok := ms.sessions[id]; (ok || version != 0) && s.version != version {
+		return 0, ErrConflict
+	}
+	ms.sessions[id] = mockSession{data: data, expiry: expiry, version: version + 1}
+	return version + 1, nil
+}
+
+// Load is a mock implementation of SessionStore.
+func (ms *MockSessionStore) Load(_ context.Context, id string) ([]byte, int64, error) {
+	if ms.Error != nil {
+		return nil, 0, ms.Error
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	s, ok := ms.sessions[id]
+	if !ok || !s.expiry.After(time.Now()) {
+		return nil, 0, sessions.ErrNoSessionFound
+	}
+	return s.data, s.version, nil
+}
+
+// Delete is a mock implementation of SessionStore.
+func (ms *MockSessionStore) Delete(_ context.Context, id string) error {
+	if ms.Error != nil {
+		return ms.Error
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.sessions, id)
+	return nil
+}
+
+// Len returns the number of sessions stored, including expired ones.
+func (ms *MockSessionStore) Len() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.sessions)
+}
@@ -0,0 +1,225 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/cryptutil"
+	"github.com/pomerium/pomerium/internal/encoding"
+	"github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+var _ sessions.SessionStore = &Store{}
+var _ sessions.SessionLoader = &Store{}
+
+// timeNow is time.Now but pulled out as a variable for tests.
+var timeNow = time.Now
+
+const (
+	// sessionIDSize is the number of random bytes in a session id.
+	sessionIDSize = 32
+	// defaultExpire is how long sessions are kept for if the session cookie
+	// has no expiry of its own.
+	defaultExpire = 14 * time.Hour
+	// maxSaveAttempts is how many times a session is saved over versions
+	// saved concurrently before giving up.
+	maxSaveAttempts = 3
+)
+
+// Store implements the session store interface by keeping sessions in a
+// SessionStore, and only their ids, and the version last saved by the
+// user's browser, in the session cookie.
+type Store struct {
+	Name     string
+	Domain   string
+	Expire   time.Duration
+	HTTPOnly bool
+	Secure   bool
+
+	sessions SessionStore
+	encoder  encoding.MarshalUnmarshaler
+}
+
+// Options holds options for Store.
+type Options struct {
+	// Name, Domain, HTTPOnly and Secure are those of the session cookie.
+	// Expire is how long after it was last saved a session is kept for.
+	Name     string
+	Domain   string
+	Expire   time.Duration
+	HTTPOnly bool
+	Secure   bool
+}
+
+// NewStore returns a new store that implements the SessionStore interface
+// by keeping sessions, encoded with encoder, in store.
+func NewStore(opts *Options, store SessionStore, encoder encoding.MarshalUnmarshaler) (*Store, error) {
+	if opts.Name == "" {
+		return nil, errors.New("internal/sessions: cookie name cannot be empty")
+	}
+	if store == nil || encoder == nil {
+		return nil, errors.New("internal/sessions: session store and encoder cannot be nil")
+	}
+	expire := opts.Expire
+	if expire <= 0 {
+		expire = defaultExpire
+	}
+	return &Store{
+		Name:     opts.Name,
+		Domain:   opts.Domain,
+		Expire:   expire,
+		HTTPOnly: opts.HTTPOnly,
+		Secure:   opts.Secure,
+		sessions: store,
+		encoder:  encoder,
+	}, nil
+}
+
+func (s *Store) makeCookie(id string, version int64) *http.Cookie {
+	value := ""
+	if id != "" {
+		value = id + "." + strconv.FormatInt(version, 10)
+	}
+	return &http.Cookie{
+		Name:     s.Name,
+		Value:    value,
+		Path:     "/",
+		Domain:   s.Domain,
+		HttpOnly: s.HTTPOnly,
+		Secure:   s.Secure,
+		Expires:  timeNow().Add(s.Expire),
+	}
+}
+
+// sessionID returns the id of the request's session, if it has one, and
+// the version of it the request was made with. Session ids are base64, so
+// never contain the separator.
+func (s *Store) sessionID(r *http.Request) (string, int64) {
+	c, err := r.Cookie(s.Name)
+	if err != nil {
+		return "", 0
+	}
+	i := strings.LastIndex(c.Value, ".")
+	if i < 0 {
+		return c.Value, 0
+	}
+	version, _ := strconv.ParseInt(c.Value[i+1:], 10, 64)
+	return c.Value[:i], version
+}
+
+// LoadSession returns the encoded session whose id is in the request's
+// session cookie.
+func (s *Store) LoadSession(r *http.Request) (string, error) {
+	id, _ := s.sessionID(r)
+	if id == "" {
+		return "", sessions.ErrNoSessionFound
+	}
+	data, _, err := s.sessions.Load(r.Context(), id)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// SaveSession saves a session to the session store, and sets the session
+// cookie to its id. The id in the request's session cookie is kept if it's
+// the same user's session, e.g. when refreshing it; otherwise, such as when
+// a different user signs in, the session is saved under a new id so that an
+// id planted in a user's browser can't be used to take over their session.
+//
+// The session is saved over the version the request was made with. If it's
+// been saved since, such as by another replica refreshing it at the same
+// time, the session saved by the first of them is kept if its tokens are
+// as recent, so that the refresh token it was issued isn't lost.
+func (s *Store) SaveSession(w http.ResponseWriter, r *http.Request, x interface{}) error {
+	var data []byte
+	switch v := x.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		var err error
+		if data, err = s.encoder.Marshal(x); err != nil {
+			return fmt.Errorf("internal/sessions: marshal %w", err)
+		}
+	}
+	id, version := s.sessionID(r)
+	if id != "" && !s.sameUser(r, id, data) {
+		if err := s.sessions.Delete(r.Context(), id); err != nil {
+			log.FromRequest(r).Warn().Err(err).Msg("internal/sessions: replaced session delete failed")
+		}
+		id = ""
+	}
+	if id == "" {
+		id, version = cryptutil.NewRandomStringN(sessionIDSize), 0
+	}
+	version, err := s.save(r, id, data, version)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, s.makeCookie(id, version))
+	return nil
+}
+
+// save saves session id over version, returning the version kept.
+func (s *Store) save(r *http.Request, id string, data []byte, version int64) (int64, error) {
+	for attempt := 1; ; attempt++ {
+		newVersion, err := s.sessions.Save(r.Context(), id, data, timeNow().Add(s.Expire), version)
+		if !errors.Is(err, ErrConflict) || attempt == maxSaveAttempts {
+			return newVersion, err
+		}
+		stored, storedVersion, err := s.sessions.Load(r.Context(), id)
+		if err != nil {
+			return 0, err
+		}
+		if !s.newer(data, stored) {
+			log.FromRequest(r).Debug().Msg("internal/sessions: keeping session saved concurrently")
+			return storedVersion, nil
+		}
+		version = storedVersion
+	}
+}
+
+// newer returns whether the encoded session data has more recent tokens
+// than the stored session.
+func (s *Store) newer(data, stored []byte) bool {
+	var prev, next sessions.State
+	if s.encoder.Unmarshal(stored, &prev) != nil || s.encoder.Unmarshal(data, &next) != nil {
+		return true
+	}
+	return next.TokenExpiry().After(prev.TokenExpiry())
+}
+
+// sameUser returns whether session id exists, and is of the same user as
+// the encoded session data.
+func (s *Store) sameUser(r *http.Request, id string, data []byte) bool {
+	stored, _, err := s.sessions.Load(r.Context(), id)
+	if err != nil {
+		return false
+	}
+	var prev, next sessions.State
+	if s.encoder.Unmarshal(stored, &prev) != nil || s.encoder.Unmarshal(data, &next) != nil {
+		return false
+	}
+	return prev.Subject != "" && prev.Subject == next.Subject && prev.IdentityProvider == next.IdentityProvider
+}
+
+// ClearSession deletes the request's session from the session store, and
+// clears the session cookie.
+func (s *Store) ClearSession(w http.ResponseWriter, r *http.Request) {
+	if id, _ := s.sessionID(r); id != "" {
+		if err := s.sessions.Delete(r.Context(), id); err != nil {
+			log.FromRequest(r).Warn().Err(err).Msg("internal/sessions: session delete failed")
+		}
+	}
+	c := s.makeCookie("", 0)
+	c.MaxAge = -1
+	c.Expires = timeNow().Add(-time.Hour)
+	http.SetCookie(w, c)
+}
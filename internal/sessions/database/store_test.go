@@ -0,0 +1,170 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/cryptutil"
+	"github.com/pomerium/pomerium/internal/encoding/ecjson"
+	"github.com/pomerium/pomerium/internal/sessions"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestStore(t *testing.T) {
+	cipher, err := cryptutil.NewAEADCipher(cryptutil.NewKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := ecjson.New(cipher)
+	db := &MockSessionStore{}
+	store, err := NewStore(&Options{Name: "_pomerium", Expire: time.Hour}, db, encoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// save returns the session cookie the session was saved with
+	save := func(cookie *http.Cookie, s *sessions.State) *http.Cookie {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		if err := store.SaveSession(w, r, s); err != nil {
+			t.Fatal(err)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("SaveSession() set %d cookies, want 1", len(cookies))
+		}
+		return cookies[0]
+	}
+	load := func(cookie *http.Cookie) (*sessions.State, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookie)
+		jwt, err := store.LoadSession(r)
+		if err != nil {
+			return nil, err
+		}
+		var s sessions.State
+		if err := encoder.Unmarshal([]byte(jwt), &s); err != nil {
+			return nil, err
+		}
+		return &s, nil
+	}
+
+	signedIn := save(nil, &sessions.State{Subject: "user", Email: "user@example.com"})
+	if s, err := load(signedIn); err != nil || s.Email != "user@example.com" {
+		t.Fatalf("LoadSession() = %v, %v", s, err)
+	}
+
+	id := func(c *http.Cookie) string { return strings.Split(c.Value, ".")[0] }
+	t.Run("refresh keeps the id", func(t *testing.T) {
+		refreshed := save(signedIn, &sessions.State{Subject: "user", Email: "refreshed@example.com"})
+		if id(refreshed) != id(signedIn) {
+			t.Errorf("SaveSession() id = %q, want %q", id(refreshed), id(signedIn))
+		}
+		if s, err := load(signedIn); err != nil || s.Email != "refreshed@example.com" {
+			t.Errorf("LoadSession() = %v, %v", s, err)
+		}
+	})
+	t.Run("concurrent refreshes keep the first", func(t *testing.T) {
+		expiry := jwt.NewNumericDate(time.Now().Add(time.Hour))
+		session := save(nil, &sessions.State{Subject: "user"})
+		save(session, &sessions.State{Subject: "user", Email: "first@example.com", Expiry: expiry})
+		second := save(session, &sessions.State{Subject: "user", Email: "second@example.com", Expiry: expiry})
+		if s, err := load(second); err != nil || s.Email != "first@example.com" {
+			t.Errorf("LoadSession() = %v, %v, want the first refresh", s, err)
+		}
+		newer := save(session, &sessions.State{Subject: "user", Email: "newer@example.com", Expiry: jwt.NewNumericDate(time.Now().Add(2 * time.Hour))})
+		if s, err := load(newer); err != nil || s.Email != "newer@example.com" {
+			t.Errorf("LoadSession() = %v, %v, want the session with newer tokens", s, err)
+		}
+	})
+	t.Run("another user gets a new id", func(t *testing.T) {
+		planted := save(nil, &sessions.State{Subject: "attacker"})
+		victim := save(planted, &sessions.State{Subject: "victim"})
+		if victim.Value == planted.Value {
+			t.Error("SaveSession() kept the id of another user's session")
+		}
+		if _, err := load(planted); !errors.Is(err, sessions.ErrNoSessionFound) {
+			t.Errorf("LoadSession() of the replaced session error = %v, want %v", err, sessions.ErrNoSessionFound)
+		}
+	})
+	t.Run("unknown id gets a new id", func(t *testing.T) {
+		unknown := &http.Cookie{Name: "_pomerium", Value: "planted.1"}
+		if saved := save(unknown, &sessions.State{Subject: "user"}); id(saved) == id(unknown) {
+			t.Error("SaveSession() kept an id which wasn't a session")
+		}
+	})
+	t.Run("the cookie only holds the id", func(t *testing.T) {
+		if len(signedIn.Value) > 64 {
+			t.Errorf("session cookie is %d bytes", len(signedIn.Value))
+		}
+	})
+	t.Run("clear", func(t *testing.T) {
+		session := save(nil, &sessions.State{Subject: "user"})
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(session)
+		w := httptest.NewRecorder()
+		store.ClearSession(w, r)
+		if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+			t.Errorf("ClearSession() cookies = %v", cookies)
+		}
+		if _, err := load(session); !errors.Is(err, sessions.ErrNoSessionFound) {
+			t.Errorf("LoadSession() of a cleared session error = %v, want %v", err, sessions.ErrNoSessionFound)
+		}
+	})
+	t.Run("no session", func(t *testing.T) {
+		if _, err := store.LoadSession(httptest.NewRequest(http.MethodGet, "/", nil)); !errors.Is(err, sessions.ErrNoSessionFound) {
+			t.Errorf("LoadSession() error = %v, want %v", err, sessions.ErrNoSessionFound)
+		}
+	})
+}
+
+func TestStoreError(t *testing.T) {
+	t.Parallel()
+	cipher, err := cryptutil.NewAEADCipher(cryptutil.NewKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(&Options{Name: "_pomerium"}, &MockSessionStore{Error: errors.New("unavailable")}, ecjson.New(cipher))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := store.SaveSession(w, httptest.NewRequest(http.MethodGet, "/", nil), &sessions.State{Subject: "user"}); err == nil {
+		t.Error("SaveSession() expected an error")
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("SaveSession() set the session cookie of a session which wasn't saved")
+	}
+}
+
+func TestNewPostgresStore(t *testing.T) {
+	t.Parallel()
+	if _, err := NewPostgresStore("postgres://localhost:0/pomerium?sslmode=disable&connect_timeout=1"); err == nil {
+		t.Error("NewPostgresStore() expected error for an unreachable server")
+	}
+}
+
+func TestPostgresStore_RunCleanup(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		(&PostgresStore{}).RunCleanup(ctx, time.Hour)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("RunCleanup() didn't stop when its context was canceled")
+	}
+}
@@ -17,12 +17,35 @@ var (
 	// ErrExpired indicates that token is used after expiry time indicated in exp claim.
 	ErrExpired = errors.New("internal/sessions: validation failed, token is expired (exp)")
 
+	// ErrExpiringSoon indicates that the token expires soon and can't be
+	// refreshed, so the user must re-authenticate.
+	ErrExpiringSoon = errors.New("internal/sessions: token expires soon and cannot be refreshed")
+
 	// ErrExpiryRequired indicates that the token does not contain a valid expiry (exp) claim.
 	ErrExpiryRequired = errors.New("internal/sessions: validation failed, token expiry (exp) is required")
 
 	// ErrIssuedInTheFuture indicates that the iat field is in the future.
 	ErrIssuedInTheFuture = errors.New("internal/sessions: validation field, token issued in the future (iat)")
 
+	// ErrInsufficientScope indicates that the session hasn't been granted
+	// the scopes a route requires, so the user must grant them.
+	ErrInsufficientScope = errors.New("internal/sessions: session lacks required scopes")
+
+	// ErrAuthenticationTooOld indicates that the user authenticated longer
+	// ago than a route's max age allows, so must authenticate again.
+	ErrAuthenticationTooOld = errors.New("internal/sessions: authentication is older than the required max age")
+
+	// ErrMaxDurationExceeded indicates that the session was signed in
+	// longer ago than the maximum session duration allows.
+	ErrMaxDurationExceeded = errors.New("internal/sessions: session exceeded its maximum duration")
+
+	// ErrIdleTimeout indicates that the session went unused for longer than
+	// the idle timeout allows.
+	ErrIdleTimeout = errors.New("internal/sessions: session idle for too long")
+
+	// ErrRevoked indicates that the session was signed out.
+	ErrRevoked = errors.New("internal/sessions: session has been revoked")
+
 	// ErrInvalidAudience indicated invalid aud claim.
 	ErrInvalidAudience = errors.New("internal/sessions: validation failed, invalid audience claim (aud)")
 )
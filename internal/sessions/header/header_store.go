@@ -5,11 +5,17 @@ package header
 import (
 	"net/http"
 	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
 
 	"github.com/pomerium/pomerium/internal/encoding"
 	"github.com/pomerium/pomerium/internal/sessions"
 )
 
+// timeNow is time.Now but pulled out as a variable for tests.
+var timeNow = time.Now
+
 var _ sessions.SessionLoader = &Store{}
 
 const (
@@ -23,6 +29,9 @@ type Store struct {
 	authHeader string
 	authType   string
 	encoder    encoding.Unmarshaler
+	// validate is whether sessions are decoded, and checked to be current,
+	// when they are loaded.
+	validate bool
 }
 
 // NewStore returns a new header store for loading sessions from
@@ -41,13 +50,58 @@ func NewStore(enc encoding.Unmarshaler, headerType string) *Store {
 	}
 }
 
+// NewBearerStore returns a header store for loading sessions from a bearer
+// token, as sent by API and command line clients.
+//
+//	Authorization: Bearer <jwt>
+//
+// Unlike NewStore's, the store's sessions are validated as they're loaded:
+// a token must decode, and so be signed (or sealed) with the encoder's key,
+// and be within its nbf and exp claims. Since bearer tokens are as likely to
+// be meant for an upstream application, tokens which don't decode aren't an
+// error, and are left for the next session loader, but expired ones are.
+func NewBearerStore(enc encoding.Unmarshaler) *Store {
+	as := NewStore(enc, defaultAuthType)
+	as.validate = true
+	return as
+}
+
 // LoadSession tries to retrieve the token string from the Authorization header.
 func (as *Store) LoadSession(r *http.Request) (string, error) {
-	jwt := TokenFromHeader(r, as.authHeader, as.authType)
-	if jwt == "" {
+	token := TokenFromHeader(r, as.authHeader, as.authType)
+	if token == "" {
+		return "", sessions.ErrNoSessionFound
+	}
+	if !as.validate {
+		return token, nil
+	}
+	var s sessions.State
+	if as.encoder == nil || as.encoder.Unmarshal([]byte(token), &s) != nil {
 		return "", sessions.ErrNoSessionFound
 	}
-	return jwt, nil
+	if err := validateTimes(&s); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// validateTimes checks that a session is within its nbf and exp claims,
+// allowing for jwt.DefaultLeeway of clock skew. A session must expire.
+func validateTimes(s *sessions.State) error {
+	now := timeNow()
+	if s.Expiry == nil {
+		return sessions.ErrExpiryRequired
+	}
+	if now.Add(-jwt.DefaultLeeway).After(s.Expiry.Time()) {
+		return sessions.ErrExpired
+	}
+	if s.NotBefore != nil && now.Add(jwt.DefaultLeeway).Before(s.NotBefore.Time()) {
+		return sessions.ErrNotValidYet
+	}
+	if s.IssuedAt != nil && now.Add(jwt.DefaultLeeway).Before(s.IssuedAt.Time()) {
+		return sessions.ErrIssuedInTheFuture
+	}
+	return nil
 }
 
 // TokenFromHeader retrieves the value of the authorization header from a given
@@ -0,0 +1,72 @@
+package header
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/pomerium/pomerium/internal/cryptutil"
+	"github.com/pomerium/pomerium/internal/encoding/jws"
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestBearerStore_LoadSession(t *testing.T) {
+	key := cryptutil.NewKey()
+	signer, err := jws.NewHS256Signer(key, "authenticate.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forger, err := jws.NewHS256Signer(cryptutil.NewKey(), "authenticate.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	sign := func(t *testing.T, s *sessions.State) string {
+		t.Helper()
+		raw, err := signer.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(raw)
+	}
+	forged, err := forger.Marshal(&sessions.State{Email: "user@example.com", Expiry: jwt.NewNumericDate(now.Add(time.Hour))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		header  string
+		wantErr error
+	}{
+		{"good", "Bearer " + sign(t, &sessions.State{Email: "user@example.com", Expiry: jwt.NewNumericDate(now.Add(time.Hour))}), nil},
+		{"lower case type", "bearer " + sign(t, &sessions.State{Email: "user@example.com", Expiry: jwt.NewNumericDate(now.Add(time.Hour))}), nil},
+		{"missing header", "", sessions.ErrNoSessionFound},
+		{"other auth type", "Pomerium " + sign(t, &sessions.State{Email: "user@example.com", Expiry: jwt.NewNumericDate(now.Add(time.Hour))}), sessions.ErrNoSessionFound},
+		{"upstream token", "Bearer some-opaque-token", sessions.ErrNoSessionFound},
+		{"forged signature", "Bearer " + string(forged), sessions.ErrNoSessionFound},
+		{"expired", "Bearer " + sign(t, &sessions.State{Email: "user@example.com", Expiry: jwt.NewNumericDate(now.Add(-time.Hour))}), sessions.ErrExpired},
+		{"no expiry", "Bearer " + sign(t, &sessions.State{Email: "user@example.com"}), sessions.ErrExpiryRequired},
+		{"not valid yet", "Bearer " + sign(t, &sessions.State{Email: "user@example.com", Expiry: jwt.NewNumericDate(now.Add(2 * time.Hour)), NotBefore: jwt.NewNumericDate(now.Add(time.Hour))}), sessions.ErrNotValidYet},
+		{"issued in the future", "Bearer " + sign(t, &sessions.State{Email: "user@example.com", Expiry: jwt.NewNumericDate(now.Add(2 * time.Hour)), IssuedAt: jwt.NewNumericDate(now.Add(time.Hour))}), sessions.ErrIssuedInTheFuture},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			got, err := NewBearerStore(signer).LoadSession(r)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("LoadSession() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && "Bearer "+got != tt.header && "bearer "+got != tt.header {
+				t.Errorf("LoadSession() = %q, want the header's token", got)
+			}
+		})
+	}
+}
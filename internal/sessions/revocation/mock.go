@@ -0,0 +1,62 @@
+package revocation
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var _ Store = &MockStore{}
+
+// MockStore is a mock implementation of Store, which keeps what's been
+// revoked, when, and for how long, in memory.
+type MockStore struct {
+	Error error
+	// Lookups counts the calls to RevokedAt.
+	Lookups int
+
+	mu      sync.Mutex
+	revoked map[string]mockRevocation
+}
+
+type mockRevocation struct {
+	at  time.Time
+	ttl time.Duration
+}
+
+// Revoke is a mock implementation of Store.
+func (ms *MockStore) Revoke(_ context.Context, id string, ttl time.Duration) error {
+	if ms.Error != nil {
+		return ms.Error
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.revoked == nil {
+		ms.revoked = make(map[string]mockRevocation)
+	}
+	ms.revoked[id] = mockRevocation{at: time.Now(), ttl: ttl}
+	return nil
+}
+
+// RevokedAt is a mock implementation of Store.
+func (ms *MockStore) RevokedAt(_ context.Context, ids ...string) ([]time.Time, error) {
+	if ms.Error != nil {
+		return nil, ms.Error
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.Lookups++
+	at := make([]time.Time, len(ids))
+	for i, id := range ids {
+		at[i] = ms.revoked[id].at
+	}
+	return at, nil
+}
+
+// TTL returns the ttl id was revoked for, and whether it was.
+func (ms *MockStore) TTL(id string) (time.Duration, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	r, ok := ms.revoked[id]
+	return r.ttl, ok
+}
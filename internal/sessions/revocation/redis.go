@@ -0,0 +1,91 @@
+package revocation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const redisPrefix = "pomerium/sessions/revoked/v1/"
+
+// maxUnixSeconds tells revocations recorded in seconds, as they once were,
+// from those recorded in nanoseconds; it is far in the future as seconds,
+// and long past as nanoseconds.
+const maxUnixSeconds = 1 << 40
+
+// redisStore is a Store backed by redis, which lets every replica see the
+// sessions any of them revoked.
+type redisStore struct {
+	db *redis.Client
+}
+
+// NewRedisStore returns a Store backed by the redis server at rawURL (e.g.
+// `redis://:password@localhost:6379/0`, or `rediss://` for TLS).
+func NewRedisStore(rawURL string) (Store, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("internal/sessions: invalid revocation redis url: %w", err)
+	}
+	db := redis.NewClient(opts)
+	if _, err := db.Ping().Result(); err != nil {
+		return nil, fmt.Errorf("internal/sessions: error connecting to revocation redis: %w", err)
+	}
+	return &redisStore{db: db}, nil
+}
+
+// Revoke implements Store.
+func (s *redisStore) Revoke(ctx context.Context, id string, ttl time.Duration) error {
+	if id == "" {
+		return errors.New("internal/sessions: can't revoke a session without an id")
+	}
+	at := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := s.db.WithContext(ctx).Set(redisPrefix+id, at, ttl).Err(); err != nil {
+		return fmt.Errorf("internal/sessions: revoke failed: %w", err)
+	}
+	return nil
+}
+
+// RevokedAt implements Store.
+func (s *redisStore) RevokedAt(ctx context.Context, ids ...string) ([]time.Time, error) {
+	at := make([]time.Time, len(ids))
+	var keys []string
+	for _, id := range ids {
+		if id != "" {
+			keys = append(keys, redisPrefix+id)
+		}
+	}
+	if len(keys) == 0 {
+		return at, nil
+	}
+	vals, err := s.db.WithContext(ctx).MGet(keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("internal/sessions: revocation lookup failed: %w", err)
+	}
+	for i, id := range ids {
+		if id == "" {
+			continue
+		}
+		val := vals[0]
+		vals = vals[1:]
+		str, ok := val.(string)
+		if !ok {
+			// not revoked
+			continue
+		}
+		v, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("internal/sessions: revocation lookup failed: %w", err)
+		}
+		if v < maxUnixSeconds {
+			// recorded to the second, before revocations were more precise
+			at[i] = time.Unix(v, 0)
+		} else {
+			at[i] = time.Unix(0, v)
+		}
+	}
+	return at, nil
+}
@@ -0,0 +1,13 @@
+package revocation
+
+import "testing"
+
+func TestNewRedisStore(t *testing.T) {
+	t.Parallel()
+	if _, err := NewRedisStore("http://localhost:6379"); err == nil {
+		t.Error("NewRedisStore() expected error for a non redis url")
+	}
+	if _, err := NewRedisStore("redis://localhost:0"); err == nil {
+		t.Error("NewRedisStore() expected error for an unreachable server")
+	}
+}
@@ -0,0 +1,128 @@
+// Package revocation records sessions which have been signed out, so that
+// replicas of the authenticate and proxy services which didn't sign them
+// out can reject them too. It also records users whose groups have changed,
+// so that every replica fetches them again.
+package revocation
+
+import (
+	"context"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+// Store records revoked sessions. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Revoke records that id has been revoked, now, to the nanosecond so
+	// that sessions signed in just after aren't revoked too. The record may be
+	// dropped after ttl, by when the sessions it revokes would have
+	// expired.
+	Revoke(ctx context.Context, id string, ttl time.Duration) error
+	// RevokedAt returns when each of ids was revoked, or the zero time for
+	// those which haven't been, in a single lookup. Empty ids never are.
+	RevokedAt(ctx context.Context, ids ...string) ([]time.Time, error)
+}
+
+// RevokeSession revokes a session, and the route sessions made from it.
+func RevokeSession(ctx context.Context, store Store, s *sessions.State, ttl time.Duration) error {
+	return store.Revoke(ctx, sessionKey(s.RevocationID()), ttl)
+}
+
+// RevokeIdentityProviderSession revokes the sessions signed in during the
+// user's session sid with the named identity provider.
+func RevokeIdentityProviderSession(ctx context.Context, store Store, provider, sid string, ttl time.Duration) error {
+	return store.Revoke(ctx, identityProviderSessionKey(provider, sid), ttl)
+}
+
+// RevokeSubject revokes every session the user sub of the named identity
+// provider signed in before now.
+func RevokeSubject(ctx context.Context, store Store, provider, sub string, ttl time.Duration) error {
+	return store.Revoke(ctx, subjectKey(provider, sub), ttl)
+}
+
+// Status is what the revocation store records about a session.
+type Status struct {
+	// Revoked is whether the session has been revoked: by itself, by the
+	// identity provider session it was signed in during, or by its user
+	// since it was signed in.
+	Revoked bool
+	// GroupsInvalidatedAt is when the session's user's groups were last
+	// invalidated, if they have been.
+	GroupsInvalidatedAt time.Time
+}
+
+// Check looks up the session's status in a single round trip to the store.
+func Check(ctx context.Context, store Store, s *sessions.State) (Status, error) {
+	var sid, sub, groups string
+	if s.IdentityProviderSessionID != "" {
+		sid = identityProviderSessionKey(s.IdentityProvider, s.IdentityProviderSessionID)
+	}
+	if s.Subject != "" {
+		sub = subjectKey(s.IdentityProvider, s.Subject)
+		groups = groupsKey(s.IdentityProvider, s.Subject)
+	}
+	at, err := store.RevokedAt(ctx, sessionKey(s.RevocationID()), sid, sub, groups)
+	if err != nil {
+		return Status{}, err
+	}
+	status := Status{
+		Revoked:             !at[0].IsZero() || !at[1].IsZero(),
+		GroupsInvalidatedAt: at[3],
+	}
+	if !at[2].IsZero() {
+		signedIn := s.SignedInTime()
+		status.Revoked = status.Revoked || signedIn.IsZero() || !signedIn.After(at[2])
+	}
+	return status, nil
+}
+
+// IsRevoked returns whether the session has been revoked.
+func IsRevoked(ctx context.Context, store Store, s *sessions.State) (bool, error) {
+	status, err := Check(ctx, store, s)
+	return status.Revoked, err
+}
+
+// InvalidateGroups records that the groups of the user sub of the named
+// identity provider have changed, so that sessions whose groups were
+// fetched before now fetch them again.
+func InvalidateGroups(ctx context.Context, store Store, provider, sub string, ttl time.Duration) error {
+	return store.Revoke(ctx, groupsKey(provider, sub), ttl)
+}
+
+// GroupsInvalidated returns whether the groups of s, a session of the user
+// the status was checked for, were fetched before their groups were
+// invalidated. Sessions whose groups weren't fetched, such as those with
+// configured groups, never are.
+func (st Status) GroupsInvalidated(s *sessions.State) bool {
+	if st.GroupsInvalidatedAt.IsZero() || s.GroupsRefreshedAt == nil {
+		return false
+	}
+	// groups are timestamped to the second, so those fetched in the second
+	// the groups were invalidated may be either side of it, and are fetched
+	// again
+	at := st.GroupsInvalidatedAt.Truncate(time.Second)
+	if !at.Equal(st.GroupsInvalidatedAt) {
+		at = at.Add(time.Second)
+	}
+	return s.GroupsRefreshedAt.Time().Before(at)
+}
+
+func sessionKey(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "session/" + id
+}
+
+func identityProviderSessionKey(provider, sid string) string {
+	return "sid/" + provider + "/" + sid
+}
+
+func subjectKey(provider, sub string) string {
+	return "sub/" + provider + "/" + sub
+}
+
+func groupsKey(provider, sub string) string {
+	return "groups/" + provider + "/" + sub
+}
@@ -0,0 +1,130 @@
+package revocation
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/pomerium/pomerium/internal/sessions"
+)
+
+func TestIsRevoked(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	before := jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	after := jwt.NewNumericDate(time.Now().Add(time.Hour))
+
+	store := &MockStore{}
+	for _, err := range []error{
+		RevokeSession(ctx, store, &sessions.State{SessionID: "revoked"}, time.Hour),
+		RevokeIdentityProviderSession(ctx, store, "corp", "revoked", time.Hour),
+		RevokeSubject(ctx, store, "", "revoked", time.Hour),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	revokedAt, err := store.RevokedAt(ctx, subjectKey("", "revoked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// signed in during the second the user's sessions were revoked
+	sameSecond := func(d time.Duration) *sessions.State {
+		signedIn := revokedAt[0].Add(d)
+		return &sessions.State{SessionID: "other", Subject: "revoked", SignedInAt: jwt.NewNumericDate(signedIn), SignedInAtNano: signedIn.UnixNano()}
+	}
+
+	tests := []struct {
+		name    string
+		store   *MockStore
+		s       *sessions.State
+		want    bool
+		wantErr bool
+	}{
+		{"session", store, &sessions.State{SessionID: "revoked", Subject: "user"}, true, false},
+		{"route session", store, &sessions.State{SessionID: "revoked", AccessTokenID: "other"}, true, false},
+		{"other session", store, &sessions.State{SessionID: "other", Subject: "user"}, false, false},
+		{"identity provider session", store, &sessions.State{SessionID: "other", IdentityProvider: "corp", IdentityProviderSessionID: "revoked"}, true, false},
+		{"other provider's session", store, &sessions.State{SessionID: "other", IdentityProviderSessionID: "revoked"}, false, false},
+		{"subject signed in before", store, &sessions.State{SessionID: "other", Subject: "revoked", SignedInAt: before}, true, false},
+		{"subject signed in after", store, &sessions.State{SessionID: "other", Subject: "revoked", SignedInAt: after}, false, false},
+		{"subject signed in just before", store, sameSecond(-time.Nanosecond), true, false},
+		{"subject signed in just after", store, sameSecond(time.Nanosecond), false, false},
+		{"subject sign in unknown", store, &sessions.State{SessionID: "other", Subject: "revoked"}, true, false},
+		{"other provider's subject", store, &sessions.State{SessionID: "other", IdentityProvider: "corp", Subject: "revoked"}, false, false},
+		{"store error", &MockStore{Error: errors.New("error")}, &sessions.State{SessionID: "revoked"}, false, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := IsRevoked(ctx, tt.store, tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("IsRevoked() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("IsRevoked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupsInvalidated(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	before := jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	after := jwt.NewNumericDate(time.Now().Add(time.Hour))
+
+	store := &MockStore{}
+	if err := InvalidateGroups(ctx, store, "corp", "user", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	invalidatedAt, err := store.RevokedAt(ctx, groupsKey("corp", "user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// groups are timestamped to the second
+	sameSecond := jwt.NewNumericDate(invalidatedAt[0].Truncate(time.Second))
+	// invalidated partway through the second
+	midSecond := &MockStore{revoked: map[string]mockRevocation{
+		groupsKey("corp", "user"): {at: time.Unix(1000, int64(500*time.Millisecond))},
+	}}
+
+	tests := []struct {
+		name    string
+		store   *MockStore
+		s       *sessions.State
+		want    bool
+		wantErr bool
+	}{
+		{"fetched before", store, &sessions.State{IdentityProvider: "corp", Subject: "user", GroupsRefreshedAt: before}, true, false},
+		{"fetched after", store, &sessions.State{IdentityProvider: "corp", Subject: "user", GroupsRefreshedAt: after}, false, false},
+		{"fetched the same second", store, &sessions.State{IdentityProvider: "corp", Subject: "user", GroupsRefreshedAt: sameSecond}, true, false},
+		{"fetched the same second, partway through", midSecond, &sessions.State{IdentityProvider: "corp", Subject: "user", GroupsRefreshedAt: jwt.NewNumericDate(time.Unix(1000, 0))}, true, false},
+		{"fetched the next second", midSecond, &sessions.State{IdentityProvider: "corp", Subject: "user", GroupsRefreshedAt: jwt.NewNumericDate(time.Unix(1001, 0))}, false, false},
+		{"configured groups", store, &sessions.State{IdentityProvider: "corp", Subject: "user"}, false, false},
+		{"other user", store, &sessions.State{IdentityProvider: "corp", Subject: "other", GroupsRefreshedAt: before}, false, false},
+		{"other provider's user", store, &sessions.State{Subject: "user", GroupsRefreshedAt: before}, false, false},
+		{"store error", &MockStore{Error: errors.New("error")}, &sessions.State{Subject: "user", GroupsRefreshedAt: before}, false, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			status, err := Check(ctx, tt.store, tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := status.GroupsInvalidated(tt.s); got != tt.want {
+				t.Errorf("GroupsInvalidated() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// invalidating a user's groups doesn't revoke their sessions
+	if revoked, err := IsRevoked(ctx, store, &sessions.State{IdentityProvider: "corp", Subject: "user", SignedInAt: before}); err != nil || revoked {
+		t.Errorf("IsRevoked() = %v, %v, want false", revoked, err)
+	}
+}
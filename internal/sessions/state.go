@@ -12,11 +12,17 @@ import (
 	"github.com/mitchellh/hashstructure"
 	"golang.org/x/oauth2"
 	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/pomerium/pomerium/internal/cryptutil"
 )
 
 // timeNow is time.Now but pulled out as a variable for tests.
 var timeNow = time.Now
 
+// activityResolution is how stale a session's last activity must be before
+// it's updated, so that sessions aren't saved again on every request.
+const activityResolution = time.Minute
+
 // State is our object that keeps track of a user's session state
 type State struct {
 	// Public claim values (as specified in RFC 7519).
@@ -32,6 +38,34 @@ type State struct {
 	Email  string   `json:"email"`
 	Groups []string `json:"groups,omitempty"`
 	User   string   `json:"user,omitempty"` // google
+	// Orgs are the user's organizations, for identity providers which
+	// distinguish them from groups.
+	Orgs []string `json:"orgs,omitempty"`
+	// GroupsRefreshedAt is when Groups were last fetched from the identity
+	// provider, if they were.
+	GroupsRefreshedAt *jwt.NumericDate `json:"groups_refreshed_at,omitempty"`
+
+	// SignedInAt is when the user signed in, and LastActiveAt roughly when
+	// the session was last used. Unlike the expiry, which follows the
+	// identity provider's tokens, neither changes when the session is
+	// refreshed.
+	SignedInAt   *jwt.NumericDate `json:"signed_in_at,omitempty"`
+	LastActiveAt *jwt.NumericDate `json:"last_active_at,omitempty"`
+	// SignedInAtNano is SignedInAt to the nanosecond, so that sessions
+	// signed in during the same second as their user's sessions were
+	// revoked can be told apart from those signed in before.
+	SignedInAtNano int64 `json:"signed_in_at_nano,omitempty"`
+	// SessionID identifies the sign in the session, and the route sessions
+	// derived from it, came from. Unlike the jti and access token id, it
+	// doesn't change when the session is refreshed.
+	SessionID string `json:"session_id,omitempty"`
+	// IdentityProviderSessionID is the user's session with the identity
+	// provider, as given by the id token's sid claim, which back-channel
+	// logout tokens name it by.
+	IdentityProviderSessionID string `json:"sid,omitempty"`
+	// RawIDToken is the id token the identity provider last issued, which
+	// is sent back to it as a hint when the user signs out.
+	RawIDToken string `json:"id_token,omitempty"`
 
 	// commonly supported IdP information
 	// https://www.iana.org/assignments/jwt/jwt.xhtml#claims
@@ -41,6 +75,22 @@ type State struct {
 	Picture       string `json:"picture,omitempty"`        // google
 	EmailVerified bool   `json:"email_verified,omitempty"` // google
 
+	// ACR and AMR are the authentication context class the user signed in
+	// with, and the methods used to (e.g. `mfa`), as reported by the
+	// identity provider.
+	// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+	ACR string   `json:"acr,omitempty"`
+	AMR []string `json:"amr,omitempty"`
+	// AuthTime is when the user last authenticated with the identity
+	// provider, as reported by its auth_time claim. Unlike SignedInAt, it
+	// doesn't change if the identity provider signs the user in from its
+	// own session without asking them to authenticate.
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+
+	// ForwardedClaims are the identity provider's claims, by name, which are
+	// set as headers on requests proxied for the user.
+	ForwardedClaims map[string]interface{} `json:"forwarded_claims,omitempty"`
+
 	// Impersonate-able fields
 	ImpersonateEmail  string   `json:"impersonate_email,omitempty"`
 	ImpersonateGroups []string `json:"impersonate_groups,omitempty"`
@@ -52,6 +102,14 @@ type State struct {
 	AccessToken   *oauth2.Token `json:"act,omitempty"`
 	AccessTokenID string        `json:"ati,omitempty"`
 
+	// Scopes are the oauth2 scopes granted to the session's access token,
+	// as reported by the identity provider, if known.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// IdentityProvider is the name of the identity provider which
+	// authenticated the session. Empty for the default provider.
+	IdentityProvider string `json:"identity_provider,omitempty"`
+
 	idToken *oidc.IDToken
 }
 
@@ -73,6 +131,8 @@ func NewStateFromTokens(idToken *oidc.IDToken, accessToken *oauth2.Token, audien
 	s.idToken = idToken
 	s.AccessToken = accessToken
 	s.AccessTokenID = s.accessTokenHash()
+	s.Scopes = grantedScopes(accessToken)
+	s.RawIDToken, _ = accessToken.Extra("id_token").(string)
 	return s, nil
 }
 
@@ -95,9 +155,45 @@ func (s *State) UpdateState(idToken *oidc.IDToken, accessToken *oauth2.Token) er
 	s.Audience = audience
 	s.Expiry = jwt.NewNumericDate(accessToken.Expiry)
 	s.AccessTokenID = s.accessTokenHash()
+	if rawIDToken, ok := accessToken.Extra("id_token").(string); ok && rawIDToken != "" {
+		s.RawIDToken = rawIDToken
+	}
+	// a refreshed token keeps its grant unless told otherwise (rfc6749 6)
+	if scopes := grantedScopes(accessToken); len(scopes) != 0 {
+		s.Scopes = scopes
+	}
 	return nil
 }
 
+// grantedScopes returns the scopes a token response says were granted, or
+// nil if it doesn't say, in which case they are the ones requested.
+//
+// https://tools.ietf.org/html/rfc6749#section-5.1
+func grantedScopes(token *oauth2.Token) []string {
+	scope, _ := token.Extra("scope").(string)
+	if scope == "" {
+		return nil
+	}
+	return strings.Fields(scope)
+}
+
+// HasScopes returns whether all of scopes have been granted to the session.
+func (s *State) HasScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		found := false
+		for _, granted := range s.Scopes {
+			if granted == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 // NewSession updates issuer, audience, and issuance timestamps but keeps
 // parent expiry.
 func (s State) NewSession(issuer string, audience []string) *State {
@@ -108,9 +204,129 @@ func (s State) NewSession(issuer string, audience []string) *State {
 	return &s
 }
 
-// RouteSession creates a route session with access tokens stripped.
+// SetGroups sets the user's groups, as just fetched from the identity
+// provider.
+func (s *State) SetGroups(groups []string) {
+	s.Groups = groups
+	s.GroupsRefreshedAt = jwt.NewNumericDate(timeNow())
+}
+
+// GroupsStale reports whether the session's groups were fetched more than
+// interval ago, and should be fetched again. Sessions whose groups weren't
+// fetched, such as those with configured groups, are never stale, nor are
+// any if interval is zero.
+func (s *State) GroupsStale(interval time.Duration) bool {
+	if interval <= 0 || s.GroupsRefreshedAt == nil {
+		return false
+	}
+	return timeNow().After(s.GroupsRefreshedAt.Time().Add(interval))
+}
+
+// SetSignedIn marks the session as signed in, and active, now, giving it a
+// new session id.
+func (s *State) SetSignedIn() {
+	now := timeNow()
+	s.SignedInAt = jwt.NewNumericDate(now)
+	s.SignedInAtNano = now.UnixNano()
+	s.LastActiveAt = s.SignedInAt
+	s.SessionID = cryptutil.NewRandomStringN(32)
+}
+
+// SignedInTime returns when the session was signed in, to the nanosecond
+// if that was recorded, or the zero time if it wasn't recorded at all.
+func (s *State) SignedInTime() time.Time {
+	switch {
+	case s.SignedInAtNano != 0:
+		return time.Unix(0, s.SignedInAtNano)
+	case s.SignedInAt != nil:
+		return s.SignedInAt.Time()
+	}
+	return time.Time{}
+}
+
+// AuthenticatedWithin reports whether the user authenticated with the
+// identity provider no longer than maxAge ago. Sessions which don't record
+// when the user authenticated haven't, unless maxAge is unset.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+func (s *State) AuthenticatedWithin(maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return true
+	}
+	return s.AuthTime != nil && !timeNow().After(s.AuthTime.Time().Add(maxAge))
+}
+
+// RevocationID returns the id the session is revoked by: its session id or,
+// for sessions signed in before they had one, its access token's.
+func (s *State) RevocationID() string {
+	if s.SessionID != "" {
+		return s.SessionID
+	}
+	return s.AccessTokenID
+}
+
+// CheckLifetime returns an error if the session was signed in longer ago
+// than maxDuration, or has been idle for longer than idleTimeout, however
+// long its token is valid for. Either check is skipped if its limit is
+// unset. Programmatic sessions are held by their clients, not in a cookie
+// which can be updated as they're used, so have no idle timeout. Sessions
+// which don't record when they signed in, or were last active, have
+// exceeded any limit.
+func (s *State) CheckLifetime(maxDuration, idleTimeout time.Duration) error {
+	now := timeNow()
+	if maxDuration > 0 && (s.SignedInAt == nil || now.After(s.SignedInAt.Time().Add(maxDuration))) {
+		return ErrMaxDurationExceeded
+	}
+	if idleTimeout > 0 && !s.Programmatic && (s.LastActiveAt == nil || now.After(s.LastActiveAt.Time().Add(idleTimeout))) {
+		return ErrIdleTimeout
+	}
+	return nil
+}
+
+// Touch records that the session is active, if an idle timeout is set and
+// it was last marked active more than a minute ago, though never once it
+// has been idle for longer than the timeout. Sessions signed in before
+// either limit was set don't record when they signed in, or were last
+// active, and start that limit's clock now. It reports whether the session
+// changed, and so should be saved. Touch is called before CheckLifetime,
+// so that those sessions pass it.
+func (s *State) Touch(maxDuration, idleTimeout time.Duration) bool {
+	now := timeNow()
+	touched := false
+	if maxDuration > 0 && s.SignedInAt == nil {
+		s.SignedInAt = jwt.NewNumericDate(now)
+		touched = true
+	}
+	if idleTimeout > 0 && !s.Programmatic {
+		switch {
+		case s.LastActiveAt == nil:
+		case now.Sub(s.LastActiveAt.Time()) < activityResolution:
+			return touched
+		case now.After(s.LastActiveAt.Time().Add(idleTimeout)):
+			// left for CheckLifetime to reject
+			return touched
+		}
+		s.LastActiveAt = jwt.NewNumericDate(now)
+		touched = true
+	}
+	return touched
+}
+
+// ActiveAt records that the session was used at t, such as on one of the
+// proxy's routes, if that's later than its last recorded activity. It
+// reports whether the session changed, and so should be saved.
+func (s *State) ActiveAt(t time.Time) bool {
+	if t.After(timeNow()) || (s.LastActiveAt != nil && !t.After(s.LastActiveAt.Time())) {
+		return false
+	}
+	s.LastActiveAt = jwt.NewNumericDate(t)
+	return true
+}
+
+// RouteSession creates a route session with access and id tokens stripped.
 func (s State) RouteSession() *State {
 	s.AccessToken = nil
+	s.RawIDToken = ""
 	return &s
 }
 
@@ -135,6 +351,41 @@ func (s *State) Verify(audience string) error {
 	return nil
 }
 
+// TokenExpiry returns when the session's access token expires or, if it has
+// none, when the session does. It returns the zero time if neither expires.
+func (s *State) TokenExpiry() time.Time {
+	if s.AccessToken != nil && !s.AccessToken.Expiry.IsZero() {
+		return s.AccessToken.Expiry
+	}
+	if s.Expiry != nil {
+		return s.Expiry.Time()
+	}
+	return time.Time{}
+}
+
+// NeedsReauthentication reports whether the session's token expires within
+// threshold and, having no refresh token, can't be refreshed, so the user
+// should sign in again before it does. Sessions issued less than threshold
+// ago are never reported, so that an identity provider issuing tokens which
+// live shorter than threshold can't cause a loop of sign ins.
+func (s *State) NeedsReauthentication(threshold time.Duration) bool {
+	if threshold <= 0 {
+		return false
+	}
+	if s.AccessToken != nil && s.AccessToken.RefreshToken != "" {
+		return false
+	}
+	expiry := s.TokenExpiry()
+	if expiry.IsZero() {
+		return false
+	}
+	now := timeNow()
+	if s.IssuedAt != nil && now.Sub(s.IssuedAt.Time()) < threshold {
+		return false
+	}
+	return now.Add(threshold).After(expiry)
+}
+
 // Impersonating returns if the request is impersonating.
 func (s *State) Impersonating() bool {
 	return s.ImpersonateEmail != "" || len(s.ImpersonateGroups) != 0
@@ -178,12 +429,15 @@ func (s *State) accessTokenHash() string {
 }
 
 // UnmarshalJSON parses the JSON-encoded session state.
-// TODO(BDD): remove in v0.8.0
+//
+// Groups may be encoded either as an array of strings or, as some identity
+// providers do in their tokens' groups claim, a space delimited string.
 func (s *State) UnmarshalJSON(b []byte) error {
 	type Alias State
 	t := &struct {
 		*Alias
-		OldToken *oauth2.Token `json:"access_token,omitempty"` // < v0.5.0
+		Groups   json.RawMessage `json:"groups,omitempty"`
+		OldToken *oauth2.Token   `json:"access_token,omitempty"` // < v0.5.0 TODO(BDD): remove in v0.8.0
 	}{
 		Alias: (*Alias)(s),
 	}
@@ -193,7 +447,29 @@ func (s *State) UnmarshalJSON(b []byte) error {
 	if t.AccessToken == nil {
 		t.AccessToken = t.OldToken
 	}
+	groups, err := ParseGroups(t.Groups)
+	if err != nil {
+		return err
+	}
+	t.Alias.Groups = groups
 	*s = *(*State)(t.Alias)
 
 	return nil
 }
+
+// ParseGroups parses a JSON encoded list of groups, which may either be an
+// array of strings or a space delimited string.
+func ParseGroups(b json.RawMessage) ([]string, error) {
+	if len(b) == 0 || string(b) == "null" {
+		return nil, nil
+	}
+	var groups []string
+	if err := json.Unmarshal(b, &groups); err == nil {
+		return groups, nil
+	}
+	var group string
+	if err := json.Unmarshal(b, &group); err != nil {
+		return nil, fmt.Errorf("sessions: groups must be a string or an array of strings: %w", err)
+	}
+	return strings.Fields(group), nil
+}
@@ -1,6 +1,7 @@
 package sessions
 
 import (
+	"encoding/json"
 	"strings"
 	"testing"
 	"time"
@@ -82,6 +83,211 @@ func TestState_Verify(t *testing.T) {
 	}
 }
 
+func TestState_NeedsReauthentication(t *testing.T) {
+	t.Parallel()
+	now := timeNow()
+	tests := []struct {
+		name      string
+		state     State
+		threshold time.Duration
+		want      bool
+	}{
+		{"disabled", State{Expiry: jwt.NewNumericDate(now.Add(time.Minute))}, 0, false},
+		{"session expires soon", State{Expiry: jwt.NewNumericDate(now.Add(time.Minute))}, 5 * time.Minute, true},
+		{"access token expires soon", State{Expiry: jwt.NewNumericDate(now.Add(time.Hour)), AccessToken: &oauth2.Token{Expiry: now.Add(time.Minute)}}, 5 * time.Minute, true},
+		{"not soon", State{Expiry: jwt.NewNumericDate(now.Add(time.Hour))}, 5 * time.Minute, false},
+		{"refreshable", State{AccessToken: &oauth2.Token{RefreshToken: "refresh", Expiry: now.Add(time.Minute)}}, 5 * time.Minute, false},
+		{"no expiry", State{AccessToken: &oauth2.Token{}}, 5 * time.Minute, false},
+		{"just issued", State{IssuedAt: jwt.NewNumericDate(now), Expiry: jwt.NewNumericDate(now.Add(time.Minute))}, 5 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := tt.state.NeedsReauthentication(tt.threshold); got != tt.want {
+				t.Errorf("State.NeedsReauthentication() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestState_HasScopes(t *testing.T) {
+	t.Parallel()
+	granted := State{Scopes: []string{"openid", "email", "admin"}}
+	tests := []struct {
+		name   string
+		state  State
+		scopes []string
+		want   bool
+	}{
+		{"none required", State{}, nil, true},
+		{"granted", granted, []string{"admin"}, true},
+		{"all granted", granted, []string{"email", "admin"}, true},
+		{"not granted", granted, []string{"admin", "billing"}, false},
+		{"unknown grant", State{}, []string{"admin"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.state.HasScopes(tt.scopes); got != tt.want {
+			t.Errorf("%s: State.HasScopes() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestState_GroupsStale(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	refreshed := func(ago time.Duration) *jwt.NumericDate { return jwt.NewNumericDate(now.Add(-ago)) }
+	tests := []struct {
+		name     string
+		state    State
+		interval time.Duration
+		want     bool
+	}{
+		{"fresh", State{GroupsRefreshedAt: refreshed(time.Minute)}, time.Hour, false},
+		{"stale", State{GroupsRefreshedAt: refreshed(2 * time.Hour)}, time.Hour, true},
+		{"never fetched", State{}, time.Hour, false},
+		{"no interval", State{GroupsRefreshedAt: refreshed(2 * time.Hour)}, 0, false},
+	}
+	for _, tt := range tests {
+		if got := tt.state.GroupsStale(tt.interval); got != tt.want {
+			t.Errorf("%s: State.GroupsStale() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	var s State
+	s.SetGroups([]string{"admins"})
+	if s.GroupsRefreshedAt == nil || s.GroupsStale(time.Hour) {
+		t.Errorf("SetGroups() refreshed at = %v, want now", s.GroupsRefreshedAt)
+	}
+}
+
+func TestState_AuthenticatedWithin(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ago := func(d time.Duration) *jwt.NumericDate { return jwt.NewNumericDate(now.Add(-d)) }
+	tests := []struct {
+		name   string
+		state  State
+		maxAge time.Duration
+		want   bool
+	}{
+		{"no max age", State{}, 0, true},
+		{"recent", State{AuthTime: ago(time.Minute)}, 5 * time.Minute, true},
+		{"too old", State{AuthTime: ago(10 * time.Minute)}, 5 * time.Minute, false},
+		{"signed in recently, authenticated long ago", State{SignedInAt: ago(time.Minute), AuthTime: ago(10 * time.Minute)}, 5 * time.Minute, false},
+		{"auth time not recorded", State{SignedInAt: ago(time.Minute)}, 5 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		if got := tt.state.AuthenticatedWithin(tt.maxAge); got != tt.want {
+			t.Errorf("%s: State.AuthenticatedWithin() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestState_CheckLifetime(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ago := func(d time.Duration) *jwt.NumericDate { return jwt.NewNumericDate(now.Add(-d)) }
+	tests := []struct {
+		name        string
+		state       State
+		maxDuration time.Duration
+		idleTimeout time.Duration
+		want        error
+	}{
+		{"no limits", State{}, 0, 0, nil},
+		{"within limits", State{SignedInAt: ago(time.Hour), LastActiveAt: ago(time.Minute)}, 8 * time.Hour, 15 * time.Minute, nil},
+		{"max duration exceeded", State{SignedInAt: ago(9 * time.Hour), LastActiveAt: ago(time.Minute)}, 8 * time.Hour, 15 * time.Minute, ErrMaxDurationExceeded},
+		{"idle", State{SignedInAt: ago(time.Hour), LastActiveAt: ago(20 * time.Minute)}, 8 * time.Hour, 15 * time.Minute, ErrIdleTimeout},
+		{"idle, no idle timeout", State{SignedInAt: ago(time.Hour), LastActiveAt: ago(20 * time.Minute)}, 8 * time.Hour, 0, nil},
+		{"idle programmatic", State{SignedInAt: ago(time.Hour), LastActiveAt: ago(20 * time.Minute), Programmatic: true}, 8 * time.Hour, 15 * time.Minute, nil},
+		{"sign in not recorded", State{LastActiveAt: ago(time.Minute)}, 8 * time.Hour, 0, ErrMaxDurationExceeded},
+		{"activity not recorded", State{SignedInAt: ago(time.Hour)}, 0, 15 * time.Minute, ErrIdleTimeout},
+	}
+	for _, tt := range tests {
+		if got := tt.state.CheckLifetime(tt.maxDuration, tt.idleTimeout); got != tt.want {
+			t.Errorf("%s: State.CheckLifetime() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestState_Touch(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ago := func(d time.Duration) *jwt.NumericDate { return jwt.NewNumericDate(now.Add(-d)) }
+	tests := []struct {
+		name        string
+		state       State
+		maxDuration time.Duration
+		idleTimeout time.Duration
+		want        bool
+	}{
+		{"no limits", State{LastActiveAt: ago(time.Hour)}, 0, 0, false},
+		{"recently active", State{LastActiveAt: ago(10 * time.Second)}, 0, 15 * time.Minute, false},
+		{"active a while ago", State{LastActiveAt: ago(5 * time.Minute)}, 0, 15 * time.Minute, true},
+		{"activity not recorded", State{}, 0, 15 * time.Minute, true},
+		{"idle", State{LastActiveAt: ago(20 * time.Minute)}, 0, 15 * time.Minute, false},
+		{"programmatic", State{LastActiveAt: ago(5 * time.Minute), Programmatic: true}, 0, 15 * time.Minute, false},
+		{"signed in", State{SignedInAt: ago(time.Hour)}, 8 * time.Hour, 0, false},
+		{"sign in not recorded", State{}, 8 * time.Hour, 0, true},
+	}
+	for _, tt := range tests {
+		s := tt.state
+		if got := s.Touch(tt.maxDuration, tt.idleTimeout); got != tt.want {
+			t.Errorf("%s: State.Touch() = %v, want %v", tt.name, got, tt.want)
+		}
+		if tt.idleTimeout > 0 && tt.want && now.Sub(s.LastActiveAt.Time()) > time.Second {
+			t.Errorf("%s: State.Touch() last active at = %v, want now", tt.name, s.LastActiveAt)
+		}
+		if tt.maxDuration > 0 && tt.want && now.Sub(s.SignedInAt.Time()) > time.Second {
+			t.Errorf("%s: State.Touch() signed in at = %v, want now", tt.name, s.SignedInAt)
+		}
+	}
+
+	var s State
+	s.SetSignedIn()
+	if err := s.CheckLifetime(time.Hour, 15*time.Minute); err != nil {
+		t.Errorf("SetSignedIn() CheckLifetime() = %v, want nil", err)
+	}
+}
+
+func TestState_ActiveAt(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ago := func(d time.Duration) *jwt.NumericDate { return jwt.NewNumericDate(now.Add(-d)) }
+	tests := []struct {
+		name  string
+		state State
+		t     time.Time
+		want  bool
+	}{
+		{"active since", State{LastActiveAt: ago(time.Hour)}, now.Add(-time.Minute), true},
+		{"active before", State{LastActiveAt: ago(time.Minute)}, now.Add(-time.Hour), false},
+		{"activity not recorded", State{}, now.Add(-time.Minute), true},
+		{"in the future", State{LastActiveAt: ago(time.Hour)}, now.Add(time.Hour), false},
+	}
+	for _, tt := range tests {
+		s := tt.state
+		if got := s.ActiveAt(tt.t); got != tt.want {
+			t.Errorf("%s: State.ActiveAt() = %v, want %v", tt.name, got, tt.want)
+		}
+		if tt.want && s.LastActiveAt.Time().Unix() != tt.t.Unix() {
+			t.Errorf("%s: State.ActiveAt() last active at = %v, want %v", tt.name, s.LastActiveAt, tt.t)
+		}
+	}
+}
+
+func TestGrantedScopes(t *testing.T) {
+	t.Parallel()
+	token := (&oauth2.Token{}).WithExtra(map[string]interface{}{"scope": "openid email admin"})
+	if diff := cmp.Diff([]string{"openid", "email", "admin"}, grantedScopes(token)); diff != "" {
+		t.Errorf("grantedScopes() = %s", diff)
+	}
+	if got := grantedScopes(&oauth2.Token{}); got != nil {
+		t.Errorf("grantedScopes() = %v, want nil", got)
+	}
+}
+
 func TestState_RouteSession(t *testing.T) {
 	now := time.Now()
 	timeNow = func() time.Time {
@@ -145,3 +351,38 @@ func TestState_accessTokenHash(t *testing.T) {
 		})
 	}
 }
+
+func TestState_UnmarshalJSON_Groups(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		json    string
+		want    []string
+		wantErr bool
+	}{
+		{"array", `{"email":"user@example.com","groups":["admins","devs"]}`, []string{"admins", "devs"}, false},
+		{"space delimited", `{"email":"user@example.com","groups":"admins  devs"}`, []string{"admins", "devs"}, false},
+		{"missing", `{"email":"user@example.com"}`, nil, false},
+		{"null", `{"email":"user@example.com","groups":null}`, nil, false},
+		{"invalid", `{"email":"user@example.com","groups":42}`, nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var s State
+			err := json.Unmarshal([]byte(tt.json), &s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tt.want, s.Groups); diff != "" {
+				t.Errorf("Groups = %s", diff)
+			}
+			if s.Email != "user@example.com" {
+				t.Errorf("Email = %q", s.Email)
+			}
+		})
+	}
+}
@@ -14,6 +14,10 @@ var (
 	TagKeyGRPCMethod  = tag.MustNewKey("grpc_method")
 	TagKeyHost        = tag.MustNewKey("host")
 	TagKeyDestination = tag.MustNewKey("destination")
+	TagKeyProvider    = tag.MustNewKey("provider")
+	TagKeyResult      = tag.MustNewKey("result")
+	TagKeyOperation   = tag.MustNewKey("operation")
+	TagKeyStatusClass = tag.MustNewKey("status_class")
 )
 
 // Default distributions used by views in this package.
@@ -39,5 +43,6 @@ var (
 		HTTPClientViews,
 		HTTPServerViews,
 		InfoViews,
+		IdentityViews,
 	}
 )
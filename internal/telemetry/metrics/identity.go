@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
+	"github.com/pomerium/pomerium/internal/log"
+)
+
+// Identity provider views
+var (
+	// IdentityViews contains opencensus views for identity provider metrics.
+	IdentityViews = []*view.View{
+		GroupsCacheRequestCountView,
+		GroupsCircuitBreakerStateView,
+		IdentityAPIRequestCountView,
+		IdentityAPIRequestDurationView,
+		IdentityAPIRequestErrorCountView,
+		UserGroupsCountView,
+	}
+
+	groupsCacheRequests = stats.Int64(
+		"identity_groups_cache_requests_total",
+		"Total user group cache lookups",
+		stats.UnitDimensionless)
+
+	// GroupsCacheRequestCountView is an OpenCensus view that tracks user group
+	// cache lookups by identity provider and result (hit or miss)
+	GroupsCacheRequestCountView = &view.View{
+		Name:        groupsCacheRequests.Name(),
+		Measure:     groupsCacheRequests,
+		Description: groupsCacheRequests.Description(),
+		TagKeys:     []tag.Key{TagKeyProvider, TagKeyResult},
+		Aggregation: view.Count(),
+	}
+
+	groupsCircuitBreakerState = stats.Int64(
+		"identity_groups_circuit_breaker_state",
+		"State of the user groups circuit breaker: 0 closed, 1 half-open, 2 open",
+		stats.UnitDimensionless)
+
+	// GroupsCircuitBreakerStateView is an OpenCensus view that tracks the
+	// current state of the circuit breaker around user group lookups by
+	// identity provider
+	GroupsCircuitBreakerStateView = &view.View{
+		Name:        groupsCircuitBreakerState.Name(),
+		Measure:     groupsCircuitBreakerState,
+		Description: groupsCircuitBreakerState.Description(),
+		TagKeys:     []tag.Key{TagKeyProvider},
+		Aggregation: view.LastValue(),
+	}
+
+	identityAPIRequestDuration = stats.Float64(
+		"identity_api_request_duration_ms",
+		"Identity provider API request duration in ms",
+		stats.UnitMilliseconds)
+
+	identityAPIRequestErrors = stats.Int64(
+		"identity_api_request_errors_total",
+		"Total failed identity provider API requests",
+		stats.UnitDimensionless)
+
+	// IdentityAPIRequestCountView is an OpenCensus view that tracks requests
+	// made to an identity provider's API by provider and operation
+	IdentityAPIRequestCountView = &view.View{
+		Name:        "identity_api_requests_total",
+		Measure:     identityAPIRequestDuration,
+		Description: "Total identity provider API requests",
+		TagKeys:     []tag.Key{TagKeyProvider, TagKeyOperation},
+		Aggregation: view.Count(),
+	}
+
+	// IdentityAPIRequestDurationView is an OpenCensus view that tracks the
+	// duration of requests made to an identity provider's API by provider and
+	// operation
+	IdentityAPIRequestDurationView = &view.View{
+		Name:        identityAPIRequestDuration.Name(),
+		Measure:     identityAPIRequestDuration,
+		Description: identityAPIRequestDuration.Description(),
+		TagKeys:     []tag.Key{TagKeyProvider, TagKeyOperation},
+		Aggregation: DefaultHTTPLatencyDistrubtion,
+	}
+
+	// IdentityAPIRequestErrorCountView is an OpenCensus view that tracks failed
+	// requests made to an identity provider's API by provider, operation and
+	// response status class
+	IdentityAPIRequestErrorCountView = &view.View{
+		Name:        identityAPIRequestErrors.Name(),
+		Measure:     identityAPIRequestErrors,
+		Description: identityAPIRequestErrors.Description(),
+		TagKeys:     []tag.Key{TagKeyProvider, TagKeyOperation, TagKeyStatusClass},
+		Aggregation: view.Count(),
+	}
+
+	userGroupsCount = stats.Int64(
+		"identity_user_groups",
+		"Number of groups returned by user group lookups",
+		stats.UnitDimensionless)
+
+	// UserGroupsCountView is an OpenCensus view that tracks the distribution
+	// of the number of groups user group lookups return by identity provider
+	UserGroupsCountView = &view.View{
+		Name:        userGroupsCount.Name(),
+		Measure:     userGroupsCount,
+		Description: userGroupsCount.Description(),
+		TagKeys:     []tag.Key{TagKeyProvider},
+		Aggregation: view.Distribution(1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000),
+	}
+)
+
+// RecordGroupsCacheRequest records the result of a user group cache lookup
+// for a given identity provider.
+func RecordGroupsCacheRequest(ctx context.Context, provider string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	if err := stats.RecordWithTags(
+		ctx,
+		[]tag.Mutator{tag.Upsert(TagKeyProvider, provider), tag.Upsert(TagKeyResult, result)},
+		groupsCacheRequests.M(1),
+	); err != nil {
+		log.Warn().Err(err).Msg("telemetry/metrics: failed to record groups cache request")
+	}
+}
+
+// RecordGroupsCircuitBreakerState records a change in the state of the
+// circuit breaker around a given identity provider's user group lookups.
+func RecordGroupsCircuitBreakerState(ctx context.Context, provider string, state int64) {
+	if err := stats.RecordWithTags(
+		ctx,
+		[]tag.Mutator{tag.Upsert(TagKeyProvider, provider)},
+		groupsCircuitBreakerState.M(state),
+	); err != nil {
+		log.Warn().Err(err).Msg("telemetry/metrics: failed to record groups circuit breaker state")
+	}
+}
+
+// RecordUserGroups records the number of groups a user group lookup
+// returned for a given identity provider.
+func RecordUserGroups(ctx context.Context, provider string, count int) {
+	if err := stats.RecordWithTags(
+		ctx,
+		[]tag.Mutator{tag.Upsert(TagKeyProvider, provider)},
+		userGroupsCount.M(int64(count)),
+	); err != nil {
+		log.Warn().Err(err).Msg("telemetry/metrics: failed to record user groups")
+	}
+}
+
+// RecordIdentityAPIRequest records a request made to an identity provider's
+// API. Status is the HTTP status code of the response, or zero if no response
+// was received.
+func RecordIdentityAPIRequest(ctx context.Context, provider, operation string, status int, duration time.Duration, err error) {
+	mutators := []tag.Mutator{
+		tag.Upsert(TagKeyProvider, provider),
+		tag.Upsert(TagKeyOperation, operation),
+	}
+	measurements := []stats.Measurement{
+		identityAPIRequestDuration.M(float64(duration) / float64(time.Millisecond)),
+	}
+	if err := stats.RecordWithTags(ctx, mutators, measurements...); err != nil {
+		log.Warn().Err(err).Msg("telemetry/metrics: failed to record identity api request")
+	}
+	if err == nil {
+		return
+	}
+	mutators = append(mutators, tag.Upsert(TagKeyStatusClass, statusClass(status)))
+	if err := stats.RecordWithTags(ctx, mutators, identityAPIRequestErrors.M(1)); err != nil {
+		log.Warn().Err(err).Msg("telemetry/metrics: failed to record identity api request error")
+	}
+}
+
+// statusClass returns the class of an HTTP status code, e.g. "5xx", or
+// "none" if no response was received.
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "none"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
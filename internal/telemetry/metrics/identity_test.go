@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+func Test_RecordGroupsCacheRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		hit  bool
+		want string
+	}{
+		{"hit", true, "{ { {provider gitlab}{result hit} }&{1} }"},
+		{"miss", false, "{ { {provider gitlab}{result miss} }&{1} }"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			view.Unregister(IdentityViews...)
+			view.Register(IdentityViews...)
+			RecordGroupsCacheRequest(context.Background(), "gitlab", tt.hit)
+
+			testDataRetrieval(GroupsCacheRequestCountView, t, tt.want)
+		})
+	}
+}
+
+func Test_RecordGroupsCircuitBreakerState(t *testing.T) {
+	view.Unregister(IdentityViews...)
+	view.Register(IdentityViews...)
+	RecordGroupsCircuitBreakerState(context.Background(), "gitlab", 2)
+	RecordGroupsCircuitBreakerState(context.Background(), "gitlab", 1)
+
+	testDataRetrieval(GroupsCircuitBreakerStateView, t, "{ { {provider gitlab} }&{1} }")
+}
+
+func Test_RecordIdentityAPIRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		err        error
+		wantCount  string
+		wantErrors string
+	}{
+		{"ok", 200, nil, "{ { {operation user_groups}{provider gitlab} }&{1} }", ""},
+		{"server error", 503, errors.New("unavailable"),
+			"{ { {operation user_groups}{provider gitlab} }&{1} }",
+			"{ { {operation user_groups}{provider gitlab}{status_class 5xx} }&{1} }"},
+		{"no response", 0, errors.New("connection reset"),
+			"{ { {operation user_groups}{provider gitlab} }&{1} }",
+			"{ { {operation user_groups}{provider gitlab}{status_class none} }&{1} }"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			view.Unregister(IdentityViews...)
+			view.Register(IdentityViews...)
+			RecordIdentityAPIRequest(context.Background(), "gitlab", "user_groups", tt.status, 10*time.Millisecond, tt.err)
+
+			testDataRetrieval(IdentityAPIRequestCountView, t, tt.wantCount)
+			testDataRetrieval(IdentityAPIRequestErrorCountView, t, tt.wantErrors)
+		})
+	}
+}
+
+func Test_RecordUserGroups(t *testing.T) {
+	view.Unregister(IdentityViews...)
+	view.Register(IdentityViews...)
+	RecordUserGroups(context.Background(), "gitlab", 3)
+	RecordUserGroups(context.Background(), "gitlab", 40)
+
+	testDataRetrieval(UserGroupsCountView, t, "{ { {provider gitlab} }&{2 3 40 21.5")
+}
@@ -16,6 +16,12 @@ const (
 	QueryRefreshToken      = "pomerium_refresh_token"
 	QueryAccessTokenID     = "pomerium_session_access_token_id"
 	QueryAudience          = "pomerium_session_audience"
+	QueryIdentityProvider  = "pomerium_identity_provider"
+	QueryLastActive        = "pomerium_last_active"
+	QueryLoginHint         = "login_hint"
+	QueryMaxAge            = "pomerium_max_age"
+	QueryPrompt            = "pomerium_prompt"
+	QueryScope             = "pomerium_scope"
 )
 
 // URL signature based query params used for verifying the authenticity of a URL.
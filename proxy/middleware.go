@@ -2,18 +2,22 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 
 	"github.com/pomerium/pomerium/internal/httputil"
 	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/sessions"
+	"github.com/pomerium/pomerium/internal/sessions/revocation"
 	"github.com/pomerium/pomerium/internal/telemetry/trace"
 	"github.com/pomerium/pomerium/internal/urlutil"
 )
@@ -25,10 +29,24 @@ func (p *Proxy) AuthenticateSession(next http.Handler) http.Handler {
 		ctx, span := trace.StartSpan(r.Context(), "proxy.AuthenticateSession")
 		defer span.End()
 
-		if _, err := sessions.FromContext(ctx); err != nil {
+		jwt, err := sessions.FromContext(ctx)
+		if err != nil {
 			log.FromRequest(r).Debug().Err(err).Msg("proxy: session state")
 			return p.redirectToSignin(w, r)
 		}
+		// step-up: send the user back to grant the route's scopes, or to
+		// authenticate again if they did so too long ago
+		if scopes, maxAge := signInScopesFromContext(ctx), signInMaxAgeFromContext(ctx); len(scopes) != 0 || maxAge > 0 {
+			var s sessions.State
+			if err := p.encoder.Unmarshal([]byte(jwt), &s); err != nil || !s.HasScopes(scopes) {
+				log.FromRequest(r).Debug().Err(err).Strs("scopes", scopes).Msg("proxy: session lacks route scopes")
+				return p.redirectToSignin(w, r)
+			}
+			if !s.AuthenticatedWithin(maxAge) {
+				log.FromRequest(r).Debug().Dur("max_age", maxAge).Msg("proxy: session authentication too old for route")
+				return p.redirectToSignin(w, r)
+			}
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 		return nil
 	})
@@ -47,6 +65,10 @@ func (p *Proxy) refresh(ctx context.Context, oldSession string) (string, error)
 	q := refreshURI.Query()
 	q.Set(urlutil.QueryAccessTokenID, s.AccessTokenID)          // hash value points to parent token
 	q.Set(urlutil.QueryAudience, strings.Join(s.Audience, ",")) // request's audience, this route
+	if s.LastActiveAt != nil {
+		// the user's activity on this route, which authenticate doesn't see
+		q.Set(urlutil.QueryLastActive, strconv.FormatInt(s.LastActiveAt.Time().Unix(), 10))
+	}
 	refreshURI.RawQuery = q.Encode()
 	signedRefreshURL := urlutil.NewSignedURL(p.SharedKey, &refreshURI).String()
 
@@ -79,6 +101,18 @@ func (p *Proxy) redirectToSignin(w http.ResponseWriter, r *http.Request) error {
 	signinURL := *p.authenticateSigninURL
 	q := signinURL.Query()
 	q.Set(urlutil.QueryRedirectURI, urlutil.GetAbsoluteURL(r).String())
+	if idp := identityProviderFromContext(r.Context()); idp != "" {
+		q.Set(urlutil.QueryIdentityProvider, idp)
+	}
+	if prompt := signInPromptFromContext(r.Context()); prompt != "" {
+		q.Set(urlutil.QueryPrompt, prompt)
+	}
+	if scopes := signInScopesFromContext(r.Context()); len(scopes) != 0 {
+		q.Set(urlutil.QueryScope, strings.Join(scopes, " "))
+	}
+	if maxAge := signInMaxAgeFromContext(r.Context()); maxAge > 0 {
+		q.Set(urlutil.QueryMaxAge, strconv.FormatInt(int64(maxAge/time.Second), 10))
+	}
 	signinURL.RawQuery = q.Encode()
 	log.FromRequest(r).Debug().Str("url", signinURL.String()).Msg("proxy: redirectToSignin")
 	httputil.Redirect(w, r, urlutil.NewSignedURL(p.SharedKey, &signinURL).String(), http.StatusFound)
@@ -107,11 +141,20 @@ func (p *Proxy) authorize(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return httputil.NewError(http.StatusInternalServerError, err)
 	}
+	if p.sessionRevoked(r, jwt) {
+		log.FromRequest(r).Info().Err(sessions.ErrRevoked).Msg("proxy: session revoked")
+		return p.redirectToSignin(w, r)
+	}
+	jwt, err = p.checkSessionLifetime(w, r, jwt)
+	if err != nil {
+		log.FromRequest(r).Info().Err(err).Msg("proxy: session lifetime")
+		return p.redirectToSignin(w, r)
+	}
 	authz, err := p.AuthorizeClient.Authorize(ctx, jwt, r)
 	if err != nil {
 		return httputil.NewError(http.StatusInternalServerError, err)
 	}
-	if authz.GetSessionExpired() {
+	if authz.GetSessionExpired() || p.groupsStale(jwt) {
 		newJwt, err := p.refresh(ctx, jwt)
 		if err != nil {
 			p.sessionStore.ClearSession(w, r)
@@ -141,6 +184,68 @@ func (p *Proxy) authorize(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// groupsStale reports whether the groups in the session were fetched longer
+// ago than the groups refresh interval, so that it should be refreshed even
+// though it hasn't expired.
+func (p *Proxy) groupsStale(jwt string) bool {
+	if p.groupsRefreshInterval <= 0 {
+		return false
+	}
+	var s sessions.State
+	if err := p.encoder.Unmarshal([]byte(jwt), &s); err != nil {
+		return false
+	}
+	return s.GroupsStale(p.groupsRefreshInterval)
+}
+
+// sessionRevoked returns whether the session has been signed out, as
+// recorded in the revocation store. As with the authenticate service,
+// sessions are accepted if the store can't be reached.
+func (p *Proxy) sessionRevoked(r *http.Request, jwt string) bool {
+	if p.revocations == nil {
+		return false
+	}
+	var s sessions.State
+	if err := p.encoder.Unmarshal([]byte(jwt), &s); err != nil {
+		return false
+	}
+	revoked, err := revocation.IsRevoked(r.Context(), p.revocations, &s)
+	if err != nil {
+		log.FromRequest(r).Warn().Err(err).Msg("proxy: session revocation check failed")
+		return false
+	}
+	return revoked
+}
+
+// checkSessionLifetime returns an error if the session has outlived the
+// session max duration or idle timeout. Otherwise, it returns the session,
+// re-signed and saved if its last activity needed updating.
+func (p *Proxy) checkSessionLifetime(w http.ResponseWriter, r *http.Request, jwt string) (string, error) {
+	if p.sessionMaxDuration <= 0 && p.sessionIdleTimeout <= 0 {
+		return jwt, nil
+	}
+	var s sessions.State
+	if err := p.encoder.Unmarshal([]byte(jwt), &s); err != nil {
+		// left for the authorize service to reject
+		return jwt, nil
+	}
+	touched := s.Touch(p.sessionMaxDuration, p.sessionIdleTimeout)
+	if err := s.CheckLifetime(p.sessionMaxDuration, p.sessionIdleTimeout); err != nil {
+		return "", err
+	}
+	if !touched {
+		return jwt, nil
+	}
+	newJwt, err := p.encoder.Marshal(&s)
+	if err != nil {
+		return "", err
+	}
+	if err := p.sessionStore.SaveSession(w, r, newJwt); err != nil {
+		return "", err
+	}
+	return string(newJwt), nil
+}
+
 // SetResponseHeaders sets a map of response headers.
 func SetResponseHeaders(headers map[string]string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -155,11 +260,91 @@ func SetResponseHeaders(headers map[string]string) func(next http.Handler) http.
 	}
 }
 
+type identityProviderKey struct{}
+
+// SetIdentityProvider is middleware which sets the named identity provider
+// users are sent to when they need to sign in to a route.
+func SetIdentityProvider(name string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), identityProviderKey{}, name)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func identityProviderFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(identityProviderKey{}).(string)
+	return name
+}
+
+type signInPromptKey struct{}
+
+// SetSignInPrompt is middleware which sets the OpenID Connect prompt users
+// are sent to the identity provider with when they need to sign in to a
+// route.
+func SetSignInPrompt(prompt string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), signInPromptKey{}, prompt)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func signInPromptFromContext(ctx context.Context) string {
+	prompt, _ := ctx.Value(signInPromptKey{}).(string)
+	return prompt
+}
+
+type signInScopesKey struct{}
+
+// SetSignInScopes is middleware which sets the oauth2 scopes, in addition to
+// those requested at sign in, that users must have granted to access a
+// route. Users whose sessions lack any of them are sent back to the identity
+// provider to grant them.
+func SetSignInScopes(scopes []string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), signInScopesKey{}, scopes)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func signInScopesFromContext(ctx context.Context) []string {
+	scopes, _ := ctx.Value(signInScopesKey{}).([]string)
+	return scopes
+}
+
+type signInMaxAgeKey struct{}
+
+// SetSignInMaxAge is middleware which sets how long ago users may have last
+// authenticated with the identity provider to access a route. Users who
+// authenticated longer ago are sent back to the identity provider to
+// authenticate again.
+func SetSignInMaxAge(maxAge time.Duration) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), signInMaxAgeKey{}, maxAge)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func signInMaxAgeFromContext(ctx context.Context) time.Duration {
+	maxAge, _ := ctx.Value(signInMaxAgeKey{}).(time.Duration)
+	return maxAge
+}
+
 func (p *Proxy) jwtClaimMiddleware(next http.Handler) http.Handler {
 	return httputil.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		p.clearClaimHeaders(r)
 		if jwt, err := sessions.FromContext(r.Context()); err == nil {
 			var jwtClaims map[string]interface{}
 			if err := p.encoder.Unmarshal([]byte(jwt), &jwtClaims); err == nil {
+				p.setClaimHeaders(r, jwtClaims)
+
 				formattedJWTClaims := make(map[string]string)
 
 				// reformat claims into something resembling map[string]string
@@ -202,3 +387,47 @@ func (p *Proxy) jwtClaimMiddleware(next http.Handler) http.Handler {
 		return nil
 	})
 }
+
+// clearClaimHeaders removes any of the headers identity provider claims are
+// set as from the request, so that they can't be passed on as though they
+// came from the identity provider.
+func (p *Proxy) clearClaimHeaders(r *http.Request) {
+	for _, claimHeaders := range p.claimHeaders {
+		for _, header := range claimHeaders {
+			r.Header.Del(header)
+		}
+	}
+}
+
+// setClaimHeaders sets the headers the session's identity provider maps its
+// forwarded claims to. Multi-valued claims are comma separated.
+func (p *Proxy) setClaimHeaders(r *http.Request, jwtClaims map[string]interface{}) {
+	provider, _ := jwtClaims["identity_provider"].(string)
+	claims, _ := jwtClaims["forwarded_claims"].(map[string]interface{})
+	for claim, header := range p.claimHeaders[provider] {
+		if v, ok := claims[claim]; ok && v != nil {
+			r.Header.Set(header, formatClaim(v))
+		}
+	}
+}
+
+// claimHeaderReplacer keeps claims from breaking out of their header.
+var claimHeaderReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// formatClaim formats a claim's value as a header value: strings as they
+// are, lists as their comma separated elements, and anything else as JSON.
+func formatClaim(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return claimHeaderReplacer.Replace(v)
+	case []interface{}:
+		elements := make([]string, len(v))
+		for i, e := range v {
+			elements[i] = formatClaim(e)
+		}
+		return strings.Join(elements, ",")
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
@@ -1,10 +1,12 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -18,6 +20,8 @@ import (
 	"github.com/pomerium/pomerium/internal/identity"
 	"github.com/pomerium/pomerium/internal/sessions"
 	mstore "github.com/pomerium/pomerium/internal/sessions/mock"
+	"github.com/pomerium/pomerium/internal/sessions/revocation"
+	"github.com/pomerium/pomerium/internal/urlutil"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
 
@@ -139,6 +143,65 @@ func Test_jwtClaimMiddleware(t *testing.T) {
 
 }
 
+func TestProxy_claimHeaders(t *testing.T) {
+	t.Parallel()
+	encoder, err := jws.NewHS256Signer(nil, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Proxy{
+		encoder: encoder,
+		claimHeaders: map[string]map[string]string{
+			"":     {"email": "X-Email", "roles": "X-Roles", "level": "X-Level", "address": "X-Address"},
+			"corp": {"upn": "X-User"},
+		},
+	}
+	tests := []struct {
+		name    string
+		session *sessions.State
+		want    http.Header
+	}{
+		{"default provider", &sessions.State{ForwardedClaims: map[string]interface{}{
+			"email":   "user@example.com",
+			"roles":   []string{"admin", "dev"},
+			"level":   3,
+			"address": map[string]string{"country": "NZ"},
+			"upn":     "ignored",
+		}}, http.Header{
+			"X-Email":   {"user@example.com"},
+			"X-Roles":   {"admin,dev"},
+			"X-Level":   {"3"},
+			"X-Address": {`{"country":"NZ"}`},
+		}},
+		{"named provider", &sessions.State{IdentityProvider: "corp", ForwardedClaims: map[string]interface{}{"upn": "user@corp.example", "email": "ignored"}}, http.Header{
+			"X-User": {"user@corp.example"},
+		}},
+		{"header injection", &sessions.State{ForwardedClaims: map[string]interface{}{"email": "user@example.com\r\nX-Admin: true"}}, http.Header{
+			"X-Email": {"user@example.com  X-Admin: true"},
+		}},
+		{"no claims", &sessions.State{}, http.Header{}},
+	}
+	for _, tt := range tests {
+		jwt, err := encoder.Marshal(tt.session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got http.Header
+		handler := p.jwtClaimMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		// sent by the client, so must be replaced or removed
+		r.Header.Set("X-Email", "spoofed@example.com")
+		r.Header.Set("X-User", "spoofed@example.com")
+		r = r.WithContext(sessions.NewContext(r.Context(), string(jwt), nil))
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s: jwtClaimMiddleware() headers = %s", tt.name, diff)
+		}
+	}
+}
+
 func TestProxy_AuthorizeSession(t *testing.T) {
 	t.Parallel()
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -233,3 +296,258 @@ func TestProxy_SetResponseHeaders(t *testing.T) {
 		})
 	}
 }
+
+func TestProxy_SetIdentityProvider(t *testing.T) {
+	t.Parallel()
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	tests := []struct {
+		name       string
+		provider   string
+		prompt     string
+		want       string
+		wantPrompt string
+	}{
+		{"default", "", "", "", ""},
+		{"named", "contractors", "", "contractors", ""},
+		{"prompt", "", "login", "", "login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Proxy{
+				SharedKey:             "80ldlrU2d7w+wVpKNfevk6fmb8otEx6CqOfshj2LwhQ=",
+				authenticateSigninURL: uriParseHelper("https://authenticate.corp.example/sign_in"),
+				sessionStore:          &mstore.Store{},
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r = r.WithContext(sessions.NewContext(r.Context(), "", errors.New("no session")))
+			w := httptest.NewRecorder()
+			SetIdentityProvider(tt.provider)(SetSignInPrompt(tt.prompt)(a.AuthenticateSession(fn))).ServeHTTP(w, r)
+			if w.Code != http.StatusFound {
+				t.Fatalf("AuthenticateSession() status = %v, want %v", w.Code, http.StatusFound)
+			}
+			u, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.Query().Get(urlutil.QueryIdentityProvider); got != tt.want {
+				t.Errorf("sign in identity provider = %q, want %q", got, tt.want)
+			}
+			if got := u.Query().Get(urlutil.QueryPrompt); got != tt.wantPrompt {
+				t.Errorf("sign in prompt = %q, want %q", got, tt.wantPrompt)
+			}
+		})
+	}
+}
+
+func TestProxy_SetSignInScopes(t *testing.T) {
+	t.Parallel()
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	encoder, err := jws.NewHS256Signer(nil, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		scopes     []string
+		session    *sessions.State
+		wantStatus int
+		wantScope  string
+	}{
+		{"no scopes required", nil, &sessions.State{Email: "user@test.example"}, http.StatusOK, ""},
+		{"scopes granted", []string{"admin"}, &sessions.State{Email: "user@test.example", Scopes: []string{"openid", "admin"}}, http.StatusOK, ""},
+		{"step up", []string{"admin", "billing"}, &sessions.State{Email: "user@test.example", Scopes: []string{"openid", "admin"}}, http.StatusFound, "admin billing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Proxy{
+				SharedKey:             "80ldlrU2d7w+wVpKNfevk6fmb8otEx6CqOfshj2LwhQ=",
+				authenticateSigninURL: uriParseHelper("https://authenticate.corp.example/sign_in"),
+				sessionStore:          &mstore.Store{},
+				encoder:               encoder,
+			}
+			jwt, err := encoder.Marshal(tt.session)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r = r.WithContext(sessions.NewContext(r.Context(), string(jwt), nil))
+			w := httptest.NewRecorder()
+			SetSignInScopes(tt.scopes)(a.AuthenticateSession(fn)).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("AuthenticateSession() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			u, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.Query().Get(urlutil.QueryScope); got != tt.wantScope {
+				t.Errorf("sign in scope = %q, want %q", got, tt.wantScope)
+			}
+		})
+	}
+}
+
+func TestProxy_SetSignInMaxAge(t *testing.T) {
+	t.Parallel()
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	encoder, err := jws.NewHS256Signer(nil, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ago := func(d time.Duration) *jwt.NumericDate { return jwt.NewNumericDate(time.Now().Add(-d)) }
+	tests := []struct {
+		name       string
+		maxAge     time.Duration
+		session    *sessions.State
+		wantStatus int
+		wantMaxAge string
+	}{
+		{"no max age", 0, &sessions.State{Email: "user@test.example"}, http.StatusOK, ""},
+		{"recent", 5 * time.Minute, &sessions.State{Email: "user@test.example", AuthTime: ago(time.Minute)}, http.StatusOK, ""},
+		{"too old", 5 * time.Minute, &sessions.State{Email: "user@test.example", AuthTime: ago(10 * time.Minute)}, http.StatusFound, "300"},
+		{"auth time not recorded", 5 * time.Minute, &sessions.State{Email: "user@test.example"}, http.StatusFound, "300"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Proxy{
+				SharedKey:             "80ldlrU2d7w+wVpKNfevk6fmb8otEx6CqOfshj2LwhQ=",
+				authenticateSigninURL: uriParseHelper("https://authenticate.corp.example/sign_in"),
+				sessionStore:          &mstore.Store{},
+				encoder:               encoder,
+			}
+			jwt, err := encoder.Marshal(tt.session)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r = r.WithContext(sessions.NewContext(r.Context(), string(jwt), nil))
+			w := httptest.NewRecorder()
+			SetSignInMaxAge(tt.maxAge)(a.AuthenticateSession(fn)).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("AuthenticateSession() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			u, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.Query().Get(urlutil.QueryMaxAge); got != tt.wantMaxAge {
+				t.Errorf("sign in max age = %q, want %q", got, tt.wantMaxAge)
+			}
+		})
+	}
+}
+
+func TestProxy_groupsStale(t *testing.T) {
+	t.Parallel()
+	encoder, err := jws.NewHS256Signer(nil, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		interval time.Duration
+		session  *sessions.State
+		want     bool
+	}{
+		{"fresh", time.Minute, &sessions.State{GroupsRefreshedAt: jwt.NewNumericDate(time.Now())}, false},
+		{"stale", time.Minute, &sessions.State{GroupsRefreshedAt: jwt.NewNumericDate(time.Now().Add(-time.Hour))}, true},
+		{"never fetched", time.Minute, &sessions.State{}, false},
+		{"disabled", 0, &sessions.State{GroupsRefreshedAt: jwt.NewNumericDate(time.Now().Add(-time.Hour))}, false},
+	}
+	for _, tt := range tests {
+		jwt, err := encoder.Marshal(tt.session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := Proxy{encoder: encoder, groupsRefreshInterval: tt.interval}
+		if got := p.groupsStale(string(jwt)); got != tt.want {
+			t.Errorf("%s: groupsStale() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_checkSessionLifetime(t *testing.T) {
+	t.Parallel()
+	encoder, err := jws.NewHS256Signer(nil, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ago := func(d time.Duration) *jwt.NumericDate { return jwt.NewNumericDate(now.Add(-d)) }
+	tests := []struct {
+		name        string
+		maxDuration time.Duration
+		idleTimeout time.Duration
+		session     *sessions.State
+		wantErr     error
+		wantResaved bool
+	}{
+		{"disabled", 0, 0, &sessions.State{}, nil, false},
+		{"active", 8 * time.Hour, 15 * time.Minute, &sessions.State{SignedInAt: ago(time.Hour), LastActiveAt: ago(10 * time.Second)}, nil, false},
+		{"active a while ago", 8 * time.Hour, 15 * time.Minute, &sessions.State{SignedInAt: ago(time.Hour), LastActiveAt: ago(5 * time.Minute)}, nil, true},
+		{"idle", 8 * time.Hour, 15 * time.Minute, &sessions.State{SignedInAt: ago(time.Hour), LastActiveAt: ago(20 * time.Minute)}, sessions.ErrIdleTimeout, false},
+		{"max duration exceeded", 8 * time.Hour, 0, &sessions.State{SignedInAt: ago(9 * time.Hour)}, sessions.ErrMaxDurationExceeded, false},
+		{"lifetime not recorded", 8 * time.Hour, 15 * time.Minute, &sessions.State{}, nil, true},
+	}
+	for _, tt := range tests {
+		jwt, err := encoder.Marshal(tt.session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := Proxy{
+			encoder:            encoder,
+			sessionStore:       &mstore.Store{},
+			sessionMaxDuration: tt.maxDuration,
+			sessionIdleTimeout: tt.idleTimeout,
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		got, err := p.checkSessionLifetime(httptest.NewRecorder(), r, string(jwt))
+		if err != tt.wantErr {
+			t.Errorf("%s: checkSessionLifetime() error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (got != string(jwt)) != tt.wantResaved {
+			t.Errorf("%s: checkSessionLifetime() resaved = %v, want %v", tt.name, got != string(jwt), tt.wantResaved)
+		}
+	}
+}
+
+func TestProxy_sessionRevoked(t *testing.T) {
+	t.Parallel()
+	encoder, err := jws.NewHS256Signer(nil, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocations := &revocation.MockStore{}
+	if err := revocation.RevokeSession(context.Background(), revocations, &sessions.State{SessionID: "signed-out"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		revocations revocation.Store
+		session     *sessions.State
+		want        bool
+	}{
+		{"signed out", revocations, &sessions.State{SessionID: "signed-out"}, true},
+		{"signed in", revocations, &sessions.State{SessionID: "signed-in"}, false},
+		{"signed out, by access token id", revocations, &sessions.State{AccessTokenID: "signed-out"}, true},
+		{"store unavailable", &revocation.MockStore{Error: errors.New("unavailable")}, &sessions.State{SessionID: "signed-out"}, false},
+		{"no store", nil, &sessions.State{SessionID: "signed-out"}, false},
+	}
+	for _, tt := range tests {
+		jwt, err := encoder.Marshal(tt.session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := Proxy{encoder: encoder, revocations: tt.revocations}
+		if got := p.sessionRevoked(httptest.NewRequest(http.MethodGet, "/", nil), string(jwt)); got != tt.want {
+			t.Errorf("%s: sessionRevoked() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -32,6 +32,7 @@ import (
 	"github.com/pomerium/pomerium/internal/sessions/cookie"
 	"github.com/pomerium/pomerium/internal/sessions/header"
 	"github.com/pomerium/pomerium/internal/sessions/queryparam"
+	"github.com/pomerium/pomerium/internal/sessions/revocation"
 	"github.com/pomerium/pomerium/internal/telemetry/metrics"
 	"github.com/pomerium/pomerium/internal/tripper"
 	"github.com/pomerium/pomerium/internal/urlutil"
@@ -81,16 +82,23 @@ type Proxy struct {
 
 	AuthorizeClient client.Authorizer
 
-	encoder                encoding.Unmarshaler
+	encoder                encoding.MarshalUnmarshaler
 	cookieOptions          *cookie.Options
 	cookieSecret           []byte
 	defaultUpstreamTimeout time.Duration
 	refreshCooldown        time.Duration
+	groupsRefreshInterval  time.Duration
+	sessionMaxDuration     time.Duration
+	sessionIdleTimeout     time.Duration
+	revocations            revocation.Store
 	Handler                http.Handler
 	sessionStore           sessions.SessionStore
 	sessionLoaders         []sessions.SessionLoader
 	templates              *template.Template
 	jwtClaimHeaders        []string
+	// claimHeaders are the claim to header mappings of each identity
+	// provider, by name.
+	claimHeaders map[string]map[string]string
 }
 
 // New takes a Proxy service from options and a validation function.
@@ -122,6 +130,14 @@ func New(opts config.Options) (*Proxy, error) {
 		return nil, err
 	}
 
+	var revocations revocation.Store
+	if opts.SessionRevocationRedisURL != "" {
+		revocations, err = revocation.NewRedisStore(opts.SessionRevocationRedisURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	p := &Proxy{
 		SharedKey:    opts.SharedKey,
 		sharedCipher: sharedCipher,
@@ -131,13 +147,24 @@ func New(opts config.Options) (*Proxy, error) {
 		cookieOptions:          cookieOptions,
 		defaultUpstreamTimeout: opts.DefaultUpstreamTimeout,
 		refreshCooldown:        opts.RefreshCooldown,
+		groupsRefreshInterval:  opts.GroupsRefreshInterval,
+		sessionMaxDuration:     opts.SessionMaxDuration,
+		sessionIdleTimeout:     opts.SessionIdleTimeout,
+		revocations:            revocations,
 		sessionStore:           cookieStore,
+		// authorization headers are tried before cookies, as API clients
+		// which send one may also carry a stale session cookie
 		sessionLoaders: []sessions.SessionLoader{
-			cookieStore,
 			header.NewStore(encoder, "Pomerium"),
+			header.NewBearerStore(encoder),
+			cookieStore,
 			queryparam.NewStore(encoder, "pomerium_session")},
 		templates:       template.Must(frontend.NewTemplates()),
 		jwtClaimHeaders: opts.JWTClaimsHeaders,
+		claimHeaders:    map[string]map[string]string{"": opts.ClaimHeaders},
+	}
+	for _, idp := range opts.IdentityProviders {
+		p.claimHeaders[idp.Name] = opts.IdentityProviderClaimHeaders(idp.Name)
 	}
 	// errors checked in ValidateOptions
 	p.authorizeURL, _ = urlutil.DeepCopy(opts.AuthorizeURL)
@@ -263,6 +290,20 @@ func (p *Proxy) reverseProxyHandler(r *mux.Router, policy config.Policy) *mux.Ro
 		return r
 	}
 
+	// Optional: if the route uses a named identity provider, send users to it
+	if policy.IdentityProvider != "" {
+		rp.Use(SetIdentityProvider(policy.IdentityProvider))
+	}
+	if policy.IdentityProviderPrompt != "" {
+		rp.Use(SetSignInPrompt(policy.IdentityProviderPrompt))
+	}
+	if len(policy.IdentityProviderScopes) != 0 {
+		rp.Use(SetSignInScopes(policy.IdentityProviderScopes))
+	}
+	if policy.IdentityProviderMaxAge > 0 {
+		rp.Use(SetSignInMaxAge(policy.IdentityProviderMaxAge))
+	}
+
 	// 4. Retrieve the user session and add it to the request context
 	rp.Use(sessions.RetrieveSession(p.sessionLoaders...))
 	// 5. AuthN - Verify user session has been added to the request context